@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// newAccessLogWriter returns where the access log is written, which is
+// ACCESS_LOG_FILE if it's set, rotated once it grows past
+// ACCESS_LOG_MAX_MEGABYTES, and stdout otherwise. The returned closer closes
+// the file, and does nothing for stdout.
+func newAccessLogWriter(config *EnvConfig) (io.Writer, func() error) {
+	if config.AccessLogFile == "" {
+		return os.Stdout, func() error { return nil }
+	}
+
+	fileLogger := &lumberjack.Logger{
+		Filename:   config.AccessLogFile,
+		MaxBackups: config.AccessLogMaxBackups,
+		MaxSize:    config.AccessLogMaxMegabytes,
+	}
+	return fileLogger, fileLogger.Close
+}
+
+// accessLogHandler logs a line for each request to handler once it's been
+// served. Requests are logged by the route they matched, like
+// `DELETE /suppressions/{address}`, rather than their path so that addresses
+// and other values in paths stay out of the log.
+func accessLogHandler(handler http.Handler, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			recorder = &accessLogResponseWriter{ResponseWriter: w, status: http.StatusOK}
+			start    = time.Now()
+		)
+		handler.ServeHTTP(recorder, r)
+
+		// The mux sets the pattern on the request it was given, so it's known
+		// after the request has been served.
+		logger.InfoContext(r.Context(), "Request",
+			slog.String("method", r.Method),
+			slog.String("route", r.Pattern),
+			slog.Int("status", recorder.status),
+			slog.Int64("bytes", recorder.bytes),
+			slog.Duration("duration", time.Since(start)),
+		)
+	})
+}
+
+// accessLogResponseWriter records the status and size of a response for the
+// access log.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+
+	bytes       int64
+	status      int
+	wroteHeader bool
+}
+
+func (w *accessLogResponseWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.status = statusCode
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Unwrap gives http.ResponseController the underlying writer so that
+// streamed responses, like email events, can still be flushed.
+func (w *accessLogResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+
+	// Serves a request through the access log, returning the log's lines.
+	serve := func(t *testing.T, config *EnvConfig, read func() string) []map[string]any {
+		t.Helper()
+
+		accessLogWriter, closeAccessLog := newAccessLogWriter(config)
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("DELETE /suppressions/{address}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"Suppression not found."}`))
+		})
+
+		handler := accessLogHandler(mux, slog.New(slog.NewJSONHandler(accessLogWriter, nil)))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/suppressions/receiver@example.com", nil))
+		require.NoError(t, closeAccessLog())
+
+		var lines []map[string]any
+		for line := range strings.Lines(read()) {
+			var logged map[string]any
+			require.NoError(t, json.Unmarshal([]byte(line), &logged))
+			lines = append(lines, logged)
+		}
+		return lines
+	}
+
+	t.Run("File", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "access.log")
+
+		lines := serve(t, &EnvConfig{AccessLogFile: path, AccessLogMaxMegabytes: 100}, func() string {
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			return string(data)
+		})
+		require.Len(t, lines, 1)
+		require.Equal(t, "Request", lines[0]["msg"])
+		require.Equal(t, http.MethodDelete, lines[0]["method"])
+		require.Equal(t, "DELETE /suppressions/{address}", lines[0]["route"])
+		require.InDelta(t, http.StatusNotFound, lines[0]["status"], 0)
+		require.InDelta(t, len(`{"message":"Suppression not found."}`), lines[0]["bytes"], 0)
+		require.Contains(t, lines[0], "duration")
+
+		// Addresses in paths aren't logged.
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NotContains(t, string(data), "receiver@example.com")
+	})
+
+	t.Run("StdoutByDefault", func(t *testing.T) {
+		t.Parallel()
+
+		accessLogWriter, closeAccessLog := newAccessLogWriter(&EnvConfig{})
+		require.Equal(t, os.Stdout, accessLogWriter)
+		require.NoError(t, closeAccessLog())
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		t.Parallel()
+
+		// Streamed responses are flushed through the access log's writer.
+		recorder := httptest.NewRecorder()
+		require.NoError(t, http.NewResponseController(&accessLogResponseWriter{ResponseWriter: recorder}).Flush())
+		require.True(t, recorder.Flushed)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+)
+
+// attachmentContentTypeDefault is the content type of attachments that don't
+// have one.
+const attachmentContentTypeDefault = "application/octet-stream"
+
+// EmailAttachment is a file attached to an email. In JSON its content is
+// base64 encoded, like any other bytes. Requests can also upload attachments
+// as files in a multipart form; see newMultipartEmailHandler.
+type EmailAttachment struct {
+	Content     []byte `json:"content"      validate:"required"`
+	ContentType string `json:"content_type"` // like application/pdf; defaults to application/octet-stream
+	Filename    string `json:"filename"     validate:"required,max=255"`
+}
+
+// validateAttachments checks the content types of attachments, which would
+// otherwise only be found to be malformed by the recipient's mail client.
+func validateAttachments(attachments []*EmailAttachment) error {
+	for i, attachment := range attachments {
+		if attachment.ContentType == "" {
+			continue
+		}
+		if _, _, err := mime.ParseMediaType(attachment.ContentType); err != nil {
+			return &APIError{
+				Code:       errorCodeInvalidRequest,
+				Message:    fmt.Sprintf("Attachment %d has an invalid content_type %q.", i, attachment.ContentType),
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+	}
+	return nil
+}
+
+// writeAttachmentPart writes an attachment as a base64 encoded part of a
+// multipart/mixed message. Its filename is encoded as needed for names with
+// non-ASCII characters.
+func writeAttachmentPart(mw *multipart.Writer, attachment *EmailAttachment) {
+	partWriter, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Type":              {cmp.Or(attachment.ContentType, attachmentContentTypeDefault)},
+	})
+
+	// Lines of base64 are kept to 76 characters as RFC 2045 requires.
+	const lineLength = 76
+	encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+	for len(encoded) > lineLength {
+		_, _ = io.WriteString(partWriter, encoded[:lineLength]+"\r\n")
+		encoded = encoded[lineLength:]
+	}
+	_, _ = io.WriteString(partWriter, encoded+"\r\n")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/riverqueue/river"
+)
+
+// Actions recorded in audit_events, one for each transition in an email's
+// lifecycle.
+const (
+	auditActionCancelled = "cancelled" // by the account or because it could never be sent
+	auditActionCreated   = "created"
+	auditActionFailed    = "failed" // an attempt failed, and it may be retried
+	auditActionRetried   = "retried"
+	auditActionSent      = "sent"
+)
+
+// recordAuditEvent adds an event to an email's audit log. Emails that are
+// queued, cancelled, or retried from the API record theirs in the same
+// transaction so that the log can't disagree with what happened.
+func recordAuditEvent(ctx context.Context, db dbExecutor, accountID uuid.UUID, jobID int64, action string, attempt int, detail string) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO audit_events (account_id, job_id, action, attempt, detail)
+		VALUES ($1, $2, $3, NULLIF($4, 0), NULLIF($5, ''))`,
+		accountID, jobID, action, attempt, detail,
+	)
+	return err
+}
+
+// recordWorkAudit records the outcome of an attempt to send an email. The
+// email may already be sent, so a failure to record it is logged rather than
+// failing the job, which would send it again.
+func (w *SendEmailWorker) recordWorkAudit(ctx context.Context, job *river.Job[SendEmailArgs], workErr error) {
+	if w.dbPool == nil {
+		return
+	}
+
+	// A snoozed job wasn't attempted, so there's nothing to record until it
+	// is.
+	var snoozeErr *river.JobSnoozeError
+	if errors.As(workErr, &snoozeErr) {
+		return
+	}
+
+	action := auditActionSent
+	var cancelErr *river.JobCancelError
+	switch {
+	case errors.As(workErr, &cancelErr):
+		action = auditActionCancelled
+	case workErr != nil:
+		action = auditActionFailed
+	}
+
+	var detail string
+	if workErr != nil {
+		detail = workErr.Error()
+	}
+
+	// The job's context may have been cancelled by its timeout, which
+	// shouldn't keep the attempt out of the log.
+	if err := recordAuditEvent(context.WithoutCancel(ctx), w.dbPool, job.Args.AccountID, job.ID, action, job.Attempt, detail); err != nil && w.logger != nil {
+		w.logger.ErrorContext(ctx, "Error recording audit event", slog.Int64("job_id", job.ID), slog.String("action", action), slog.String("error", err.Error()))
+	}
+}
+
+type HandleEmailAuditRequest struct {
+	ID int64 `json:"-" validate:"required"`
+}
+
+func (r *HandleEmailAuditRequest) BindRequest(httpReq *http.Request) (err error) {
+	r.ID, err = parseEmailID(httpReq)
+	return err
+}
+
+type HandleEmailAuditResponse struct {
+	Events []*HandleEmailAuditEvent `json:"events"` // oldest first
+}
+
+type HandleEmailAuditEvent struct {
+	Action    string    `json:"action"`
+	Attempt   int       `json:"attempt,omitempty"` // for events from sending
+	CreatedAt time.Time `json:"created_at"`
+	Detail    string    `json:"detail,omitempty"` // error of a failed or cancelled attempt
+}
+
+// EmailAudit returns the audit log of an email. Events are kept after the
+// email's job is cleaned up, so an email can be found here after it's gone
+// from `GET /emails/{id}`.
+func (s *APIService) EmailAudit(ctx context.Context, req *HandleEmailAuditRequest) (*HandleEmailAuditResponse, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	rows, err := tx.Query(ctx, `
+		SELECT action, coalesce(attempt, 0), created_at, coalesce(detail, '')
+		FROM audit_events
+		WHERE job_id = $1
+		ORDER BY id`,
+		req.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*HandleEmailAuditEvent, error) {
+		var event HandleEmailAuditEvent
+		return &event, row.Scan(&event.Action, &event.Attempt, &event.CreatedAt, &event.Detail)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Emails queued before there was an audit log have none, but they're
+	// still emails.
+	if len(events) < 1 {
+		job, err := s.riverClient.JobGetTx(ctx, tx, req.ID)
+		if err != nil && !errors.Is(err, river.ErrNotFound) {
+			return nil, err
+		}
+		if job == nil || job.Kind != (SendEmailArgs{}).Kind() {
+			return nil, &APIError{Code: errorCodeNotFound, Message: "Email not found.", StatusCode: http.StatusNotFound}
+		}
+		events = []*HandleEmailAuditEvent{}
+	}
+
+	return &HandleEmailAuditResponse{Events: events}, nil
+}
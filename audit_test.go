@@ -0,0 +1,243 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+)
+
+func TestEmailAudit(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		accountID uuid.UUID
+		apiServer *APIService
+		sender    *fakeEmailSender
+		tx        pgx.Tx
+		worker    *SendEmailWorker
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx    = t.Context()
+			sender = &fakeEmailSender{}
+			tx     = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			accountID: uuid.New(),
+			apiServer: &APIService{
+				begin:       tx.Begin,
+				metrics:     newMetrics(),
+				riverClient: riverClient,
+				tracer:      testTracer,
+			},
+			sender: sender,
+			tx:     tx,
+			worker: &SendEmailWorker{dbPool: tx, sender: sender, tracer: testTracer},
+		}, ctx
+	}
+
+	// Queues an email, returning its job ID.
+	createEmail := func(ctx context.Context, t *testing.T, bundle *testBundle, req *HandleEmailCreateRequest) int64 {
+		t.Helper()
+
+		if req == nil {
+			req = &HandleEmailCreateRequest{Body: "Hello from River's idempotent mail demo.", Subject: "Hello."}
+		}
+		req.AccountID, req.EmailRecipient, req.EmailSender = bundle.accountID, "receiver@example.com", "sender@example.com"
+		req.IdempotencyKey = cmp.Or(req.IdempotencyKey, uuid.NewString())
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		jobID, err := strconv.ParseInt(resp.Location[len("/emails/"):], 10, 64)
+		require.NoError(t, err)
+		return jobID
+	}
+
+	// Works an email's job as the given attempt.
+	workEmail := func(ctx context.Context, t *testing.T, bundle *testBundle, jobID int64, attempt int) error {
+		t.Helper()
+
+		jobRow, err := bundle.apiServer.riverClient.JobGetTx(ctx, bundle.tx, jobID)
+		require.NoError(t, err)
+		jobRow.Attempt = attempt
+
+		job := &river.Job[SendEmailArgs]{JobRow: jobRow}
+		require.NoError(t, json.Unmarshal(jobRow.EncodedArgs, &job.Args))
+		return bundle.worker.Work(ctx, job)
+	}
+
+	auditActions := func(ctx context.Context, t *testing.T, bundle *testBundle, jobID int64) []string {
+		t.Helper()
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailAudit, &HandleEmailAuditRequest{ID: jobID})
+		require.NoError(t, err)
+
+		actions := make([]string, len(resp.Events))
+		for i, event := range resp.Events {
+			actions[i] = event.Action
+		}
+		return actions
+	}
+
+	t.Run("FailedThenSent", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		jobID := createEmail(ctx, t, bundle, nil)
+
+		bundle.sender.err = errors.New("connection refused")
+		require.Error(t, workEmail(ctx, t, bundle, jobID, 1))
+
+		bundle.sender.err = nil
+		require.NoError(t, workEmail(ctx, t, bundle, jobID, 2))
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailAudit, &HandleEmailAuditRequest{ID: jobID})
+		require.NoError(t, err)
+		require.Len(t, resp.Events, 3)
+
+		require.Equal(t, auditActionCreated, resp.Events[0].Action)
+		require.Zero(t, resp.Events[0].Attempt)
+
+		require.Equal(t, auditActionFailed, resp.Events[1].Action)
+		require.Equal(t, 1, resp.Events[1].Attempt)
+		require.Equal(t, "connection refused", resp.Events[1].Detail)
+
+		require.Equal(t, auditActionSent, resp.Events[2].Action)
+		require.Equal(t, 2, resp.Events[2].Attempt)
+		require.Empty(t, resp.Events[2].Detail)
+
+		var accountID uuid.UUID
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT DISTINCT account_id FROM audit_events WHERE job_id = $1", jobID).Scan(&accountID))
+		require.Equal(t, bundle.accountID, accountID)
+	})
+
+	t.Run("CancelledAndRetried", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		jobID := createEmail(ctx, t, bundle, nil)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCancelByAccount, &HandleCancelByAccountRequest{AccountID: bundle.accountID})
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailRetry, &HandleEmailRetryRequest{ID: jobID})
+		require.NoError(t, err)
+
+		require.NoError(t, workEmail(ctx, t, bundle, jobID, 1))
+
+		require.Equal(t, []string{auditActionCreated, auditActionCancelled, auditActionRetried, auditActionSent}, auditActions(ctx, t, bundle, jobID))
+	})
+
+	t.Run("CancelledByWorker", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.worker.maxMessageBytes = 1
+
+		jobID := createEmail(ctx, t, bundle, nil)
+
+		var cancelErr *river.JobCancelError
+		require.ErrorAs(t, workEmail(ctx, t, bundle, jobID, 1), &cancelErr)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailAudit, &HandleEmailAuditRequest{ID: jobID})
+		require.NoError(t, err)
+		require.Len(t, resp.Events, 2)
+		require.Equal(t, auditActionCancelled, resp.Events[1].Action)
+		require.Contains(t, resp.Events[1].Detail, "SMTP_MAX_MESSAGE_BYTES")
+	})
+
+	t.Run("SnoozedNotRecorded", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.worker.cooldown = newSMTPCooldown(time.Hour)
+		bundle.worker.cooldown.start("")
+
+		jobID := createEmail(ctx, t, bundle, nil)
+
+		var snoozeErr *river.JobSnoozeError
+		require.ErrorAs(t, workEmail(ctx, t, bundle, jobID, 1), &snoozeErr)
+
+		require.Equal(t, []string{auditActionCreated}, auditActions(ctx, t, bundle, jobID))
+	})
+
+	t.Run("DuplicateNotRecorded", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := &HandleEmailCreateRequest{Body: "Hello from River's idempotent mail demo.", IdempotencyKey: uuid.NewString(), Subject: "Hello."}
+		jobID := createEmail(ctx, t, bundle, req)
+		require.Equal(t, jobID, createEmail(ctx, t, bundle, req))
+
+		require.Equal(t, []string{auditActionCreated}, auditActions(ctx, t, bundle, jobID))
+	})
+
+	t.Run("Immutable", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		jobID := createEmail(ctx, t, bundle, nil)
+
+		_, err := bundle.tx.Exec(ctx, "SAVEPOINT audit_update")
+		require.NoError(t, err)
+		_, err = bundle.tx.Exec(ctx, "UPDATE audit_events SET action = 'sent' WHERE job_id = $1", jobID)
+		require.ErrorContains(t, err, "audit_events can't be changed or deleted")
+		_, err = bundle.tx.Exec(ctx, "ROLLBACK TO SAVEPOINT audit_update")
+		require.NoError(t, err)
+
+		_, err = bundle.tx.Exec(ctx, "DELETE FROM audit_events WHERE job_id = $1", jobID)
+		require.ErrorContains(t, err, "audit_events can't be changed or deleted")
+	})
+
+	t.Run("NoEvents", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		// Like an email queued before there was an audit log.
+		insertRes, err := bundle.apiServer.riverClient.InsertTx(ctx, bundle.tx, SendEmailArgs{AccountID: bundle.accountID, IdempotencyKey: uuid.NewString()}, nil)
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailAudit, &HandleEmailAuditRequest{ID: insertRes.Job.ID})
+		require.NoError(t, err)
+		require.Empty(t, resp.Events)
+		require.NotNil(t, resp.Events)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailAudit, &HandleEmailAuditRequest{ID: 123_456_789})
+		require.Equal(t, &APIError{Code: errorCodeNotFound, Message: "Email not found.", StatusCode: http.StatusNotFound}, err)
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type HandleEmailCreateBatchRequest struct {
+	Emails  []*HandleEmailCreateRequest `json:"emails" validate:"required,min=1,max=100"` // capped to keep requests quick; each is validated on its own
+	Partial bool                        `json:"-"`                                        // from the `partial` query parameter
+}
+
+// BindRequest reads partial from the query string, and gives each email the
+// request's `Accept-Language` header to pick template locales with.
+// Idempotency keys must be in each email, since one `Idempotency-Key` header
+// can't be shared by several of them.
+func (r *HandleEmailCreateBatchRequest) BindRequest(httpReq *http.Request) error {
+	for _, email := range r.Emails {
+		if email != nil {
+			email.acceptLanguage = httpReq.Header.Get("Accept-Language")
+		}
+	}
+
+	if partial := httpReq.URL.Query().Get("partial"); partial != "" {
+		var err error
+		if r.Partial, err = strconv.ParseBool(partial); err != nil {
+			return &APIError{Code: errorCodeInvalidRequest, Message: "Invalid partial: " + partial, StatusCode: http.StatusBadRequest}
+		}
+	}
+	return nil
+}
+
+type HandleEmailCreateBatchResponse struct {
+	Emails     []*HandleEmailCreateBatchEmail `json:"emails"` // in the same order as the requested emails
+	Message    string                         `json:"message"`
+	StatusCode int                            `json:"-"`
+}
+
+func (r *HandleEmailCreateBatchResponse) ResponseStatusCode() int { return r.StatusCode }
+
+// HandleEmailCreateBatchEmail is the outcome of one email in a batch: either
+// the response it'd have gotten from `POST /emails` on its own, or the error
+// it was rejected with.
+type HandleEmailCreateBatchEmail struct {
+	Email            *HandleEmailCreateResponse `json:"email,omitempty"`
+	ErrorCode        string                     `json:"error_code,omitempty"`
+	Location         string                     `json:"location,omitempty"` // URL of the email's status, like the Location header of a single email
+	Message          string                     `json:"message,omitempty"`  // error message, if the email was rejected
+	StatusCode       int                        `json:"status_code"`
+	ValidationErrors []*ValidationError         `json:"validation_errors,omitempty"`
+}
+
+// EmailCreateBatch queues a batch of emails, each like one sent to `POST
+// /emails` with its own idempotency key. By default, an email that's rejected
+// for any reason, whether it's invalid, its recipient is suppressed, or its
+// key was used for a different email, rejects the whole batch with its
+// errors. With partial set, the other emails are queued anyway and the
+// rejected ones reported alongside them with a 207.
+//
+// A batch that's all or nothing is queued in one transaction, which is rolled
+// back if any email is rejected. Each email of a partial batch is queued on
+// its own, like it would be with `POST /emails`.
+func (s *APIService) EmailCreateBatch(ctx context.Context, req *HandleEmailCreateBatchRequest) (*HandleEmailCreateBatchResponse, error) {
+	// Checked up front so that maintenance isn't reported as every email in
+	// the batch being rejected.
+	if s.maintenanceMode.Load() {
+		return nil, errMaintenanceMode
+	}
+
+	var batch *emailBatch
+	if !req.Partial {
+		batchTx, err := s.begin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = batchTx.Rollback(ctx) }()
+
+		batch = &emailBatch{tx: batchTx}
+		ctx = context.WithValue(ctx, batchTxKey{}, batch)
+	}
+
+	var (
+		emails    = make([]*HandleEmailCreateBatchEmail, len(req.Emails))
+		numFailed int
+	)
+	for i, emailReq := range req.Emails {
+		resp, err := s.emailCreateBatchEmail(ctx, emailReq)
+		if err != nil {
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				return nil, err
+			}
+			emails[i] = emailCreateBatchError(apiErr)
+			numFailed++
+			continue
+		}
+		emails[i] = &HandleEmailCreateBatchEmail{Email: resp, Location: resp.Location, StatusCode: resp.StatusCode}
+	}
+
+	if batch != nil {
+		if numFailed > 0 {
+			return nil, emailCreateBatchRejected(emails)
+		}
+		if err := batch.tx.Commit(ctx); err != nil {
+			return nil, err
+		}
+		for _, afterCommit := range batch.afterCommit {
+			afterCommit()
+		}
+	}
+
+	resp := &HandleEmailCreateBatchResponse{
+		Emails:     emails,
+		Message:    fmt.Sprintf("%d of %d email(s) accepted.", len(req.Emails)-numFailed, len(req.Emails)),
+		StatusCode: http.StatusCreated,
+	}
+	if numFailed > 0 {
+		resp.StatusCode = http.StatusMultiStatus
+	}
+	return resp, nil
+}
+
+// emailCreateBatchEmail validates and queues an email of a batch, which
+// unlike a single email hasn't been validated on its way in.
+func (s *APIService) emailCreateBatchEmail(ctx context.Context, req *HandleEmailCreateRequest) (*HandleEmailCreateResponse, error) {
+	if req == nil {
+		return nil, &APIError{Code: errorCodeInvalidRequest, Message: "Email must be an object.", StatusCode: http.StatusBadRequest}
+	}
+
+	if err := validateRequest(ctx, req); err != nil {
+		return nil, err
+	}
+
+	return s.EmailCreate(ctx, req)
+}
+
+// emailCreateBatchRejected returns the error that rejects a whole batch, with
+// the errors of each of its emails that was rejected, which are the ones
+// that have an error code. If they were all rejected for the same reason,
+// like a key reused for a different email, the batch is rejected with that
+// reason's code and status, so that clients can handle it the same way as
+// for a single email. Otherwise it's a validation failure, with a 400 if
+// every email was invalid and a 422 if some were rejected for other reasons.
+func emailCreateBatchRejected(emails []*HandleEmailCreateBatchEmail) *APIError {
+	var rejected []*HandleEmailCreateBatchEmail
+	for _, email := range emails {
+		if email.ErrorCode != "" {
+			rejected = append(rejected, email)
+		}
+	}
+
+	apiErr := &APIError{
+		Code:       rejected[0].ErrorCode,
+		Message:    fmt.Sprintf("%d of %d email(s) were rejected, so none were queued.", len(rejected), len(emails)),
+		StatusCode: rejected[0].StatusCode,
+	}
+	for _, email := range rejected[1:] {
+		if email.ErrorCode != apiErr.Code {
+			apiErr.Code = errorCodeValidationFailed
+		}
+		if email.StatusCode != apiErr.StatusCode {
+			apiErr.StatusCode = http.StatusUnprocessableEntity
+		}
+	}
+	for i, email := range emails {
+		if email.ErrorCode == "" {
+			continue
+		}
+		if len(email.ValidationErrors) < 1 {
+			apiErr.ValidationErrors = append(apiErr.ValidationErrors, &ValidationError{Field: fmt.Sprintf("emails[%d]", i), Message: email.Message, Rule: email.ErrorCode})
+			continue
+		}
+		for _, validationErr := range email.ValidationErrors {
+			apiErr.ValidationErrors = append(apiErr.ValidationErrors, &ValidationError{Field: fmt.Sprintf("emails[%d].%s", i, validationErr.Field), Message: validationErr.Message, Rule: validationErr.Rule})
+		}
+	}
+	return apiErr
+}
+
+// batchTxKey is a context key for the emailBatch of a batch that's queued
+// all or nothing. Emails queued in its context use savepoints within its
+// transaction instead of transactions of their own, so that rolling it back
+// unqueues all of them.
+type batchTxKey struct{}
+
+// emailBatch is a batch that's queued all or nothing in one transaction.
+type emailBatch struct {
+	afterCommit []func() // run once tx commits, for what mustn't happen for emails that end up unqueued
+	tx          pgx.Tx
+}
+
+// beginEmailTx begins a transaction for queuing an email, which is a
+// savepoint of the batch's transaction if the email is part of one that's
+// all or nothing.
+func (s *APIService) beginEmailTx(ctx context.Context) (pgx.Tx, error) {
+	if batch, ok := ctx.Value(batchTxKey{}).(*emailBatch); ok {
+		return batch.tx.Begin(ctx)
+	}
+	return s.begin(ctx)
+}
+
+// afterEmailCommit runs fn once an email's transaction from beginEmailTx has
+// committed for good, which for an email that's part of a batch queued all or
+// nothing isn't until the batch's transaction commits, if it does.
+func afterEmailCommit(ctx context.Context, fn func()) {
+	if batch, ok := ctx.Value(batchTxKey{}).(*emailBatch); ok {
+		batch.afterCommit = append(batch.afterCommit, fn)
+		return
+	}
+	fn()
+}
+
+func emailCreateBatchError(apiErr *APIError) *HandleEmailCreateBatchEmail {
+	return &HandleEmailCreateBatchEmail{
+		ErrorCode:        apiErr.Code,
+		Message:          apiErr.Message,
+		StatusCode:       apiErr.StatusCode,
+		ValidationErrors: apiErr.ValidationErrors,
+	}
+}
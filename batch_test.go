@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+)
+
+func TestAPIServiceEmailCreateBatch(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		accountID uuid.UUID
+		apiServer *APIService
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			accountID: uuid.New(),
+			apiServer: &APIService{
+				begin:       tx.Begin,
+				metrics:     newMetrics(),
+				riverClient: riverClient,
+				tracer:      testTracer,
+			},
+			tx: tx,
+		}, ctx
+	}
+
+	testEmail := func(bundle *testBundle) *HandleEmailCreateRequest {
+		return &HandleEmailCreateRequest{
+			AccountID:      bundle.accountID,
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		}
+	}
+
+	// A batch of three emails, the second of which is missing its subject.
+	testBatch := func(bundle *testBundle) []*HandleEmailCreateRequest {
+		invalidEmail := testEmail(bundle)
+		invalidEmail.Subject = ""
+
+		return []*HandleEmailCreateRequest{testEmail(bundle), invalidEmail, testEmail(bundle)}
+	}
+
+	numEmails := func(ctx context.Context, t *testing.T, bundle *testBundle) int {
+		t.Helper()
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE kind = 'send_email' AND args->>'account_id' = $1::text", bundle.accountID).Scan(&numJobs))
+		return numJobs
+	}
+
+	t.Run("AllValid", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreateBatch, &HandleEmailCreateBatchRequest{Emails: []*HandleEmailCreateRequest{testEmail(bundle), testEmail(bundle)}})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		require.Equal(t, "2 of 2 email(s) accepted.", resp.Message)
+		require.Len(t, resp.Emails, 2)
+		for _, email := range resp.Emails {
+			require.Equal(t, http.StatusCreated, email.StatusCode)
+			require.Regexp(t, `^/emails/\d+$`, email.Location)
+			require.Empty(t, email.ErrorCode)
+		}
+		require.Equal(t, 2, numEmails(ctx, t, bundle))
+	})
+
+	t.Run("StrictRejectsBatch", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreateBatch, &HandleEmailCreateBatchRequest{Emails: testBatch(bundle)})
+		require.Equal(t, &APIError{
+			Code:       errorCodeValidationFailed,
+			Message:    "1 of 3 email(s) were rejected, so none were queued.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "emails[1].subject", Message: "subject is required unless template or raw_message is set.", Rule: "required_without_all"},
+			},
+		}, err)
+		require.Zero(t, numEmails(ctx, t, bundle))
+	})
+
+	t.Run("StrictRejectsBatchForNonValidationError", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		unknownTemplateEmail := testEmail(bundle)
+		unknownTemplateEmail.Body, unknownTemplateEmail.Subject, unknownTemplateEmail.Template = "", "", "goodbye"
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreateBatch, &HandleEmailCreateBatchRequest{Emails: []*HandleEmailCreateRequest{testEmail(bundle), unknownTemplateEmail}})
+		require.Equal(t, &APIError{
+			Code:       errorCodeUnknownTemplate,
+			Message:    "1 of 2 email(s) were rejected, so none were queued.",
+			StatusCode: http.StatusUnprocessableEntity,
+			ValidationErrors: []*ValidationError{
+				{Field: "emails[1]", Message: `Unknown template "goodbye".`, Rule: errorCodeUnknownTemplate},
+			},
+		}, err)
+		require.Zero(t, numEmails(ctx, t, bundle))
+	})
+
+	t.Run("StrictRejectsBatchForSuppressedRecipient", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		suppressedEmail := testEmail(bundle)
+		suppressedEmail.EmailRecipient = "suppressed@example.com"
+		_, err := invokeHandler(ctx, bundle.apiServer.SuppressionCreate, &HandleSuppressionCreateRequest{AccountID: bundle.accountID, Email: suppressedEmail.EmailRecipient})
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreateBatch, &HandleEmailCreateBatchRequest{Emails: []*HandleEmailCreateRequest{testEmail(bundle), suppressedEmail, testEmail(bundle)}})
+		require.Equal(t, &APIError{
+			Code:       errorCodeRecipientSuppressed,
+			Message:    "1 of 3 email(s) were rejected, so none were queued.",
+			StatusCode: http.StatusUnprocessableEntity,
+			ValidationErrors: []*ValidationError{
+				{Field: "emails[1]", Message: "Recipient has opted out of email from this account or is on its suppression list; email not queued.", Rule: errorCodeRecipientSuppressed},
+			},
+		}, err)
+		require.Zero(t, numEmails(ctx, t, bundle))
+	})
+
+	t.Run("StrictRejectsBatchForReusedKey", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		email := testEmail(bundle)
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, email)
+		require.NoError(t, err)
+
+		reusedKeyEmail := testEmail(bundle)
+		reusedKeyEmail.IdempotencyKey, reusedKeyEmail.Subject = email.IdempotencyKey, "A different subject"
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreateBatch, &HandleEmailCreateBatchRequest{Emails: []*HandleEmailCreateRequest{testEmail(bundle), reusedKeyEmail}})
+		require.Equal(t, &APIError{
+			Code:       errorCodeIdempotencyKeyReuse,
+			Message:    "1 of 2 email(s) were rejected, so none were queued.",
+			StatusCode: http.StatusConflict,
+			ValidationErrors: []*ValidationError{
+				{Field: "emails[1]", Message: errMismatchedParameters.Message, Rule: errorCodeIdempotencyKeyReuse},
+			},
+		}, err)
+		require.Equal(t, 1, numEmails(ctx, t, bundle))
+	})
+
+	t.Run("StrictRejectsBatchForDifferentReasons", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		email := testEmail(bundle)
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, email)
+		require.NoError(t, err)
+
+		invalidEmail := testEmail(bundle)
+		invalidEmail.Subject = ""
+
+		reusedKeyEmail := testEmail(bundle)
+		reusedKeyEmail.IdempotencyKey, reusedKeyEmail.Subject = email.IdempotencyKey, "A different subject"
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreateBatch, &HandleEmailCreateBatchRequest{Emails: []*HandleEmailCreateRequest{invalidEmail, reusedKeyEmail}})
+		require.Equal(t, &APIError{
+			Code:       errorCodeValidationFailed,
+			Message:    "2 of 2 email(s) were rejected, so none were queued.",
+			StatusCode: http.StatusUnprocessableEntity,
+			ValidationErrors: []*ValidationError{
+				{Field: "emails[0].subject", Message: "subject is required unless template or raw_message is set.", Rule: "required_without_all"},
+				{Field: "emails[1]", Message: errMismatchedParameters.Message, Rule: errorCodeIdempotencyKeyReuse},
+			},
+		}, err)
+		require.Equal(t, 1, numEmails(ctx, t, bundle))
+	})
+
+	t.Run("StrictLogsQueuedEmailsOnCommit", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		var logBuf bytes.Buffer
+		bundle.apiServer.logger = slog.New(slog.NewTextHandler(&logBuf, nil))
+
+		// The valid emails of a rejected batch were inserted before it was
+		// rolled back, but never queued.
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreateBatch, &HandleEmailCreateBatchRequest{Emails: testBatch(bundle)})
+		require.Error(t, err)
+		require.NotContains(t, logBuf.String(), "Queued email")
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreateBatch, &HandleEmailCreateBatchRequest{Emails: []*HandleEmailCreateRequest{testEmail(bundle), testEmail(bundle)}})
+		require.NoError(t, err)
+		require.Equal(t, 2, strings.Count(logBuf.String(), "Queued email"))
+	})
+
+	t.Run("StrictChecksSpamOnce", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.spamPrecheck = SpamPrecheckFlag
+
+		shoutingEmail := testEmail(bundle)
+		shoutingEmail.Subject = "HELLO THERE EVERYONE"
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreateBatch, &HandleEmailCreateBatchRequest{Emails: []*HandleEmailCreateRequest{shoutingEmail}})
+		require.NoError(t, err)
+		require.InDelta(t, 1, testutil.ToFloat64(bundle.apiServer.metrics.emailsSpamPrecheck.WithLabelValues(spamRuleAllCapsSubject)), 0)
+	})
+
+	t.Run("Partial", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreateBatch, &HandleEmailCreateBatchRequest{Emails: testBatch(bundle), Partial: true})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+		require.Equal(t, "2 of 3 email(s) accepted.", resp.Message)
+		require.Len(t, resp.Emails, 3)
+
+		require.Equal(t, http.StatusCreated, resp.Emails[0].StatusCode)
+		require.Equal(t, &HandleEmailCreateBatchEmail{
+			ErrorCode:  errorCodeValidationFailed,
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "subject", Message: "subject is required unless template or raw_message is set.", Rule: "required_without_all"},
+			},
+		}, resp.Emails[1])
+		require.Equal(t, http.StatusCreated, resp.Emails[2].StatusCode)
+
+		require.Equal(t, 2, numEmails(ctx, t, bundle))
+	})
+
+	t.Run("PartialDuplicate", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		// An email already queued is a duplicate like it'd be on its own,
+		// rather than a failure.
+		email := testEmail(bundle)
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, email)
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreateBatch, &HandleEmailCreateBatchRequest{Emails: []*HandleEmailCreateRequest{email, testEmail(bundle)}, Partial: true})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		require.Equal(t, http.StatusOK, resp.Emails[0].StatusCode)
+		require.Equal(t, http.StatusCreated, resp.Emails[1].StatusCode)
+		require.Equal(t, 2, numEmails(ctx, t, bundle))
+	})
+
+	t.Run("MaintenanceMode", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.maintenanceMode.Store(true)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreateBatch, &HandleEmailCreateBatchRequest{Emails: []*HandleEmailCreateRequest{testEmail(bundle)}, Partial: true})
+		require.Equal(t, errMaintenanceMode, err)
+		require.Zero(t, numEmails(ctx, t, bundle))
+	})
+}
+
+func TestHandleEmailCreateBatchRequestBindRequest(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Partial", func(t *testing.T) {
+		t.Parallel()
+
+		req := &HandleEmailCreateBatchRequest{Emails: []*HandleEmailCreateRequest{{}}}
+		httpReq := httptest.NewRequest(http.MethodPost, "/emails/batch?partial=true", nil)
+		httpReq.Header.Set("Accept-Language", "fr")
+		require.NoError(t, req.BindRequest(httpReq))
+		require.True(t, req.Partial)
+		require.Equal(t, "fr", req.Emails[0].acceptLanguage)
+	})
+
+	t.Run("StrictByDefault", func(t *testing.T) {
+		t.Parallel()
+
+		req := &HandleEmailCreateBatchRequest{}
+		require.NoError(t, req.BindRequest(httptest.NewRequest(http.MethodPost, "/emails/batch", nil)))
+		require.False(t, req.Partial)
+	})
+
+	t.Run("InvalidPartial", func(t *testing.T) {
+		t.Parallel()
+
+		req := &HandleEmailCreateBatchRequest{}
+		err := req.BindRequest(httptest.NewRequest(http.MethodPost, "/emails/batch?partial=sometimes", nil))
+		require.Equal(t, &APIError{Code: errorCodeInvalidRequest, Message: "Invalid partial: sometimes", StatusCode: http.StatusBadRequest}, err)
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// charsetDefault is the charset of email bodies that don't ask for another.
+const charsetDefault = "utf-8"
+
+// errUnsupportedCharset is returned for charsets that bodies can't be
+// transcoded to.
+var errUnsupportedCharset = errors.New("unsupported charset")
+
+// lookupCharset returns the encoding for an IANA charset name like
+// `ISO-8859-1` or one of its aliases like `latin1`, along with its canonical
+// name in lowercase as it should appear in a `Content-Type` header.
+func lookupCharset(name string) (encoding.Encoding, string, error) {
+	enc, err := ianaindex.MIME.Encoding(name)
+	if err != nil || enc == nil {
+		// A nil encoding is a charset that's known but not implemented.
+		return nil, "", fmt.Errorf("%w: %q", errUnsupportedCharset, name)
+	}
+
+	canonicalName, err := ianaindex.MIME.Name(enc)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %q", errUnsupportedCharset, name)
+	}
+
+	return enc, strings.ToLower(canonicalName), nil
+}
+
+// normalizeCharset returns the canonical name of a charset from a request, or
+// empty for the default of UTF-8 so that requests that name it explicitly are
+// the same as ones that leave it out.
+func normalizeCharset(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+
+	enc, canonicalName, err := lookupCharset(name)
+	if err != nil {
+		return "", err
+	}
+	if enc == unicode.UTF8 {
+		return "", nil
+	}
+	return canonicalName, nil
+}
+
+// transcodeBody converts a UTF-8 body to the given charset. The result is a
+// string of the charset's bytes, which aren't necessarily valid UTF-8. Bodies
+// containing characters the charset can't represent are an error.
+func transcodeBody(charset, body string) (string, error) {
+	if charset == "" || body == "" {
+		return body, nil
+	}
+
+	enc, _, err := lookupCharset(charset)
+	if err != nil {
+		return "", err
+	}
+
+	transcoded, err := enc.NewEncoder().String(body)
+	if err != nil {
+		return "", fmt.Errorf("body can't be represented in charset %s: %w", charset, err)
+	}
+	return transcoded, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeCharset(t *testing.T) {
+	t.Parallel()
+
+	for name, expected := range map[string]string{
+		"":           "",
+		"utf-8":      "",
+		"UTF-8":      "",
+		"ISO-8859-1": "iso-8859-1",
+		"latin1":     "iso-8859-1",
+		"Shift_JIS":  "shift_jis",
+	} {
+		charset, err := normalizeCharset(name)
+		require.NoError(t, err, "Unexpected error for %q", name)
+		require.Equal(t, expected, charset, "Unexpected result for %q", name)
+	}
+
+	_, err := normalizeCharset("not-a-charset")
+	require.ErrorIs(t, err, errUnsupportedCharset)
+}
+
+func TestTranscodeBody(t *testing.T) {
+	t.Parallel()
+
+	t.Run("UTF8Unchanged", func(t *testing.T) {
+		t.Parallel()
+
+		body, err := transcodeBody("", "Café")
+		require.NoError(t, err)
+		require.Equal(t, "Café", body)
+	})
+
+	t.Run("Latin1", func(t *testing.T) {
+		t.Parallel()
+
+		body, err := transcodeBody("iso-8859-1", "Café")
+		require.NoError(t, err)
+		require.Equal(t, "Caf\xe9", body)
+	})
+
+	t.Run("Unrepresentable", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := transcodeBody("iso-8859-1", "Hello 👋")
+		require.ErrorContains(t, err, "body can't be represented in charset iso-8859-1")
+	})
+}
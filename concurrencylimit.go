@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// concurrencyLimitRetryAfter is how long clients are asked to wait before
+// trying again when a request is turned away by MAX_CONCURRENT_REQUESTS.
+// Requests are quick, so a slot is likely to be free again soon.
+const concurrencyLimitRetryAfter = time.Second
+
+// errOverloaded is returned for requests made while MAX_CONCURRENT_REQUESTS
+// are already in progress.
+var errOverloaded = &APIError{ //nolint:gochecknoglobals
+	Code:       errorCodeOverloaded,
+	Message:    "Too many requests are in progress. Try again shortly.",
+	RetryAfter: concurrencyLimitRetryAfter,
+	StatusCode: http.StatusServiceUnavailable,
+}
+
+// newConcurrencyLimiter returns a function that wraps handlers so that no
+// more than limit requests to all of them together are in progress at once.
+// A request over the limit is answered with a 503 straight away instead of
+// waiting for a slot, since requests that wait pile up without bound while
+// their clients time out and retry. Streamed responses like email events hold
+// their slot for as long as they stream. A zero limit leaves handlers as they
+// are.
+func newConcurrencyLimiter(limit int, opts *HandlerOpts) func(handler http.Handler) http.Handler {
+	if limit <= 0 {
+		return func(handler http.Handler) http.Handler { return handler }
+	}
+
+	sem := make(chan struct{}, limit)
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// A request whose client has already gone away isn't worth a slot.
+			if r.Context().Err() != nil {
+				return
+			}
+
+			select {
+			case sem <- struct{}{}:
+			default:
+				writeErrorWithOpts(w, opts, errOverloaded)
+				return
+			}
+			defer func() { <-sem }()
+
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	t.Parallel()
+
+	// A handler that holds its request until release is closed, signaling on
+	// started once it's in progress.
+	slowHandler := func(started chan<- struct{}, release <-chan struct{}) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+
+	t.Run("RejectsOverLimit", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			limit   = newConcurrencyLimiter(2, &HandlerOpts{})
+			release = make(chan struct{})
+			started = make(chan struct{})
+		)
+
+		// The limit is shared by every handler it wraps.
+		handlers := []http.Handler{limit(slowHandler(started, release)), limit(slowHandler(started, release))}
+
+		var wg sync.WaitGroup
+		recorders := make([]*httptest.ResponseRecorder, len(handlers))
+		for i, handler := range handlers {
+			recorders[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handler.ServeHTTP(recorders[i], httptest.NewRequest(http.MethodGet, "/", nil))
+			}()
+			<-started
+		}
+
+		recorder := httptest.NewRecorder()
+		limit(slowHandler(started, release)).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		require.Equal(t, "1", recorder.Header().Get("Retry-After"))
+
+		var resp APIError
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+		require.Equal(t, errorCodeOverloaded, resp.Code)
+
+		close(release)
+		wg.Wait()
+		for _, recorder := range recorders {
+			require.Equal(t, http.StatusOK, recorder.Code)
+		}
+
+		// Slots are given back once requests finish.
+		recorder = httptest.NewRecorder()
+		go func() { <-started }()
+		limit(slowHandler(started, release)).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("ContextDone", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		var served bool
+		handler := newConcurrencyLimiter(1, &HandlerOpts{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true }))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		require.False(t, served)
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		t.Parallel()
+
+		mux := http.NewServeMux()
+		require.Same(t, mux, newConcurrencyLimiter(0, &HandlerOpts{})(mux))
+	})
+}
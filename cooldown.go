@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/textproto"
+	"slices"
+	"sync"
+	"time"
+)
+
+// smtpCodeServiceUnavailable is the reply an SMTP server gives when it has
+// too many connections or is otherwise too busy, and wants to be tried again
+// later.
+const smtpCodeServiceUnavailable = 421
+
+// smtpCooldown pauses sends through an SMTP sender for a while once it
+// answers with smtpCodeServiceUnavailable. Retrying straight away, as every
+// worker would, only keeps a busy server busy, so sends are snoozed until the
+// cooldown is over instead. Each sender, keyed by the sender domain it's
+// configured for in SMTP_DOMAINS, or an empty key for the default one, cools
+// down on its own, so that one busy provider doesn't hold up email that's
+// sent through others.
+type smtpCooldown struct {
+	duration time.Duration
+
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newSMTPCooldown(duration time.Duration) *smtpCooldown {
+	return &smtpCooldown{duration: duration, until: make(map[string]time.Time)}
+}
+
+// remaining returns how much longer sends through the sender with the given
+// key are paused for, or zero if they aren't.
+func (c *smtpCooldown) remaining(key string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return max(time.Until(c.until[key]), 0)
+}
+
+// start pauses sends through the sender with the given key for the
+// cooldown's duration, starting now, and returns how long it lasts. A
+// cooldown that's already in progress is extended rather than cut short.
+func (c *smtpCooldown) start(key string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if until := time.Now().Add(c.duration); until.After(c.until[key]) {
+		c.until[key] = until
+	}
+	return time.Until(c.until[key])
+}
+
+// isSMTPServiceUnavailable returns true if err is, or wraps, a 421 reply from
+// an SMTP server, whether to its greeting or any command after it. An error
+// that joins several, like failoverSender's when every provider failed, is
+// only one if all of them are, since a provider that failed otherwise isn't
+// busy, and waiting on the others won't get the email through it.
+func isSMTPServiceUnavailable(err error) bool {
+	switch err := err.(type) { //nolint:errorlint
+	case *textproto.Error:
+		return err.Code == smtpCodeServiceUnavailable
+	case interface{ Unwrap() []error }:
+		errs := err.Unwrap()
+		return len(errs) > 0 && !slices.ContainsFunc(errs, func(err error) bool { return !isSMTPServiceUnavailable(err) })
+	case interface{ Unwrap() error }:
+		return isSMTPServiceUnavailable(err.Unwrap())
+	}
+	return false
+}
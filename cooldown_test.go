@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/rivertype"
+)
+
+func TestSMTPCooldown(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Start", func(t *testing.T) {
+		t.Parallel()
+
+		cooldown := newSMTPCooldown(time.Hour)
+		require.Zero(t, cooldown.remaining(""))
+
+		require.InDelta(t, time.Hour, cooldown.start(""), float64(time.Second))
+		require.InDelta(t, time.Hour, cooldown.remaining(""), float64(time.Second))
+	})
+
+	t.Run("ExtendedNotShortened", func(t *testing.T) {
+		t.Parallel()
+
+		cooldown := newSMTPCooldown(time.Minute)
+		cooldown.start("")
+
+		cooldown.until[""] = time.Now().Add(time.Hour)
+		require.InDelta(t, time.Hour, cooldown.start(""), float64(time.Second))
+	})
+
+	t.Run("PerSender", func(t *testing.T) {
+		t.Parallel()
+
+		cooldown := newSMTPCooldown(time.Hour)
+		cooldown.start("example.com")
+
+		require.Positive(t, cooldown.remaining("example.com"))
+		require.Zero(t, cooldown.remaining("example.org"))
+		require.Zero(t, cooldown.remaining(""))
+	})
+}
+
+func TestIsSMTPServiceUnavailable(t *testing.T) {
+	t.Parallel()
+
+	var (
+		busyErr     = &textproto.Error{Code: smtpCodeServiceUnavailable, Msg: "4.7.0 Too many connections, try again later"}
+		rejectedErr = &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+	)
+
+	require.True(t, isSMTPServiceUnavailable(busyErr))
+	require.True(t, isSMTPServiceUnavailable(fmt.Errorf("provider primary: %w", busyErr)))
+	require.False(t, isSMTPServiceUnavailable(rejectedErr))
+	require.False(t, isSMTPServiceUnavailable(errors.New("connection refused")))
+
+	// Like failoverSender's error when every provider failed.
+	require.True(t, isSMTPServiceUnavailable(fmt.Errorf("all SMTP providers failed: %w", errors.Join(busyErr, busyErr))))
+	require.False(t, isSMTPServiceUnavailable(fmt.Errorf("all SMTP providers failed: %w", errors.Join(busyErr, rejectedErr))))
+}
+
+func TestSendEmailWorkerCooldown(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		server *fakeSMTPServer
+	}
+
+	setup := func(t *testing.T) (*SendEmailWorker, *testBundle) {
+		t.Helper()
+
+		server := startFakeSMTPServer(t)
+
+		pool := newSMTPPool(server.Addr(), smtp.PlainAuth("", "a-user", "a-pass", "127.0.0.1"), "", 1, smtpTLSModeSTARTTLS, nil)
+		t.Cleanup(func() { require.NoError(t, pool.Close()) })
+
+		return &SendEmailWorker{cooldown: newSMTPCooldown(time.Hour), sender: pool, tracer: testTracer}, &testBundle{server: server}
+	}
+
+	testJob := func() *river.Job[SendEmailArgs] {
+		return &river.Job[SendEmailArgs]{
+			JobRow: &rivertype.JobRow{ID: 123},
+			Args: SendEmailArgs{
+				AccountID:      uuid.New(),
+				Body:           "Hello from River's idempotent mail demo.",
+				EmailRecipient: "receiver@example.com",
+				EmailSender:    "sender@example.com",
+				IdempotencyKey: uuid.NewString(),
+				Subject:        "Hello.",
+			},
+		}
+	}
+
+	t.Run("SnoozedOn421", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		bundle.server.RejectMail("421 4.7.0 Too many connections, try again later")
+
+		var snoozeErr *river.JobSnoozeError
+		require.ErrorAs(t, worker.Work(t.Context(), testJob()), &snoozeErr)
+		require.InDelta(t, time.Hour, snoozeErr.Duration, float64(time.Second))
+		require.Empty(t, bundle.server.Messages())
+	})
+
+	t.Run("LaterSendsWaitOutCooldown", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		bundle.server.RejectMail("421 4.7.0 Too many connections, try again later")
+
+		var snoozeErr *river.JobSnoozeError
+		require.ErrorAs(t, worker.Work(t.Context(), testJob()), &snoozeErr)
+
+		// The server would accept mail now, but sends wait for the cooldown
+		// to be over without trying it.
+		bundle.server.RejectMail("")
+		numConns := bundle.server.NumConns()
+
+		require.ErrorAs(t, worker.Work(t.Context(), testJob()), &snoozeErr)
+		require.LessOrEqual(t, snoozeErr.Duration, time.Hour)
+		require.Positive(t, snoozeErr.Duration)
+		require.Equal(t, numConns, bundle.server.NumConns())
+		require.Empty(t, bundle.server.Messages())
+
+		// Once it's over, sends go out again.
+		worker.cooldown.mu.Lock()
+		worker.cooldown.until[""] = time.Now()
+		worker.cooldown.mu.Unlock()
+
+		require.NoError(t, worker.Work(t.Context(), testJob()))
+		require.Len(t, bundle.server.Messages(), 1)
+	})
+
+	t.Run("OtherSendersNotPaused", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.domainSenders = map[string]EmailSender{"example.com": worker.sender, "example.org": worker.sender}
+		worker.cooldown.start("example.com")
+
+		var snoozeErr *river.JobSnoozeError
+		require.ErrorAs(t, worker.Work(t.Context(), testJob()), &snoozeErr)
+		require.Empty(t, bundle.server.Messages())
+
+		job := testJob()
+		job.Args.EmailSender = "sender@example.org"
+		require.NoError(t, worker.Work(t.Context(), job))
+		require.Len(t, bundle.server.Messages(), 1)
+	})
+
+	t.Run("OtherErrorsNotSnoozed", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		bundle.server.RejectMail("451 4.3.0 Temporary failure")
+
+		err := worker.Work(t.Context(), testJob())
+		require.ErrorContains(t, err, "451")
+		var snoozeErr *river.JobSnoozeError
+		require.NotErrorAs(t, err, &snoozeErr)
+		require.Zero(t, worker.cooldown.remaining(""))
+	})
+
+	t.Run("WithoutCooldown", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.cooldown = nil
+		bundle.server.RejectMail("421 4.7.0 Too many connections, try again later")
+
+		err := worker.Work(t.Context(), testJob())
+		require.ErrorContains(t, err, "421")
+		var snoozeErr *river.JobSnoozeError
+		require.NotErrorAs(t, err, &snoozeErr)
+	})
+}
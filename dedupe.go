@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/rivertype"
+)
+
+// ContentDedupeArgs marks that an email with a given content hash was queued,
+// for DEDUPE_BY_CONTENT. River only allows one unique key per job, and an
+// email's is its idempotency key, so content gets a second job of its own
+// that's unique by content hash within a period. Inserting one that's skipped
+// as a duplicate means that an identical email was already queued.
+//
+// They're completed in the transaction that inserts them, so they never take
+// a worker from the queue of the emails they mark, and keep deduplicating
+// until River removes them along with other completed jobs after
+// JOB_RETENTION.
+type ContentDedupeArgs struct {
+	ContentHash string `json:"content_hash" river:"unique"`
+	EmailJobID  int64  `json:"email_job_id" river:"-"` // job of the email that was queued with this content
+}
+
+func (ContentDedupeArgs) Kind() string { return "email_content_dedupe" }
+
+func (ContentDedupeArgs) InsertOpts() river.InsertOpts {
+	return river.InsertOpts{
+		Queue: queueTransactional,
+	}
+}
+
+// ContentDedupeWorker has nothing to do. ContentDedupeArgs jobs are completed
+// as they're inserted, so it's only registered for River to know their kind.
+type ContentDedupeWorker struct {
+	river.WorkerDefaults[ContentDedupeArgs]
+}
+
+func (w *ContentDedupeWorker) Work(ctx context.Context, job *river.Job[ContentDedupeArgs]) error {
+	return nil
+}
+
+// emailContentHash hashes what makes two emails identical as far as their
+// recipient can tell: who they're from and to, their subject, bodies, and
+// attachments, and the headers that show or thread them, like the sender's
+// name, reply-to address, and custom headers. Copies to cc and bcc aren't
+// part of it, since they don't change what the recipient gets. It's scoped
+// to the account so that one account's email is never mistaken for
+// another's. An email that's rendered from its template when it's sent has
+// no subject or bodies yet, so its template, data, and locale stand in for
+// them.
+func emailContentHash(args *SendEmailArgs) (string, error) {
+	fields := []any{
+		args.AccountID,
+		args.EmailSender,
+		args.EmailRecipient,
+		args.Subject,
+		args.Body,
+		args.BodyHTML,
+		args.RawMessage,
+	}
+
+	// Left out otherwise so that hashes of emails without templates are the
+	// same as they were before they could have one.
+	if args.Template != "" {
+		fields = append(fields, args.Template, args.TemplateData, args.TemplateLocale)
+	}
+
+	// Likewise for attachments.
+	if len(args.Attachments) > 0 {
+		fields = append(fields, args.Attachments)
+	}
+
+	// And for headers.
+	if args.SenderName != "" || args.ReplyTo != "" || len(args.Headers) > 0 || args.InReplyTo != "" || len(args.References) > 0 {
+		fields = append(fields, args.SenderName, args.ReplyTo, args.Headers, args.InReplyTo, args.References)
+	}
+
+	content, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// contentDedupeStates are the states of an email's job in which it has been
+// or will be sent, so that an identical email is a duplicate of it.
+var contentDedupeStates = []rivertype.JobState{ //nolint:gochecknoglobals
+	rivertype.JobStateAvailable,
+	rivertype.JobStateCompleted,
+	rivertype.JobStateRetryable,
+	rivertype.JobStateRunning,
+	rivertype.JobStateScheduled,
+}
+
+// dedupeByContentTx deduplicates newly inserted emails against identical
+// ones queued with a different idempotency key within the dedupe period. A
+// duplicate's job is deleted again, and its result is replaced by one of
+// the email that was queued first, skipped as a duplicate.
+func (s *APIService) dedupeByContentTx(ctx context.Context, tx pgx.Tx, emails []*SendEmailArgs, insertResults []*rivertype.JobInsertResult) error {
+	var (
+		insertParams  = make([]river.InsertManyParams, 0, len(emails))
+		insertIndexes = make([]int, 0, len(emails))
+	)
+	for i, insertRes := range insertResults {
+		if insertRes == nil || insertRes.UniqueSkippedAsDuplicate {
+			continue
+		}
+
+		contentHash, err := emailContentHash(emails[i])
+		if err != nil {
+			return err
+		}
+
+		insertParams = append(insertParams, river.InsertManyParams{
+			Args: ContentDedupeArgs{ContentHash: contentHash, EmailJobID: insertRes.Job.ID},
+			InsertOpts: &river.InsertOpts{
+				UniqueOpts: river.UniqueOpts{
+					ByArgs:   true,
+					ByPeriod: s.dedupeByContentPeriod,
+				},
+			},
+		})
+		insertIndexes = append(insertIndexes, i)
+	}
+	if len(insertParams) < 1 {
+		return nil
+	}
+
+	inserted, err := s.riverClient.InsertManyTx(ctx, tx, insertParams)
+	if err != nil {
+		return err
+	}
+
+	var newDedupeJobIDs []int64
+	for _, dedupeRes := range inserted {
+		if !dedupeRes.UniqueSkippedAsDuplicate {
+			newDedupeJobIDs = append(newDedupeJobIDs, dedupeRes.Job.ID)
+		}
+	}
+	if len(newDedupeJobIDs) > 0 {
+		if _, err := tx.Exec(ctx, `
+			UPDATE river_job
+			SET finalized_at = now(),
+				state = 'completed'
+			WHERE id = ANY($1::bigint[])`,
+			newDedupeJobIDs,
+		); err != nil {
+			return err
+		}
+	}
+
+	for i, dedupeRes := range inserted {
+		if !dedupeRes.UniqueSkippedAsDuplicate {
+			continue
+		}
+
+		var dedupeArgs ContentDedupeArgs
+		if err := json.Unmarshal(dedupeRes.Job.EncodedArgs, &dedupeArgs); err != nil {
+			return err
+		}
+
+		insertIndex := insertIndexes[i]
+
+		// The first email may never be sent, like if it was cancelled or ran
+		// out of attempts, or be gone already after being cleaned up. This
+		// one goes out after all then, and later identical emails are
+		// deduplicated against it instead.
+		firstJob, err := s.riverClient.JobGetTx(ctx, tx, dedupeArgs.EmailJobID)
+		if err != nil && !errors.Is(err, river.ErrNotFound) {
+			return err
+		}
+		if firstJob == nil || !slices.Contains(contentDedupeStates, firstJob.State) {
+			if _, err := tx.Exec(ctx, "UPDATE river_job SET args = jsonb_set(args, '{email_job_id}', to_jsonb($1::bigint)) WHERE id = $2", insertResults[insertIndex].Job.ID, dedupeRes.Job.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := s.riverClient.JobDeleteTx(ctx, tx, insertResults[insertIndex].Job.ID); err != nil {
+			return err
+		}
+		insertResults[insertIndex] = &rivertype.JobInsertResult{Job: firstJob, UniqueSkippedAsDuplicate: true}
+	}
+
+	return nil
+}
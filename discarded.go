@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/riverqueue/river/rivertype"
+)
+
+// mediaTypeNDJSON is newline-delimited JSON, with one object per line.
+const mediaTypeNDJSON = "application/x-ndjson"
+
+// EmailDiscarded is an email that ran out of attempts without being sent.
+type EmailDiscarded struct {
+	Attempt        int       `json:"attempt"`
+	EmailRecipient string    `json:"email_recipient"`
+	Error          string    `json:"error"` // error from the last attempt
+	FinalizedAt    time.Time `json:"finalized_at"`
+	ID             int64     `json:"id"`
+	Subject        string    `json:"subject"`
+}
+
+type HandleEmailListDiscardedResponse struct {
+	Emails []*EmailDiscarded `json:"emails"`
+}
+
+// handleEmailListDiscarded lists an account's discarded emails, the dead
+// letters that need someone to look at them and maybe retry them with
+// `POST /emails/{id}/retry`. The account is given by an `account_id` query
+// parameter.
+//
+// There can be a lot of them, so clients that send `Accept:
+// application/x-ndjson` get one email per line, streamed as they're read from
+// the database instead of being held in memory all at once. Because of that,
+// this handler isn't built with MakeHandler.
+func (s *APIService) handleEmailListDiscarded(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context()
+		opts = s.handlerOpts()
+	)
+
+	accountID, err := uuid.Parse(r.URL.Query().Get("account_id"))
+	if err != nil {
+		writeErrorWithOpts(w, opts, &APIError{Code: errorCodeInvalidRequest, Message: "Invalid account_id: " + r.URL.Query().Get("account_id"), StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		writeErrorWithOpts(w, opts, err)
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	rows, err := tx.Query(ctx, `
+		SELECT args,
+			attempt,
+			coalesce(errors[array_length(errors, 1)]->>'error', ''),
+			finalized_at,
+			id
+		FROM river_job
+		WHERE kind = $1
+			AND state = $2
+			AND args->>'account_id' = $3
+		ORDER BY id`,
+		(SendEmailArgs{}).Kind(), rivertype.JobStateDiscarded, accountID.String(),
+	)
+	if err != nil {
+		writeErrorWithOpts(w, opts, err)
+		return
+	}
+	defer rows.Close()
+
+	// Args are decoded in full, rather than picking fields out of them in
+	// SQL, since the recipient may be encrypted.
+	scanEmail := func(row pgx.CollectableRow) (*EmailDiscarded, error) {
+		var (
+			email       EmailDiscarded
+			encodedArgs []byte
+		)
+		if err := row.Scan(&encodedArgs, &email.Attempt, &email.Error, &email.FinalizedAt, &email.ID); err != nil {
+			return nil, err
+		}
+
+		args, err := s.decodeEmailArgs(encodedArgs)
+		if err != nil {
+			return nil, err
+		}
+		email.EmailRecipient, email.Subject = args.EmailRecipient, args.Subject
+
+		return &email, nil
+	}
+
+	if !acceptsNDJSON(r.Header.Get("Accept")) {
+		emails, err := pgx.CollectRows(rows, scanEmail)
+		if err != nil {
+			writeErrorWithOpts(w, opts, err)
+			return
+		}
+
+		respData, err := marshalResponse(wrapResponse(&HandleEmailListDiscardedResponse{Emails: emails}, opts), opts.JSONCase)
+		if err != nil {
+			writeErrorWithOpts(w, opts, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(respData); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing response: %s", err)
+		}
+		return
+	}
+
+	// Once the first line is written the status can't be changed, so errors
+	// part way through can only be logged, leaving the client with a
+	// truncated listing.
+	responseController := http.NewResponseController(w)
+	w.Header().Set("Content-Type", mediaTypeNDJSON)
+	for rows.Next() {
+		email, err := scanEmail(rows)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading discarded email: %s", err)
+			return
+		}
+
+		line, err := marshalResponse(email, opts.JSONCase)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error marshaling discarded email: %s", err)
+			return
+		}
+
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing response: %s", err)
+			return
+		}
+		_ = responseController.Flush()
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading discarded emails: %s", err)
+	}
+}
+
+// acceptsNDJSON returns true if an `Accept` header asks for NDJSON.
+func acceptsNDJSON(accept string) bool {
+	for mediaRange := range strings.SplitSeq(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err == nil && mediaType == mediaTypeNDJSON {
+			return true
+		}
+	}
+	return false
+}
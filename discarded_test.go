@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+)
+
+func TestAPIServiceEmailListDiscarded(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		accountID uuid.UUID
+		apiServer *APIService
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			accountID: uuid.New(),
+			apiServer: &APIService{
+				begin:       tx.Begin,
+				metrics:     newMetrics(),
+				riverClient: riverClient,
+				tracer:      testTracer,
+			},
+			tx: tx,
+		}, ctx
+	}
+
+	// Queues an email and returns its job ID, discarding it with the given
+	// error unless it's empty.
+	createEmail := func(ctx context.Context, t *testing.T, bundle *testBundle, accountID uuid.UUID, recipient, discardErr string) int64 {
+		t.Helper()
+
+		idempotencyKey := uuid.NewString()
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      accountID,
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: recipient,
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: idempotencyKey,
+			Subject:        "Hello.",
+		})
+		require.NoError(t, err)
+
+		var jobID int64
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT id FROM river_job WHERE args->>'idempotency_key' = $1", idempotencyKey).Scan(&jobID))
+
+		if discardErr != "" {
+			// Cheat by setting the job row directly to discarded as if it'd
+			// run out of attempts.
+			_, err = bundle.tx.Exec(ctx, `
+				UPDATE river_job
+				SET attempt = 25,
+					errors = ARRAY[jsonb_build_object('at', now(), 'attempt', 25, 'error', $2::text)],
+					finalized_at = now(),
+					state = 'discarded'
+				WHERE id = $1`,
+				jobID, discardErr,
+			)
+			require.NoError(t, err)
+		}
+
+		return jobID
+	}
+
+	serve := func(t *testing.T, bundle *testBundle, accountID, accept string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "/emails/discarded?account_id="+accountID, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		recorder := httptest.NewRecorder()
+		bundle.apiServer.ServeMux().ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		jobID := createEmail(ctx, t, bundle, bundle.accountID, "first@example.com", "550 No such user")
+		createEmail(ctx, t, bundle, bundle.accountID, "pending@example.com", "")
+		createEmail(ctx, t, bundle, uuid.New(), "other-account@example.com", "550 No such user")
+
+		recorder := serve(t, bundle, bundle.accountID.String(), "")
+		require.Equal(t, http.StatusOK, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+		require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+		var resp HandleEmailListDiscardedResponse
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+		require.Len(t, resp.Emails, 1)
+		require.Equal(t, jobID, resp.Emails[0].ID)
+		require.Equal(t, 25, resp.Emails[0].Attempt)
+		require.Equal(t, "first@example.com", resp.Emails[0].EmailRecipient)
+		require.Equal(t, "550 No such user", resp.Emails[0].Error)
+		require.Equal(t, "Hello.", resp.Emails[0].Subject)
+		require.False(t, resp.Emails[0].FinalizedAt.IsZero())
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		encrypter, err := newEmailEncrypter(generateEncryptionKey(t))
+		require.NoError(t, err)
+		bundle.apiServer.encrypter = encrypter
+
+		createEmail(ctx, t, bundle, bundle.accountID, "first@example.com", "550 No such user")
+
+		recorder := serve(t, bundle, bundle.accountID.String(), "")
+		require.Equal(t, http.StatusOK, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+
+		var resp HandleEmailListDiscardedResponse
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+		require.Len(t, resp.Emails, 1)
+		require.Equal(t, "first@example.com", resp.Emails[0].EmailRecipient)
+		require.Equal(t, "Hello.", resp.Emails[0].Subject)
+	})
+
+	t.Run("JSONEmpty", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		recorder := serve(t, bundle, bundle.accountID.String(), "")
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.JSONEq(t, `{"emails":[]}`, recorder.Body.String())
+	})
+
+	t.Run("NDJSON", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		jobIDs := []int64{
+			createEmail(ctx, t, bundle, bundle.accountID, "first@example.com", "550 No such user"),
+			createEmail(ctx, t, bundle, bundle.accountID, "second@example.com", "552 Mailbox full"),
+			createEmail(ctx, t, bundle, bundle.accountID, "third@example.com", "554 Rejected"),
+		}
+
+		recorder := serve(t, bundle, bundle.accountID.String(), "application/x-ndjson")
+		require.Equal(t, http.StatusOK, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+		require.Equal(t, "application/x-ndjson", recorder.Header().Get("Content-Type"))
+		require.True(t, recorder.Flushed)
+
+		// Each line is a complete email of its own.
+		var emails []*EmailDiscarded
+		scanner := bufio.NewScanner(recorder.Body)
+		for scanner.Scan() {
+			var email EmailDiscarded
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &email), "Line isn't a JSON object: %s", scanner.Text())
+			emails = append(emails, &email)
+		}
+		require.NoError(t, scanner.Err())
+
+		require.Len(t, emails, len(jobIDs))
+		for i, email := range emails {
+			require.Equal(t, jobIDs[i], email.ID)
+		}
+		require.Equal(t, "second@example.com", emails[1].EmailRecipient)
+		require.Equal(t, "552 Mailbox full", emails[1].Error)
+	})
+
+	t.Run("InvalidAccountID", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		recorder := serve(t, bundle, "not-a-uuid", "")
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+		require.JSONEq(t, `{"error_code":"invalid_request","message":"Invalid account_id: not-a-uuid"}`, recorder.Body.String())
+	})
+}
+
+func TestAcceptsNDJSON(t *testing.T) {
+	t.Parallel()
+
+	for accept, expected := range map[string]bool{
+		"":                                       false,
+		"application/json":                       false,
+		"application/x-ndjson":                   true,
+		"application/json, application/x-ndjson": true,
+		"APPLICATION/X-NDJSON; q=0.9":            true,
+		"*/*":                                    false,
+	} {
+		require.Equal(t, expected, acceptsNDJSON(accept), "Unexpected result for %q", accept)
+	}
+}
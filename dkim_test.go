@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/stretchr/testify/require"
+)
+
+// verifyDKIM verifies the DKIM signature of msg the way a receiver would,
+// with publicKey published as the selector `mail` of example.com in place of
+// DNS. Verification failures are in the result's Err.
+func verifyDKIM(t *testing.T, msg []byte, publicKey *rsa.PublicKey) *dkim.Verification {
+	t.Helper()
+
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != "mail._domainkey.example.com" {
+				return nil, fmt.Errorf("no TXT record for %q", domain)
+			}
+			return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(publicKeyDER)}, nil
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, verifications, 1)
+	return verifications[0]
+}
+
+// generateDKIMKey generates an RSA key for DKIM signing, returning it along
+// with its PKCS #8 PEM encoding.
+func generateDKIMKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestDKIMSigner(t *testing.T) {
+	t.Parallel()
+
+	key, keyPEM := generateDKIMKey(t)
+
+	signer, err := newDKIMSigner("example.com", "mail", keyPEM)
+	require.NoError(t, err)
+
+	msg := buildMessage(&SendEmailArgs{
+		Body:           "Hello from River's idempotent mail demo.",
+		Cc:             []string{"manager@example.com"},
+		EmailRecipient: "receiver@example.com",
+		EmailSender:    "sender@example.com",
+		Subject:        "Hello.",
+	})
+
+	t.Run("Verifies", func(t *testing.T) {
+		t.Parallel()
+
+		signedMsg, err := signer.sign(msg)
+		require.NoError(t, err)
+		require.True(t, bytes.HasPrefix(signedMsg, []byte("DKIM-Signature: ")))
+		require.True(t, bytes.HasSuffix(signedMsg, msg), "Expected the original message to follow the signature")
+
+		verification := verifyDKIM(t, signedMsg, &key.PublicKey)
+		require.NoError(t, verification.Err)
+		require.Equal(t, "example.com", verification.Domain)
+		require.Equal(t, dkimSignedHeaders, verification.HeaderKeys)
+		require.WithinDuration(t, time.Now(), verification.Time, time.Minute)
+		require.Contains(t, string(signedMsg[:bytes.Index(signedMsg, []byte("\r\n\r\n"))]), "c=relaxed/relaxed")
+	})
+
+	t.Run("TamperedFails", func(t *testing.T) {
+		t.Parallel()
+
+		signedMsg, err := signer.sign(msg)
+		require.NoError(t, err)
+
+		verification := verifyDKIM(t, bytes.Replace(signedMsg, []byte("Subject: Hello."), []byte("Subject: Goodbye."), 1), &key.PublicKey)
+		require.ErrorContains(t, verification.Err, "signature did not verify")
+
+		verification = verifyDKIM(t, bytes.Replace(signedMsg, []byte("mail demo."), []byte("mail scam."), 1), &key.PublicKey)
+		require.ErrorContains(t, verification.Err, "body hash did not verify")
+
+		// Headers that weren't there when the message was signed can't be
+		// added afterward.
+		verification = verifyDKIM(t, bytes.Replace(signedMsg, []byte("Subject: Hello.\r\n"), []byte("Subject: Hello.\r\nReply-To: scammer@example.net\r\n"), 1), &key.PublicKey)
+		require.ErrorContains(t, verification.Err, "signature did not verify")
+	})
+
+	t.Run("WrongKeyFails", func(t *testing.T) {
+		t.Parallel()
+
+		otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		require.NoError(t, err)
+
+		signedMsg, err := signer.sign(msg)
+		require.NoError(t, err)
+
+		require.ErrorContains(t, verifyDKIM(t, signedMsg, &otherKey.PublicKey).Err, "signature did not verify")
+	})
+
+	t.Run("RelaxedWhitespace", func(t *testing.T) {
+		t.Parallel()
+
+		signedMsg, err := signer.sign(msg)
+		require.NoError(t, err)
+
+		// Relays that rewrap headers or pad lines don't break the signature.
+		rewritten := bytes.Replace(signedMsg, []byte("Subject: Hello.\r\n"), []byte("Subject:   Hello.  \r\n"), 1)
+		rewritten = bytes.Replace(rewritten, []byte("mail demo.\r\n"), []byte("mail  demo. \r\n\r\n"), 1)
+		require.NoError(t, verifyDKIM(t, rewritten, &key.PublicKey).Err)
+	})
+
+	t.Run("BareLineFeeds", func(t *testing.T) {
+		t.Parallel()
+
+		signedMsg, err := signer.sign([]byte("From: sender@example.com\nSubject: Built elsewhere\n\nHello.\n"))
+		require.NoError(t, err)
+		require.NotContains(t, strings.ReplaceAll(string(signedMsg), "\r\n", ""), "\n")
+
+		require.NoError(t, verifyDKIM(t, signedMsg, &key.PublicKey).Err)
+	})
+
+	t.Run("PKCS1Key", func(t *testing.T) {
+		t.Parallel()
+
+		signer, err := newDKIMSigner("example.com", "mail", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+		require.NoError(t, err)
+
+		signedMsg, err := signer.sign(msg)
+		require.NoError(t, err)
+
+		require.NoError(t, verifyDKIM(t, signedMsg, &key.PublicKey).Err)
+	})
+
+	t.Run("InvalidKeys", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newDKIMSigner("example.com", "mail", []byte("not a key"))
+		require.EqualError(t, err, "DKIM_PRIVATE_KEY must be a PEM encoded private key")
+
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		ecKeyDER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+		require.NoError(t, err)
+
+		_, err = newDKIMSigner("example.com", "mail", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecKeyDER}))
+		require.EqualError(t, err, "DKIM_PRIVATE_KEY must be an RSA key, but was *ecdsa.PrivateKey")
+
+		_, err = newDKIMSigner("example.com", "mail", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("cert")}))
+		require.EqualError(t, err, `DKIM_PRIVATE_KEY must be a PEM encoded private key, but was a "CERTIFICATE" block`)
+	})
+}
+
+func TestDKIMSigningSender(t *testing.T) {
+	t.Parallel()
+
+	key, keyPEM := generateDKIMKey(t)
+
+	signer, err := newDKIMSigner("example.com", "mail", keyPEM)
+	require.NoError(t, err)
+
+	var (
+		fakeSender = &fakeEmailSender{}
+		msg        = buildMessage(&SendEmailArgs{Body: "Hello.", EmailRecipient: "receiver@example.com", EmailSender: "sender@example.com", Subject: "Hello."})
+		sender     = &dkimSigningSender{sender: fakeSender, signer: signer}
+	)
+	require.NoError(t, sender.SendMail(t.Context(), "bounces@example.com", []string{"receiver@example.com"}, msg))
+	require.Len(t, fakeSender.sent, 1)
+	require.Equal(t, "bounces@example.com", fakeSender.sent[0].From)
+	require.Equal(t, []string{"receiver@example.com"}, fakeSender.sent[0].To)
+
+	require.NoError(t, verifyDKIM(t, fakeSender.sent[0].Message, &key.PublicKey).Err)
+}
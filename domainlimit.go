@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// domainLimiter limits how many sends may be in progress at once to each
+// recipient domain, so that a burst of email to one domain doesn't open more
+// connections to it than it'd like all at once.
+//
+// Domains are tracked only while they have sends in progress or waiting, so
+// that the limiter doesn't grow with every domain that's ever been sent to.
+type domainLimiter struct {
+	limit int
+
+	mu      sync.Mutex
+	domains map[string]*domainSlots
+}
+
+// domainSlots are the slots of one domain. A send holds one by putting a
+// value in sem for as long as it takes.
+type domainSlots struct {
+	sem   chan struct{}
+	users int // sends holding or waiting for a slot
+}
+
+func newDomainLimiter(limit int) *domainLimiter {
+	return &domainLimiter{domains: make(map[string]*domainSlots), limit: limit}
+}
+
+// acquire waits for one of the domain's slots to be free and takes it,
+// returning a function that gives it back. It returns an error without taking
+// a slot if ctx is done first.
+func (l *domainLimiter) acquire(ctx context.Context, domain string) (func(), error) {
+	domain = strings.ToLower(domain)
+
+	l.mu.Lock()
+	slots, ok := l.domains[domain]
+	if !ok {
+		slots = &domainSlots{sem: make(chan struct{}, l.limit)}
+		l.domains[domain] = slots
+	}
+	slots.users++
+	l.mu.Unlock()
+
+	select {
+	case slots.sem <- struct{}{}:
+	case <-ctx.Done():
+		l.done(domain, slots)
+		return nil, ctx.Err()
+	}
+
+	return func() {
+		<-slots.sem
+		l.done(domain, slots)
+	}, nil
+}
+
+// done stops tracking a domain once nothing is using its slots.
+func (l *domainLimiter) done(domain string, slots *domainSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slots.users--
+	if slots.users == 0 {
+		delete(l.domains, domain)
+	}
+}
+
+// addressDomain returns the domain of an email address.
+func addressDomain(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainLimiter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("LimitsEachDomain", func(t *testing.T) {
+		t.Parallel()
+
+		limiter := newDomainLimiter(1)
+
+		release, err := limiter.acquire(t.Context(), "example.com")
+		require.NoError(t, err)
+
+		// The domain's only slot is taken, including under another case.
+		ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+		defer cancel()
+		_, err = limiter.acquire(ctx, "EXAMPLE.com")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// Other domains have slots of their own.
+		releaseOther, err := limiter.acquire(t.Context(), "example.org")
+		require.NoError(t, err)
+		releaseOther()
+
+		release()
+		release, err = limiter.acquire(t.Context(), "example.com")
+		require.NoError(t, err)
+		release()
+	})
+
+	t.Run("ForgetsIdleDomains", func(t *testing.T) {
+		t.Parallel()
+
+		limiter := newDomainLimiter(2)
+
+		release, err := limiter.acquire(t.Context(), "example.com")
+		require.NoError(t, err)
+		require.Len(t, limiter.domains, 1)
+
+		release()
+		require.Empty(t, limiter.domains)
+	})
+}
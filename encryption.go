@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// encryptedEmailFields are the fields of SendEmailArgs that are encrypted at
+// rest: an email's content, including its attachments and the data its
+// template is rendered with, and everyone it's addressed to. Others are left
+// in plaintext, notably the account ID and idempotency key that make up its
+// unique key, which River has to be able to read to deduplicate it.
+type encryptedEmailFields struct {
+	Attachments    []*EmailAttachment `json:"attachments,omitempty"` // missing from emails encrypted before they could have attachments
+	Bcc            []string           `json:"bcc"`
+	Body           string             `json:"body"`
+	BodyHTML       string             `json:"body_html"`
+	Cc             []string           `json:"cc"`
+	EmailRecipient string             `json:"email_recipient"`
+	RawMessage     []byte             `json:"raw_message"`
+	TemplateData   map[string]any     `json:"template_data,omitempty"` // missing from emails encrypted before templates could be rendered when sent
+}
+
+// emailEncrypter encrypts the sensitive fields of emails with envelope
+// encryption before they're stored in their job's args. Each email's fields
+// are encrypted with a random data key of its own, and the data key is
+// encrypted with the key from ENCRYPTION_KEY, which never leaves the
+// process. Both use AES-256-GCM.
+//
+// Methods on a nil emailEncrypter leave emails unencrypted.
+type emailEncrypter struct {
+	key cipher.AEAD
+}
+
+// newEmailEncrypter makes an emailEncrypter from a base64 encoded 32 byte key,
+// or returns nil if the key is empty.
+func newEmailEncrypter(encodedKey string) (*emailEncrypter, error) {
+	if encodedKey == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("ENCRYPTION_KEY must be 32 bytes encoded as base64, like from `openssl rand -base64 32`")
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &emailEncrypter{key: aead}, nil
+}
+
+// encrypt moves the sensitive fields of args into its EncryptedContent,
+// encrypted with a new data key that's stored encrypted in EncryptedKey.
+func (e *emailEncrypter) encrypt(args *SendEmailArgs) error {
+	if e == nil {
+		return nil
+	}
+
+	content, err := json.Marshal(&encryptedEmailFields{
+		Attachments:    args.Attachments,
+		Bcc:            args.Bcc,
+		Body:           args.Body,
+		BodyHTML:       args.BodyHTML,
+		Cc:             args.Cc,
+		EmailRecipient: args.EmailRecipient,
+		RawMessage:     args.RawMessage,
+		TemplateData:   args.TemplateData,
+	})
+	if err != nil {
+		return err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	if args.EncryptedContent, err = sealAEAD(dataAEAD, content, encryptedContentAdditionalData(args)); err != nil {
+		return err
+	}
+	if args.EncryptedKey, err = sealAEAD(e.key, dataKey, nil); err != nil {
+		return err
+	}
+
+	args.Bcc, args.Body, args.BodyHTML, args.Cc, args.EmailRecipient, args.RawMessage, args.TemplateData = nil, "", "", nil, "", nil, nil
+	args.Attachments = nil
+	return nil
+}
+
+// decrypt restores the sensitive fields of args encrypted by encrypt. Args
+// that aren't encrypted, like those of jobs inserted before ENCRYPTION_KEY
+// was set, are left as they are.
+func (e *emailEncrypter) decrypt(args *SendEmailArgs) error {
+	if len(args.EncryptedKey) == 0 {
+		return nil
+	}
+	if e == nil {
+		return errors.New("email is encrypted, but ENCRYPTION_KEY isn't set")
+	}
+
+	dataKey, err := openAEAD(e.key, args.EncryptedKey, nil)
+	if err != nil {
+		return fmt.Errorf("error decrypting email's data key: %w", err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	content, err := openAEAD(dataAEAD, args.EncryptedContent, encryptedContentAdditionalData(args))
+	if err != nil {
+		return fmt.Errorf("error decrypting email: %w", err)
+	}
+
+	var fields encryptedEmailFields
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return err
+	}
+
+	args.Bcc, args.Body, args.BodyHTML, args.Cc, args.EmailRecipient, args.RawMessage = fields.Bcc, fields.Body, fields.BodyHTML, fields.Cc, fields.EmailRecipient, fields.RawMessage
+	args.Attachments, args.TemplateData = fields.Attachments, fields.TemplateData
+	args.EncryptedContent, args.EncryptedKey = nil, nil
+	return nil
+}
+
+// encryptedContentAdditionalData binds an email's encrypted content to its
+// unique key, so that content copied into another job can't be decrypted.
+func encryptedContentAdditionalData(args *SendEmailArgs) []byte {
+	return []byte(args.AccountID.String() + ":" + args.IdempotencyKey)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAEAD encrypts plaintext with a random nonce, which is prepended to the
+// ciphertext for openAEAD.
+func sealAEAD(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// openAEAD decrypts ciphertext from sealAEAD.
+func openAEAD(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
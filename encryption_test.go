@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// generateEncryptionKey generates a key for ENCRYPTION_KEY.
+func generateEncryptionKey(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestEmailEncrypter(t *testing.T) {
+	t.Parallel()
+
+	encrypter, err := newEmailEncrypter(generateEncryptionKey(t))
+	require.NoError(t, err)
+
+	testArgs := func() *SendEmailArgs {
+		return &SendEmailArgs{
+			AccountID:      uuid.New(),
+			Bcc:            []string{"audit@example.com"},
+			Body:           "Your password reset code is 314159.",
+			BodyHTML:       "<p>Your password reset code is <b>314159</b>.</p>",
+			Cc:             []string{"manager@example.com"},
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Password reset",
+		}
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			args      = testArgs()
+			plainArgs = *args
+		)
+		require.NoError(t, encrypter.encrypt(args))
+
+		// Only the unique key and fields that aren't sensitive are left in
+		// plaintext.
+		encodedArgs, err := json.Marshal(args)
+		require.NoError(t, err)
+		for _, plaintext := range []string{"314159", "receiver@example.com", "manager@example.com", "audit@example.com"} {
+			require.NotContains(t, string(encodedArgs), plaintext)
+		}
+		require.Equal(t, plainArgs.AccountID, args.AccountID)
+		require.Equal(t, plainArgs.IdempotencyKey, args.IdempotencyKey)
+		require.Equal(t, "sender@example.com", args.EmailSender)
+		require.Equal(t, "Password reset", args.Subject)
+
+		var storedArgs SendEmailArgs
+		require.NoError(t, json.Unmarshal(encodedArgs, &storedArgs))
+		require.NoError(t, encrypter.decrypt(&storedArgs))
+		require.Equal(t, &plainArgs, &storedArgs)
+	})
+
+	t.Run("Attachments", func(t *testing.T) {
+		t.Parallel()
+
+		attachments := []*EmailAttachment{{Content: []byte("Your password reset code is 314159."), ContentType: "text/plain", Filename: "code.txt"}}
+
+		args := testArgs()
+		args.Attachments = attachments
+		require.NoError(t, encrypter.encrypt(args))
+		require.Nil(t, args.Attachments)
+
+		require.NoError(t, encrypter.decrypt(args))
+		require.Equal(t, attachments, args.Attachments)
+	})
+
+	t.Run("RawMessage", func(t *testing.T) {
+		t.Parallel()
+
+		args := &SendEmailArgs{AccountID: uuid.New(), IdempotencyKey: uuid.NewString(), RawMessage: []byte("Subject: Hello.\r\n\r\nHello.\r\n")}
+		require.NoError(t, encrypter.encrypt(args))
+		require.Nil(t, args.RawMessage)
+
+		require.NoError(t, encrypter.decrypt(args))
+		require.Equal(t, []byte("Subject: Hello.\r\n\r\nHello.\r\n"), args.RawMessage)
+	})
+
+	t.Run("TemplateData", func(t *testing.T) {
+		t.Parallel()
+
+		args := &SendEmailArgs{AccountID: uuid.New(), IdempotencyKey: uuid.NewString(), Template: "welcome", TemplateData: map[string]any{"name": "Ada"}}
+		require.NoError(t, encrypter.encrypt(args))
+		require.Nil(t, args.TemplateData)
+		require.Equal(t, "welcome", args.Template)
+
+		require.NoError(t, encrypter.decrypt(args))
+		require.Equal(t, map[string]any{"name": "Ada"}, args.TemplateData)
+	})
+
+	t.Run("DataKeyPerEmail", func(t *testing.T) {
+		t.Parallel()
+
+		args1, args2 := testArgs(), testArgs()
+		require.NoError(t, encrypter.encrypt(args1))
+		require.NoError(t, encrypter.encrypt(args2))
+		require.NotEqual(t, args1.EncryptedKey, args2.EncryptedKey)
+	})
+
+	t.Run("ContentBoundToUniqueKey", func(t *testing.T) {
+		t.Parallel()
+
+		args, otherArgs := testArgs(), testArgs()
+		require.NoError(t, encrypter.encrypt(args))
+		require.NoError(t, encrypter.encrypt(otherArgs))
+
+		// Content copied into another email's job can't be decrypted.
+		otherArgs.EncryptedContent, otherArgs.EncryptedKey = args.EncryptedContent, args.EncryptedKey
+		require.ErrorContains(t, encrypter.decrypt(otherArgs), "error decrypting email: ")
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		t.Parallel()
+
+		otherEncrypter, err := newEmailEncrypter(generateEncryptionKey(t))
+		require.NoError(t, err)
+
+		args := testArgs()
+		require.NoError(t, encrypter.encrypt(args))
+		require.ErrorContains(t, otherEncrypter.decrypt(args), "error decrypting email's data key: ")
+	})
+
+	t.Run("NotEncrypted", func(t *testing.T) {
+		t.Parallel()
+
+		var nilEncrypter *emailEncrypter
+
+		args := testArgs()
+		require.NoError(t, nilEncrypter.encrypt(args))
+		require.Equal(t, testArgs().Body, args.Body)
+		require.Nil(t, args.EncryptedKey)
+
+		// Jobs inserted before encryption was turned on are left as they are.
+		require.NoError(t, encrypter.decrypt(args))
+		require.Equal(t, testArgs().Body, args.Body)
+	})
+
+	t.Run("EncryptedWithoutKey", func(t *testing.T) {
+		t.Parallel()
+
+		var nilEncrypter *emailEncrypter
+
+		args := testArgs()
+		require.NoError(t, encrypter.encrypt(args))
+		require.EqualError(t, nilEncrypter.decrypt(args), "email is encrypted, but ENCRYPTION_KEY isn't set")
+	})
+
+	t.Run("InvalidKeys", func(t *testing.T) {
+		t.Parallel()
+
+		encrypter, err := newEmailEncrypter("")
+		require.NoError(t, err)
+		require.Nil(t, encrypter)
+
+		for _, key := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("too short"))} {
+			_, err := newEmailEncrypter(key)
+			require.EqualError(t, err, "ENCRYPTION_KEY must be 32 bytes encoded as base64, like from `openssl rand -base64 32`")
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/riverqueue/river/rivertype"
+)
+
+// emailEventsPollInterval is how often an email's state is checked for
+// `GET /emails/{id}/events` by default.
+const emailEventsPollInterval = time.Second
+
+// emailStatesFinal are the states an email's job never leaves, after which
+// there are no more events to send.
+var emailStatesFinal = []rivertype.JobState{ //nolint:gochecknoglobals
+	rivertype.JobStateCancelled,
+	rivertype.JobStateCompleted,
+	rivertype.JobStateDiscarded,
+}
+
+// handleEmailEvents streams an email's state as server-sent events so that a
+// UI can watch its progress without polling. The job's state is checked
+// every eventsPollInterval, and a `state` event with the same data as
+// EmailGet is sent each time it changes, starting with the state it's in now.
+// The stream ends once the email reaches a final state, or when the client
+// goes away.
+//
+// It streams for as long as the email takes, so it isn't built with
+// MakeHandler.
+func (s *APIService) handleEmailEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, err := parseEmailID(r)
+	if err != nil {
+		writeErrorWithOpts(w, s.handlerOpts(), err)
+		return
+	}
+
+	// Emails that don't exist are an error like any other until the stream
+	// has started.
+	email, err := s.EmailGet(ctx, &HandleEmailGetRequest{ID: id})
+	if err != nil {
+		writeErrorWithOpts(w, s.handlerOpts(), err)
+		return
+	}
+
+	responseController := http.NewResponseController(w)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+
+	pollInterval := s.eventsPollInterval
+	if pollInterval <= 0 {
+		pollInterval = emailEventsPollInterval
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	var lastState rivertype.JobState
+	for {
+		if email.State != lastState {
+			data, err := marshalResponse(email, s.jsonCase)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error marshaling email event: %s", err)
+				return
+			}
+
+			if _, err := fmt.Fprintf(w, "event: state\ndata: %s\n\n", data); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing response: %s", err)
+				return
+			}
+			_ = responseController.Flush()
+			lastState = email.State
+		}
+
+		if slices.Contains(emailStatesFinal, email.State) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Once the stream has started, errors can only be logged. A job
+		// that's gone was deleted, like by cleanup, and has nothing more to
+		// report.
+		if email, err = s.EmailGet(ctx, &HandleEmailGetRequest{ID: id}); err != nil {
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "Error getting email for events: %s", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+	"github.com/riverqueue/river/rivertype"
+)
+
+func TestAPIServiceEmailEvents(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		apiServer *APIService
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			apiServer: &APIService{
+				begin:              tx.Begin,
+				eventsPollInterval: time.Millisecond,
+				metrics:            newMetrics(),
+				riverClient:        riverClient,
+				tracer:             testTracer,
+			},
+			tx: tx,
+		}, ctx
+	}
+
+	// Queues an email, returning the ID of its job.
+	createEmail := func(ctx context.Context, t *testing.T, bundle *testBundle) int64 {
+		t.Helper()
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		})
+		require.NoError(t, err)
+
+		var jobID int64
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT max(id) FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&jobID))
+		return jobID
+	}
+
+	// Moves the job through the given states, one each time the service
+	// looks it up. The handler and the test share a transaction, so states
+	// change from the handler's own goroutine rather than concurrently.
+	driveStates := func(ctx context.Context, t *testing.T, bundle *testBundle, jobID int64, states ...rivertype.JobState) {
+		t.Helper()
+
+		bundle.apiServer.begin = func(ctx context.Context) (pgx.Tx, error) {
+			if len(states) > 0 {
+				_, err := bundle.tx.Exec(ctx, `
+					UPDATE river_job
+					SET finalized_at = CASE WHEN $2 IN ('cancelled', 'completed', 'discarded') THEN now() END,
+						state = $2::river_job_state
+					WHERE id = $1`,
+					jobID, string(states[0]),
+				)
+				require.NoError(t, err)
+				states = states[1:]
+			}
+			return bundle.tx.Begin(ctx)
+		}
+	}
+
+	t.Run("StreamsStateChangesUntilFinal", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		jobID := createEmail(ctx, t, bundle)
+		driveStates(ctx, t, bundle, jobID,
+			rivertype.JobStateAvailable,
+			rivertype.JobStateRunning,
+			rivertype.JobStateRetryable,
+			rivertype.JobStateRetryable,
+			rivertype.JobStateRunning,
+			rivertype.JobStateCompleted,
+		)
+
+		recorder := httptest.NewRecorder()
+		bundle.apiServer.ServeMux().ServeHTTP(recorder, httptest.NewRequestWithContext(ctx, http.MethodGet, "/emails/"+strconv.FormatInt(jobID, 10)+"/events", nil))
+
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, "text/event-stream", recorder.Header().Get("Content-Type"))
+
+		// Each state is sent once, even when it's seen more than once.
+		event := func(state rivertype.JobState) string {
+			return `event: state` + "\n" + `data: {"id":` + strconv.FormatInt(jobID, 10) + `,"state":"` + string(state) + `"}` + "\n\n"
+		}
+		require.Equal(t, event(rivertype.JobStateAvailable)+
+			event(rivertype.JobStateRunning)+
+			event(rivertype.JobStateRetryable)+
+			event(rivertype.JobStateRunning)+
+			event(rivertype.JobStateCompleted), recorder.Body.String())
+	})
+
+	t.Run("AlreadyFinal", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		jobID := createEmail(ctx, t, bundle)
+		driveStates(ctx, t, bundle, jobID, rivertype.JobStateDiscarded)
+
+		recorder := httptest.NewRecorder()
+		bundle.apiServer.ServeMux().ServeHTTP(recorder, httptest.NewRequestWithContext(ctx, http.MethodGet, "/emails/"+strconv.FormatInt(jobID, 10)+"/events", nil))
+
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, `event: state`+"\n"+`data: {"id":`+strconv.FormatInt(jobID, 10)+`,"state":"discarded"}`+"\n\n", recorder.Body.String())
+	})
+
+	t.Run("ClientDisconnects", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		jobID := createEmail(ctx, t, bundle)
+
+		// The email is never sent, so the stream only ends because the
+		// client goes away, which it does after a couple of polls. It's
+		// cancelled between queries so none is interrupted partway.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var numPolls int
+		bundle.apiServer.begin = func(ctx context.Context) (pgx.Tx, error) {
+			numPolls++
+			if numPolls > 2 {
+				cancel()
+			}
+			return bundle.tx.Begin(ctx)
+		}
+
+		recorder := httptest.NewRecorder()
+		bundle.apiServer.ServeMux().ServeHTTP(recorder, httptest.NewRequestWithContext(ctx, http.MethodGet, "/emails/"+strconv.FormatInt(jobID, 10)+"/events", nil))
+
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, `event: state`+"\n"+`data: {"id":`+strconv.FormatInt(jobID, 10)+`,"state":"available"}`+"\n\n", recorder.Body.String())
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		recorder := httptest.NewRecorder()
+		bundle.apiServer.ServeMux().ServeHTTP(recorder, httptest.NewRequestWithContext(ctx, http.MethodGet, "/emails/123456789/events", nil))
+
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+		require.JSONEq(t, `{"error_code":"not_found","message":"Email not found."}`, recorder.Body.String())
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/riverqueue/river/rivertype"
+)
+
+// replayOrStoreResponse returns the response stored for an idempotency key,
+// like Stripe's idempotent requests do, or if there isn't one yet, invokes
+// create and stores its response if it queued email. A stored response is
+// only replayed to a request for the same email, as told by argsHash, and a
+// request for a different one is rejected like it would be without stored
+// responses.
+//
+// Only responses that queued email are stored, along with rejections that
+// replayedRejection says are final. Others, like a duplicate of a job queued
+// before responses were being stored, are recomputed each time.
+//
+// The lookup and the store are transactions of their own rather than one
+// that's held open while create runs, which would hold a second connection
+// from the pool for as long as create uses its own.
+func (s *APIService) replayOrStoreResponse(ctx context.Context, accountID uuid.UUID, idempotencyKey, argsHash string, create func() (*HandleEmailCreateResponse, error)) (*HandleEmailCreateResponse, error) {
+	resp, err := s.replayResponse(ctx, accountID, idempotencyKey, argsHash)
+	if err != nil || resp != nil {
+		return resp, err
+	}
+
+	resp, err = create()
+	if err != nil {
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || !replayedRejection(apiErr) {
+			return nil, err
+		}
+		if err := s.storeResponse(ctx, accountID, idempotencyKey, argsHash, "", apiErr.StatusCode, apiErr); err != nil {
+			return nil, err
+		}
+		return nil, apiErr
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return resp, nil
+	}
+
+	if err := s.storeResponse(ctx, accountID, idempotencyKey, argsHash, resp.Location, resp.StatusCode, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// replayResponse returns the response stored for an idempotency key, or nil
+// if there isn't one. A stored rejection is returned as the error it was.
+func (s *APIService) replayResponse(ctx context.Context, accountID uuid.UUID, idempotencyKey, argsHash string) (*HandleEmailCreateResponse, error) {
+	tx, err := s.beginEmailTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var (
+		location       *string // NULL for requests with recipients
+		response       string
+		statusCode     int
+		storedArgsHash *string // NULL for responses stored before hashes were
+	)
+	err = tx.QueryRow(ctx, `
+		SELECT args_hash, location, response, status_code
+		FROM idempotency_responses
+		WHERE account_id = $1
+			AND idempotency_key = $2`,
+		accountID, idempotencyKey,
+	).Scan(&storedArgsHash, &location, &response, &statusCode)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil, nil //nolint:nilnil
+	case err != nil:
+		return nil, err
+	}
+
+	if storedArgsHash != nil && *storedArgsHash != argsHash {
+		return nil, errMismatchedParameters
+	}
+
+	s.metrics.emailsDuplicate.WithLabelValues("replayed").Inc()
+	// A stored rejection is returned as the error it was, so that it's
+	// written out the same way again.
+	if statusCode >= http.StatusBadRequest {
+		apiErr := &APIError{StatusCode: statusCode}
+		if err := json.Unmarshal([]byte(response), apiErr); err != nil {
+			return nil, err
+		}
+		return nil, apiErr
+	}
+	resp := &HandleEmailCreateResponse{replayed: []byte(response), StatusCode: statusCode}
+	if location != nil {
+		resp.Location = *location
+	}
+	return resp, nil
+}
+
+// replayedRejection returns true if an error rejecting an email is final for
+// its idempotency key, so that retries get the same rejection even if what
+// caused it has changed since, like a recipient being taken off the
+// suppression list. Client errors like invalid parameters aren't, since a
+// retry with the same key is how a client fixes them. Like any stored
+// response, a rejection is only final for the same email, and a request
+// that changes it, like to another recipient, is a reuse of the key.
+func replayedRejection(apiErr *APIError) bool {
+	return apiErr.Code == errorCodeRecipientSuppressed
+}
+
+// storeResponse stores the response to the first request with an idempotency
+// key, along with the hash of the email it was for.
+func (s *APIService) storeResponse(ctx context.Context, accountID uuid.UUID, idempotencyKey, argsHash, location string, statusCode int, resp any) error {
+	respData, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.beginEmailTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// A concurrent request with the same key might've stored a response
+	// first, in which case it's left in place as the original.
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO idempotency_responses (account_id, idempotency_key, args_hash, location, status_code, response)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6)
+		ON CONFLICT DO NOTHING`,
+		accountID, idempotencyKey, argsHash, location, statusCode, string(respData),
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// emailArgsHash hashes an email the way emailArgsMatch compares it, along with
+// the recipients of a request that has them, so that a stored response is
+// only replayed to a request for the same email.
+func emailArgsHash(args *SendEmailArgs, recipients []string) (string, error) {
+	normalized, err := normalizeEmailArgs(args)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal([]any{normalized, recipients})
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// idempotencyKeyRetention is how long a used idempotency key is remembered
+// after JOB_RETENTION has cleaned up its email's job, during which reusing it
+// is still reported as an expired key rather than a new one.
+const idempotencyKeyRetention = 30 * 24 * time.Hour
+
+// recordIdempotencyKey records that a newly queued email's job holds its
+// unique key, along with the earlier job that held it, if any, so that
+// keyExpired can still tell that the key was used before after the earlier
+// job is cleaned up.
+func recordIdempotencyKey(ctx context.Context, db dbExecutor, job *rivertype.JobRow) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO idempotency_keys (unique_key, job_id)
+		VALUES ($1, $2)
+		ON CONFLICT (unique_key) DO UPDATE
+		SET job_id = EXCLUDED.job_id,
+			previous_job_id = idempotency_keys.job_id,
+			updated_at = now()`,
+		job.UniqueKey, job.ID,
+	)
+	return err
+}
+
+// keyExpired returns true if a newly queued email's idempotency key was used
+// for an earlier email that's no longer deduplicated against, like because it
+// was cancelled, discarded, or cleaned up after JOB_RETENTION, which is why
+// it was queued again instead of being treated as a duplicate. Keys are
+// remembered for idempotencyKeyRetention after their jobs are cleaned up, and
+// one that's been forgotten since looks new.
+func (s *APIService) keyExpired(ctx context.Context, job *rivertype.JobRow) (bool, error) {
+	tx, err := s.beginEmailTx(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// Jobs that share a unique key are the same email for the configured
+	// idempotency scope, whatever it is.
+	var expired bool
+	if err := tx.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1
+			FROM river_job
+			WHERE unique_key = $1
+				AND id <> $2
+		) OR EXISTS (
+			SELECT 1
+			FROM idempotency_keys
+			WHERE unique_key = $1
+				AND job_id = $2
+				AND previous_job_id IS NOT NULL
+		)`,
+		job.UniqueKey, job.ID,
+	).Scan(&expired); err != nil {
+		return false, err
+	}
+
+	return expired, nil
+}
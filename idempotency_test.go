@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+)
+
+func TestAPIServiceIdempotentResponses(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		apiServer *APIService
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			apiServer: &APIService{
+				begin:               tx.Begin,
+				idempotentResponses: true,
+				metrics:             newMetrics(),
+				riverClient:         riverClient,
+				tracer:              testTracer,
+			},
+			tx: tx,
+		}, ctx
+	}
+
+	emailCreateReq := func() *HandleEmailCreateRequest {
+		return &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		}
+	}
+
+	// Posts an email create through the service's mux as a client would.
+	postEmail := func(t *testing.T, mux *http.ServeMux, req any) *httptest.ResponseRecorder {
+		t.Helper()
+
+		data, err := json.Marshal(req)
+		require.NoError(t, err)
+
+		httpReq := httptest.NewRequest(http.MethodPost, "/emails", bytes.NewReader(data))
+		httpReq.Header.Set("Content-Type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httpReq)
+		return recorder
+	}
+
+	t.Run("ReplaysByteIdenticalResponse", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		var (
+			mux = bundle.apiServer.ServeMux()
+			req = emailCreateReq()
+		)
+
+		first := postEmail(t, mux, req)
+		require.Equal(t, http.StatusCreated, first.Code, "Unexpected status; response body: %s", first.Body.String())
+		require.Regexp(t, `^/emails/[0-9]+$`, first.Header().Get("Location"))
+
+		for range 2 {
+			replay := postEmail(t, mux, req)
+			require.Equal(t, first.Code, replay.Code)
+			require.Equal(t, first.Body.Bytes(), replay.Body.Bytes())
+			require.Equal(t, first.Header().Get("Location"), replay.Header().Get("Location"))
+		}
+	})
+
+	t.Run("ReusedKeyChangedBody", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		var (
+			mux = bundle.apiServer.ServeMux()
+			req = emailCreateReq()
+		)
+
+		first := postEmail(t, mux, req)
+		require.Equal(t, http.StatusCreated, first.Code, "Unexpected status; response body: %s", first.Body.String())
+
+		// A different email under the same key isn't a retry of the first,
+		// so it's not replayed the first's response.
+		req.Body = "A different body."
+		resp := postEmail(t, mux, req)
+		require.Equal(t, http.StatusConflict, resp.Code, "Unexpected status; response body: %s", resp.Body.String())
+
+		var apiErr APIError
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &apiErr))
+		require.Equal(t, errorCodeIdempotencyKeyReuse, apiErr.Code)
+	})
+
+	t.Run("ResponsesLeaveNoTxOpen", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		// Every transaction is begun from the test's, so one that's left
+		// open while another is begun shows up as more than one at once.
+		var numOpen, maxOpen int
+		begin := bundle.apiServer.begin
+		bundle.apiServer.begin = func(ctx context.Context) (pgx.Tx, error) {
+			tx, err := begin(ctx)
+			if err != nil {
+				return nil, err
+			}
+			numOpen++
+			maxOpen = max(maxOpen, numOpen)
+			return &closeTrackingTx{Tx: tx, onClose: func() { numOpen-- }}, nil
+		}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, emailCreateReq())
+		require.NoError(t, err)
+		require.Equal(t, 1, maxOpen)
+		require.Zero(t, numOpen)
+	})
+
+	t.Run("ReplaysRecipients", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		var (
+			mux = bundle.apiServer.ServeMux()
+			req = emailCreateReq()
+		)
+		req.EmailRecipient = ""
+		req.Recipients = []string{"receiver1@example.com", "receiver2@example.com"}
+
+		first := postEmail(t, mux, req)
+		require.Equal(t, http.StatusCreated, first.Code, "Unexpected status; response body: %s", first.Body.String())
+		require.JSONEq(t, `{"jobs":{"duplicate":0,"queued":2,"suppressed":0},"message":"2 email(s) queued for sending; 0 already queued; 0 suppressed."}`, first.Body.String())
+
+		require.Empty(t, first.Header().Get("Location"))
+
+		replay := postEmail(t, mux, req)
+		require.Equal(t, first.Code, replay.Code)
+		require.Equal(t, first.Body.Bytes(), replay.Body.Bytes())
+		require.Empty(t, replay.Header().Get("Location"))
+	})
+
+	t.Run("ReplaysSuppressedRejection", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		var (
+			mux = bundle.apiServer.ServeMux()
+			req = emailCreateReq()
+		)
+
+		_, err := bundle.tx.Exec(ctx, "INSERT INTO suppressions (account_id, email, reason) VALUES ($1, $2, $3)", req.AccountID, req.EmailRecipient, suppressionReasonManual)
+		require.NoError(t, err)
+
+		first := postEmail(t, mux, req)
+		require.Equal(t, http.StatusUnprocessableEntity, first.Code, "Unexpected status; response body: %s", first.Body.String())
+
+		var apiErr APIError
+		require.NoError(t, json.Unmarshal(first.Body.Bytes(), &apiErr))
+		require.Equal(t, errorCodeRecipientSuppressed, apiErr.Code)
+
+		// The recipient is no longer suppressed, but the key was already
+		// rejected, so retries get the same rejection rather than being
+		// checked again.
+		_, err = bundle.tx.Exec(ctx, "DELETE FROM suppressions WHERE account_id = $1", req.AccountID)
+		require.NoError(t, err)
+
+		for range 2 {
+			replay := postEmail(t, mux, req)
+			require.Equal(t, first.Code, replay.Code)
+			require.Equal(t, first.Body.Bytes(), replay.Body.Bytes())
+		}
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE kind = 'send_email' AND args->>'account_id' = $1::text", req.AccountID).Scan(&numJobs))
+		require.Zero(t, numJobs)
+
+		// A new key is checked like any other.
+		req.IdempotencyKey = uuid.NewString()
+		resp := postEmail(t, mux, req)
+		require.Equal(t, http.StatusCreated, resp.Code, "Unexpected status; response body: %s", resp.Body.String())
+	})
+
+	t.Run("SuppressedRejectionNotReplayedToDifferentEmail", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		var (
+			mux = bundle.apiServer.ServeMux()
+			req = emailCreateReq()
+		)
+
+		_, err := bundle.tx.Exec(ctx, "INSERT INTO suppressions (account_id, email, reason) VALUES ($1, $2, $3)", req.AccountID, req.EmailRecipient, suppressionReasonManual)
+		require.NoError(t, err)
+
+		first := postEmail(t, mux, req)
+		require.Equal(t, http.StatusUnprocessableEntity, first.Code, "Unexpected status; response body: %s", first.Body.String())
+
+		// The rejection was of an email to someone else, so one to a
+		// different recipient under the same key is a reuse of the key.
+		req.EmailRecipient = "other-receiver@example.com"
+		resp := postEmail(t, mux, req)
+		require.Equal(t, http.StatusConflict, resp.Code, "Unexpected status; response body: %s", resp.Body.String())
+
+		var apiErr APIError
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &apiErr))
+		require.Equal(t, errorCodeIdempotencyKeyReuse, apiErr.Code)
+	})
+
+	t.Run("ValidationErrorNotStored", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		var (
+			mux = bundle.apiServer.ServeMux()
+			req = emailCreateReq()
+		)
+		req.Subject = ""
+
+		first := postEmail(t, mux, req)
+		require.Equal(t, http.StatusBadRequest, first.Code, "Unexpected status; response body: %s", first.Body.String())
+
+		// Fixing a request and retrying it with the same key is allowed.
+		req.Subject = "Hello."
+		resp := postEmail(t, mux, req)
+		require.Equal(t, http.StatusCreated, resp.Code, "Unexpected status; response body: %s", resp.Body.String())
+	})
+
+	t.Run("DryRunNotStored", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := emailCreateReq()
+		req.DryRun = true
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		req.DryRun = false
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+
+	t.Run("PreexistingJobNotStored", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := emailCreateReq()
+
+		// Queued before responses were being stored.
+		bundle.apiServer.idempotentResponses = false
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		bundle.apiServer.idempotentResponses = true
+		for range 2 {
+			resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+			require.NoError(t, err)
+			requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+		}
+
+		var numResponses int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM idempotency_responses WHERE account_id = $1", req.AccountID).Scan(&numResponses))
+		require.Zero(t, numResponses)
+	})
+}
+
+// closeTrackingTx is a pgx.Tx that calls onClose the first time it's
+// committed or rolled back.
+type closeTrackingTx struct {
+	pgx.Tx
+
+	closed  bool
+	onClose func()
+}
+
+func (tx *closeTrackingTx) Commit(ctx context.Context) error {
+	tx.close()
+	return tx.Tx.Commit(ctx)
+}
+
+func (tx *closeTrackingTx) Rollback(ctx context.Context) error {
+	tx.close()
+	return tx.Tx.Rollback(ctx)
+}
+
+func (tx *closeTrackingTx) close() {
+	if !tx.closed {
+		tx.closed = true
+		tx.onClose()
+	}
+}
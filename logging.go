@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// How email content and addresses are redacted in logs.
+const (
+	LogRedactHash     = "hash"     // replaced by a hash that's the same for the same value, for correlating logs
+	LogRedactNone     = "none"     // logged in full
+	LogRedactTruncate = "truncate" // cut short with an ellipsis
+)
+
+// logTruncateLength is the most characters of a body that's logged with
+// LogRedactTruncate.
+const logTruncateLength = 32
+
+// logRedactedKeys are the keys of log attributes holding an email's content
+// or recipients, which are redacted according to LOG_REDACT wherever they're
+// logged.
+var logRedactedKeys = []string{"bcc", "body", "body_html", "cc", "email_recipient"} //nolint:gochecknoglobals
+
+// newLogger makes a logger that writes JSON to w, with email content and
+// recipients redacted according to redact, one of LogRedactHash,
+// LogRedactNone, or LogRedactTruncate. Only logs are redacted, never what's
+// queued or sent.
+func newLogger(w io.Writer, redact string) (*slog.Logger, error) {
+	if redact != LogRedactHash && redact != LogRedactNone && redact != LogRedactTruncate {
+		return nil, fmt.Errorf("LOG_REDACT must be %q, %q, or %q, but was %q", LogRedactHash, LogRedactNone, LogRedactTruncate, redact)
+	}
+
+	opts := &slog.HandlerOptions{}
+	if redact != LogRedactNone {
+		opts.ReplaceAttr = func(groups []string, attr slog.Attr) slog.Attr {
+			if !slices.Contains(logRedactedKeys, attr.Key) {
+				return attr
+			}
+
+			isBody := attr.Key == "body" || attr.Key == "body_html"
+			switch value := attr.Value.Any().(type) {
+			case string:
+				return slog.String(attr.Key, redactLogValue(value, redact, isBody))
+			case []string:
+				redacted := make([]string, len(value))
+				for i, address := range value {
+					redacted[i] = redactLogValue(address, redact, false)
+				}
+				return slog.Any(attr.Key, redacted)
+			}
+			return attr
+		}
+	}
+
+	return slog.New(slog.NewJSONHandler(w, opts)), nil
+}
+
+// redactLogValue redacts a body or an email address for logging. Truncated
+// addresses keep their domain, which is often what's needed to look into a
+// delivery problem.
+func redactLogValue(value, redact string, isBody bool) string {
+	if value == "" {
+		return ""
+	}
+
+	if redact == LogRedactHash {
+		hash := sha256.Sum256([]byte(value))
+		return "sha256:" + hex.EncodeToString(hash[:6])
+	}
+
+	if isBody {
+		if runes := []rune(value); len(runes) > logTruncateLength {
+			return string(runes[:logTruncateLength]) + "…"
+		}
+		return value
+	}
+
+	localPart, domain, ok := strings.Cut(value, "@")
+	if !ok || localPart == "" {
+		return "…"
+	}
+	return string([]rune(localPart)[:1]) + "…@" + domain
+}
+
+// emailLogAttr returns an email's details for logging, grouped under an
+// `email` key. Bodies and recipients are redacted by the logger.
+func emailLogAttr(args *SendEmailArgs) slog.Attr {
+	attrs := []any{
+		slog.String("account_id", args.AccountID.String()),
+		slog.String("idempotency_key", args.IdempotencyKey),
+		slog.String("email_sender", args.EmailSender),
+		slog.String("email_recipient", args.EmailRecipient),
+	}
+	if len(args.Cc) > 0 {
+		attrs = append(attrs, slog.Any("cc", args.Cc))
+	}
+	if len(args.Bcc) > 0 {
+		attrs = append(attrs, slog.Any("bcc", args.Bcc))
+	}
+	if args.Body != "" {
+		attrs = append(attrs, slog.String("body", args.Body))
+	}
+	if args.BodyHTML != "" {
+		attrs = append(attrs, slog.String("body_html", args.BodyHTML))
+	}
+	if len(args.RawMessage) > 0 {
+		attrs = append(attrs, slog.Int("raw_message_bytes", len(args.RawMessage)))
+	}
+	if len(args.Attachments) > 0 {
+		attrs = append(attrs, slog.Int("attachments", len(args.Attachments)))
+	}
+	if args.Template != "" {
+		attrs = append(attrs, slog.String("template", args.Template))
+	}
+	return slog.Group("email", attrs...)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLogger(t *testing.T) {
+	t.Parallel()
+
+	args := &SendEmailArgs{
+		AccountID:      uuid.New(),
+		Bcc:            []string{"audit@example.com"},
+		Body:           "Your password reset code is 314159. It expires in an hour.",
+		BodyHTML:       "<p>Your password reset code is <b>314159</b>. It expires in an hour.</p>",
+		EmailRecipient: "receiver@example.com",
+		EmailSender:    "sender@example.com",
+		IdempotencyKey: uuid.NewString(),
+	}
+
+	// Logs args with a logger using the given redaction, returning what was
+	// logged for the email.
+	logEmail := func(t *testing.T, redact string) map[string]any {
+		t.Helper()
+
+		var buf bytes.Buffer
+		logger, err := newLogger(&buf, redact)
+		require.NoError(t, err)
+
+		logger.Info("Queued email", emailLogAttr(args))
+
+		var logged struct {
+			Email map[string]any `json:"email"`
+		}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &logged))
+		return logged.Email
+	}
+
+	t.Run("Truncate", func(t *testing.T) {
+		t.Parallel()
+
+		require.Equal(t, map[string]any{
+			"account_id":      args.AccountID.String(),
+			"bcc":             []any{"a…@example.com"},
+			"body":            "Your password reset code is 3141…",
+			"body_html":       "<p>Your password reset code is <…",
+			"email_recipient": "r…@example.com",
+			"email_sender":    "sender@example.com",
+			"idempotency_key": args.IdempotencyKey,
+		}, logEmail(t, LogRedactTruncate))
+	})
+
+	t.Run("Hash", func(t *testing.T) {
+		t.Parallel()
+
+		logged := logEmail(t, LogRedactHash)
+		require.Regexp(t, `^sha256:[0-9a-f]{12}$`, logged["body"])
+		require.Regexp(t, `^sha256:[0-9a-f]{12}$`, logged["body_html"])
+		require.Regexp(t, `^sha256:[0-9a-f]{12}$`, logged["email_recipient"])
+		require.NotContains(t, logged["body"], "314159")
+		require.Equal(t, "sender@example.com", logged["email_sender"])
+
+		// The same value hashes the same to correlate logs.
+		require.Equal(t, logged["email_recipient"], logEmail(t, LogRedactHash)["email_recipient"])
+	})
+
+	t.Run("None", func(t *testing.T) {
+		t.Parallel()
+
+		logged := logEmail(t, LogRedactNone)
+		require.Equal(t, args.Body, logged["body"])
+		require.Equal(t, args.BodyHTML, logged["body_html"])
+		require.Equal(t, []any{"audit@example.com"}, logged["bcc"])
+		require.Equal(t, "receiver@example.com", logged["email_recipient"])
+	})
+
+	t.Run("ShortBodyNotTruncated", func(t *testing.T) {
+		t.Parallel()
+
+		require.Equal(t, "Hello.", redactLogValue("Hello.", LogRedactTruncate, true))
+		require.Equal(t, "…", redactLogValue("not-an-address", LogRedactTruncate, false))
+		require.Empty(t, redactLogValue("", LogRedactHash, false))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newLogger(&bytes.Buffer{}, "mask")
+		require.EqualError(t, err, `LOG_REDACT must be "hash", "none", or "truncate", but was "mask"`)
+	})
+}
@@ -1,21 +1,56 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
-	"net/smtp"
+	"net/mail"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata" // for time_zone validation on hosts without a tz database
+	"unicode"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sethvargo/go-envconfig"
+	"go.opentelemetry.io/contrib/exporters/autoexport"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/time/rate"
 
 	"github.com/riverqueue/river"
 	"github.com/riverqueue/river/riverdriver/riverpgxv5"
@@ -23,174 +58,2447 @@ import (
 )
 
 type APIService struct {
-	begin       func(ctx context.Context) (pgx.Tx, error)
+	// accountSenders are the sender addresses that each account may send
+	// from. An account with one sends from it when a request doesn't name a
+	// sender, and accounts that aren't listed may send from any address.
+	accountSenders map[uuid.UUID][]string
+
+	// allowedSenderDomains are the only domains that email may be sent from,
+	// compared case insensitively, to keep callers from spoofing other
+	// domains. Email may be sent from any domain if it's empty.
+	allowedSenderDomains []string
+
+	// batchJitter spreads out when emails in a request to several recipients
+	// become available to send, over a random window of this length, so that
+	// they don't all hit the SMTP server at once.
+	batchJitter time.Duration
+
+	begin func(ctx context.Context) (pgx.Tx, error)
+
+	// buildCommit and buildVersion are what the binary was built from, as
+	// injected into commit and version with -ldflags. See `GET /version`.
+	buildCommit  string
+	buildVersion string
+
+	// dedupeByContentPeriod is the period within which an email is
+	// deduplicated against identical ones queued with a different
+	// idempotency key. Emails are only deduplicated by key if it's zero.
+	dedupeByContentPeriod time.Duration
+
+	// dedupeFailedEmails keeps deduplicating an email's idempotency key after
+	// its job is discarded or cancelled, so that a resubmit is told the email
+	// failed instead of queuing it again. See uniqueOptsDedupeFailed.
+	dedupeFailedEmails bool
+
+	// defaultBody and defaultSubject are the body and subject of emails that
+	// don't specify their own, for notifications that always have the same
+	// copy. Neither applies to templates or raw messages.
+	defaultBody    string
+	defaultSubject string
+
+	// defaultSender is the sender of emails that don't specify one.
+	defaultSender string
+
+	// encrypter encrypts the content and recipients of emails before they're
+	// inserted. They're inserted in plaintext if it's nil.
+	encrypter *emailEncrypter
+
+	// enrichEmail is an optional hook invoked on every email before it's
+	// inserted, letting a deployment handle cross-cutting concerns like adding
+	// standard headers or tags in one place. It may modify args and opts.
+	enrichEmail func(args *SendEmailArgs, opts *river.InsertOpts)
+
+	// envelopeResponses wraps responses in an envelope for API gateways that
+	// expect one. See HandlerOpts.
+	envelopeResponses bool
+
+	// eventsPollInterval is how often an email's state is checked for
+	// changes to stream for `GET /emails/{id}/events`, or
+	// emailEventsPollInterval if it's zero.
+	eventsPollInterval time.Duration
+
+	// idempotencyScope is which fields make an email unique, either
+	// IdempotencyScopeAccountKey or IdempotencyScopeKey.
+	idempotencyScope string
+
+	// idempotentResponses stores the response to each successful create so
+	// that retries with the same idempotency key get back exactly the same
+	// response instead of one saying that the email was already queued.
+	idempotentResponses bool
+
+	// jsonCase is how keys in JSON responses are named. See HandlerOpts.
+	jsonCase string
+
+	// logger logs each email that's queued, with its content and recipients
+	// redacted according to LOG_REDACT. Nothing is logged if it's nil.
+	logger *slog.Logger
+
+	// maxConcurrentRequests is the most API requests that may be in progress
+	// at once, past which requests are answered with a 503 straight away
+	// rather than waiting. Requests aren't limited if it's zero.
+	maxConcurrentRequests int
+
+	// maxRecipients is the most addresses that an email may be sent to,
+	// counting its recipient along with everyone it's copied to. Emails
+	// aren't limited if it's zero.
+	maxRecipients int
+
+	// maxRequestBytes is the largest request body that's read. See
+	// HandlerOpts.
+	maxRequestBytes int
+
+	// maxUploadBytes is the largest multipart form that may be posted to
+	// `POST /emails`, attachments included. See newMultipartEmailHandler.
+	maxUploadBytes int
+
+	// maintenanceMode rejects new emails while it's on. It's set from
+	// MAINTENANCE_MODE at startup and can be changed with MaintenanceSet.
+	maintenanceMode atomic.Bool
+
+	metrics *metrics
+
+	// purgeEnabled allows EmailPurgeAccount, which deletes an account's email
+	// history for good. It's refused unless it's on.
+	purgeEnabled bool
+
+	// recipientDomainAllowlist are the only domains that email may be sent
+	// to, compared case insensitively, like a company's own domains in
+	// staging so that real customers can't be emailed. Email may be sent to
+	// any domain if it's empty.
+	recipientDomainAllowlist []string
+
+	// renderTemplatesAtSend stores the template and data of emails from
+	// templates instead of their rendered subject and bodies, which are
+	// rendered by the worker when they're sent. That keeps jobs small for
+	// large fan-outs to many recipients, at the cost of rendering each
+	// email again when it's sent.
+	renderTemplatesAtSend bool
+
+	// requestTimeout is the longest that an API request may take, after which
+	// it's answered with a 503 and its context is canceled. Requests aren't
+	// limited if it's zero.
+	requestTimeout time.Duration
+
 	riverClient *river.Client[pgx.Tx]
+
+	// sendRates are how many emails per second each queue's workers are
+	// expected to send, which the estimated send times of new emails are
+	// based on along with smtpSendRate.
+	sendRates map[string]float64
+
+	// smtpSendRate is SMTP_SEND_RATE, the most emails per second that all
+	// queues send together, or zero if they're not limited.
+	smtpSendRate float64
+
+	// spamPrecheck is SpamPrecheckFlag or SpamPrecheckReject to check the
+	// content of new emails with spamPrecheck, or empty to not check it.
+	spamPrecheck string
+
+	templates emailTemplates
+	tracer    trace.Tracer
+
+	// txMaxRetries is how many times an email's insert transaction is run
+	// again after failing with an error that's likely to be transient.
+	txMaxRetries int
+
+	// unsubscribeSecret verifies tokens in unsubscribe URLs.
+	unsubscribeSecret []byte
+}
+
+// tracerName is the name of the OpenTelemetry tracer used by the service.
+const tracerName = "github.com/riverqueue/idempotent-email-demo"
+
+// tracePropagator propagates trace context from incoming HTTP requests to
+// email jobs using W3C Trace Context.
+var tracePropagator = propagation.TraceContext{} //nolint:gochecknoglobals
+
+// metrics are Prometheus metrics for the service, kept in their own registry
+// so that tests can each have their own.
+type metrics struct {
+	emailDeliveryLatency prometheus.Histogram
+	emailsBounced        *prometheus.CounterVec
+	emailsDelivered      *prometheus.CounterVec
+	emailsDuplicate      *prometheus.CounterVec
+	emailsSpamPrecheck   *prometheus.CounterVec
+	registry             *prometheus.Registry
+}
+
+func newMetrics() *metrics {
+	metrics := &metrics{
+		emailDeliveryLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "email_delivery_latency_seconds",
+			Help: "Time from when an email was queued until it was delivered, including time spent waiting on retries or a schedule like quiet hours.",
+			// From a prompt send on an idle queue up to a backlog of half an
+			// hour. Anything longer lands in the +Inf bucket.
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800},
+		}),
+		emailsBounced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "emails_bounced_total",
+			Help: "Number of bounces reported by SMTP providers, by whether they were hard or soft.",
+		}, []string{"type"}),
+		emailsDelivered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "emails_delivered_total",
+			Help: "Number of emails delivered, by the SMTP provider that accepted them. Deliveries by a provider other than the first indicate that failover is happening.",
+		}, []string{"provider"}),
+		emailsDuplicate: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "emails_duplicate_total",
+			Help: "Number of email creates that reused an idempotency key for an email that was already queued or sent. A spike may indicate a retry storm or a bug in a caller.",
+		}, []string{"state"}),
+		emailsSpamPrecheck: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "emails_spam_precheck_failed_total",
+			Help: "Number of email creates that broke a rule of SPAM_PRECHECK, by rule, whether they were flagged or rejected.",
+		}, []string{"rule"}),
+		registry: prometheus.NewRegistry(),
+	}
+	metrics.registry.MustRegister(metrics.emailDeliveryLatency, metrics.emailsBounced, metrics.emailsDelivered, metrics.emailsDuplicate, metrics.emailsSpamPrecheck)
+	return metrics
 }
 
+// Queues that emails are sent from. Transactional emails like password resets
+// and receipts go to their own queue so they're never stuck waiting behind
+// large bulk sends like newsletters. Transactional emails that are scheduled
+// for later go to yet another, so that they don't hold up the ones that are
+// meant to go out right away when a lot of them come due at once.
+const (
+	queueBulk          = "bulk"
+	queueScheduled     = "scheduled"
+	queueTransactional = "transactional"
+)
+
+// jobPriorityNormal is the River job priority used for emails that don't
+// specify one. It's one below River's highest priority so that urgent emails
+// can still be moved ahead of it.
+const jobPriorityNormal = 2
+
+// Email priorities, which determine the queue that an email is sent from.
+const (
+	PriorityBulk          = "bulk"
+	PriorityTransactional = "transactional"
+)
+
 type HandleEmailCreateRequest struct {
-	AccountID      uuid.UUID `json:"account_id"      validate:"required"`
-	Body           string    `json:"body"            validate:"required"`
-	EmailRecipient string    `json:"email_recipient" validate:"required"`
-	EmailSender    string    `json:"email_sender"    validate:"required"`
-	IdempotencyKey uuid.UUID `json:"idempotency_key" validate:"required"`
-	Subject        string    `json:"subject"         validate:"required"`
+	AccountID      uuid.UUID          `json:"account_id"      validate:"required"`
+	Attachments    []*EmailAttachment `json:"attachments"     validate:"omitempty,dive"`       // files attached to the email, or uploaded in a multipart form
+	Bcc            []string           `json:"bcc"             validate:"omitempty,dive,email"` // sent a copy without being listed in headers
+	Body           string             `json:"body"`                                            // defaults to DEFAULT_BODY; required unless template or raw_message is set
+	BodyHTML       string             `json:"body_html"`                                       // optional HTML alternative to the plain text body
+	Cc             []string           `json:"cc"              validate:"omitempty,dive,email"`
+	Charset        string             `json:"charset"` // charset that bodies are sent in, like iso-8859-1; defaults to utf-8
+	DryRun         bool               `json:"dry_run"` // validate the request without queuing an email
+	EmailRecipient string             `json:"email_recipient" validate:"required_without=Recipients"`
+	EmailSender    string             `json:"email_sender"    validate:"omitempty,email"` // defaults to DEFAULT_SENDER
+	Headers        map[string]string  `json:"headers"`
+	IdempotencyKey string             `json:"idempotency_key" validate:"required,max=255"`                   // any opaque string like a UUID or ULID
+	InReplyTo      string             `json:"in_reply_to"     validate:"omitempty,message_id"`               // Message-ID of the email this one replies to, like <id@example.com>
+	JobPriority    int                `json:"job_priority"    validate:"omitempty,min=1,max=4"`              // River priority within a queue, 1 being highest; defaults to jobPriorityNormal
+	Locale         string             `json:"locale"          validate:"omitempty,bcp47_language_tag"`       // locale to render template in, like fr or pt-BR; defaults to the Accept-Language header
+	Priority       string             `json:"priority"        validate:"omitempty,oneof=bulk transactional"` // defaults to transactional
+	Recipients     []string           `json:"recipients"      validate:"omitempty,dive,email"`               // send to each as a separate email instead of to email_recipient
+	References     []string           `json:"references"      validate:"omitempty,dive,message_id"`          // Message-IDs of earlier emails in the thread, oldest first
+	ReplyTo        string             `json:"reply_to"        validate:"omitempty,email"`
+	ReturnPath     string             `json:"return_path"     validate:"omitempty,email"`
+	SendAt         time.Time          `json:"send_at"`     // when to send the email, like 2026-11-02T09:00:00Z; right away if unset or in the past
+	SenderName     string             `json:"sender_name"` // display name for the From header, like "Acme Support"
+	RawMessage     []byte             `json:"raw_message"` // fully formed RFC 822 message, base64 encoded, to send as is instead of one built from fields
+	Subject        string             `json:"subject"`     // defaults to DEFAULT_SUBJECT; required unless template or raw_message is set
+	Template       string             `json:"template"`    // render subject and body from this template instead
+	TemplateData   map[string]any     `json:"template_data"`
+	TimeZone       string             `json:"time_zone"       validate:"omitempty,timezone"` // recipient's IANA time zone, like America/New_York; bulk email is held for quiet hours in it
+	Track          bool               `json:"track"`                                         // add an open tracking pixel to an HTML body
+	UnsubscribeURL string             `json:"unsubscribe_url" validate:"omitempty,url"`      // one-click unsubscribe URL; bulk email gets one derived from UNSUBSCRIBE_BASE_URL otherwise
+
+	// acceptLanguage is the request's `Accept-Language` header, used to pick
+	// a template's locale when Locale isn't set.
+	acceptLanguage string
+}
+
+// BindRequest reads an idempotency key from the conventional `Idempotency-Key`
+// header for callers that don't send one in the request body. If both are
+// sent, they must match.
+func (r *HandleEmailCreateRequest) BindRequest(httpReq *http.Request) error {
+	r.acceptLanguage = httpReq.Header.Get("Accept-Language")
+
+	headerKey := httpReq.Header.Get("Idempotency-Key")
+	if headerKey == "" {
+		return nil
+	}
+
+	switch {
+	case r.IdempotencyKey == "":
+		r.IdempotencyKey = headerKey
+	case r.IdempotencyKey != headerKey:
+		return &APIError{Code: errorCodeInvalidRequest, Message: "Idempotency-Key header doesn't match idempotency_key in request body.", StatusCode: http.StatusBadRequest}
+	}
+
+	return nil
+}
+
+type HandleEmailCreateResponse struct {
+	EstimatedSendAt *time.Time                  `json:"estimated_send_at,omitempty"` // when a newly queued email is expected to be sent, except for requests with recipients
+	Jobs            *HandleEmailCreateJobCounts `json:"jobs,omitempty"`              // only for requests with recipients
+	KeyExpired      bool                        `json:"key_expired,omitempty"`       // idempotency key's earlier email is no longer deduplicated against, so a new one was queued
+	Location        string                      `json:"-"`                           // URL of the email's status, except for requests with recipients
+	Message         string                      `json:"message"`
+	MessageID       string                      `json:"message_id,omitempty"` // email's Message-ID header, except for raw messages and requests with recipients
+	StatusCode      int                         `json:"-"`
+
+	// replayed is a response stored when a request with the same idempotency
+	// key was first handled, which is sent verbatim instead of the fields
+	// above.
+	replayed []byte
+}
+
+func (r *HandleEmailCreateResponse) MarshalJSON() ([]byte, error) {
+	if r.replayed != nil {
+		return r.replayed, nil
+	}
+
+	// Defined type without this method so that json.Marshal doesn't recurse.
+	type handleEmailCreateResponse HandleEmailCreateResponse
+	return json.Marshal((*handleEmailCreateResponse)(r))
+}
+
+// HandleEmailCreateJobCounts counts what happened to each email of a request
+// sent to multiple recipients.
+type HandleEmailCreateJobCounts struct {
+	Duplicate  int `json:"duplicate"`
+	Queued     int `json:"queued"`
+	Suppressed int `json:"suppressed"`
+}
+
+func (r *HandleEmailCreateResponse) ResponseHeader() http.Header {
+	if r.Location == "" {
+		return nil
+	}
+	return http.Header{"Location": []string{r.Location}}
+}
+
+func (r *HandleEmailCreateResponse) ResponseStatusCode() int { return r.StatusCode }
+
+func (s *APIService) EmailCreate(ctx context.Context, req *HandleEmailCreateRequest) (*HandleEmailCreateResponse, error) {
+	if s.maintenanceMode.Load() {
+		return nil, errMaintenanceMode
+	}
+
+	if err := validateHeaders(req.Headers); err != nil {
+		return nil, err
+	}
+
+	// Separate from how many recipients a request may have, since each of
+	// those gets its own email with the same copies.
+	if numRecipients := 1 + len(req.Cc) + len(req.Bcc); s.maxRecipients > 0 && numRecipients > s.maxRecipients {
+		return nil, &APIError{
+			Code:       errorCodeInvalidRequest,
+			Message:    fmt.Sprintf("Email has %d recipients including cc and bcc, but at most %d are allowed.", numRecipients, s.maxRecipients),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	// The resolved sender is the one stored with the email, so a request that
+	// omits it is a duplicate of one that names the default explicitly.
+	// An account's own single sender comes ahead of DEFAULT_SENDER.
+	emailSender := req.EmailSender
+	if accountSenders := s.accountSenders[req.AccountID]; len(accountSenders) == 1 {
+		emailSender = cmp.Or(emailSender, accountSenders[0])
+	}
+	emailSender = cmp.Or(emailSender, s.defaultSender)
+	if emailSender == "" {
+		return nil, &APIError{
+			Code:       errorCodeValidationFailed,
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "email_sender", Message: "email_sender is required when DEFAULT_SENDER isn't configured.", Rule: "required"},
+			},
+		}
+	}
+
+	if accountSenders, ok := s.accountSenders[req.AccountID]; ok {
+		if !slices.ContainsFunc(accountSenders, func(sender string) bool { return strings.EqualFold(sender, emailSender) }) {
+			return nil, &APIError{Code: errorCodeSenderNotAllowed, Message: fmt.Sprintf("Account isn't allowed to send from %q.", emailSender), StatusCode: http.StatusForbidden}
+		}
+	}
+
+	if len(s.allowedSenderDomains) > 0 {
+		senderDomain := addressDomain(emailSender)
+		if !slices.ContainsFunc(s.allowedSenderDomains, func(domain string) bool { return strings.EqualFold(domain, senderDomain) }) {
+			return nil, &APIError{Code: errorCodeSenderNotAllowed, Message: fmt.Sprintf("Sending from domain %q isn't allowed.", senderDomain), StatusCode: http.StatusForbidden}
+		}
+	}
+
+	// Everyone the email goes to is checked, copies included, so that a
+	// blocked address can't be reached through cc or bcc either.
+	if len(s.recipientDomainAllowlist) > 0 {
+		for _, recipient := range slices.Concat([]string{req.EmailRecipient}, req.Recipients, req.Cc, req.Bcc) {
+			if recipient == "" {
+				continue
+			}
+			recipientDomain := addressDomain(recipient)
+			if !slices.ContainsFunc(s.recipientDomainAllowlist, func(domain string) bool { return strings.EqualFold(domain, recipientDomain) }) {
+				return nil, &APIError{Code: errorCodeRecipientNotAllowed, Message: fmt.Sprintf("Sending to domain %q isn't allowed.", recipientDomain), StatusCode: http.StatusForbidden}
+			}
+		}
+	}
+
+	// Default copy is resolved before it's stored like the sender is, so it's
+	// what a resubmitted email is compared with.
+	body, subject := req.Body, req.Subject
+	if req.Template == "" && len(req.RawMessage) == 0 {
+		body, subject = cmp.Or(body, s.defaultBody), cmp.Or(subject, s.defaultSubject)
+
+		var validationErrors []*ValidationError
+		if body == "" {
+			validationErrors = append(validationErrors, &ValidationError{Field: "body", Message: "body is required unless template or raw_message is set.", Rule: "required_without_all"})
+		}
+		if subject == "" {
+			validationErrors = append(validationErrors, &ValidationError{Field: "subject", Message: "subject is required unless template or raw_message is set.", Rule: "required_without_all"})
+		}
+		if len(validationErrors) > 0 {
+			return nil, &APIError{
+				Code:             errorCodeValidationFailed,
+				Message:          "Invalid parameters.",
+				StatusCode:       http.StatusBadRequest,
+				ValidationErrors: validationErrors,
+			}
+		}
+	}
+
+	if len(req.RawMessage) > 0 {
+		if len(req.Attachments) > 0 || req.Body != "" || req.BodyHTML != "" || req.Charset != "" || len(req.Headers) > 0 || req.InReplyTo != "" || len(req.References) > 0 ||
+			req.ReplyTo != "" || req.SenderName != "" || req.Subject != "" || req.Template != "" || req.Track || req.UnsubscribeURL != "" {
+			return nil, &APIError{
+				Code:       errorCodeInvalidRequest,
+				Message:    "raw_message can't be set along with attachments, body, body_html, charset, headers, in_reply_to, references, reply_to, sender_name, subject, template, track, or unsubscribe_url.",
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+
+		// Relays only reject a malformed message after it's been sent, and
+		// would on every attempt.
+		if _, err := mail.ReadMessage(bytes.NewReader(req.RawMessage)); err != nil {
+			return nil, &APIError{Code: errorCodeInvalidRequest, Message: "raw_message isn't a valid RFC 822 message: " + err.Error(), StatusCode: http.StatusBadRequest}
+		}
+	}
+
+	if err := validateAttachments(req.Attachments); err != nil {
+		return nil, err
+	}
+
+	charset, err := normalizeCharset(req.Charset)
+	if err != nil {
+		return nil, &APIError{Code: errorCodeInvalidRequest, Message: fmt.Sprintf("Unsupported charset %q.", req.Charset), StatusCode: http.StatusBadRequest}
+	}
+
+	args := SendEmailArgs{
+		AccountID:      req.AccountID,
+		Attachments:    req.Attachments,
+		Bcc:            req.Bcc,
+		Body:           body,
+		BodyHTML:       req.BodyHTML,
+		Cc:             req.Cc,
+		Charset:        charset,
+		EmailRecipient: req.EmailRecipient,
+		EmailSender:    emailSender,
+		Headers:        req.Headers,
+		IdempotencyKey: req.IdempotencyKey,
+		InReplyTo:      req.InReplyTo,
+		RawMessage:     req.RawMessage,
+		References:     req.References,
+		ReplyTo:        req.ReplyTo,
+		ReturnPath:     req.ReturnPath,
+		SenderName:     req.SenderName,
+		Subject:        subject,
+		Track:          req.Track,
+		UnsubscribeURL: req.UnsubscribeURL,
+	}
+
+	bodies, sentSubject := []string{args.Body, args.BodyHTML}, args.Subject
+	if req.Template != "" {
+		if req.Body != "" || req.BodyHTML != "" || req.Subject != "" {
+			return nil, &APIError{Code: errorCodeInvalidRequest, Message: "body, body_html, and subject can't be set along with template.", StatusCode: http.StatusBadRequest}
+		}
+
+		// Templates are rendered even if they're rendered again when sent,
+		// so that data that doesn't fit is rejected now instead of on every
+		// attempt. It's rendered once however many recipients there are.
+		locale := cmp.Or(req.Locale, req.acceptLanguage)
+		rendered, err := s.templates.render(req.Template, locale, req.TemplateData)
+		if err != nil {
+			return nil, err
+		}
+		bodies, sentSubject = []string{rendered.Body, rendered.BodyHTML}, rendered.Subject
+
+		if s.renderTemplatesAtSend {
+			args.Template, args.TemplateData, args.TemplateLocale = req.Template, req.TemplateData, locale
+		} else {
+			args.Body, args.BodyHTML, args.Subject = rendered.Body, rendered.BodyHTML, rendered.Subject
+		}
+	}
+
+	// Bodies are transcoded when they're sent, which would fail on every
+	// attempt for characters the charset doesn't have, so check up front.
+	for _, body := range bodies {
+		if _, err := transcodeBody(charset, body); err != nil {
+			return nil, &APIError{Code: errorCodeInvalidRequest, Message: fmt.Sprintf("Body contains characters that can't be represented in charset %s.", charset), StatusCode: http.StatusBadRequest}
+		}
+	}
+
+	// Raw messages are passed through as they are, so only emails that are
+	// composed here are checked.
+	if len(req.RawMessage) < 1 {
+		if err := s.checkSpam(ctx, req.AccountID, sentSubject, bodies[0], bodies[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	insertOpts := &river.InsertOpts{
+		// Like queue, job priority isn't part of an email's unique arguments,
+		// so a resubmit with a different priority is still deduplicated.
+		Priority: cmp.Or(req.JobPriority, jobPriorityNormal),
+		Queue:    queueForPriority(req.Priority),
+	}
+	if s.dedupeFailedEmails {
+		insertOpts.UniqueOpts = uniqueOptsDedupeFailed()
+	}
+
+	// Marketing email mustn't arrive at night, so bulk email queued during
+	// the recipient's quiet hours is held until they're over. Transactional
+	// email like password resets goes out right away regardless.
+	if insertOpts.Queue == queueBulk && req.TimeZone != "" {
+		loc, err := time.LoadLocation(req.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+		insertOpts.ScheduledAt = quietHoursScheduledAt(time.Now(), loc)
+	}
+
+	// Quiet hours can only push a send back further than asked for.
+	if req.SendAt.After(insertOpts.ScheduledAt) {
+		insertOpts.ScheduledAt = req.SendAt
+	}
+
+	if s.enrichEmail != nil {
+		s.enrichEmail(&args, insertOpts)
+	}
+
+	// Bulk email is never urgent, so it stays in its own queue whenever it's
+	// scheduled for, which is also what has it sent as bulk.
+	if insertOpts.Queue == queueTransactional && insertOpts.ScheduledAt.After(time.Now()) {
+		insertOpts.Queue = queueScheduled
+	}
+
+	// All validation has passed by this point. A dry run stops short of
+	// inserting anything.
+	if req.DryRun {
+		return &HandleEmailCreateResponse{Message: "Validation passed; no email queued.", StatusCode: http.StatusOK}, nil
+	}
+
+	if s.idempotentResponses {
+		argsHash, err := emailArgsHash(&args, req.Recipients)
+		if err != nil {
+			return nil, err
+		}
+		return s.replayOrStoreResponse(ctx, req.AccountID, req.IdempotencyKey, argsHash, func() (*HandleEmailCreateResponse, error) {
+			return s.emailCreateInsert(ctx, &args, insertOpts, req.Recipients)
+		})
+	}
+
+	return s.emailCreateInsert(ctx, &args, insertOpts, req.Recipients)
+}
+
+// emailCreateInsert inserts the email of a create request, or one for each of
+// its recipients.
+func (s *APIService) emailCreateInsert(ctx context.Context, args *SendEmailArgs, insertOpts *river.InsertOpts, recipients []string) (*HandleEmailCreateResponse, error) {
+	if len(recipients) > 0 {
+		return s.emailCreateRecipients(ctx, args, insertOpts, recipients)
+	}
+
+	args.MessageID = emailMessageID(args)
+
+	insertRes, err := s.insertEmail(ctx, args, insertOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	if insertRes.UniqueSkippedAsDuplicate {
+		existingArgs, err := s.decodeEmailArgs(insertRes.Job.EncodedArgs)
+		if err != nil {
+			return nil, err
+		}
+
+		// A duplicate that isn't the same email was either found by
+		// DEDUPE_BY_CONTENT, which only looks within an account, or is
+		// another account's use of the key with IdempotencyScopeKey, which
+		// conflicts. One found by content is identical as far as its
+		// recipient can tell, so it's not compared field by field.
+		if !sameUniqueness(*args, *existingArgs) {
+			if existingArgs.AccountID != args.AccountID {
+				return nil, errMismatchedParameters
+			}
+			s.metrics.emailsDuplicate.WithLabelValues("same_content").Inc()
+			return &HandleEmailCreateResponse{Location: emailLocation(insertRes.Job.ID), Message: "An identical email was already queued for this recipient; email not queued.", MessageID: existingArgs.MessageID, StatusCode: http.StatusOK}, nil
+		}
+
+		// If incoming parameters don't match those of an already queued job,
+		// tell the user about it. There's probably a bug in the caller.
+		match, err := emailArgsMatch(args, existingArgs)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			return nil, errMismatchedParameters
+		}
+
+		switch insertRes.Job.State {
+		case rivertype.JobStateCompleted:
+			s.metrics.emailsDuplicate.WithLabelValues("already_sent").Inc()
+			return &HandleEmailCreateResponse{Location: emailLocation(insertRes.Job.ID), Message: "Email has been sent.", MessageID: existingArgs.MessageID, StatusCode: http.StatusOK}, nil
+
+		// Only found with DEDUPE_FAILED_EMAILS. Otherwise, these states
+		// aren't deduplicated against and a new email is queued instead.
+		case rivertype.JobStateCancelled, rivertype.JobStateDiscarded:
+			s.metrics.emailsDuplicate.WithLabelValues(string(insertRes.Job.State)).Inc()
+			return nil, errEmailFailed(insertRes.Job)
+		}
+
+		s.metrics.emailsDuplicate.WithLabelValues("still_pending").Inc()
+		return &HandleEmailCreateResponse{Location: emailLocation(insertRes.Job.ID), Message: "Email was already queued and is pending send.", MessageID: existingArgs.MessageID, StatusCode: http.StatusOK}, nil
+	}
+
+	keyExpired, err := s.keyExpired(ctx, insertRes.Job)
+	if err != nil {
+		return nil, err
+	}
+
+	estimatedSendAt, err := s.estimateSendAt(ctx, insertRes.Job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HandleEmailCreateResponse{EstimatedSendAt: &estimatedSendAt, KeyExpired: keyExpired, Location: emailLocation(insertRes.Job.ID), Message: "Email has been queued for sending.", MessageID: args.MessageID, StatusCode: http.StatusCreated}, nil
+}
+
+// messageIDNamespace is the UUID namespace of the UUIDs in Message-IDs.
+var messageIDNamespace = uuid.MustParse("239cd759-6563-4fd0-bdd6-cefdb7781b11") //nolint:gochecknoglobals
+
+// emailMessageID returns the Message-ID for an email, like
+// `<uuid@example.com>` in the domain of its sender. The UUID is derived from
+// the email's account and idempotency key rather than random, so a retry of
+// the request gets the same Message-ID as the email that was queued. Raw
+// messages bring their own headers, so they don't get one.
+func emailMessageID(args *SendEmailArgs) string {
+	if len(args.RawMessage) > 0 {
+		return ""
+	}
+
+	id := uuid.NewSHA1(messageIDNamespace, []byte(args.AccountID.String()+":"+args.IdempotencyKey))
+	return "<" + id.String() + "@" + addressDomain(args.EmailSender) + ">"
+}
+
+// emailLocation returns the path of an email's status, as served by
+// EmailGet.
+func emailLocation(jobID int64) string {
+	return "/emails/" + strconv.FormatInt(jobID, 10)
+}
+
+// decodeEmailArgs decodes the args of an email's job, decrypting them if they
+// were encrypted.
+func (s *APIService) decodeEmailArgs(encodedArgs []byte) (*SendEmailArgs, error) {
+	var args SendEmailArgs
+	if err := json.Unmarshal(encodedArgs, &args); err != nil {
+		return nil, err
+	}
+	if err := s.encrypter.decrypt(&args); err != nil {
+		return nil, err
+	}
+	return &args, nil
+}
+
+// errMismatchedParameters is returned when an idempotency key is reused for
+// an email with different parameters than the one it was first used for.
+// The request itself is fine, but it conflicts with state on the server, so
+// it's a 409 rather than a 400. Clients can tell it apart from other
+// conflicts by its error code.
+var errMismatchedParameters = &APIError{ //nolint:gochecknoglobals
+	Code:       errorCodeIdempotencyKeyReuse,
+	Message:    "Incoming parameters don't match those of queued email. You may have a bug.",
+	StatusCode: http.StatusConflict,
+}
+
+// errEmailFailed is returned for a resubmit of an email whose job was
+// discarded after running out of attempts or was cancelled, with
+// DEDUPE_FAILED_EMAILS. Like errMismatchedParameters, it's a conflict with
+// state on the server, and the message tells the client how to send the
+// email anyway, since queuing it again under the same key won't.
+func errEmailFailed(job *rivertype.JobRow) *APIError {
+	retry := fmt.Sprintf("It won't be sent unless it's retried with POST %s/retry.", emailLocation(job.ID))
+
+	message := "Email was cancelled before it was sent. " + retry
+	if job.State == rivertype.JobStateDiscarded {
+		message = fmt.Sprintf("Email failed to send after %d attempt(s) and was discarded. %s", job.Attempt, retry)
+	}
+
+	return &APIError{Code: errorCodeEmailFailed, Message: message, StatusCode: http.StatusConflict}
+}
+
+// sameUniqueness returns true if a and b are the same email as far as
+// idempotency goes, meaning they were submitted by the same account with the
+// same idempotency key. Keys are always scoped to an account: two accounts
+// that happen to use the same key are sending different emails, whatever the
+// idempotency scope.
+func sameUniqueness(a, b SendEmailArgs) bool {
+	return a.AccountID == b.AccountID && a.IdempotencyKey == b.IdempotencyKey
+}
+
+// emailArgsIgnoredKeys are the JSON keys of SendEmailArgs that are left out
+// when checking whether a resubmitted email matches the one already queued.
+// They're metadata about a request rather than the email's content, or part
+// of or derived from the job's unique key so they're equal by definition,
+// like the Message-ID, which is derived from the account and idempotency key.
+// Emails queued before they had a Message-ID don't have one to compare
+// anyway. The account ID is compared because with IdempotencyScopeKey it's
+// not part of the unique key, and one account's email mustn't be mistaken
+// for a retry of another's.
+var emailArgsIgnoredKeys = []string{"idempotency_key", "message_id", "trace_context"} //nolint:gochecknoglobals
+
+// emailArgsMatch returns true if two emails have the same content and
+// addressing, meaning a request for one is a faithful retry of the other.
+//
+// Every field of SendEmailArgs takes part except emailArgsIgnoredKeys, so
+// fields added later are compared without anyone needing to remember to add
+// them here.
+func emailArgsMatch(args, existingArgs *SendEmailArgs) (bool, error) {
+	normalized, err := normalizeEmailArgs(args)
+	if err != nil {
+		return false, err
+	}
+
+	existingNormalized, err := normalizeEmailArgs(existingArgs)
+	if err != nil {
+		return false, err
+	}
+
+	return reflect.DeepEqual(normalized, existingNormalized), nil
+}
+
+// normalizeEmailArgs converts args to a generic form for comparison with
+// emailArgsMatch. Ignored keys and empty values are dropped so that an unset
+// field is the same whether it's encoded as empty or missing, like a field
+// that didn't exist yet when an older job was inserted.
+func normalizeEmailArgs(args *SendEmailArgs) (map[string]any, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalized map[string]any
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return nil, err
+	}
+
+	for _, key := range emailArgsIgnoredKeys {
+		delete(normalized, key)
+	}
+	for key, value := range normalized {
+		if isEmptyJSONValue(value) {
+			delete(normalized, key)
+		}
+	}
+
+	return normalized, nil
+}
+
+// isEmptyJSONValue returns true if a decoded JSON value is null or the zero
+// value of its type.
+func isEmptyJSONValue(value any) bool {
+	switch value := value.(type) {
+	case nil:
+		return true
+	case bool:
+		return !value
+	case float64:
+		return value == 0
+	case string:
+		return value == ""
+	case []any:
+		return len(value) == 0
+	case map[string]any:
+		return len(value) == 0
+	}
+	return false
+}
+
+// emailCreateRecipients sends the same email to each of a list of recipients
+// as separate jobs that are tracked independently. Each job gets its own
+// idempotency key made up of the base key plus its recipient, so a retried
+// request dedupes each recipient's email on its own. Recipients on the
+// suppression list are skipped rather than failing the whole request.
+func (s *APIService) emailCreateRecipients(ctx context.Context, args *SendEmailArgs, insertOpts *river.InsertOpts, recipients []string) (*HandleEmailCreateResponse, error) {
+	if args.EmailRecipient != "" {
+		return nil, &APIError{Code: errorCodeInvalidRequest, Message: "Only one of email_recipient or recipients may be set.", StatusCode: http.StatusBadRequest}
+	}
+
+	var (
+		emails = make([]*SendEmailArgs, 0, len(recipients))
+		seen   = make(map[string]struct{}, len(recipients))
+	)
+	for _, recipient := range recipients {
+		// Inserting the same unique job twice in one batch is an error.
+		if _, ok := seen[recipient]; ok {
+			continue
+		}
+		seen[recipient] = struct{}{}
+
+		email := *args
+		email.EmailRecipient = recipient
+		email.IdempotencyKey = args.IdempotencyKey + ":" + recipient
+		email.MessageID = emailMessageID(&email)
+		emails = append(emails, &email)
+	}
+
+	insertResults, err := s.insertEmails(ctx, emails, insertOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	var counts HandleEmailCreateJobCounts
+	for i, insertRes := range insertResults {
+		switch {
+		case insertRes == nil:
+			counts.Suppressed++
+
+		case insertRes.UniqueSkippedAsDuplicate:
+			existingArgs, err := s.decodeEmailArgs(insertRes.Job.EncodedArgs)
+			if err != nil {
+				return nil, err
+			}
+			if !sameUniqueness(*emails[i], *existingArgs) {
+				if existingArgs.AccountID != emails[i].AccountID {
+					return nil, errMismatchedParameters
+				}
+				counts.Duplicate++ // found by DEDUPE_BY_CONTENT
+				continue
+			}
+			match, err := emailArgsMatch(emails[i], existingArgs)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				return nil, errMismatchedParameters
+			}
+			counts.Duplicate++
+
+		default:
+			counts.Queued++
+		}
+	}
+
+	statusCode := http.StatusOK
+	if counts.Queued > 0 {
+		statusCode = http.StatusCreated
+	}
+
+	return &HandleEmailCreateResponse{
+		Jobs:       &counts,
+		Message:    fmt.Sprintf("%d email(s) queued for sending; %d already queued; %d suppressed.", counts.Queued, counts.Duplicate, counts.Suppressed),
+		StatusCode: statusCode,
+	}, nil
+}
+
+// insertEmail inserts a single email job, returning an API error if its
+// recipient is suppressed.
+func (s *APIService) insertEmail(ctx context.Context, args *SendEmailArgs, insertOpts *river.InsertOpts) (*rivertype.JobInsertResult, error) {
+	insertResults, err := s.insertEmails(ctx, []*SendEmailArgs{args}, insertOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	if insertResults[0] == nil {
+		return nil, &APIError{
+			Code:       errorCodeRecipientSuppressed,
+			Message:    "Recipient has opted out of email from this account or is on its suppression list; email not queued.",
+			StatusCode: http.StatusUnprocessableEntity,
+		}
+	}
+
+	return insertResults[0], nil
+}
+
+// insertEmails inserts a job for each email in a single transaction, which is
+// traced as a span. The span's context is stored in each job's args so that
+// the trace continues when the job is worked. Emails to recipients who are
+// suppressed aren't inserted, and have a nil result.
+func (s *APIService) insertEmails(ctx context.Context, emails []*SendEmailArgs, insertOpts *river.InsertOpts) ([]*rivertype.JobInsertResult, error) {
+	ctx, span := s.tracer.Start(ctx, "EmailCreate insert")
+	defer span.End()
+
+	// A transaction that fails on a serialization error or dropped
+	// connection is run again from the top. That's safe even if a commit
+	// went through before the connection dropped because the insert is
+	// idempotent, though the retry then sees the email as a duplicate.
+	var insertResults []*rivertype.JobInsertResult
+	err := retryTx(ctx, s.txMaxRetries, func() error {
+		var err error
+		insertResults, err = s.insertEmailsTx(ctx, emails, insertOpts)
+		return err
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	if len(insertResults) == 1 && insertResults[0] != nil {
+		span.SetAttributes(
+			attribute.Int64("job.id", insertResults[0].Job.ID),
+			attribute.Bool("job.unique_skipped_as_duplicate", insertResults[0].UniqueSkippedAsDuplicate),
+		)
+	}
+	span.SetAttributes(attribute.Int("emails.count", len(emails)))
+
+	return insertResults, nil
+}
+
+// uniqueArgs returns args in the form whose unique fields match the
+// configured idempotency scope.
+func (s *APIService) uniqueArgs(args *SendEmailArgs) river.JobArgs {
+	if s.idempotencyScope == IdempotencyScopeKey {
+		return keyScopedSendEmailArgs{SendEmailArgs: *args, IdempotencyKey: args.IdempotencyKey}
+	}
+	return *args
+}
+
+// insertEmailsTx runs the transaction for insertEmails.
+func (s *APIService) insertEmailsTx(ctx context.Context, emails []*SendEmailArgs, insertOpts *river.InsertOpts) ([]*rivertype.JobInsertResult, error) {
+	tx, err := s.beginEmailTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var (
+		insertParams  = make([]river.InsertManyParams, 0, len(emails))
+		insertIndexes = make([]int, 0, len(emails))
+	)
+
+	// Jittered emails are spread out after they'd otherwise be scheduled,
+	// like at the end of quiet hours.
+	jitterFrom := insertOpts.ScheduledAt
+	if jitterFrom.IsZero() {
+		jitterFrom = time.Now()
+	}
+
+	for i, args := range emails {
+		suppressed, err := isSuppressed(ctx, tx, args.AccountID, args.EmailRecipient, insertOpts.Queue == queueBulk)
+		if err != nil {
+			return nil, err
+		}
+		if suppressed {
+			continue
+		}
+
+		args.TraceContext = make(map[string]string)
+		tracePropagator.Inject(ctx, propagation.MapCarrier(args.TraceContext))
+
+		// Uniqueness is by args alone, so jitter doesn't stop a retried
+		// request from being deduplicated.
+		emailInsertOpts := insertOpts
+		if s.batchJitter > 0 && len(emails) > 1 {
+			jitteredOpts := *insertOpts
+			jitteredOpts.ScheduledAt = jitterFrom.Add(rand.N(s.batchJitter))
+			emailInsertOpts = &jitteredOpts
+		}
+
+		// Only what's stored is encrypted. args stays in plaintext to be
+		// compared with the email already queued for a duplicate.
+		storedArgs := *args
+		if err := s.encrypter.encrypt(&storedArgs); err != nil {
+			return nil, err
+		}
+
+		insertParams = append(insertParams, river.InsertManyParams{Args: s.uniqueArgs(&storedArgs), InsertOpts: emailInsertOpts})
+		insertIndexes = append(insertIndexes, i)
+	}
+
+	insertResults := make([]*rivertype.JobInsertResult, len(emails))
+	if len(insertParams) < 1 {
+		return insertResults, nil
+	}
+
+	inserted, err := s.riverClient.InsertManyTx(ctx, tx, insertParams)
+	if err != nil {
+		return nil, err
+	}
+	for i, insertRes := range inserted {
+		insertResults[insertIndexes[i]] = insertRes
+	}
+
+	if s.dedupeByContentPeriod > 0 {
+		if err := s.dedupeByContentTx(ctx, tx, emails, insertResults); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, insertRes := range insertResults {
+		if insertRes != nil && !insertRes.UniqueSkippedAsDuplicate {
+			if err := recordAuditEvent(ctx, tx, emails[i].AccountID, insertRes.Job.ID, auditActionCreated, 0, ""); err != nil {
+				return nil, err
+			}
+			if err := recordIdempotencyKey(ctx, tx, insertRes.Job); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	if s.logger != nil {
+		afterEmailCommit(ctx, func() {
+			for i, insertRes := range insertResults {
+				if insertRes != nil && !insertRes.UniqueSkippedAsDuplicate {
+					s.logger.InfoContext(ctx, "Queued email", slog.Int64("job_id", insertRes.Job.ID), emailLogAttr(emails[i]))
+				}
+			}
+		})
+	}
+
+	return insertResults, nil
+}
+
+// queueForPriority returns the queue that emails of the given priority should
+// be sent from. Priority isn't part of an email's unique arguments, so a
+// resubmit with a different priority is still deduplicated.
+func queueForPriority(priority string) string {
+	if priority == PriorityBulk {
+		return queueBulk
+	}
+	return queueTransactional
+}
+
+// Bulk email is only delivered between these hours in the recipient's time
+// zone.
+const (
+	quietHoursEnd   = 8  // 8am
+	quietHoursStart = 20 // 8pm
+)
+
+// quietHoursScheduledAt returns when bulk email queued at now should be sent to
+// a recipient in loc, which is the end of quiet hours if now falls within
+// them. A zero time, meaning to send immediately, is returned otherwise.
+func quietHoursScheduledAt(now time.Time, loc *time.Location) time.Time {
+	localNow := now.In(loc)
+
+	switch hour := localNow.Hour(); {
+	case hour < quietHoursEnd:
+		return time.Date(localNow.Year(), localNow.Month(), localNow.Day(), quietHoursEnd, 0, 0, 0, loc)
+	case hour >= quietHoursStart:
+		return time.Date(localNow.Year(), localNow.Month(), localNow.Day()+1, quietHoursEnd, 0, 0, 0, loc)
+	}
+
+	return time.Time{}
+}
+
+// deniedHeaders are headers that are set from specific email fields, and which
+// custom headers aren't allowed to override. Keys are in canonical form.
+var deniedHeaders = map[string]struct{}{ //nolint:gochecknoglobals
+	"Bcc":                       {},
+	"Cc":                        {},
+	"Content-Transfer-Encoding": {},
+	"Content-Type":              {},
+	"Date":                      {},
+	"From":                      {},
+	"In-Reply-To":               {},
+	"Message-Id":                {},
+	"Mime-Version":              {},
+	"References":                {},
+	"Reply-To":                  {},
+	"Return-Path":               {},
+	"Subject":                   {},
+	"To":                        {},
+}
+
+// validateHeaders checks that custom headers have names made up of only the
+// printable ASCII characters permitted by RFC 5322, that no value contains a
+// line break that could be used to inject extra headers, and that none of them
+// would override a header that's set from a specific email field.
+func validateHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if name == "" || strings.IndexFunc(name, func(r rune) bool { return r < '!' || r > '~' || r == ':' }) != -1 {
+			return &APIError{Code: errorCodeInvalidRequest, Message: fmt.Sprintf("Invalid header name %q.", name), StatusCode: http.StatusBadRequest}
+		}
+
+		if _, ok := deniedHeaders[textproto.CanonicalMIMEHeaderKey(name)]; ok {
+			return &APIError{Code: errorCodeInvalidRequest, Message: fmt.Sprintf("Header %q can't be set as a custom header.", name), StatusCode: http.StatusBadRequest}
+		}
+
+		if strings.ContainsAny(value, "\r\n") {
+			return &APIError{Code: errorCodeInvalidRequest, Message: fmt.Sprintf("Value of header %q may not contain line breaks.", name), StatusCode: http.StatusBadRequest}
+		}
+	}
+
+	return nil
+}
+
+// parseEmailID parses the ID of an email's job from a request path.
+func parseEmailID(httpReq *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(httpReq.PathValue("id"), 10, 64)
+	if err != nil {
+		return 0, &APIError{Code: errorCodeInvalidRequest, StatusCode: http.StatusBadRequest, Message: "Invalid email ID: " + httpReq.PathValue("id")}
+	}
+	return id, nil
+}
+
+type HandleEmailGetRequest struct {
+	ID int64 `json:"-" validate:"required"`
+}
+
+func (r *HandleEmailGetRequest) BindRequest(httpReq *http.Request) (err error) {
+	r.ID, err = parseEmailID(httpReq)
+	return err
+}
+
+type HandleEmailGetResponse struct {
+	ID    int64              `json:"id"`
+	State rivertype.JobState `json:"state"`
+}
+
+// EmailGet looks up the state of an email's job, like whether it's still
+// queued or has been sent.
+func (s *APIService) EmailGet(ctx context.Context, req *HandleEmailGetRequest) (*HandleEmailGetResponse, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	job, err := s.riverClient.JobGetTx(ctx, tx, req.ID)
+	if err != nil {
+		if errors.Is(err, river.ErrNotFound) {
+			return nil, &APIError{Code: errorCodeNotFound, Message: "Email not found.", StatusCode: http.StatusNotFound}
+		}
+		return nil, err
+	}
+
+	if job.Kind != (SendEmailArgs{}).Kind() {
+		return nil, &APIError{Code: errorCodeNotFound, Message: "Email not found.", StatusCode: http.StatusNotFound}
+	}
+
+	return &HandleEmailGetResponse{ID: job.ID, State: job.State}, nil
+}
+
+type HandleEmailRetryRequest struct {
+	ID int64 `json:"-" validate:"required"`
+}
+
+func (r *HandleEmailRetryRequest) BindRequest(httpReq *http.Request) (err error) {
+	r.ID, err = parseEmailID(httpReq)
+	return err
+}
+
+type HandleEmailRetryResponse struct {
+	ID    int64              `json:"id"`
+	State rivertype.JobState `json:"state"`
+}
+
+// EmailRetry requeues an email whose job has permanently failed or been
+// cancelled so that it'll be sent again. Emails in any other state are either
+// still pending or already sent, and retrying them would risk a double send.
+func (s *APIService) EmailRetry(ctx context.Context, req *HandleEmailRetryRequest) (*HandleEmailRetryResponse, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	job, err := s.riverClient.JobGetTx(ctx, tx, req.ID)
+	if err != nil {
+		if errors.Is(err, river.ErrNotFound) {
+			return nil, &APIError{Code: errorCodeNotFound, Message: "Email not found.", StatusCode: http.StatusNotFound}
+		}
+		return nil, err
+	}
+
+	if job.Kind != (SendEmailArgs{}).Kind() {
+		return nil, &APIError{Code: errorCodeNotFound, Message: "Email not found.", StatusCode: http.StatusNotFound}
+	}
+
+	if job.State != rivertype.JobStateCancelled && job.State != rivertype.JobStateDiscarded {
+		return nil, &APIError{
+			Code:       errorCodeInvalidState,
+			Message:    fmt.Sprintf("Email can't be retried from state %q; only cancelled or discarded emails can be retried.", job.State),
+			StatusCode: http.StatusConflict,
+		}
+	}
+
+	job, err = s.riverClient.JobRetryTx(ctx, tx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var args SendEmailArgs
+	if err := json.Unmarshal(job.EncodedArgs, &args); err != nil {
+		return nil, err
+	}
+	if err := recordAuditEvent(ctx, tx, args.AccountID, job.ID, auditActionRetried, 0, ""); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return &HandleEmailRetryResponse{ID: job.ID, State: job.State}, nil
+}
+
+type HandleCancelByAccountRequest struct {
+	AccountID uuid.UUID `json:"account_id" validate:"required"`
+}
+
+type HandleCancelByAccountResponse struct {
+	Cancelled int    `json:"cancelled"`
+	Message   string `json:"message"`
+}
+
+// emailStatesUnsent are the states of email jobs that haven't been sent yet and
+// aren't being worked right now.
+var emailStatesUnsent = []string{ //nolint:gochecknoglobals
+	string(rivertype.JobStateAvailable),
+	string(rivertype.JobStatePending),
+	string(rivertype.JobStateRetryable),
+	string(rivertype.JobStateScheduled),
+}
+
+// EmailCancelByAccount cancels every email queued for an account that hasn't
+// been sent yet, like when the account's been compromised and is being used to
+// send spam. Emails that have already been sent are left alone, as are any
+// being sent at this moment, which can't be stopped partway.
+func (s *APIService) EmailCancelByAccount(ctx context.Context, req *HandleCancelByAccountRequest) (*HandleCancelByAccountResponse, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// River's job list can't filter on args, so jobs are found directly.
+	rows, err := tx.Query(ctx, `
+		SELECT id
+		FROM river_job
+		WHERE kind = $1
+			AND state = ANY($2::river_job_state[])
+			AND args->>'account_id' = $3
+		ORDER BY id`,
+		(SendEmailArgs{}).Kind(), emailStatesUnsent, req.AccountID.String(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	jobIDs, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, jobID := range jobIDs {
+		if _, err := s.riverClient.JobCancelTx(ctx, tx, jobID); err != nil {
+			return nil, err
+		}
+		if err := recordAuditEvent(ctx, tx, req.AccountID, jobID, auditActionCancelled, 0, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return &HandleCancelByAccountResponse{
+		Cancelled: len(jobIDs),
+		Message:   fmt.Sprintf("%d unsent email(s) cancelled.", len(jobIDs)),
+	}, nil
+}
+
+func (s *APIService) ServeMux() *http.ServeMux {
+	opts := s.handlerOpts()
+
+	// The discarded email listing and email events can stream for as long as
+	// they take, so they're the only API endpoints without a timeout.
+	timeout := func(handler http.Handler) http.Handler {
+		return timeoutHandler(handler, s.requestTimeout, opts)
+	}
+
+	// Every endpoint but metrics shares one limit on requests in progress, so
+	// that a burst of them can't take every connection in the database pool.
+	limit := newConcurrencyLimiter(s.maxConcurrentRequests, opts)
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /emails", limit(timeout(newMultipartEmailHandler(MakeHandler(s.EmailCreate, opts), s.maxUploadBytes, opts))))
+	mux.Handle("POST /emails/batch", limit(timeout(MakeHandler(s.EmailCreateBatch, opts))))
+	mux.Handle("POST /emails/cancel-account", limit(timeout(MakeHandler(s.EmailCancelByAccount, opts))))
+	mux.Handle("POST /emails/preview", limit(timeout(MakeHandler(s.EmailPreview, opts))))
+	mux.Handle("GET /emails/discarded", limit(http.HandlerFunc(s.handleEmailListDiscarded)))
+	mux.Handle("GET /emails/stats", limit(timeout(MakeHandler(s.EmailStats, opts))))
+	mux.Handle("POST /emails/status-batch", limit(timeout(MakeHandler(s.EmailStatusBatch, opts))))
+	mux.Handle("GET /emails/{id}", limit(timeout(MakeHandler(s.EmailGet, opts))))
+	mux.Handle("GET /emails/{id}/audit", limit(timeout(MakeHandler(s.EmailAudit, opts))))
+	mux.Handle("GET /emails/{id}/events", limit(http.HandlerFunc(s.handleEmailEvents)))
+	mux.Handle("POST /emails/{id}/retry", limit(timeout(MakeHandler(s.EmailRetry, opts))))
+	mux.Handle("POST /admin/maintenance", limit(timeout(MakeHandler(s.MaintenanceSet, opts))))
+	mux.Handle("POST /admin/purge-account", limit(timeout(MakeHandler(s.EmailPurgeAccount, opts))))
+	mux.Handle("POST /bounces", limit(timeout(MakeHandler(s.BounceCreate, opts))))
+	mux.Handle("POST /suppressions", limit(timeout(MakeHandler(s.SuppressionCreate, opts))))
+	mux.Handle("DELETE /suppressions/{address}", limit(timeout(MakeHandler(s.SuppressionDelete, opts))))
+	mux.Handle("GET /suppressions/history/{address}", limit(timeout(MakeHandler(s.SuppressionHistory, opts))))
+	mux.Handle("POST /unsubscribe", limit(timeout(http.HandlerFunc(s.handleUnsubscribe))))
+	mux.Handle("GET /version", limit(timeout(MakeHandler(s.Version, opts))))
+	mux.Handle("GET /metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+type SendEmailArgs struct {
+	AccountID        uuid.UUID          `json:"account_id"        river:"unique"` // simplified for demo; this would be determined through an auth token in real life
+	Attachments      []*EmailAttachment `json:"attachments"       river:"-"`
+	Bcc              []string           `json:"bcc"               river:"-"`
+	Body             string             `json:"body"              river:"-"`
+	BodyHTML         string             `json:"body_html"         river:"-"`
+	Cc               []string           `json:"cc"                river:"-"`
+	Charset          string             `json:"charset"           river:"-"` // empty for utf-8
+	EmailRecipient   string             `json:"email_recipient"   river:"-"`
+	EmailSender      string             `json:"email_sender"      river:"-"`
+	EncryptedContent []byte             `json:"encrypted_content" river:"-"` // sensitive fields encrypted with ENCRYPTION_KEY; see emailEncrypter
+	EncryptedKey     []byte             `json:"encrypted_key"     river:"-"`
+	Headers          map[string]string  `json:"headers"           river:"-"`
+	IdempotencyKey   string             `json:"idempotency_key"   river:"unique"` // from the request body or an `Idempotency-Key` header
+	InReplyTo        string             `json:"in_reply_to"       river:"-"`
+	MessageID        string             `json:"message_id"        river:"-"` // derived from the unique key; see emailMessageID
+	RawMessage       []byte             `json:"raw_message"       river:"-"` // sent as is instead of a message built from the fields below
+	References       []string           `json:"references"        river:"-"`
+	ReplyTo          string             `json:"reply_to"          river:"-"`
+	ReturnPath       string             `json:"return_path"       river:"-"`
+	SenderName       string             `json:"sender_name"       river:"-"`
+	Subject          string             `json:"subject"           river:"-"`
+	Template         string             `json:"template"          river:"-"` // rendered into the subject and bodies when sent, for RENDER_TEMPLATES_AT_SEND
+	TemplateData     map[string]any     `json:"template_data"     river:"-"`
+	TemplateLocale   string             `json:"template_locale"   river:"-"` // locale or `Accept-Language` to render the template in
+	TraceContext     map[string]string  `json:"trace_context"     river:"-"` // trace context of the request that created the email
+	Track            bool               `json:"track"             river:"-"`
+	UnsubscribeURL   string             `json:"unsubscribe_url"   river:"-"`
+}
+
+func (SendEmailArgs) Kind() string { return "send_email" }
+
+func (SendEmailArgs) InsertOpts() river.InsertOpts {
+	return river.InsertOpts{
+		UniqueOpts: river.UniqueOpts{
+			ByArgs: true,
+		},
+	}
+}
+
+// uniqueOptsDedupeFailed are the unique options of emails with
+// DEDUPE_FAILED_EMAILS, which are unique in every state rather than River's
+// default of every state but cancelled and discarded. Unique keys don't
+// depend on states, so emails queued before it was turned on are still
+// deduplicated against, but only in the states they were queued with.
+func uniqueOptsDedupeFailed() river.UniqueOpts {
+	return river.UniqueOpts{
+		ByArgs:  true,
+		ByState: rivertype.JobStates(),
+	}
+}
+
+// Scopes within which an idempotency key identifies an email.
+const (
+	IdempotencyScopeAccountKey = "account_key" // keys are unique per account
+	IdempotencyScopeKey        = "key"         // keys are unique across all accounts
+)
+
+// keyScopedSendEmailArgs is SendEmailArgs made unique by its idempotency key
+// alone, for IdempotencyScopeKey. River takes unique fields from struct tags,
+// so the key is shadowed by a field tagged unique and SendEmailArgs' own
+// fields, including its unique account ID, are left untagged by embedding.
+// It's encoded exactly like SendEmailArgs under the same kind, so jobs are
+// worked the same whichever scope inserted them.
+type keyScopedSendEmailArgs struct {
+	SendEmailArgs
+
+	IdempotencyKey string `json:"idempotency_key" river:"unique"`
+}
+
+func (a keyScopedSendEmailArgs) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.SendEmailArgs)
+}
+
+// EmailSender sends a fully formed message. from is the envelope sender (SMTP's
+// MAIL FROM, where bounces are delivered), which may be different from the
+// message's `From:` header.
+type EmailSender interface {
+	SendMail(ctx context.Context, from string, to []string, msg []byte) error
+}
+
+type SendEmailWorker struct {
+	river.WorkerDefaults[SendEmailArgs]
+
+	// cooldown pauses sends through an SMTP sender from all of the worker's
+	// goroutines after the sender's server answers with a 421, snoozing jobs
+	// until it's over. A 421 fails a job like any other error if it's nil.
+	cooldown *smtpCooldown
+
+	// dbPool records the outcome of each attempt in the email's audit log.
+	// Nothing is recorded if it's nil.
+	dbPool dbExecutor
+
+	// domainLimiter caps how many sends to each recipient domain are in
+	// progress at once. Sends aren't limited if it's nil.
+	domainLimiter *domainLimiter
+
+	// domainSenders send email from each of the sender domains in
+	// SMTP_DOMAINS with that domain's credentials. When it's set, email from
+	// any other domain fails, and sender isn't used.
+	domainSenders map[string]EmailSender
+
+	// encrypter decrypts emails that were encrypted when they were inserted.
+	encrypter *emailEncrypter
+
+	// limiter caps the rate of sends across all of the worker's goroutines to
+	// stay under an SMTP provider's limits. Sends aren't limited if it's nil.
+	limiter *rate.Limiter
+
+	// logger logs each email that's sent. Nothing is logged if it's nil.
+	logger *slog.Logger
+
+	// maxMessageBytes is the largest message that'll be sent, or zero for no
+	// limit.
+	maxMessageBytes int
+
+	// metrics records delivery latency. It may be nil.
+	metrics *metrics
+
+	// redirectAllTo is an address that all email is delivered to instead of
+	// its recipients, like a test inbox in staging, so that real customers are
+	// never emailed. The original recipients are kept in an `X-Original-To`
+	// header. Email goes to its recipients if it's empty.
+	redirectAllTo string
+
+	// returnPath is a default envelope sender used for all email, which may
+	// be overridden on a per-message basis. When neither is set, the envelope
+	// sender is the same as the `From:` header.
+	returnPath string
+
+	// sendTimeout is how long a job has to send its email before it's
+	// aborted and retried, or zero to use River's default job timeout.
+	sendTimeout time.Duration
+
+	sender EmailSender
+
+	// subjectPrefix and subjectSuffix are added to the subject of every
+	// message that's composed, like to tag email from a staging environment.
+	// They're separated from the subject by a space, and are left out if
+	// they're empty.
+	subjectPrefix string
+	subjectSuffix string
+
+	// templates render the emails that were queued with a template to be
+	// rendered when they're sent.
+	templates emailTemplates
+
+	tracer trace.Tracer
+
+	// trackingBaseURL is the base of tracking pixel URLs for emails that ask
+	// to be tracked. Tracking is disabled if it's empty.
+	trackingBaseURL string
+
+	// unsubscribeBaseURL is the URL of the unsubscribe endpoint, used to
+	// derive unsubscribe URLs signed with unsubscribeSecret for bulk email
+	// that doesn't bring its own. They're not derived if it's empty.
+	unsubscribeBaseURL string
+	unsubscribeSecret  []byte
+}
+
+// Timeout bounds how long a send can take. A hung SMTP server would otherwise
+// tie up a worker indefinitely, so the job's context is cancelled when it's
+// reached, and sends stop as soon as their context is done.
+func (w *SendEmailWorker) Timeout(job *river.Job[SendEmailArgs]) time.Duration {
+	return w.sendTimeout
+}
+
+func (w *SendEmailWorker) Work(ctx context.Context, job *river.Job[SendEmailArgs]) error {
+	err := w.work(ctx, job)
+	w.recordWorkAudit(ctx, job, err)
+	return err
+}
+
+func (w *SendEmailWorker) work(ctx context.Context, job *river.Job[SendEmailArgs]) error {
+	ctx = tracePropagator.Extract(ctx, propagation.MapCarrier(job.Args.TraceContext))
+
+	ctx, span := w.tracer.Start(ctx, "SendEmailWorker send", trace.WithAttributes(
+		attribute.Int64("job.id", job.ID),
+		attribute.Int("job.attempt", job.Attempt),
+	))
+	defer span.End()
+
+	if err := w.encrypter.decrypt(&job.Args); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	// Raw messages were built by the caller, so they're relayed untouched.
+	msg := job.Args.RawMessage
+	if len(msg) == 0 {
+		var err error
+		if msg, err = w.composeMessage(job); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	}
+
+	// The envelope comes from the fields even for raw messages, whose headers
+	// only say who the message is addressed to.
+	args := job.Args
+	to := slices.Concat([]string{args.EmailRecipient}, args.Cc, args.Bcc)
+
+	// Headers may come in any order, so one naming the recipients that were
+	// redirected away from can go first, even in a raw message.
+	if w.redirectAllTo != "" {
+		msg = slices.Concat([]byte("X-Original-To: "+strings.Join(to, ", ")+"\r\n"), msg)
+		to = []string{w.redirectAllTo}
+	}
+
+	// Relays reject oversized messages only after they've been sent in full,
+	// often with an unclear error. A message that's too big will be too big on
+	// every attempt, so the job is cancelled instead of retried.
+	if w.maxMessageBytes > 0 && len(msg) > w.maxMessageBytes {
+		err := fmt.Errorf("message is %d bytes, which is more than the SMTP_MAX_MESSAGE_BYTES limit of %d", len(msg), w.maxMessageBytes)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return river.JobCancel(err)
+	}
+
+	sender, err := w.senderFor(args.EmailSender)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	cooldownKey := w.senderKey(args.EmailSender)
+
+	// Jobs are snoozed rather than failed while their SMTP server is cooling
+	// down, since a busy server isn't a problem with the email, and snoozing
+	// doesn't use up any of its attempts.
+	if w.cooldown != nil {
+		if remaining := w.cooldown.remaining(cooldownKey); remaining > 0 {
+			return river.JobSnooze(remaining)
+		}
+	}
+
+	if w.limiter != nil {
+		// Returns early with an error if the job's context is cancelled, like
+		// on shutdown, and the job will be retried later.
+		if err := w.limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Like the rate limit, giving up on a slot when the job's context is
+	// cancelled has the job retried later.
+	if w.domainLimiter != nil {
+		release, err := w.domainLimiter.acquire(ctx, addressDomain(to[0]))
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	envelopeSender := cmp.Or(args.ReturnPath, w.returnPath, args.EmailSender)
+	if err := sender.SendMail(ctx, envelopeSender, to, msg); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		if w.cooldown != nil && isSMTPServiceUnavailable(err) {
+			cooldown := w.cooldown.start(cooldownKey)
+			if w.logger != nil {
+				w.logger.WarnContext(ctx, "SMTP server is unavailable; pausing sends", slog.Int64("job_id", job.ID), slog.Duration("cooldown", cooldown), slog.String("error", err.Error()))
+			}
+			return river.JobSnooze(cooldown)
+		}
+		return err
+	}
+
+	if w.metrics != nil {
+		w.metrics.emailDeliveryLatency.Observe(time.Since(job.CreatedAt).Seconds())
+	}
+
+	if w.logger != nil {
+		w.logger.InfoContext(ctx, "Sent email", slog.Int64("job_id", job.ID), slog.Int("attempt", job.Attempt), emailLogAttr(&args))
+	}
+
+	return nil
+}
+
+// senderFor returns the EmailSender for email from emailSender, which is the
+// one for its domain if there are domainSenders. A domain without a sender
+// won't get one by retrying, so the job is cancelled.
+func (w *SendEmailWorker) senderFor(emailSender string) (EmailSender, error) {
+	if len(w.domainSenders) < 1 {
+		return w.sender, nil
+	}
+
+	domain := w.senderKey(emailSender)
+	sender, ok := w.domainSenders[domain]
+	if !ok {
+		return nil, river.JobCancel(fmt.Errorf("sender domain %q isn't configured in SMTP_DOMAINS", domain))
+	}
+	return sender, nil
+}
+
+// senderKey returns the key in domainSenders of the sender that senderFor
+// returns for an email from emailSender, or an empty key for the default
+// sender.
+func (w *SendEmailWorker) senderKey(emailSender string) string {
+	if len(w.domainSenders) < 1 {
+		return ""
+	}
+	return strings.ToLower(addressDomain(emailSender))
+}
+
+// composeMessage builds a job's message from its fields, or its template if
+// it was queued to be rendered when it's sent, adding a tracking pixel,
+// unsubscribe URL, and subject prefix and suffix where they're called for.
+// Errors that would happen on every attempt are wrapped in river.JobCancel.
+func (w *SendEmailWorker) composeMessage(job *river.Job[SendEmailArgs]) ([]byte, error) {
+	args := job.Args
+
+	// The template was rendered when the email was queued, so this only
+	// fails if it's changed since then, which retrying won't fix.
+	if args.Template != "" {
+		rendered, err := w.templates.render(args.Template, args.TemplateLocale, args.TemplateData)
+		if err != nil {
+			return nil, river.JobCancel(err)
+		}
+		args.Body, args.BodyHTML, args.Subject = rendered.Body, rendered.BodyHTML, rendered.Subject
+	}
+
+	// Only the sent subject is tagged, never the stored one, so an email
+	// compares the same for deduplication in every environment.
+	if w.subjectPrefix != "" {
+		args.Subject = w.subjectPrefix + " " + args.Subject
+	}
+	if w.subjectSuffix != "" {
+		args.Subject += " " + w.subjectSuffix
+	}
+
+	if args.Track && args.BodyHTML != "" && w.trackingBaseURL != "" {
+		pixelURL, err := url.JoinPath(w.trackingBaseURL, strconv.FormatInt(job.ID, 10))
+		if err != nil {
+			return nil, err
+		}
+		args.BodyHTML = injectTrackingPixel(args.BodyHTML, pixelURL)
+	}
+
+	// Bulk senders are expected to offer one-click unsubscribes, but it
+	// doesn't make sense to unsubscribe from transactional email like
+	// password resets. Callers that set their own `List-Unsubscribe` header
+	// are handling unsubscribes themselves.
+	if args.UnsubscribeURL == "" && job.Queue == queueBulk && w.unsubscribeBaseURL != "" && !hasHeader(args.Headers, "List-Unsubscribe") {
+		unsubscribeURL, err := makeUnsubscribeURL(w.unsubscribeBaseURL, w.unsubscribeSecret, args.AccountID, args.EmailRecipient)
+		if err != nil {
+			return nil, err
+		}
+		args.UnsubscribeURL = unsubscribeURL
+	}
+
+	// Checked when the email was created, so this only fails for jobs
+	// inserted some other way, which would fail the same way on every
+	// attempt.
+	for _, body := range []*string{&args.Body, &args.BodyHTML} {
+		transcoded, err := transcodeBody(args.Charset, *body)
+		if err != nil {
+			return nil, river.JobCancel(err)
+		}
+		*body = transcoded
+	}
+
+	return buildMessage(&args), nil
+}
+
+// buildMessage assembles the headers and body of an email into a message that
+// can be sent over SMTP. Custom headers follow the standard ones, written in
+// sorted order so that output is stable. Any custom headers that would override
+// one of the standard ones are skipped (they should've been rejected at the
+// API level already).
+func buildMessage(args *SendEmailArgs) []byte {
+	var sb strings.Builder
+
+	if args.SenderName != "" {
+		// Quotes or encodes the name as needed so that it can contain
+		// punctuation and non-ASCII characters.
+		fmt.Fprintf(&sb, "From: %s\r\n", (&mail.Address{Name: args.SenderName, Address: args.EmailSender}).String())
+	} else {
+		fmt.Fprintf(&sb, "From: %s\r\n", args.EmailSender)
+	}
+	if args.ReplyTo != "" {
+		fmt.Fprintf(&sb, "Reply-To: %s\r\n", args.ReplyTo)
+	}
+	fmt.Fprintf(&sb, "To: %s\r\n", args.EmailRecipient)
+	if len(args.Cc) > 0 {
+		fmt.Fprintf(&sb, "Cc: %s\r\n", strings.Join(args.Cc, ", "))
+	}
+	// Non-ASCII subjects are encoded as RFC 2047 encoded-words so that mail
+	// clients don't mangle them. ASCII subjects are left as is.
+	fmt.Fprintf(&sb, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", args.Subject))
+	if args.MessageID != "" {
+		fmt.Fprintf(&sb, "Message-ID: %s\r\n", args.MessageID)
+	}
+	if args.InReplyTo != "" {
+		fmt.Fprintf(&sb, "In-Reply-To: %s\r\n", args.InReplyTo)
+	}
+	if len(args.References) > 0 {
+		fmt.Fprintf(&sb, "References: %s\r\n", strings.Join(args.References, " "))
+	}
+	if args.UnsubscribeURL != "" {
+		fmt.Fprintf(&sb, "List-Unsubscribe: <%s>\r\n", args.UnsubscribeURL)
+		sb.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(args.Headers)) {
+		if _, ok := deniedHeaders[textproto.CanonicalMIMEHeaderKey(name)]; ok {
+			continue
+		}
+		if _, ok := unsubscribeHeaders[textproto.CanonicalMIMEHeaderKey(name)]; ok && args.UnsubscribeURL != "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s: %s\r\n", name, args.Headers[name])
+	}
+
+	contentType, body := buildMessageBody(args)
+
+	if len(args.Attachments) < 1 {
+		// UTF-8 bodies without HTML have always gone out without a
+		// `Content-Type`, and are left that way.
+		if contentType != "" {
+			sb.WriteString("MIME-Version: 1.0\r\n")
+			fmt.Fprintf(&sb, "Content-Type: %s\r\n", contentType)
+		}
+		sb.WriteString("\r\n")
+		sb.WriteString(body)
+		return []byte(sb.String())
+	}
+
+	// Attachments follow the body, which is the first part of the message
+	// whether it's plain text or has an HTML alternative.
+	mw := multipart.NewWriter(&sb)
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&sb, "Content-Type: multipart/mixed; boundary=%q\r\n", mw.Boundary())
+	sb.WriteString("\r\n")
+
+	partWriter, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {cmp.Or(contentType, "text/plain; charset="+charsetDefault)}})
+	_, _ = io.WriteString(partWriter, body)
+	for _, attachment := range args.Attachments {
+		writeAttachmentPart(mw, attachment)
+	}
+	_ = mw.Close()
+
+	return []byte(sb.String())
+}
+
+// buildMessageBody returns the body of an email, which is either its plain
+// text body alone or a multipart/alternative of it and its HTML body, along
+// with the body's content type. The content type is empty for a UTF-8 plain
+// text body.
+func buildMessageBody(args *SendEmailArgs) (string, string) {
+	// Bodies are assumed to already be in the charset.
+	charset := cmp.Or(args.Charset, charsetDefault)
+
+	if args.BodyHTML == "" {
+		var contentType string
+		if args.Charset != "" {
+			contentType = "text/plain; charset=" + charset
+		}
+		return contentType, args.Body + "\r\n"
+	}
+
+	// With an HTML body, the plain text body becomes the fallback for clients
+	// that don't display HTML.
+	var sb strings.Builder
+	mw := multipart.NewWriter(&sb)
+	for _, part := range []struct{ body, contentType string }{
+		{args.Body, "text/plain; charset=" + charset},
+		{args.BodyHTML, "text/html; charset=" + charset},
+	} {
+		partWriter, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		_, _ = io.WriteString(partWriter, part.body+"\r\n")
+	}
+	_ = mw.Close()
+
+	return fmt.Sprintf("multipart/alternative; boundary=%q", mw.Boundary()), sb.String()
+}
+
+// unsubscribeHeaders are headers written for an email's unsubscribe URL, which
+// take the place of any custom headers of the same name.
+var unsubscribeHeaders = map[string]struct{}{ //nolint:gochecknoglobals
+	"List-Unsubscribe":      {},
+	"List-Unsubscribe-Post": {},
+}
+
+// hasHeader returns true if headers includes one with the given name, compared
+// case insensitively.
+func hasHeader(headers map[string]string, name string) bool {
+	for headerName := range headers {
+		if textproto.CanonicalMIMEHeaderKey(headerName) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// injectTrackingPixel adds a 1x1 image loading pixelURL to an HTML body, which
+// lets opens be tracked when the recipient's client loads images. The pixel
+// goes right before the closing `</body>` tag if there is one, or at the end
+// of the HTML otherwise, leaving the rest of the markup untouched.
+func injectTrackingPixel(bodyHTML, pixelURL string) string {
+	pixel := `<img src="` + html.EscapeString(pixelURL) + `" width="1" height="1" alt="" style="display:none">`
+
+	if i := strings.LastIndex(strings.ToLower(bodyHTML), "</body>"); i != -1 {
+		return bodyHTML[:i] + pixel + bodyHTML[i:]
+	}
+	return bodyHTML + pixel
+}
+
+type CleanupEmailJobsArgs struct{}
+
+func (CleanupEmailJobsArgs) Kind() string { return "cleanup_email_jobs" }
+
+func (CleanupEmailJobsArgs) InsertOpts() river.InsertOpts {
+	return river.InsertOpts{
+		Queue: queueBulk,
+	}
+}
+
+// dbExecutor executes SQL. It's implemented by both pgxpool.Pool and pgx.Tx.
+type dbExecutor interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// CleanupEmailJobsWorker deletes completed email jobs once they're older than
+// the retention window. Jobs are deleted in batches, each in its own implicit
+// transaction, so that no single transaction runs for long or holds locks on
+// a large number of rows.
+//
+// The retention window is also how long a key can be reused to deduplicate an
+// email that's already been sent. After that, the key is only remembered as
+// having been used, for idempotencyKeyRetention more, and reusing it queues a
+// new email.
+type CleanupEmailJobsWorker struct {
+	river.WorkerDefaults[CleanupEmailJobsArgs]
+
+	batchSize int
+	dbPool    dbExecutor
+	retention time.Duration
+}
+
+func (w *CleanupEmailJobsWorker) Work(ctx context.Context, job *river.Job[CleanupEmailJobsArgs]) error {
+	finalizedBefore := time.Now().Add(-w.retention)
+
+	for {
+		res, err := w.dbPool.Exec(ctx, `
+			DELETE FROM river_job
+			WHERE id IN (
+				SELECT id
+				FROM river_job
+				WHERE kind = $1
+					AND state = 'completed'
+					AND finalized_at < $2
+				ORDER BY id
+				LIMIT $3
+			)`,
+			(SendEmailArgs{}).Kind(), finalizedBefore, w.batchSize,
+		)
+		if err != nil {
+			return err
+		}
+
+		if res.RowsAffected() < int64(w.batchSize) {
+			break
+		}
+	}
+
+	// Responses stored for replay outlive their jobs by no more than jobs
+	// outlive their sends. After that, a retry queues a new email anyway.
+	for {
+		res, err := w.dbPool.Exec(ctx, `
+			DELETE FROM idempotency_responses
+			WHERE (account_id, idempotency_key) IN (
+				SELECT account_id, idempotency_key
+				FROM idempotency_responses
+				WHERE created_at < $1
+				ORDER BY created_at
+				LIMIT $2
+			)`,
+			finalizedBefore, w.batchSize,
+		)
+		if err != nil {
+			return err
+		}
+
+		if res.RowsAffected() < int64(w.batchSize) {
+			break
+		}
+	}
+
+	for {
+		res, err := w.dbPool.Exec(ctx, `
+			DELETE FROM idempotency_keys
+			WHERE unique_key IN (
+				SELECT unique_key
+				FROM idempotency_keys
+				WHERE updated_at < $1
+				ORDER BY updated_at
+				LIMIT $2
+			)`,
+			finalizedBefore.Add(-idempotencyKeyRetention), w.batchSize,
+		)
+		if err != nil {
+			return err
+		}
+
+		if res.RowsAffected() < int64(w.batchSize) {
+			return nil
+		}
+	}
+}
+
+func main() {
+	// Cancelled on Ctrl+C or when a deployment asks the process to stop,
+	// which starts a graceful shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s", err)
+		os.Exit(1)
+	}
+}
+
+type EnvConfig struct {
+	AccessLogFile            string        `env:"ACCESS_LOG_FILE"` // access log goes to stdout if empty
+	AccessLogMaxBackups      int           `env:"ACCESS_LOG_MAX_BACKUPS,default=5"`
+	AccessLogMaxMegabytes    int           `env:"ACCESS_LOG_MAX_MEGABYTES,default=100"` // size at which the access log file is rotated
+	AccountSenders           string        `env:"ACCOUNT_SENDERS"`                      // JSON object of account IDs to the sender addresses they may use
+	AllowedSenderDomains     []string      `env:"ALLOWED_SENDER_DOMAINS"`               // comma-separated; any domain if empty
+	AutoMigrate              bool          `env:"AUTO_MIGRATE"`
+	BatchJitter              time.Duration `env:"BATCH_JITTER"`
+	BulkMaxWorkers           int           `env:"BULK_MAX_WORKERS,default=20"`
+	DatabaseURL              string        `env:"DATABASE_URL,required"`
+	DBMaxConnLifetime        time.Duration `env:"DB_MAX_CONN_LIFETIME"` // defaults to pgx's default of an hour
+	DBMaxConns               int           `env:"DB_MAX_CONNS"`         // defaults to pgx's default of the greater of 4 or the number of CPUs
+	DBMinConns               int           `env:"DB_MIN_CONNS"`
+	DedupeByContent          bool          `env:"DEDUPE_BY_CONTENT"`
+	DedupeByContentPeriod    time.Duration `env:"DEDUPE_BY_CONTENT_PERIOD,default=10m"`
+	DedupeFailedEmails       bool          `env:"DEDUPE_FAILED_EMAILS"`
+	DefaultBody              string        `env:"DEFAULT_BODY"`
+	DefaultSender            string        `env:"DEFAULT_SENDER"`
+	DefaultSubject           string        `env:"DEFAULT_SUBJECT"`
+	DKIMDomain               string        `env:"DKIM_DOMAIN"`
+	DKIMPrivateKey           string        `env:"DKIM_PRIVATE_KEY"` // PEM encoded RSA key
+	DKIMSelector             string        `env:"DKIM_SELECTOR"`
+	EncryptionKey            string        `env:"ENCRYPTION_KEY"` // base64 encoded AES-256 key
+	EnvelopeResponses        bool          `env:"ENVELOPE_RESPONSES"`
+	FetchCooldown            time.Duration `env:"FETCH_COOLDOWN,default=100ms"`
+	FetchPollInterval        time.Duration `env:"FETCH_POLL_INTERVAL,default=1s"`
+	IdempotencyScope         string        `env:"IDEMPOTENCY_SCOPE,default=account_key"`
+	IdempotentResponses      bool          `env:"IDEMPOTENT_RESPONSES"`
+	JobRetention             time.Duration `env:"JOB_RETENTION,default=168h"`
+	JSONCase                 string        `env:"JSON_CASE,default=snake"`
+	ListenAddr               string        `env:"LISTEN_ADDR,default=:8080"`
+	LogRedact                string        `env:"LOG_REDACT,default=truncate"`
+	MaintenanceMode          bool          `env:"MAINTENANCE_MODE"`
+	MaxConcurrentRequests    int           `env:"MAX_CONCURRENT_REQUESTS"`
+	MaxWorkers               string        `env:"MAX_WORKERS"`                        // replaced by BULK_, SCHEDULED_, and TRANSACTIONAL_MAX_WORKERS; rejected if set
+	MaxRecipients            int           `env:"MAX_RECIPIENTS,default=50"`          // per email, including cc and bcc
+	MaxRequestBytes          int           `env:"MAX_REQUEST_BYTES,default=10485760"` // largest request body; 10 MiB
+	MaxUploadBytes           int           `env:"MAX_UPLOAD_BYTES,default=26214400"`  // largest multipart form posted to POST /emails; 25 MiB
+	OTELTracesExporter       string        `env:"OTEL_TRACES_EXPORTER"`
+	PerDomainConcurrency     int           `env:"PER_DOMAIN_CONCURRENCY"` // sends in progress at once to each recipient domain; unlimited if zero
+	PurgeEnabled             bool          `env:"PURGE_ENABLED"`
+	QueueName                string        `env:"QUEUE_NAME"`                 // replaced by the bulk, scheduled, and transactional queues; rejected if set
+	RecipientDomainAllowlist []string      `env:"RECIPIENT_DOMAIN_ALLOWLIST"` // comma-separated; any domain if empty
+	RedirectAllTo            string        `env:"REDIRECT_ALL_TO"`            // staging inbox that gets all email instead of its recipients
+	RenderTemplatesAtSend    bool          `env:"RENDER_TEMPLATES_AT_SEND"`
+	RequestTimeout           time.Duration `env:"REQUEST_TIMEOUT"`
+	ScheduledMaxWorkers      int           `env:"SCHEDULED_MAX_WORKERS,default=10"`
+	SMTPAuth                 string        `env:"SMTP_AUTH,default=plain"`  // plain, cram-md5, or none
+	SMTPCooldown             time.Duration `env:"SMTP_COOLDOWN,default=1m"` // how long sends pause after a 421; 421s are retried like other errors if zero
+	SMTPDomains              string        `env:"SMTP_DOMAINS"`             // JSON object of sender domains to SMTP host and credentials
+	SMTPHELOHost             string        `env:"SMTP_HELO_HOST"`           // name sent in EHLO; defaults to localhost
+	SMTPHost                 string        `env:"SMTP_HOST"`
+	SMTPHosts                string        `env:"SMTP_HOSTS"`
+	SMTPMaxMessageBytes      int           `env:"SMTP_MAX_MESSAGE_BYTES"`
+	SMTPPass                 string        `env:"SMTP_PASS"`
+	SMTPPort                 int           `env:"SMTP_PORT"` // port of SMTP hosts that don't include their own
+	SMTPPoolSize             int           `env:"SMTP_POOL_SIZE,default=10"`
+	SMTPReturnPath           string        `env:"SMTP_RETURN_PATH"`
+	SMTPSendRate             float64       `env:"SMTP_SEND_RATE"` // messages per second
+	SMTPSendTimeout          time.Duration `env:"SMTP_SEND_TIMEOUT"`
+	SMTPInsecureSkipVerify   bool          `env:"SMTP_TLS_INSECURE_SKIP_VERIFY"` // for development servers with self-signed certificates only
+	SMTPTLSMode              string        `env:"SMTP_TLS_MODE"`                 // none, starttls, or implicit; defaults to starttls
+	SMTPUser                 string        `env:"SMTP_USER"`
+	SMTPWeights              []int         `env:"SMTP_WEIGHTS"`
+	SpamPrecheck             string        `env:"SPAM_PRECHECK"`  // flag or reject; off if empty
+	SubjectPrefix            string        `env:"SUBJECT_PREFIX"` // like [STAGING]
+	SubjectSuffix            string        `env:"SUBJECT_SUFFIX"`
+	TLSCertFile              string        `env:"TLS_CERT_FILE"`
+	TLSKeyFile               string        `env:"TLS_KEY_FILE"`
+	TrackingBaseURL          string        `env:"TRACKING_BASE_URL"`
+	TransactionalMaxWorkers  int           `env:"TRANSACTIONAL_MAX_WORKERS,default=100"`
+	TxMaxRetries             int           `env:"TX_MAX_RETRIES,default=3"`
+	UnsubscribeBaseURL       string        `env:"UNSUBSCRIBE_BASE_URL"`
+	UnsubscribeSecret        string        `env:"UNSUBSCRIBE_SECRET"`
+}
+
+// loadEnvConfig loads configuration from the given lookuper, which is the
+// process' environment outside of tests.
+func loadEnvConfig(ctx context.Context, lookuper envconfig.Lookuper) (*EnvConfig, error) {
+	lookuper, err := withFileEnvVars(lookuper)
+	if err != nil {
+		return nil, err
+	}
+
+	var config EnvConfig
+	if err := envconfig.ProcessWith(ctx, &envconfig.Config{Lookuper: lookuper, Target: &config}); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// fileEnvVars are secret variables that can also be read from a file named by
+// the same variable with a `_FILE` suffix, like SMTP_PASS_FILE, which is more
+// convenient for secrets that are mounted as files.
+var fileEnvVars = []string{ //nolint:gochecknoglobals
+	"DATABASE_URL",
+	"DKIM_PRIVATE_KEY",
+	"ENCRYPTION_KEY",
+	"SMTP_DOMAINS",
+	"SMTP_HOSTS",
+	"SMTP_PASS",
+	"SMTP_USER",
+	"UNSUBSCRIBE_SECRET",
+}
+
+// withFileEnvVars returns a lookuper that resolves each variable in
+// fileEnvVars from its file if the `_FILE` variant is set, falling back to the
+// given lookuper otherwise. Files are read up front so that one that can't be
+// read fails startup. Trailing whitespace, like a final newline, is trimmed.
+func withFileEnvVars(lookuper envconfig.Lookuper) (envconfig.Lookuper, error) {
+	fileValues := make(map[string]string)
+	for _, key := range fileEnvVars {
+		path, ok := lookuper.Lookup(key + "_FILE")
+		if !ok || path == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s_FILE: %w", key, err)
+		}
+		fileValues[key] = strings.TrimRightFunc(string(data), unicode.IsSpace)
+	}
+
+	return envconfig.MultiLookuper(envconfig.MapLookuper(fileValues), lookuper), nil
+}
+
+// makeDBPoolConfig makes a database pool configuration from DATABASE_URL,
+// sized by DB_MAX_CONNS and the other pool settings where they're set. Unset
+// ones are left to pool parameters in the URL like `pool_max_conns`, or pgx's
+// defaults.
+func makeDBPoolConfig(config *EnvConfig) (*pgxpool.Config, error) {
+	poolConfig, err := pgxpool.ParseConfig(config.DatabaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing DATABASE_URL: %w", err)
+	}
+
+	if config.DBMaxConnLifetime < 0 {
+		return nil, fmt.Errorf("DB_MAX_CONN_LIFETIME must not be negative, but was %s", config.DBMaxConnLifetime)
+	}
+	if config.DBMaxConns < 0 {
+		return nil, fmt.Errorf("DB_MAX_CONNS must not be negative, but was %d", config.DBMaxConns)
+	}
+	if config.DBMinConns < 0 {
+		return nil, fmt.Errorf("DB_MIN_CONNS must not be negative, but was %d", config.DBMinConns)
+	}
+
+	if config.DBMaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = config.DBMaxConnLifetime
+	}
+	if config.DBMaxConns > 0 {
+		poolConfig.MaxConns = int32(min(config.DBMaxConns, math.MaxInt32)) //nolint:gosec
+	}
+	if config.DBMinConns > 0 {
+		poolConfig.MinConns = int32(min(config.DBMinConns, math.MaxInt32)) //nolint:gosec
+	}
+
+	if poolConfig.MinConns > poolConfig.MaxConns {
+		return nil, fmt.Errorf("DB_MIN_CONNS must not be more than the pool's maximum of %d connections, but was %d", poolConfig.MaxConns, poolConfig.MinConns)
+	}
+
+	return poolConfig, nil
+}
+
+// parseAccountSenders parses ACCOUNT_SENDERS, a JSON object like
+// `{"<account ID>": ["billing@example.com", "support@example.com"]}` of the
+// sender addresses that each account may send from. It returns nil if
+// ACCOUNT_SENDERS isn't set.
+func parseAccountSenders(config *EnvConfig) (map[uuid.UUID][]string, error) {
+	if config.AccountSenders == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	var accountSenders map[uuid.UUID][]string
+	if err := json.Unmarshal([]byte(config.AccountSenders), &accountSenders); err != nil {
+		return nil, fmt.Errorf("ACCOUNT_SENDERS must be a JSON object of account IDs to sender addresses: %w", err)
+	}
+
+	for accountID, senders := range accountSenders {
+		if len(senders) < 1 {
+			return nil, fmt.Errorf("ACCOUNT_SENDERS must include at least one sender for account %s", accountID)
+		}
+		for _, sender := range senders {
+			if validate.Var(sender, "email") != nil {
+				return nil, fmt.Errorf("ACCOUNT_SENDERS senders must be email addresses, but was %q", sender)
+			}
+		}
+	}
+
+	return accountSenders, nil
+}
+
+// makeRiverConfig makes a River client configuration from environment
+// configuration, validating the values it uses along the way.
+func makeRiverConfig(config *EnvConfig, dbPool dbExecutor, sender EmailSender, domainSenders map[string]EmailSender, encrypter *emailEncrypter, logger *slog.Logger, metrics *metrics, templates emailTemplates, tracer trace.Tracer) (*river.Config, error) {
+	if config.BulkMaxWorkers < 1 {
+		return nil, fmt.Errorf("BULK_MAX_WORKERS must be positive, but was %d", config.BulkMaxWorkers)
+	}
+	if config.DefaultSender != "" && validate.Var(config.DefaultSender, "email") != nil {
+		return nil, fmt.Errorf("DEFAULT_SENDER must be an email address, but was %q", config.DefaultSender)
+	}
+
+	if config.RedirectAllTo != "" && validate.Var(config.RedirectAllTo, "email") != nil {
+		return nil, fmt.Errorf("REDIRECT_ALL_TO must be an email address, but was %q", config.RedirectAllTo)
+	}
+	if config.FetchCooldown <= 0 {
+		return nil, fmt.Errorf("FETCH_COOLDOWN must be positive, but was %s", config.FetchCooldown)
+	}
+	if config.FetchPollInterval <= 0 {
+		return nil, fmt.Errorf("FETCH_POLL_INTERVAL must be positive, but was %s", config.FetchPollInterval)
+	}
+	if config.JobRetention <= 0 {
+		return nil, fmt.Errorf("JOB_RETENTION must be positive, but was %s", config.JobRetention)
+	}
+	if config.JSONCase != JSONCaseCamel && config.JSONCase != JSONCaseSnake {
+		return nil, fmt.Errorf("JSON_CASE must be %q or %q, but was %q", JSONCaseCamel, JSONCaseSnake, config.JSONCase)
+	}
+	if config.DedupeByContent && config.DedupeByContentPeriod < time.Second {
+		return nil, fmt.Errorf("DEDUPE_BY_CONTENT_PERIOD must be at least 1s, but was %s", config.DedupeByContentPeriod)
+	}
+	if config.IdempotencyScope != IdempotencyScopeAccountKey && config.IdempotencyScope != IdempotencyScopeKey {
+		return nil, fmt.Errorf("IDEMPOTENCY_SCOPE must be %q or %q, but was %q", IdempotencyScopeAccountKey, IdempotencyScopeKey, config.IdempotencyScope)
+	}
+	if config.BatchJitter < 0 {
+		return nil, fmt.Errorf("BATCH_JITTER must not be negative, but was %s", config.BatchJitter)
+	}
+	if config.MaxRecipients < 1 {
+		return nil, fmt.Errorf("MAX_RECIPIENTS must be at least 1, but was %d", config.MaxRecipients)
+	}
+	if config.MaxConcurrentRequests < 0 {
+		return nil, fmt.Errorf("MAX_CONCURRENT_REQUESTS must not be negative, but was %d", config.MaxConcurrentRequests)
+	}
+	if config.MaxRequestBytes < 1 {
+		return nil, fmt.Errorf("MAX_REQUEST_BYTES must be at least 1, but was %d", config.MaxRequestBytes)
+	}
+	if config.MaxUploadBytes < 1 {
+		return nil, fmt.Errorf("MAX_UPLOAD_BYTES must be at least 1, but was %d", config.MaxUploadBytes)
+	}
+	if config.SpamPrecheck != "" && config.SpamPrecheck != SpamPrecheckFlag && config.SpamPrecheck != SpamPrecheckReject {
+		return nil, fmt.Errorf("SPAM_PRECHECK must be empty, %q, or %q, but was %q", SpamPrecheckFlag, SpamPrecheckReject, config.SpamPrecheck)
+	}
+	if config.RequestTimeout < 0 {
+		return nil, fmt.Errorf("REQUEST_TIMEOUT must not be negative, but was %s", config.RequestTimeout)
+	}
+	if config.TxMaxRetries < 0 {
+		return nil, fmt.Errorf("TX_MAX_RETRIES must not be negative, but was %d", config.TxMaxRetries)
+	}
+	if config.AccessLogMaxBackups < 0 {
+		return nil, fmt.Errorf("ACCESS_LOG_MAX_BACKUPS must not be negative, but was %d", config.AccessLogMaxBackups)
+	}
+	if config.AccessLogMaxMegabytes < 0 {
+		return nil, fmt.Errorf("ACCESS_LOG_MAX_MEGABYTES must not be negative, but was %d", config.AccessLogMaxMegabytes)
+	}
+	if config.PerDomainConcurrency < 0 {
+		return nil, fmt.Errorf("PER_DOMAIN_CONCURRENCY must not be negative, but was %d", config.PerDomainConcurrency)
+	}
+	if config.SMTPMaxMessageBytes < 0 {
+		return nil, fmt.Errorf("SMTP_MAX_MESSAGE_BYTES must not be negative, but was %d", config.SMTPMaxMessageBytes)
+	}
+	if config.SMTPSendRate < 0 {
+		return nil, fmt.Errorf("SMTP_SEND_RATE must not be negative, but was %g", config.SMTPSendRate)
+	}
+	if config.SMTPSendTimeout < 0 {
+		return nil, fmt.Errorf("SMTP_SEND_TIMEOUT must not be negative, but was %s", config.SMTPSendTimeout)
+	}
+	if config.SMTPCooldown < 0 {
+		return nil, fmt.Errorf("SMTP_COOLDOWN must not be negative, but was %s", config.SMTPCooldown)
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if config.UnsubscribeBaseURL != "" && config.UnsubscribeSecret == "" {
+		return nil, errors.New("UNSUBSCRIBE_SECRET must be set when UNSUBSCRIBE_BASE_URL is")
+	}
+	// Ignoring these would silently change how many workers a deployment
+	// that still sets them runs, and which queue its emails go to.
+	if config.MaxWorkers != "" {
+		return nil, errors.New("MAX_WORKERS is no longer supported; set BULK_MAX_WORKERS, SCHEDULED_MAX_WORKERS, and TRANSACTIONAL_MAX_WORKERS instead")
+	}
+	if config.QueueName != "" {
+		return nil, errors.New("QUEUE_NAME is no longer supported; emails are sent from the bulk, scheduled, and transactional queues")
+	}
+	if config.ScheduledMaxWorkers < 1 {
+		return nil, fmt.Errorf("SCHEDULED_MAX_WORKERS must be positive, but was %d", config.ScheduledMaxWorkers)
+	}
+	if config.TransactionalMaxWorkers < 1 {
+		return nil, fmt.Errorf("TRANSACTIONAL_MAX_WORKERS must be positive, but was %d", config.TransactionalMaxWorkers)
+	}
+
+	// River workers aren't tied to a queue, so the same SendEmailWorker works
+	// jobs from all of these.
+	return &river.Config{
+		// River's own job cleaner removes completed jobs after only 24 hours
+		// by default, which would cut the email retention window short.
+		CompletedJobRetentionPeriod: config.JobRetention,
+
+		// Lower values reduce latency between a job being inserted and being
+		// worked, at the cost of more load on the database.
+		FetchCooldown:     config.FetchCooldown,
+		FetchPollInterval: config.FetchPollInterval,
+
+		Logger: logger,
+
+		PeriodicJobs: []*river.PeriodicJob{
+			river.NewPeriodicJob(
+				river.PeriodicInterval(1*time.Hour),
+				func() (river.JobArgs, *river.InsertOpts) { return CleanupEmailJobsArgs{}, nil },
+				&river.PeriodicJobOpts{RunOnStart: true},
+			),
+		},
+		Queues: map[string]river.QueueConfig{
+			queueBulk:          {MaxWorkers: config.BulkMaxWorkers},
+			queueScheduled:     {MaxWorkers: config.ScheduledMaxWorkers},
+			queueTransactional: {MaxWorkers: config.TransactionalMaxWorkers},
+		},
+		Workers: makeWorkers(config, dbPool, sender, domainSenders, encrypter, logger, metrics, templates, tracer),
+	}, nil
+}
+
+func makeWorkers(config *EnvConfig, dbPool dbExecutor, sender EmailSender, domainSenders map[string]EmailSender, encrypter *emailEncrypter, logger *slog.Logger, metrics *metrics, templates emailTemplates, tracer trace.Tracer) *river.Workers {
+	workers := river.NewWorkers()
+	river.AddWorker(workers, &CleanupEmailJobsWorker{
+		batchSize: 1_000,
+		dbPool:    dbPool,
+		retention: config.JobRetention,
+	})
+	// A limiter with a burst of one spaces sends out evenly rather than
+	// letting a backlog go out all at once.
+	var limiter *rate.Limiter
+	if config.SMTPSendRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(config.SMTPSendRate), 1)
+	}
+
+	var domainLimiter *domainLimiter
+	if config.PerDomainConcurrency > 0 {
+		domainLimiter = newDomainLimiter(config.PerDomainConcurrency)
+	}
+
+	var cooldown *smtpCooldown
+	if config.SMTPCooldown > 0 {
+		cooldown = newSMTPCooldown(config.SMTPCooldown)
+	}
+
+	river.AddWorker(workers, &ContentDedupeWorker{})
+	river.AddWorker(workers, &SendEmailWorker{
+		cooldown:        cooldown,
+		dbPool:          dbPool,
+		domainLimiter:   domainLimiter,
+		domainSenders:   domainSenders,
+		encrypter:       encrypter,
+		limiter:         limiter,
+		logger:          logger,
+		maxMessageBytes: config.SMTPMaxMessageBytes,
+		metrics:         metrics,
+		redirectAllTo:   config.RedirectAllTo,
+		returnPath:      config.SMTPReturnPath,
+		sendTimeout:     config.SMTPSendTimeout,
+		sender:          sender,
+		subjectPrefix:   config.SubjectPrefix,
+		subjectSuffix:   config.SubjectSuffix,
+		templates:       templates,
+		tracer:          tracer,
+		trackingBaseURL: config.TrackingBaseURL,
+
+		unsubscribeBaseURL: config.UnsubscribeBaseURL,
+		unsubscribeSecret:  []byte(config.UnsubscribeSecret),
+	})
+	return workers
 }
 
-type HandleEmailCreateResponse struct {
-	Message string `json:"message"`
-}
+// makeTracerProvider makes an OpenTelemetry tracer provider with an exporter
+// configured by the standard OTEL_* environment variables. Unlike the
+// OpenTelemetry default of exporting with OTLP, tracing is off unless an
+// exporter is requested explicitly with OTEL_TRACES_EXPORTER.
+func makeTracerProvider(ctx context.Context, config *EnvConfig) (trace.TracerProvider, func(ctx context.Context) error, error) {
+	if config.OTELTracesExporter == "" {
+		return tracenoop.NewTracerProvider(), func(ctx context.Context) error { return nil }, nil
+	}
 
-func (s *APIService) EmailCreate(ctx context.Context, req *HandleEmailCreateRequest) (*HandleEmailCreateResponse, error) {
-	tx, err := s.begin(ctx)
+	exporter, err := autoexport.NewSpanExporter(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer func() { _ = tx.Rollback(ctx) }()
 
-	insertRes, err := s.riverClient.InsertTx(ctx, tx, SendEmailArgs{
-		AccountID:      req.AccountID,
-		Body:           req.Body,
-		EmailRecipient: req.EmailRecipient,
-		EmailSender:    req.EmailSender,
-		IdempotencyKey: req.IdempotencyKey,
-		Subject:        req.Subject,
-	}, nil)
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	return tracerProvider, tracerProvider.Shutdown, nil
+}
+
+func run(ctx context.Context) error {
+	config, err := loadEnvConfig(ctx, envconfig.OsLookuper())
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if err := tx.Commit(ctx); err != nil {
-		return nil, err
+	dbPoolConfig, err := makeDBPoolConfig(config)
+	if err != nil {
+		return err
 	}
 
-	if insertRes.UniqueSkippedAsDuplicate {
-		var existingArgs SendEmailArgs
-		if err := json.Unmarshal(insertRes.Job.EncodedArgs, &existingArgs); err != nil {
-			return nil, err
-		}
-
-		// If incoming parameters don't match those of an already queued job,
-		// tell the user about it. There's probably a bug in the caller.
-		if req.Body != existingArgs.Body ||
-			req.EmailRecipient != existingArgs.EmailRecipient ||
-			req.EmailSender != existingArgs.EmailSender ||
-			req.Subject != existingArgs.Subject {
-			return nil, &APIError{
-				Message:    "Incoming parameters don't match those of queued email. You may have a bug.",
-				StatusCode: http.StatusBadRequest,
-			}
-		}
-
-		if insertRes.Job.State == rivertype.JobStateCompleted {
-			return &HandleEmailCreateResponse{Message: "Email has been sent."}, nil
-		}
-
-		return &HandleEmailCreateResponse{Message: "Email was already queued and is pending send."}, nil
+	dbPool, err := pgxpool.NewWithConfig(ctx, dbPoolConfig)
+	if err != nil {
+		return err
 	}
 
-	return &HandleEmailCreateResponse{Message: "Email has been queued for sending."}, nil
-}
+	if err := pgx.BeginFunc(ctx, dbPool, func(tx pgx.Tx) error {
+		return migrateDatabase(ctx, tx, config.AutoMigrate)
+	}); err != nil {
+		return err
+	}
 
-func (s *APIService) ServeMux() *http.ServeMux {
-	mux := http.NewServeMux()
-	mux.Handle("POST /emails", MakeHandler(s.EmailCreate))
-	return mux
-}
+	tracerProvider, shutdownTracerProvider, err := makeTracerProvider(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = shutdownTracerProvider(context.Background()) }()
 
-type SendEmailArgs struct {
-	AccountID      uuid.UUID `json:"account_id"      river:"unique"` // simplified for demo; this would be determined through an auth token in real life
-	Body           string    `json:"body"            river:"-"`
-	EmailRecipient string    `json:"email_recipient" river:"-"`
-	EmailSender    string    `json:"email_sender"    river:"-"`
-	IdempotencyKey uuid.UUID `json:"idempotency_key" river:"unique"` // simplified for demo; this would come in by `Idempotency-Key` header by convention
-	Subject        string    `json:"subject"         river:"-"`
-}
+	tracer := tracerProvider.Tracer(tracerName)
 
-func (SendEmailArgs) Kind() string { return "send_email" }
+	metrics := newMetrics()
 
-func (SendEmailArgs) InsertOpts() river.InsertOpts {
-	return river.InsertOpts{
-		UniqueOpts: river.UniqueOpts{
-			ByArgs: true,
-		},
+	logger, err := newLogger(os.Stdout, config.LogRedact)
+	if err != nil {
+		return err
 	}
-}
 
-type SendEmailWorker struct {
-	river.WorkerDefaults[SendEmailArgs]
-	smtpHost, smtpPass, smtpUser string
-}
+	if config.SMTPInsecureSkipVerify {
+		logger.WarnContext(ctx, "SMTP_TLS_INSECURE_SKIP_VERIFY is set, so SMTP servers' certificates aren't verified; it should only be used in development")
+	}
 
-func (w *SendEmailWorker) Work(ctx context.Context, job *river.Job[SendEmailArgs]) error {
-	// This will probably too simple to work in reality, but is here to
-	// demonstrate the basic shape of what sending an email would look like.
-	var (
-		auth    = smtp.PlainAuth("", w.smtpUser, w.smtpPass, w.smtpHost)
-		message = []byte(fmt.Sprintf("To: %s\r\n"+
-			"Subject: %s\r\n"+
-			"\r\n"+
-			"%s\r\n",
-			job.Args.EmailRecipient,
-			job.Args.Subject,
-			job.Args.Body,
-		))
-	)
-	return smtp.SendMail(w.smtpHost, auth, job.Args.EmailSender, []string{job.Args.EmailRecipient}, message)
-}
+	accessLogWriter, closeAccessLog := newAccessLogWriter(config)
+	defer func() { _ = closeAccessLog() }()
 
-func main() {
-	ctx := context.Background()
+	sender, err := makeEmailSender(config, metrics)
+	if err != nil {
+		return err
+	}
 
-	if err := run(ctx); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %s", err)
-		os.Exit(1)
+	domainSenders, err := makeDomainSenders(config, metrics)
+	if err != nil {
+		return err
 	}
-}
 
-type EnvConfig struct {
-	DatabaseURL string `env:"DATABASE_URL,required"`
-	SMTPHost    string `env:"SMTP_HOST,required"`
-	SMTPPass    string `env:"SMTP_PASS,required"`
-	SMTPUser    string `env:"SMTP_USER,required"`
-}
+	accountSenders, err := parseAccountSenders(config)
+	if err != nil {
+		return err
+	}
 
-func makeWorkers(config *EnvConfig) *river.Workers {
-	workers := river.NewWorkers()
-	river.AddWorker(workers, &SendEmailWorker{
-		smtpHost: config.SMTPHost,
-		smtpPass: config.SMTPPass,
-		smtpUser: config.SMTPUser,
-	})
-	return workers
-}
+	encrypter, err := newEmailEncrypter(config.EncryptionKey)
+	if err != nil {
+		return err
+	}
 
-func run(ctx context.Context) error {
-	var config EnvConfig
-	if err := envconfig.Process(ctx, &config); err != nil {
+	templatesDir, err := fs.Sub(templatesFS, "templates")
+	if err != nil {
+		return err
+	}
+	templates, err := loadEmailTemplates(templatesDir)
+	if err != nil {
 		return err
 	}
 
-	dbPool, err := pgxpool.New(ctx, config.DatabaseURL)
+	riverConfig, err := makeRiverConfig(config, dbPool, sender, domainSenders, encrypter, logger, metrics, templates, tracer)
 	if err != nil {
 		return err
 	}
 
-	riverClient, err := river.NewClient(riverpgxv5.New(dbPool), &river.Config{
-		Queues: map[string]river.QueueConfig{
-			river.QueueDefault: {MaxWorkers: 100},
-		},
-		Workers: makeWorkers(&config),
-	})
+	riverClient, err := river.NewClient(riverpgxv5.New(dbPool), riverConfig)
 	if err != nil {
 		return err
 	}
 
+	var dedupeByContentPeriod time.Duration
+	if config.DedupeByContent {
+		dedupeByContentPeriod = config.DedupeByContentPeriod
+	}
+
+	apiService := &APIService{
+		accountSenders:           accountSenders,
+		allowedSenderDomains:     config.AllowedSenderDomains,
+		batchJitter:              config.BatchJitter,
+		begin:                    dbPool.Begin,
+		buildCommit:              commit,
+		buildVersion:             version,
+		dedupeByContentPeriod:    dedupeByContentPeriod,
+		dedupeFailedEmails:       config.DedupeFailedEmails,
+		defaultBody:              config.DefaultBody,
+		defaultSender:            config.DefaultSender,
+		defaultSubject:           config.DefaultSubject,
+		encrypter:                encrypter,
+		envelopeResponses:        config.EnvelopeResponses,
+		idempotencyScope:         config.IdempotencyScope,
+		idempotentResponses:      config.IdempotentResponses,
+		jsonCase:                 config.JSONCase,
+		logger:                   logger,
+		maxConcurrentRequests:    config.MaxConcurrentRequests,
+		maxRecipients:            config.MaxRecipients,
+		maxRequestBytes:          config.MaxRequestBytes,
+		maxUploadBytes:           config.MaxUploadBytes,
+		metrics:                  metrics,
+		purgeEnabled:             config.PurgeEnabled,
+		recipientDomainAllowlist: config.RecipientDomainAllowlist,
+		renderTemplatesAtSend:    config.RenderTemplatesAtSend,
+		requestTimeout:           config.RequestTimeout,
+		riverClient:              riverClient,
+		sendRates:                estimatedSendRates(config),
+		smtpSendRate:             config.SMTPSendRate,
+		spamPrecheck:             config.SpamPrecheck,
+		templates:                templates,
+		tracer:                   tracer,
+		txMaxRetries:             config.TxMaxRetries,
+
+		unsubscribeSecret: []byte(config.UnsubscribeSecret),
+	}
+	apiService.maintenanceMode.Store(config.MaintenanceMode)
+
 	server := &http.Server{
-		Addr: ":8080",
-		Handler: (&APIService{
-			begin:       dbPool.Begin,
-			riverClient: riverClient,
-		}).ServeMux(),
+		Addr:    config.ListenAddr,
+		Handler: accessLogHandler(apiService.ServeMux(), slog.New(slog.NewJSONHandler(accessLogWriter, nil))),
 
 		// Specified to prevent the "Slowloris" DOS attack, in which an attacker
 		// sends many partial requests to exhaust a target server's connections.
@@ -198,82 +2506,602 @@ func run(ctx context.Context) error {
 		// https://en.wikipedia.org/wiki/Slowloris_(computer_security)
 		ReadHeaderTimeout: 5 * time.Second,
 	}
-	fmt.Printf("Listening on %s\n", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+
+	if err := startRiverClient(ctx, riverClient); err != nil {
+		_ = listener.Close()
 		return err
 	}
 
+	fmt.Printf("Listening on %s\n", listener.Addr())
+
+	serveErrCh := make(chan error, 1)
+	go func() { serveErrCh <- serveHTTP(server, listener, config) }()
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+	case serveErr = <-serveErrCh:
+	}
+
+	// Stop taking new requests, then let jobs in progress finish. Jobs still
+	// running when time's up are cancelled, and will be retried when the
+	// service is next started.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		fmt.Fprintf(os.Stderr, "Error shutting down HTTP server: %s\n", err)
+	}
+
+	if err := riverClient.Stop(shutdownCtx); err != nil {
+		fmt.Fprintf(os.Stderr, "Error stopping River client gracefully: %s\n", err)
+		if err := riverClient.StopAndCancel(context.Background()); err != nil {
+			return err
+		}
+	}
+
+	return serveErr
+}
+
+// shutdownTimeout is how long in-flight requests and jobs have to finish on
+// shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// startRiverClient starts working jobs. Without it, emails would be queued
+// but never sent, so a failure to start is fatal instead of something the
+// service carries on in spite of.
+//
+// The client is started with a context that isn't cancelled along with ctx
+// because River stops abruptly, cancelling jobs in progress, when its start
+// context is cancelled. It's stopped gracefully on shutdown instead.
+func startRiverClient(ctx context.Context, riverClient *river.Client[pgx.Tx]) error {
+	if err := riverClient.Start(context.WithoutCancel(ctx)); err != nil {
+		return fmt.Errorf("error starting River client: %w", err)
+	}
 	return nil
 }
 
+// serveHTTP serves HTTP on listener, or HTTPS if a TLS certificate and key are
+// configured.
+func serveHTTP(server *http.Server, listener net.Listener, config *EnvConfig) error {
+	if config.TLSCertFile != "" {
+		return server.ServeTLS(listener, config.TLSCertFile, config.TLSKeyFile)
+	}
+	return server.Serve(listener)
+}
+
 type APIError struct {
-	Message    string `json:"message"`
-	StatusCode int    `json:"-"`
+	Code             string             `json:"error_code"` // stable, machine-readable identifier like `not_found`; one of the errorCode* constants
+	Message          string             `json:"message"`
+	RetryAfter       time.Duration      `json:"-"` // sent as a Retry-After header if set
+	StatusCode       int                `json:"-"`
+	ValidationErrors []*ValidationError `json:"validation_errors,omitempty"`
 }
 
 func (e *APIError) Error() string { return e.Message }
 
-var validate = validator.New() //nolint:gochecknoglobals
+// Error codes set in APIError.Code. Unlike messages, these don't change, so
+// clients can rely on them to tell errors apart.
+const (
+	errorCodeEmailFailed          = "email_failed"           // key's email was discarded or cancelled without being sent; see DEDUPE_FAILED_EMAILS
+	errorCodeIdempotencyKeyReuse  = "idempotency_key_reuse"  // key was already used for an email with different parameters
+	errorCodeInternalError        = "internal_error"         // anything unexpected; details are only logged
+	errorCodeInvalidRequest       = "invalid_request"        // malformed request, like bad JSON or a disallowed header
+	errorCodeInvalidState         = "invalid_state"          // email isn't in a state that allows the operation
+	errorCodeMaintenanceMode      = "maintenance_mode"       // new email isn't accepted during maintenance
+	errorCodeNotFound             = "not_found"              // email, suppression, or other resource doesn't exist
+	errorCodeOverloaded           = "overloaded"             // more requests are in progress than MAX_CONCURRENT_REQUESTS
+	errorCodePurgeDisabled        = "purge_disabled"         // account purges aren't allowed without PURGE_ENABLED
+	errorCodeRecipientNotAllowed  = "recipient_not_allowed"  // a recipient's domain isn't in RECIPIENT_DOMAIN_ALLOWLIST
+	errorCodeRecipientSuppressed  = "recipient_suppressed"   // recipient unsubscribed or is on a suppression list
+	errorCodeRequestTooLarge      = "request_too_large"      // request body is larger than MAX_REQUEST_BYTES, or a multipart form than MAX_UPLOAD_BYTES
+	errorCodeRequestTimeout       = "request_timeout"        // request took longer than REQUEST_TIMEOUT
+	errorCodeSenderNotAllowed     = "sender_not_allowed"     // sender isn't one of its account's or its domain isn't in ALLOWED_SENDER_DOMAINS
+	errorCodeSpamPrecheckFailed   = "spam_precheck_failed"   // content broke a rule of SPAM_PRECHECK; see ValidationErrors
+	errorCodeTemplateRenderFailed = "template_render_failed" // template data doesn't fit the template
+	errorCodeUnknownTemplate      = "unknown_template"       // no template with the given name
+	errorCodeUnsupportedMediaType = "unsupported_media_type" // request body isn't JSON
+	errorCodeValidationFailed     = "validation_failed"      // fields failed validation; see ValidationErrors
+)
+
+// ValidationError describes a single request field that failed validation.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	Rule    string `json:"rule"`
+}
+
+var validate = newValidator() //nolint:gochecknoglobals
+
+// newValidator makes a validator that reports fields by their JSON names so
+// that validation errors refer to fields the way API callers know them.
+func newValidator() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	// Message IDs are checked for the angle brackets that headers like
+	// `In-Reply-To` need them in, which are easy to forget.
+	_ = validate.RegisterValidation("message_id", func(fl validator.FieldLevel) bool {
+		return messageIDRE.MatchString(fl.Field().String())
+	})
+
+	return validate
+}
+
+// messageIDRE matches a message ID like `<id@example.com>`, as in RFC 5322's
+// msg-id, though it's more lenient about what's between the angle brackets.
+var messageIDRE = regexp.MustCompile(`^<[^<>@\s]+@[^<>@\s]+>$`) //nolint:gochecknoglobals
+
+// validateRequest validates a request struct, returning an APIError that
+// describes each of its invalid fields if it fails.
+func validateRequest(ctx context.Context, req any) error {
+	err := validate.StructCtx(ctx, req)
+	if err == nil {
+		return nil
+	}
+
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return err
+	}
+
+	apiErr := &APIError{Code: errorCodeValidationFailed, StatusCode: http.StatusBadRequest, Message: "Invalid parameters."}
+	for _, fieldErr := range validationErrs {
+		apiErr.ValidationErrors = append(apiErr.ValidationErrors, &ValidationError{
+			Field:   fieldErr.Field(),
+			Message: validationErrorMessage(fieldErr, reflect.TypeOf(req)),
+			Rule:    fieldErr.Tag(),
+		})
+	}
+	return apiErr
+}
+
+// validationErrorMessage produces a human readable message for a field that
+// failed validation.
+func validationErrorMessage(fieldErr validator.FieldError, reqType reflect.Type) string {
+	switch fieldErr.Tag() {
+	case "bcp47_language_tag":
+		return fieldErr.Field() + " must be a BCP 47 language tag like fr or pt-BR."
+	case "email":
+		return fieldErr.Field() + " must be a valid email address."
+	case "max":
+		if fieldErr.Kind() == reflect.Slice {
+			return fmt.Sprintf("%s must have at most %s items.", fieldErr.Field(), fieldErr.Param())
+		}
+		return fmt.Sprintf("%s must be at most %s.", fieldErr.Field(), fieldErr.Param())
+	case "message_id":
+		return fieldErr.Field() + " must be a message ID in angle brackets like <id@example.com>."
+	case "min":
+		if fieldErr.Kind() == reflect.Slice {
+			return fmt.Sprintf("%s must have at least %s items.", fieldErr.Field(), fieldErr.Param())
+		}
+		return fmt.Sprintf("%s must be at least %s.", fieldErr.Field(), fieldErr.Param())
+	case "oneof":
+		return fmt.Sprintf("%s must be one of: %s.", fieldErr.Field(), strings.Join(strings.Fields(fieldErr.Param()), ", "))
+	case "required":
+		return fieldErr.Field() + " is required."
+	case "required_without":
+		return fmt.Sprintf("%s is required unless %s is set.", fieldErr.Field(), jsonFieldName(reqType, fieldErr.Param()))
+	case "required_without_all":
+		var names []string
+		for fieldName := range strings.FieldsSeq(fieldErr.Param()) {
+			names = append(names, jsonFieldName(reqType, fieldName))
+		}
+		return fmt.Sprintf("%s is required unless %s is set.", fieldErr.Field(), strings.Join(names, " or "))
+	case "timezone":
+		return fieldErr.Field() + " must be an IANA time zone like America/New_York."
+	case "url":
+		return fieldErr.Field() + " must be a valid URL."
+	}
+	return fmt.Sprintf("%s failed validation rule %q.", fieldErr.Field(), fieldErr.Tag())
+}
+
+// jsonFieldName returns the JSON name of a request struct's field, for rules
+// like `required_without` whose parameter is another field's Go name.
+func jsonFieldName(reqType reflect.Type, fieldName string) string {
+	if reqType.Kind() == reflect.Pointer {
+		reqType = reqType.Elem()
+	}
+	if field, ok := reqType.FieldByName(fieldName); ok {
+		if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" && name != "-" {
+			return name
+		}
+	}
+	return fieldName
+}
+
+// RequestBinder is implemented by request structs that need values from the
+// incoming HTTP request beyond its JSON body, like path parameters. It's
+// invoked after the body is unmarshaled, but before validation.
+type RequestBinder interface {
+	BindRequest(r *http.Request) error
+}
+
+// ResponseStatusCoder is implemented by response structs that want to send a
+// status code other than 200 OK on success, like 201 Created. A zero status
+// code is treated as 200 OK.
+type ResponseStatusCoder interface {
+	ResponseStatusCode() int
+}
+
+// ResponseHeaderer is implemented by response structs that want to send
+// headers along with their body, like a `Location` for a created resource.
+// These are set before the status code is written, and a nil header sets
+// none.
+type ResponseHeaderer interface {
+	ResponseHeader() http.Header
+}
+
+// HandlerOpts are options for handlers made with MakeHandler.
+type HandlerOpts struct {
+	// Envelope wraps responses in an object like `{"data": ..., "error":
+	// null}`, with successful responses under `data` and errors under
+	// `error`, for API gateways that expect every response in one. Status
+	// codes are the same either way. Streamed responses, like the lines of
+	// NDJSON or the events of an event stream, aren't wrapped.
+	Envelope bool
+
+	// JSONCase is how keys in JSON responses are named, either JSONCaseCamel
+	// or JSONCaseSnake. Defaults to JSONCaseSnake.
+	JSONCase string
+
+	// MaxRequestBytes is the largest request body that MakeHandler reads,
+	// past which requests get a 413. Bodies aren't limited if it's zero.
+	MaxRequestBytes int
+}
+
+// handlerOpts returns the options of the service's handlers, including those
+// that aren't made with MakeHandler.
+func (s *APIService) handlerOpts() *HandlerOpts {
+	return &HandlerOpts{Envelope: s.envelopeResponses, JSONCase: s.jsonCase, MaxRequestBytes: s.maxRequestBytes}
+}
+
+// responseEnvelope is the envelope that responses are wrapped in with
+// HandlerOpts.Envelope. Only one of its fields is set, but both are always
+// sent.
+type responseEnvelope struct {
+	Data  any       `json:"data"`
+	Error *APIError `json:"error"`
+}
+
+// wrapResponse returns a successful response as it's marshaled for opts,
+// which is in an envelope if opts.Envelope is set.
+func wrapResponse(resp any, opts *HandlerOpts) any {
+	if !opts.Envelope {
+		return resp
+	}
+	return &responseEnvelope{Data: resp}
+}
+
+// wrapError is wrapResponse for an error.
+func wrapError(apiErr *APIError, opts *HandlerOpts) any {
+	if !opts.Envelope {
+		return apiErr
+	}
+	return &responseEnvelope{Error: apiErr}
+}
+
+// Namings of keys in JSON responses.
+const (
+	JSONCaseCamel = "camel" // like `emailRecipient`
+	JSONCaseSnake = "snake" // like `email_recipient`, as in the response structs' JSON tags
+)
+
+// marshalResponse marshals a response to JSON, renaming its keys to the given
+// case. Response structs are written with snake_case tags, so keys are only
+// renamed for JSONCaseCamel.
+func marshalResponse(resp any, jsonCase string) ([]byte, error) {
+	data, err := json.Marshal(resp)
+	if err != nil || jsonCase != JSONCaseCamel {
+		return data, err
+	}
+
+	// Round trips through generic values instead of maintaining separate
+	// structs with camelCase tags. UseNumber keeps numbers exactly as they
+	// were, like IDs too large for a float64.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(camelCaseKeys(value))
+}
+
+// camelCaseKeys renames the keys of every object in a decoded JSON value from
+// snake_case to camelCase.
+func camelCaseKeys(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		renamed := make(map[string]any, len(value))
+		for key, elem := range value {
+			renamed[snakeToCamel(key)] = camelCaseKeys(elem)
+		}
+		return renamed
+	case []any:
+		for i, elem := range value {
+			value[i] = camelCaseKeys(elem)
+		}
+		return value
+	}
+	return value
+}
+
+// snakeToCamel converts a snake_case name like `validation_errors` to
+// camelCase like `validationErrors`.
+func snakeToCamel(name string) string {
+	first, rest, ok := strings.Cut(name, "_")
+	if !ok {
+		return name
+	}
+
+	var sb strings.Builder
+	sb.WriteString(first)
+	for word := range strings.SplitSeq(rest, "_") {
+		if word == "" {
+			continue
+		}
+		sb.WriteString(strings.ToUpper(word[:1]))
+		sb.WriteString(word[1:])
+	}
+	return sb.String()
+}
 
 // MakeHandler makes an http.Handler that wraps a "service" function. A service
 // function is a higher level handler that takes a typed request struct and
 // returns a typed response struct along with an error. MakeHandler reads a
-// request body, unmarshals it to a typed request, validates the request,
+// request body, unmarshals it to a typed request, binds any extra request
+// values if the request implements RequestBinder, validates the request,
 // invokes the inner service function, marshals the response struct to JSON, and
-// writes it to the response.
-func MakeHandler[TReq any, TResp any](serviceFunc func(ctx context.Context, req *TReq) (*TResp, error)) http.Handler {
+// writes it to the response. An empty body is allowed for requests that take
+// all their parameters from elsewhere, like the URL path.
+func MakeHandler[TReq any, TResp any](serviceFunc func(ctx context.Context, req *TReq) (*TResp, error), opts *HandlerOpts) http.Handler {
+	if opts == nil {
+		opts = &HandlerOpts{}
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opts.MaxRequestBytes > 0 && r.Context().Value(requestBodyLimitedKey{}) == nil {
+			// A body that says it's too big is turned away before any of it
+			// is read. Chunked bodies don't say how big they are, so they're
+			// cut off once they've gone past the limit instead.
+			if r.ContentLength > int64(opts.MaxRequestBytes) {
+				writeErrorWithOpts(w, opts, errRequestTooLarge(opts.MaxRequestBytes))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, int64(opts.MaxRequestBytes))
+		}
+
 		reqData, err := io.ReadAll(r.Body)
 		if err != nil {
-			writeError(w, err)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				err = errRequestTooLarge(opts.MaxRequestBytes)
+			}
+			writeErrorWithOpts(w, opts, err)
 			return
 		}
 		defer r.Body.Close()
 
 		var req TReq
-		if err := json.Unmarshal(reqData, &req); err != nil {
-			writeError(w, &APIError{StatusCode: http.StatusBadRequest, Message: "Error unmarshaling request: " + err.Error()})
-			return
+		if len(reqData) > 0 {
+			if !isJSONContentType(r.Header.Get("Content-Type")) {
+				writeErrorWithOpts(w, opts, &APIError{Code: errorCodeUnsupportedMediaType, StatusCode: http.StatusUnsupportedMediaType, Message: "Request body must be JSON with a content type of application/json."})
+				return
+			}
+
+			if err := unmarshalRequest(reqData, &req); err != nil {
+				writeErrorWithOpts(w, opts, err)
+				return
+			}
+		}
+
+		if binder, ok := any(&req).(RequestBinder); ok {
+			if err := binder.BindRequest(r); err != nil {
+				writeErrorWithOpts(w, opts, err)
+				return
+			}
 		}
 
-		ctx := r.Context()
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
 
-		if err := validate.StructCtx(ctx, &req); err != nil {
-			writeError(w, &APIError{StatusCode: http.StatusBadRequest, Message: "Invalid parameters: " + err.Error()})
+		if err := validateRequest(ctx, &req); err != nil {
+			writeErrorWithOpts(w, opts, err)
 			return
 		}
 
 		resp, err := serviceFunc(ctx, &req)
 		if err != nil {
-			writeError(w, err)
+			writeErrorWithOpts(w, opts, err)
 			return
 		}
 
-		respData, err := json.Marshal(resp)
+		respData, err := marshalResponse(wrapResponse(resp, opts), opts.JSONCase)
 		if err != nil {
-			writeError(w, err)
+			writeErrorWithOpts(w, opts, err)
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if len(respData) >= gzipMinBytes && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			var buf bytes.Buffer
+			gzipWriter := gzip.NewWriter(&buf)
+			if _, err := gzipWriter.Write(respData); err != nil {
+				writeErrorWithOpts(w, opts, err)
+				return
+			}
+			if err := gzipWriter.Close(); err != nil {
+				writeErrorWithOpts(w, opts, err)
+				return
+			}
+
+			w.Header().Set("Content-Encoding", "gzip")
+			respData = buf.Bytes()
+		}
+
+		if headerer, ok := any(resp).(ResponseHeaderer); ok {
+			for name, values := range headerer.ResponseHeader() {
+				w.Header()[name] = values
+			}
+		}
+
+		if statusCoder, ok := any(resp).(ResponseStatusCoder); ok && statusCoder.ResponseStatusCode() != 0 {
+			w.WriteHeader(statusCoder.ResponseStatusCode())
+		}
+
 		if _, err := w.Write(respData); err != nil {
 			fmt.Fprintf(os.Stderr, "Error writing response: %s", err)
 		}
 	})
 }
 
+// requestBodyLimitedKey is a context key marking a request whose body was
+// already limited on its way in, like a multipart form that's been converted
+// into JSON, so that MakeHandler doesn't limit the body again by a size it
+// doesn't have on the wire.
+type requestBodyLimitedKey struct{}
+
+// errRequestTooLarge is returned for a request body that's larger than
+// limit.
+func errRequestTooLarge(limit int) *APIError {
+	return &APIError{
+		Code:       errorCodeRequestTooLarge,
+		Message:    fmt.Sprintf("Request body is larger than the limit of %d bytes.", limit),
+		StatusCode: http.StatusRequestEntityTooLarge,
+	}
+}
+
+// timeoutHandler answers requests that take longer than timeout with a 503
+// and cancels their context, so that a request stuck on a slow database rolls
+// back its transaction instead of committing after the client has given up.
+// Like http.TimeoutHandler, which it's built on, responses are buffered until
+// the handler finishes, so it's not for streaming. A zero timeout returns
+// handler unchanged.
+func timeoutHandler(handler http.Handler, timeout time.Duration, opts *HandlerOpts) http.Handler {
+	if timeout <= 0 {
+		return handler
+	}
+
+	// Marshaling an error made of strings can't fail.
+	errorData, _ := marshalResponse(wrapError(&APIError{
+		Code:       errorCodeRequestTimeout,
+		Message:    "Request timed out.",
+		StatusCode: http.StatusServiceUnavailable,
+	}, opts), opts.JSONCase)
+
+	timeoutHandler := http.TimeoutHandler(handler, timeout, string(errorData))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Headers set by the handler replace these when it finishes in time,
+		// so this is the content type of the timeout response only.
+		w.Header().Set("Content-Type", "application/json")
+		timeoutHandler.ServeHTTP(w, r)
+	})
+}
+
+// gzipMinBytes is the smallest response body that's compressed for clients
+// that accept gzip. Smaller bodies fit in a packet or two anyway, so
+// compressing them costs more than it saves.
+const gzipMinBytes = 1024
+
+// acceptsGzip returns true if the given Accept-Encoding header value allows a
+// gzip response, either by name or with a wildcard, and not with a q-value of
+// zero. Naming gzip takes precedence over the wildcard.
+func acceptsGzip(acceptEncoding string) bool {
+	var gzipAccepted, wildcardAccepted *bool
+	for coding := range strings.SplitSeq(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.TrimSpace(name)
+
+		accepted := true
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if qValue, err := strconv.ParseFloat(q, 64); err == nil && qValue == 0 {
+				accepted = false
+			}
+		}
+
+		switch {
+		case strings.EqualFold(name, "gzip"):
+			gzipAccepted = &accepted
+		case name == "*":
+			wildcardAccepted = &accepted
+		}
+	}
+
+	if gzipAccepted != nil {
+		return *gzipAccepted
+	}
+	return wildcardAccepted != nil && *wildcardAccepted
+}
+
+// unmarshalRequest unmarshals a JSON request body. Unlike json.Unmarshal, keys
+// that don't match a field are an error so that typos like `email_reciptient`
+// are caught instead of the field being silently left empty.
+func unmarshalRequest(data []byte, req any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(req); err != nil {
+		// encoding/json doesn't have a typed error for unknown fields.
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return &APIError{Code: errorCodeInvalidRequest, StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("Unknown field in request: %s.", field)}
+		}
+		return &APIError{Code: errorCodeInvalidRequest, StatusCode: http.StatusBadRequest, Message: "Error unmarshaling request: " + err.Error()}
+	}
+
+	// Decode stops after the first value, but json.Unmarshal would've
+	// rejected anything after it.
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return &APIError{Code: errorCodeInvalidRequest, StatusCode: http.StatusBadRequest, Message: "Error unmarshaling request: unexpected data after top-level value"}
+	}
+
+	return nil
+}
+
+// isJSONContentType returns true if the given Content-Type header value is
+// application/json, allowing for parameters like charset.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
 // writeError writes an APIError to w according to its status code and JSON
 // marshaled form. If err isn't an APIError, the error is logged and an internal
 // server error is sent back.
 func writeError(w http.ResponseWriter, err error) {
+	writeErrorWithOpts(w, &HandlerOpts{}, err)
+}
+
+// writeErrorWithOpts is writeError with the error's JSON written according
+// to the given options, like the responses of handlers made with MakeHandler.
+func writeErrorWithOpts(w http.ResponseWriter, opts *HandlerOpts, err error) {
 	var apiErr *APIError
 	if !errors.As(err, &apiErr) {
 		fmt.Fprintf(os.Stderr, "Internal error: %s\n", err)
-		apiErr = &APIError{StatusCode: http.StatusInternalServerError, Message: "Internal server error."}
+		apiErr = &APIError{Code: errorCodeInternalError, StatusCode: http.StatusInternalServerError, Message: "Internal server error."}
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	if apiErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(apiErr.RetryAfter.Seconds())))
+	}
 	w.WriteHeader(apiErr.StatusCode)
 
-	errorData, err := json.Marshal(apiErr)
+	errorData, err := marshalResponse(wrapError(apiErr, opts), opts.JSONCase)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error marshaling error JSON data: %s", err)
 		return
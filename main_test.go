@@ -3,20 +3,57 @@ package main
 import (
 	"bytes"
 	"cmp"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sethvargo/go-envconfig"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/time/rate"
 
 	"github.com/riverqueue/river"
 	"github.com/riverqueue/river/riverdriver/riverpgxv5"
 	"github.com/riverqueue/river/rivershared/riversharedtest"
+	"github.com/riverqueue/river/rivertype"
 )
 
 var testConfig = &EnvConfig{ //nolint:gochecknoglobals
@@ -25,6 +62,10 @@ var testConfig = &EnvConfig{ //nolint:gochecknoglobals
 	SMTPUser: "not-a-user",
 }
 
+// testTracer is a tracer that records nothing for tests that aren't checking
+// traces.
+var testTracer = tracenoop.NewTracerProvider().Tracer(tracerName) //nolint:gochecknoglobals
+
 func TestAPIServiceEmailCreate(t *testing.T) {
 	t.Parallel()
 
@@ -43,14 +84,16 @@ func TestAPIServiceEmailCreate(t *testing.T) {
 
 		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
 			TestOnly: true,
-			Workers:  makeWorkers(testConfig),
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
 		})
 		require.NoError(t, err)
 
 		return &testBundle{
 			apiServer: &APIService{
 				begin:       tx.Begin,
+				metrics:     newMetrics(),
 				riverClient: riverClient,
+				tracer:      testTracer,
 			},
 			tx: tx,
 		}, ctx
@@ -58,7 +101,7 @@ func TestAPIServiceEmailCreate(t *testing.T) {
 
 	var (
 		accountID      = uuid.New()
-		idempotencyKey = uuid.New()
+		idempotencyKey = uuid.NewString()
 	)
 
 	testArgs := func(overrides *HandleEmailCreateRequest) *HandleEmailCreateRequest {
@@ -68,11 +111,23 @@ func TestAPIServiceEmailCreate(t *testing.T) {
 
 		return &HandleEmailCreateRequest{
 			AccountID:      cmp.Or(overrides.AccountID, accountID),
+			Bcc:            overrides.Bcc,
 			Body:           cmp.Or(overrides.Body, "Hello from River's idempotent mail demo."),
+			BodyHTML:       overrides.BodyHTML,
+			Cc:             overrides.Cc,
+			Charset:        overrides.Charset,
 			EmailRecipient: cmp.Or(overrides.EmailRecipient, "receiver@example.com"),
 			EmailSender:    cmp.Or(overrides.EmailSender, "sender@example.com"),
+			Headers:        overrides.Headers,
 			IdempotencyKey: cmp.Or(overrides.IdempotencyKey, idempotencyKey),
+			InReplyTo:      overrides.InReplyTo,
+			References:     overrides.References,
+			ReplyTo:        overrides.ReplyTo,
+			ReturnPath:     overrides.ReturnPath,
+			SenderName:     overrides.SenderName,
 			Subject:        cmp.Or(overrides.Subject, "Hello."),
+			Track:          overrides.Track,
+			UnsubscribeURL: overrides.UnsubscribeURL,
 		}
 	}
 
@@ -83,7 +138,7 @@ func TestAPIServiceEmailCreate(t *testing.T) {
 
 		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
 		require.NoError(t, err)
-		require.Equal(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending."}, resp)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
 	})
 
 	t.Run("InsertsJobIdempotently", func(t *testing.T) {
@@ -93,11 +148,59 @@ func TestAPIServiceEmailCreate(t *testing.T) {
 
 		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
 		require.NoError(t, err)
-		require.Equal(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending."}, resp)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
 
 		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
 		require.NoError(t, err)
-		require.Equal(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send."}, resp)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+	})
+
+	t.Run("CountsDuplicates", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		require.Zero(t, testutil.ToFloat64(bundle.apiServer.metrics.emailsDuplicate.WithLabelValues("still_pending")))
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		require.InDelta(t, 1.0, testutil.ToFloat64(bundle.apiServer.metrics.emailsDuplicate.WithLabelValues("still_pending")), 0)
+		require.Zero(t, testutil.ToFloat64(bundle.apiServer.metrics.emailsDuplicate.WithLabelValues("already_sent")))
+
+		_, err = bundle.tx.Exec(ctx, "UPDATE river_job SET finalized_at = now(), state = 'completed' WHERE kind = $1", (SendEmailArgs{}).Kind())
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		require.InDelta(t, 1.0, testutil.ToFloat64(bundle.apiServer.metrics.emailsDuplicate.WithLabelValues("already_sent")), 0)
+	})
+
+	t.Run("RecordsSpan", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		exporter := tracetest.NewInMemoryExporter()
+		bundle.apiServer.tracer = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)).Tracer(tracerName)
+
+		// Simulate a trace started by an upstream service.
+		ctx, parentSpan := sdktrace.NewTracerProvider().Tracer(tracerName).Start(ctx, "upstream")
+		defer parentSpan.End()
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 1)
+		require.Equal(t, "EmailCreate insert", spans[0].Name)
+		require.Equal(t, parentSpan.SpanContext().TraceID(), spans[0].SpanContext.TraceID())
+
+		// The span's trace context is handed off to the job.
+		var traceParent string
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args->'trace_context'->>'traceparent' FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&traceParent))
+		require.Contains(t, traceParent, spans[0].SpanContext.SpanID().String())
 	})
 
 	t.Run("ReportsAlreadySent", func(t *testing.T) {
@@ -107,7 +210,7 @@ func TestAPIServiceEmailCreate(t *testing.T) {
 
 		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
 		require.NoError(t, err)
-		require.Equal(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending."}, resp)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
 
 		// Cheat a little by setting the job row directly to completed as if it
 		// it'd been worked by the background worker already.
@@ -116,7 +219,141 @@ func TestAPIServiceEmailCreate(t *testing.T) {
 
 		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
 		require.NoError(t, err)
-		require.Equal(t, &HandleEmailCreateResponse{Message: "Email has been sent."}, resp)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been sent.", StatusCode: http.StatusOK}, resp)
+	})
+
+	t.Run("KeyNotExpiredWhenNew", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+		require.False(t, resp.KeyExpired)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+	})
+
+	t.Run("KeyNotExpiredForDuplicate", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		require.False(t, resp.KeyExpired)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+	})
+
+	t.Run("KeyExpiredAfterDiscard", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+
+		firstResp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		// A discarded job is no longer deduplicated against, so the same key
+		// queues a new email.
+		_, err = bundle.tx.Exec(ctx, "UPDATE river_job SET finalized_at = now(), state = 'discarded' WHERE args->>'idempotency_key' = $1", req.IdempotencyKey)
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{KeyExpired: true, Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+		require.NotEqual(t, firstResp.Location, resp.Location)
+
+		data, err := json.Marshal(resp)
+		require.NoError(t, err)
+		require.Contains(t, string(data), `"key_expired":true`)
+	})
+
+	t.Run("KeyExpiredAfterJobCleanedUp", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		// Like CleanupEmailJobsWorker does after JOB_RETENTION, which leaves
+		// no earlier job to find.
+		_, err = bundle.tx.Exec(ctx, "DELETE FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey)
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{KeyExpired: true, Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+	})
+
+	t.Run("DedupeFailedEmailsDiscarded", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.dedupeFailedEmails = true
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+
+		firstResp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, firstResp)
+
+		// Cheat by setting the job row directly to discarded as if it'd run
+		// out of attempts.
+		_, err = bundle.tx.Exec(ctx, "UPDATE river_job SET attempt = 25, finalized_at = now(), state = 'discarded' WHERE args->>'idempotency_key' = $1", req.IdempotencyKey)
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{
+			Code:       errorCodeEmailFailed,
+			Message:    fmt.Sprintf("Email failed to send after 25 attempt(s) and was discarded. It won't be sent unless it's retried with POST %s/retry.", firstResp.Location),
+			StatusCode: http.StatusConflict,
+		}, err)
+		require.InDelta(t, 1.0, testutil.ToFloat64(bundle.apiServer.metrics.emailsDuplicate.WithLabelValues("discarded")), 0)
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&numJobs))
+		require.Equal(t, 1, numJobs)
+
+		// Once it's retried, it's pending like any other email.
+		jobID, err := strconv.ParseInt(strings.TrimPrefix(firstResp.Location, "/emails/"), 10, 64)
+		require.NoError(t, err)
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailRetry, &HandleEmailRetryRequest{ID: jobID})
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+	})
+
+	t.Run("DedupeFailedEmailsCancelled", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.dedupeFailedEmails = true
+
+		req := testArgs(&HandleEmailCreateRequest{AccountID: uuid.New(), IdempotencyKey: uuid.NewString()})
+
+		firstResp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCancelByAccount, &HandleCancelByAccountRequest{AccountID: req.AccountID})
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{
+			Code:       errorCodeEmailFailed,
+			Message:    fmt.Sprintf("Email was cancelled before it was sent. It won't be sent unless it's retried with POST %s/retry.", firstResp.Location),
+			StatusCode: http.StatusConflict,
+		}, err)
 	})
 
 	t.Run("UniqueVariesOnAccountID", func(t *testing.T) {
@@ -126,13 +363,50 @@ func TestAPIServiceEmailCreate(t *testing.T) {
 
 		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
 		require.NoError(t, err)
-		require.Equal(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending."}, resp)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
 
 		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{
 			AccountID: uuid.New(),
 		}))
 		require.NoError(t, err)
-		require.Equal(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending."}, resp)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+	})
+
+	t.Run("IdempotencyKeyScopedToAccount", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.dedupeByContentPeriod = 10 * time.Minute
+
+		var (
+			reqA = testArgs(nil)
+			reqB = testArgs(&HandleEmailCreateRequest{AccountID: uuid.New()})
+		)
+
+		// Both accounts use the same key for identical content, which are
+		// two different emails.
+		respA, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, reqA)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, respA)
+
+		respB, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, reqB)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, respB)
+		require.NotEqual(t, respA.Location, respB.Location)
+		require.NotEqual(t, respA.MessageID, respB.MessageID)
+
+		// Each account's retry dedupes against its own email only.
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, reqA)
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailCreateResponse{Location: respA.Location, Message: "Email was already queued and is pending send.", MessageID: respA.MessageID, StatusCode: http.StatusOK}, resp)
+
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, reqB)
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailCreateResponse{Location: respB.Location, Message: "Email was already queued and is pending send.", MessageID: respB.MessageID, StatusCode: http.StatusOK}, resp)
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&numJobs))
+		require.Equal(t, 2, numJobs)
 	})
 
 	t.Run("UniqueVariesOnIdempotencyKey", func(t *testing.T) {
@@ -142,129 +416,5136 @@ func TestAPIServiceEmailCreate(t *testing.T) {
 
 		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
 		require.NoError(t, err)
-		require.Equal(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending."}, resp)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
 
 		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{
-			IdempotencyKey: uuid.New(),
+			IdempotencyKey: uuid.NewString(),
 		}))
 		require.NoError(t, err)
-		require.Equal(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending."}, resp)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
 	})
 
-	// Unique depends on account ID and idempotency key only. Varying other
-	// fields results in a mismatched parameters error.
-	t.Run("MismatchedParametersError", func(t *testing.T) {
+	t.Run("ReplyTo", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.ReplyTo = "support@example.com"
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+	})
+
+	t.Run("MessageID", func(t *testing.T) {
 		t.Parallel()
 
 		bundle, ctx := setup(t)
 
 		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
 		require.NoError(t, err)
-		require.Equal(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending."}, resp)
+		require.Regexp(t, `^<[0-9a-f-]{36}@example\.com>$`, resp.MessageID)
+		messageID := resp.MessageID
 
-		// Test each field in its own API request to make sure a mismatch produces the expected error.
-		for _, overrides := range []*HandleEmailCreateRequest{
-			{Body: "A different body"},
-			{EmailRecipient: "different@example.com"},
-			{EmailSender: "different@example.com"},
-			{Subject: "A different subject"},
-		} {
-			_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(overrides))
-			require.Equal(t, &APIError{StatusCode: http.StatusBadRequest, Message: "Incoming parameters don't match those of queued email. You may have a bug."}, err)
-		}
+		var encodedArgs []byte
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&encodedArgs))
+
+		var storedArgs SendEmailArgs
+		require.NoError(t, json.Unmarshal(encodedArgs, &storedArgs))
+		require.Equal(t, messageID, storedArgs.MessageID)
+
+		// The email is sent with the Message-ID that was returned.
+		sender := &fakeEmailSender{}
+		worker := &SendEmailWorker{sender: sender, tracer: testTracer}
+		require.NoError(t, worker.Work(ctx, &river.Job[SendEmailArgs]{JobRow: &rivertype.JobRow{}, Args: storedArgs}))
+		require.Len(t, sender.sent, 1)
+		msg, err := mail.ReadMessage(bytes.NewReader(sender.sent[0].Message))
+		require.NoError(t, err)
+		require.Equal(t, messageID, msg.Header.Get("Message-ID"))
+
+		// Retries get the same one back.
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", MessageID: messageID, StatusCode: http.StatusOK}, resp)
 	})
-}
 
-// Integration tests that exercise the entire HTTP stack.
-func TestAPIServiceServeMux(t *testing.T) {
-	t.Parallel()
+	t.Run("MessageIDDuplicateFromBeforeMessageIDs", func(t *testing.T) {
+		t.Parallel()
 
-	type testBundle struct {
-		mux *http.ServeMux
-		tx  pgx.Tx
-	}
+		bundle, ctx := setup(t)
 
-	setup := func(t *testing.T) (*testBundle, context.Context) {
-		t.Helper()
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
 
-		var (
-			ctx = t.Context()
-			tx  = riversharedtest.TestTx(ctx, t)
-		)
+		// Emails queued before they had a Message-ID are still matched by
+		// their retries, which don't get one back.
+		_, err = bundle.tx.Exec(ctx, "UPDATE river_job SET args = args - 'message_id' WHERE kind = $1", (SendEmailArgs{}).Kind())
+		require.NoError(t, err)
 
-		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
-			TestOnly: true,
-			Workers:  makeWorkers(testConfig),
-		})
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
 		require.NoError(t, err)
+		require.Empty(t, resp.MessageID)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+	})
 
-		return &testBundle{
-			mux: (&APIService{
-				begin:       tx.Begin,
-				riverClient: riverClient,
-			}).ServeMux(),
-			tx: tx,
-		}, ctx
-	}
+	t.Run("ThreadingHeaders", func(t *testing.T) {
+		t.Parallel()
 
-	mustMarshalJSON := func(t *testing.T, value any) []byte {
-		t.Helper()
+		bundle, ctx := setup(t)
 
-		data, err := json.Marshal(value)
+		req := testArgs(nil)
+		req.InReplyTo = "<second@example.com>"
+		req.References = []string{"<first@example.com>", "<second@example.com>"}
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
 		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
 
-		return data
-	}
+		var encodedArgs []byte
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&encodedArgs))
 
-	requireStatus := func(t *testing.T, expected int, recorder *httptest.ResponseRecorder) {
-		t.Helper()
+		var storedArgs SendEmailArgs
+		require.NoError(t, json.Unmarshal(encodedArgs, &storedArgs))
+		require.Equal(t, "<second@example.com>", storedArgs.InReplyTo)
+		require.Equal(t, []string{"<first@example.com>", "<second@example.com>"}, storedArgs.References)
+	})
 
-		require.Equal(t, expected, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
-	}
+	t.Run("ThreadingHeadersWithoutAngleBrackets", func(t *testing.T) {
+		t.Parallel()
 
-	t.Run("EmailCreate", func(t *testing.T) {
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.InReplyTo = "second@example.com"
+		req.References = []string{"<first@example.com>", "<second@example.com> <third@example.com>"}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "in_reply_to", Message: "in_reply_to must be a message ID in angle brackets like <id@example.com>.", Rule: "message_id"},
+				{Field: "references[1]", Message: "references[1] must be a message ID in angle brackets like <id@example.com>.", Rule: "message_id"},
+			},
+		}, err)
+	})
+
+	t.Run("RawMessage", func(t *testing.T) {
 		t.Parallel()
 
-		bundle, _ := setup(t)
+		bundle, ctx := setup(t)
 
-		accountID := uuid.New()
+		rawMessage := []byte("From: Acme <sender@example.com>\r\n" +
+			"To: receiver@example.com\r\n" +
+			"Subject: Built elsewhere\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"\r\n" +
+			"Hello from a client that builds its own messages.\r\n")
 
-		recorder := httptest.NewRecorder()
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Bcc:            []string{"audit@example.com"},
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			RawMessage:     rawMessage,
+			ReturnPath:     "bounces@example.com",
+		})
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
 
-		bundle.mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/emails", bytes.NewReader(mustMarshalJSON(t, &HandleEmailCreateRequest{
-			AccountID:      accountID,
-			Body:           "Hello from River's idempotent mail demo.",
+		// Round trips through the job's args, where it's base64, to be sent
+		// byte for byte with the envelope taken from the fields.
+		var encodedArgs []byte
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&encodedArgs))
+
+		var args SendEmailArgs
+		require.NoError(t, json.Unmarshal(encodedArgs, &args))
+
+		sender := &fakeEmailSender{}
+		worker := &SendEmailWorker{sender: sender, tracer: testTracer}
+		require.NoError(t, worker.Work(ctx, &river.Job[SendEmailArgs]{JobRow: &rivertype.JobRow{ID: 123}, Args: args}))
+		require.Equal(t, []*fakeSentEmail{{
+			From:    "bounces@example.com",
+			To:      []string{"receiver@example.com", "audit@example.com"},
+			Message: rawMessage,
+		}}, sender.sent)
+	})
+
+	t.Run("RawMessageWithContent", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		for _, overrides := range []*HandleEmailCreateRequest{
+			{Body: "Hello."},
+			{Subject: "Hello."},
+			{Template: "welcome"},
+			{Headers: map[string]string{"X-Campaign": "spring"}},
+			{InReplyTo: "<first@example.com>"},
+			{Track: true},
+		} {
+			req := &HandleEmailCreateRequest{
+				AccountID:      uuid.New(),
+				Body:           overrides.Body,
+				EmailRecipient: "receiver@example.com",
+				EmailSender:    "sender@example.com",
+				Headers:        overrides.Headers,
+				IdempotencyKey: uuid.NewString(),
+				InReplyTo:      overrides.InReplyTo,
+				RawMessage:     []byte("Subject: Hello.\r\n\r\nHello.\r\n"),
+				Subject:        overrides.Subject,
+				Template:       overrides.Template,
+				Track:          overrides.Track,
+			}
+
+			_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+			require.Equal(t, &APIError{
+				Code:       "invalid_request",
+				Message:    "raw_message can't be set along with body, body_html, charset, headers, in_reply_to, references, reply_to, sender_name, subject, template, track, or unsubscribe_url.",
+				StatusCode: http.StatusBadRequest,
+			}, err)
+		}
+	})
+
+	t.Run("RawMessageMalformed", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
 			EmailRecipient: "receiver@example.com",
 			EmailSender:    "sender@example.com",
-			IdempotencyKey: uuid.New(),
-			Subject:        "Hello.",
-		}))))
-		requireStatus(t, http.StatusOK, recorder)
-		require.Equal(t,
-			string(mustMarshalJSON(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending."})),
-			recorder.Body.String(),
+			IdempotencyKey: uuid.NewString(),
+			RawMessage:     []byte("not a message"),
+		})
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+		require.Contains(t, apiErr.Message, "raw_message isn't a valid RFC 822 message: ")
+	})
+
+	t.Run("MaxRecipients", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.maxRecipients = 3
+
+		// The recipient plus a cc and a bcc is right at the limit.
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{
+			Bcc: []string{"audit@example.com"},
+			Cc:  []string{"manager@example.com"},
+		}))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+
+		var (
+			bcc []string
+			cc  []string
 		)
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args->'bcc', args->'cc' FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&bcc, &cc))
+		require.Equal(t, []string{"audit@example.com"}, bcc)
+		require.Equal(t, []string{"manager@example.com"}, cc)
 	})
-}
 
-// invokeHandler invokes a service handler and returns its results.
-//
-// Service handlers are normal functions and can be invoked directly, but it's
-// preferable to invoke them with this function because a few extra niceties are
-// observed that are normally only available from the API framework:
-//
-//   - Incoming request structs are validated and an API error is emitted in case
-//     they're invalid (any `validate` tags are checked).
-//   - Outgoing response structs are validated.
-//
-// Sample invocation:
-//
-//	endpoint := &testEndpoint{}
-//	resp, err := apitest.InvokeHandler(ctx, endpoint.Execute, &testRequest{ReqField: "string"})
-//	require.NoError(t, err)
-func invokeHandler[TReq any, TResp any](ctx context.Context, handler func(context.Context, *TReq) (*TResp, error), req *TReq) (*TResp, error) {
-	if err := validate.StructCtx(ctx, req); err != nil {
-		return nil, &APIError{StatusCode: http.StatusBadRequest, Message: "Invalid parameters: " + err.Error()}
+	t.Run("MaxRecipientsExceeded", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.maxRecipients = 3
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{
+			Bcc: []string{"audit@example.com"},
+			Cc:  []string{"manager@example.com", "team@example.com"},
+		}))
+		require.Equal(t, &APIError{
+			Code:       "invalid_request",
+			Message:    "Email has 4 recipients including cc and bcc, but at most 3 are allowed.",
+			StatusCode: http.StatusBadRequest,
+		}, err)
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&numJobs))
+		require.Zero(t, numJobs)
+	})
+
+	t.Run("Charset", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(&HandleEmailCreateRequest{Body: "Café ouvert."})
+		req.Charset = "latin1"
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+
+		// Stored under its canonical name.
+		var charset string
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args->>'charset' FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&charset))
+		require.Equal(t, "iso-8859-1", charset)
+	})
+
+	t.Run("CharsetUnsupported", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.Charset = "klingon"
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{Code: "invalid_request", Message: `Unsupported charset "klingon".`, StatusCode: http.StatusBadRequest}, err)
+	})
+
+	t.Run("CharsetUnrepresentable", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(&HandleEmailCreateRequest{Body: "Hello 👋"})
+		req.Charset = "iso-8859-1"
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{Code: "invalid_request", Message: "Body contains characters that can't be represented in charset iso-8859-1.", StatusCode: http.StatusBadRequest}, err)
+	})
+
+	t.Run("ReplyToInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.ReplyTo = "not-an-email"
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "reply_to", Message: "reply_to must be a valid email address.", Rule: "email"},
+			},
+		}, err)
+	})
+
+	t.Run("MissingRequiredFields", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      accountID,
+			EmailRecipient: "receiver@example.com",
+			IdempotencyKey: idempotencyKey,
+		})
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "body", Message: "body is required unless template or raw_message is set.", Rule: "required_without_all"},
+				{Field: "subject", Message: "subject is required unless template or raw_message is set.", Rule: "required_without_all"},
+			},
+		}, err)
+	})
+
+	t.Run("DefaultCopyExplicit", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.defaultBody = "Your order has shipped."
+		bundle.apiServer.defaultSubject = "Order update"
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		var body, subject string
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args->>'body', args->>'subject' FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&body, &subject))
+		require.Equal(t, "Hello from River's idempotent mail demo.", body)
+		require.Equal(t, "Hello.", subject)
+	})
+
+	t.Run("DefaultCopyFallback", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.defaultBody = "Your order has shipped."
+		bundle.apiServer.defaultSubject = "Order update"
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+		req.Body, req.Subject = "", ""
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+
+		var body, subject string
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args->>'body', args->>'subject' FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&body, &subject))
+		require.Equal(t, "Your order has shipped.", body)
+		require.Equal(t, "Order update", subject)
+
+		// Naming the defaults explicitly is the same email, but different
+		// copy under the same key is a conflict.
+		req.Body, req.Subject = "Your order has shipped.", "Order update"
+
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+
+		req.Subject = "Something else"
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, errMismatchedParameters, err)
+	})
+
+	t.Run("DefaultCopyMissing", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.defaultSubject = "Order update"
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+		req.Body, req.Subject = "", ""
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "body", Message: "body is required unless template or raw_message is set.", Rule: "required_without_all"},
+			},
+		}, err)
+	})
+
+	t.Run("DefaultCopyNotUsedForTemplate", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.defaultBody = "Your order has shipped."
+		bundle.apiServer.defaultSubject = "Order update"
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+		req.Body, req.Subject, req.Template = "", "", "no_such_template"
+
+		// The template is what's used, rather than the defaults being
+		// rejected for being set along with it.
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, errorCodeUnknownTemplate, apiErr.Code)
+	})
+
+	t.Run("SenderExplicit", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.defaultSender = "default@example.com"
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		var emailSender string
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args->>'email_sender' FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&emailSender))
+		require.Equal(t, "sender@example.com", emailSender)
+	})
+
+	t.Run("SenderDomainAllowed", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.allowedSenderDomains = []string{"example.com", "example.org"}
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{EmailSender: "sender@EXAMPLE.com", IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+
+	t.Run("SenderDomainNotAllowed", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.allowedSenderDomains = []string{"example.org"}
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{Code: errorCodeSenderNotAllowed, Message: `Sending from domain "example.com" isn't allowed.`, StatusCode: http.StatusForbidden}, err)
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&numJobs))
+		require.Zero(t, numJobs)
+
+		// Subdomains must be allowed in their own right.
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{EmailSender: "sender@mail.example.org", IdempotencyKey: uuid.NewString()}))
+		require.Equal(t, &APIError{Code: errorCodeSenderNotAllowed, Message: `Sending from domain "mail.example.org" isn't allowed.`, StatusCode: http.StatusForbidden}, err)
+	})
+
+	t.Run("AccountSenderDefault", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.defaultSender = "default@example.com"
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+		req.EmailSender = ""
+		bundle.apiServer.accountSenders = map[uuid.UUID][]string{req.AccountID: {"billing@example.com"}}
+
+		// The account's only sender is used ahead of DEFAULT_SENDER.
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		var emailSender string
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args->>'email_sender' FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&emailSender))
+		require.Equal(t, "billing@example.com", emailSender)
+
+		// Naming it explicitly is allowed too, in any case.
+		explicitReq := testArgs(&HandleEmailCreateRequest{AccountID: req.AccountID, EmailSender: "Billing@example.com", IdempotencyKey: uuid.NewString()})
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, explicitReq)
+		require.NoError(t, err)
+	})
+
+	t.Run("AccountSenderNotAllowed", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+		bundle.apiServer.accountSenders = map[uuid.UUID][]string{req.AccountID: {"billing@example.com", "support@example.com"}}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{Code: errorCodeSenderNotAllowed, Message: `Account isn't allowed to send from "sender@example.com".`, StatusCode: http.StatusForbidden}, err)
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&numJobs))
+		require.Zero(t, numJobs)
+
+		// Accounts with more than one sender must name which to use.
+		req = testArgs(&HandleEmailCreateRequest{AccountID: req.AccountID, IdempotencyKey: uuid.NewString()})
+		req.EmailSender = ""
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, errorCodeValidationFailed, apiErr.Code)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{AccountID: req.AccountID, EmailSender: "support@example.com", IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+
+	t.Run("SpamPrecheckReject", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.spamPrecheck = SpamPrecheckReject
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString(), Subject: "   "})
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, errorCodeSpamPrecheckFailed, apiErr.Code)
+		require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+		require.Equal(t, []*ValidationError{{Field: "subject", Message: "subject is empty or only whitespace.", Rule: spamRuleEmptySubject}}, apiErr.ValidationErrors)
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&numJobs))
+		require.Zero(t, numJobs)
+
+		// Flagged emails are queued anyway.
+		bundle.apiServer.spamPrecheck = SpamPrecheckFlag
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+
+	t.Run("AccountSendersUnrestricted", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.accountSenders = map[uuid.UUID][]string{uuid.New(): {"billing@example.com"}}
+
+		// Accounts that aren't listed may send from any address.
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+
+	t.Run("SenderDomainsEmptyAllowsAll", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.allowedSenderDomains = nil
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{EmailSender: "sender@anything.example.net", IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+
+	t.Run("RecipientDomainAllowed", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.recipientDomainAllowlist = []string{"example.com", "example.org"}
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{Cc: []string{"manager@example.org"}, EmailRecipient: "receiver@EXAMPLE.com", IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+
+	t.Run("RecipientDomainNotAllowed", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.recipientDomainAllowlist = []string{"example.com"}
+
+		req := testArgs(&HandleEmailCreateRequest{EmailRecipient: "customer@gmail.com", IdempotencyKey: uuid.NewString()})
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{Code: errorCodeRecipientNotAllowed, Message: `Sending to domain "gmail.com" isn't allowed.`, StatusCode: http.StatusForbidden}, err)
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&numJobs))
+		require.Zero(t, numJobs)
+
+		// Copies are checked the same as the recipient.
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{Bcc: []string{"customer@example.net"}, IdempotencyKey: uuid.NewString()}))
+		require.Equal(t, &APIError{Code: errorCodeRecipientNotAllowed, Message: `Sending to domain "example.net" isn't allowed.`, StatusCode: http.StatusForbidden}, err)
+	})
+
+	t.Run("RecipientDomainsEmptyAllowsAll", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.recipientDomainAllowlist = nil
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{EmailRecipient: "customer@anything.example.net", IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+
+	t.Run("SenderDefault", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.defaultSender = "default@example.com"
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+		req.EmailSender = ""
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+
+		var emailSender string
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args->>'email_sender' FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&emailSender))
+		require.Equal(t, "default@example.com", emailSender)
+
+		// Naming the default explicitly is the same email.
+		req.EmailSender = "default@example.com"
+
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+	})
+
+	t.Run("SenderMissing", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.EmailSender = ""
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "email_sender", Message: "email_sender is required when DEFAULT_SENDER isn't configured.", Rule: "required"},
+			},
+		}, err)
+	})
+
+	t.Run("SenderInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.EmailSender = "not-an-email"
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "email_sender", Message: "email_sender must be a valid email address.", Rule: "email"},
+			},
+		}, err)
+	})
+
+	t.Run("EnrichEmail", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.enrichEmail = func(args *SendEmailArgs, opts *river.InsertOpts) {
+			if args.Headers == nil {
+				args.Headers = make(map[string]string)
+			}
+			args.Headers["X-Environment"] = "test"
+			opts.Tags = append(opts.Tags, "enriched")
+		}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+
+		var (
+			headers map[string]string
+			tags    []string
+		)
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args->'headers', tags FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&headers, &tags))
+		require.Equal(t, map[string]string{"X-Environment": "test"}, headers)
+		require.Equal(t, []string{"enriched"}, tags)
+	})
+
+	t.Run("MissingRecipient", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.EmailRecipient = ""
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "email_recipient", Message: "email_recipient is required unless recipients is set.", Rule: "required_without"},
+			},
+		}, err)
+	})
+
+	t.Run("Recipients", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+		req.EmailRecipient = ""
+		req.Recipients = []string{"a@example.com", "b@example.com", "c@example.com"}
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailCreateResponse{
+			Jobs:       &HandleEmailCreateJobCounts{Queued: 3},
+			Message:    "3 email(s) queued for sending; 0 already queued; 0 suppressed.",
+			StatusCode: http.StatusCreated,
+		}, resp)
+
+		rows, err := bundle.tx.Query(ctx, "SELECT args->>'email_recipient', args->>'idempotency_key' FROM river_job WHERE kind = $1 ORDER BY id", (SendEmailArgs{}).Kind())
+		require.NoError(t, err)
+		type recipientKey struct{ recipient, key string }
+		recipientKeys, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (recipientKey, error) {
+			var rk recipientKey
+			err := row.Scan(&rk.recipient, &rk.key)
+			return rk, err
+		})
+		require.NoError(t, err)
+		require.Equal(t, []recipientKey{
+			{"a@example.com", req.IdempotencyKey + ":a@example.com"},
+			{"b@example.com", req.IdempotencyKey + ":b@example.com"},
+			{"c@example.com", req.IdempotencyKey + ":c@example.com"},
+		}, recipientKeys)
+	})
+
+	t.Run("RecipientsBatchJitter", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.batchJitter = time.Hour
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+		req.EmailRecipient = ""
+		for i := range 20 {
+			req.Recipients = append(req.Recipients, fmt.Sprintf("recipient%d@example.com", i))
+		}
+
+		start := time.Now()
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		rows, err := bundle.tx.Query(ctx, "SELECT scheduled_at FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind())
+		require.NoError(t, err)
+		scheduledAts, err := pgx.CollectRows(rows, pgx.RowTo[time.Time])
+		require.NoError(t, err)
+		require.Len(t, scheduledAts, 20)
+
+		// All within the window, and spread across it rather than bunched
+		// together. With 20 uniform samples, the chance that they all land
+		// within a quarter of the window is vanishingly small.
+		for _, scheduledAt := range scheduledAts {
+			require.WithinRange(t, scheduledAt, start.Add(-time.Second), start.Add(time.Hour+time.Second))
+		}
+		require.Greater(t, slices.MaxFunc(scheduledAts, time.Time.Compare).Sub(slices.MinFunc(scheduledAts, time.Time.Compare)), 15*time.Minute)
+
+		// Jitter doesn't affect uniqueness, so the same request is
+		// deduplicated.
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailCreateJobCounts{Duplicate: 20}, resp.Jobs)
+	})
+
+	t.Run("BatchJitterNotForSingleEmail", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.batchJitter = time.Hour
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		var scheduledAt time.Time
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT scheduled_at FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&scheduledAt))
+		require.WithinDuration(t, time.Now(), scheduledAt, time.Minute)
+	})
+
+	t.Run("RecipientsDedupeIndependently", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+		req.EmailRecipient = ""
+		req.Recipients = []string{"a@example.com", "b@example.com"}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		// A retry that adds a recipient only queues an email for the new one.
+		req.Recipients = []string{"a@example.com", "b@example.com", "c@example.com", "c@example.com"}
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailCreateResponse{
+			Jobs:       &HandleEmailCreateJobCounts{Duplicate: 2, Queued: 1},
+			Message:    "1 email(s) queued for sending; 2 already queued; 0 suppressed.",
+			StatusCode: http.StatusCreated,
+		}, resp)
+
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailCreateJobCounts{Duplicate: 3}, resp.Jobs)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("RecipientsSkipsSuppressed", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(&HandleEmailCreateRequest{AccountID: uuid.New()})
+		req.EmailRecipient = ""
+		req.Recipients = []string{"a@example.com", "b@example.com"}
+
+		_, err := bundle.tx.Exec(ctx, "INSERT INTO suppressions (account_id, email, reason) VALUES ($1, $2, $3)", req.AccountID, "b@example.com", suppressionReasonManual)
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailCreateJobCounts{Queued: 1, Suppressed: 1}, resp.Jobs)
+	})
+
+	t.Run("RecipientsWithEmailRecipient", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.Recipients = []string{"a@example.com"}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{Code: "invalid_request", Message: "Only one of email_recipient or recipients may be set.", StatusCode: http.StatusBadRequest}, err)
+	})
+
+	t.Run("RecipientsInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.EmailRecipient = ""
+		req.Recipients = []string{"a@example.com", "not-an-email"}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "recipients[1]", Message: "recipients[1] must be a valid email address.", Rule: "email"},
+			},
+		}, err)
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.DryRun = true
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailCreateResponse{Message: "Validation passed; no email queued.", StatusCode: http.StatusOK}, resp)
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&numJobs))
+		require.Zero(t, numJobs)
+
+		// A real send afterwards isn't considered a duplicate.
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+	})
+
+	t.Run("DryRunValidationError", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.DryRun = true
+		req.Headers = map[string]string{"From": "attacker@example.com"}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{Code: "invalid_request", StatusCode: http.StatusBadRequest, Message: `Header "From" can't be set as a custom header.`}, err)
+
+		req = testArgs(nil)
+		req.DryRun = true
+		req.Subject = ""
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "subject", Message: "subject is required unless template or raw_message is set.", Rule: "required_without_all"},
+			},
+		}, err)
+	})
+
+	t.Run("CustomHeaders", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.Headers = map[string]string{"X-Campaign-ID": "spring-sale"}
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+	})
+
+	t.Run("CustomHeaderDenied", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.Headers = map[string]string{"subject": "Overridden subject"}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{Code: "invalid_request", StatusCode: http.StatusBadRequest, Message: `Header "subject" can't be set as a custom header.`}, err)
+	})
+
+	t.Run("CustomHeaderInvalidName", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		for _, name := range []string{"", "X Campaign", "X-Campaign:ID", "X-Campaign-ÏD"} {
+			req := testArgs(nil)
+			req.Headers = map[string]string{name: "spring-sale"}
+
+			_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+			require.Equal(t, &APIError{Code: "invalid_request", StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("Invalid header name %q.", name)}, err)
+		}
+	})
+
+	t.Run("CustomHeaderValueWithLineBreak", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.Headers = map[string]string{"X-Campaign-ID": "spring-sale\r\nBcc: attacker@example.com"}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{Code: "invalid_request", StatusCode: http.StatusBadRequest, Message: `Value of header "X-Campaign-ID" may not contain line breaks.`}, err)
+	})
+
+	t.Run("QueueByPriority", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		for _, tt := range []struct {
+			priority string
+			queue    string
+		}{
+			{priority: "", queue: queueTransactional},
+			{priority: PriorityBulk, queue: queueBulk},
+			{priority: PriorityTransactional, queue: queueTransactional},
+		} {
+			req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+			req.Priority = tt.priority
+
+			_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+			require.NoError(t, err)
+
+			var queue string
+			require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT queue FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&queue))
+			require.Equal(t, tt.queue, queue, "Unexpected queue for priority %q", tt.priority)
+		}
+	})
+
+	t.Run("PriorityNotPartOfUniqueness", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+
+		req := testArgs(nil)
+		req.Priority = PriorityBulk
+
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+	})
+
+	t.Run("JobPriority", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		for _, tt := range []struct {
+			jobPriority         int
+			expectedJobPriority int
+		}{
+			{jobPriority: 0, expectedJobPriority: jobPriorityNormal},
+			{jobPriority: 1, expectedJobPriority: 1},
+			{jobPriority: 4, expectedJobPriority: 4},
+		} {
+			req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+			req.JobPriority = tt.jobPriority
+
+			_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+			require.NoError(t, err)
+
+			var priority int
+			require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT priority FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&priority))
+			require.Equal(t, tt.expectedJobPriority, priority, "Unexpected priority for job priority %d", tt.jobPriority)
+		}
+	})
+
+	t.Run("JobPriorityOutOfRange", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		for _, tt := range []struct {
+			jobPriority     int
+			validationError *ValidationError
+		}{
+			{jobPriority: -1, validationError: &ValidationError{Field: "job_priority", Message: "job_priority must be at least 1.", Rule: "min"}},
+			{jobPriority: 5, validationError: &ValidationError{Field: "job_priority", Message: "job_priority must be at most 4.", Rule: "max"}},
+		} {
+			req := testArgs(nil)
+			req.JobPriority = tt.jobPriority
+
+			_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+			require.Equal(t, &APIError{
+				Code:             "validation_failed",
+				Message:          "Invalid parameters.",
+				StatusCode:       http.StatusBadRequest,
+				ValidationErrors: []*ValidationError{tt.validationError},
+			}, err)
+		}
+	})
+
+	t.Run("JobPriorityNotPartOfUniqueness", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+
+		req := testArgs(nil)
+		req.JobPriority = 1
+
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+	})
+
+	t.Run("QuietHoursAllowed", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.Priority = PriorityBulk
+		req.TimeZone = zoneWithLocalHour(time.Now(), 12)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		var (
+			scheduledAt time.Time
+			state       rivertype.JobState
+		)
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT scheduled_at, state FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&scheduledAt, &state))
+		require.Equal(t, rivertype.JobStateAvailable, state)
+		require.WithinDuration(t, time.Now(), scheduledAt, time.Minute)
+	})
+
+	t.Run("QuietHoursDeferred", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		var (
+			now = time.Now()
+			req = testArgs(nil)
+		)
+		req.Priority = PriorityBulk
+		req.TimeZone = zoneWithLocalHour(now, 2)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		var (
+			scheduledAt time.Time
+			state       rivertype.JobState
+		)
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT scheduled_at, state FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&scheduledAt, &state))
+		require.Equal(t, rivertype.JobStateScheduled, state)
+
+		loc, err := time.LoadLocation(req.TimeZone)
+		require.NoError(t, err)
+
+		localNow := now.In(loc)
+		require.Equal(t, time.Date(localNow.Year(), localNow.Month(), localNow.Day(), 8, 0, 0, 0, loc).UTC(), scheduledAt.UTC())
+	})
+
+	t.Run("QuietHoursTransactionalBypass", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.Priority = PriorityTransactional
+		req.TimeZone = zoneWithLocalHour(time.Now(), 2)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		var state rivertype.JobState
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT state FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&state))
+		require.Equal(t, rivertype.JobStateAvailable, state)
+	})
+
+	t.Run("SendAtScheduledQueue", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.SendAt = time.Now().Add(72 * time.Hour).Truncate(time.Second)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		var (
+			queue       string
+			scheduledAt time.Time
+			state       rivertype.JobState
+		)
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT queue, scheduled_at, state FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&queue, &scheduledAt, &state))
+		require.Equal(t, queueScheduled, queue)
+		require.Equal(t, rivertype.JobStateScheduled, state)
+		require.WithinDuration(t, req.SendAt, scheduledAt, time.Millisecond)
+	})
+
+	t.Run("ImmediateDefaultQueue", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		// A send_at that's already passed is sent right away like any other.
+		for _, sendAt := range []time.Time{{}, time.Now().Add(-time.Hour)} {
+			req := testArgs(nil)
+			req.SendAt = sendAt
+
+			_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+			require.NoError(t, err)
+
+			var queue string
+			require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT queue FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&queue))
+			require.Equal(t, queueTransactional, queue)
+		}
+	})
+
+	t.Run("SendAtBulkStaysBulk", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.Priority = PriorityBulk
+		req.SendAt = time.Now().Add(72 * time.Hour)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		var (
+			queue string
+			state rivertype.JobState
+		)
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT queue, state FROM river_job WHERE args->>'idempotency_key' = $1", req.IdempotencyKey).Scan(&queue, &state))
+		require.Equal(t, queueBulk, queue)
+		require.Equal(t, rivertype.JobStateScheduled, state)
+	})
+
+	t.Run("EstimatedSendAtScheduled", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.SendAt = time.Now().Add(72 * time.Hour).Truncate(time.Second)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		require.NotNil(t, resp.EstimatedSendAt)
+		require.WithinDuration(t, req.SendAt, *resp.EstimatedSendAt, time.Millisecond)
+	})
+
+	t.Run("EstimatedSendAtImmediate", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.sendRates = map[string]float64{queueTransactional: 1}
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+		require.NotNil(t, resp.EstimatedSendAt)
+		require.WithinDuration(t, time.Now(), *resp.EstimatedSendAt, 5*time.Second)
+
+		// The next email waits behind the first, at one email a second.
+		nextResp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+		require.NotNil(t, nextResp.EstimatedSendAt)
+		require.WithinDuration(t, resp.EstimatedSendAt.Add(time.Second), *nextResp.EstimatedSendAt, 500*time.Millisecond)
+	})
+
+	t.Run("TimeZoneInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.TimeZone = "Mars/Olympus_Mons"
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "time_zone", Message: "time_zone must be an IANA time zone like America/New_York.", Rule: "timezone"},
+			},
+		}, err)
+	})
+
+	t.Run("PriorityInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		req.Priority = "urgent"
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "priority", Message: "priority must be one of: bulk, transactional.", Rule: "oneof"},
+			},
+		}, err)
+	})
+
+	t.Run("NonUUIDIdempotencyKey", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		const ulidKey = "01ARZ3NDEKTSV4RRFFQ69G5FAV"
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: ulidKey}))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: ulidKey}))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: "01ARZ3NDEKTSV4RRFFQ69G5FAW"}))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+	})
+
+	t.Run("IdempotencyKeyTooLong", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: strings.Repeat("x", 256)}))
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "idempotency_key", Message: "idempotency_key must be at most 255.", Rule: "max"},
+			},
+		}, err)
+	})
+
+	// Unique depends on account ID and idempotency key only. Varying other
+	// fields results in a mismatched parameters error.
+	t.Run("RetriesTransientCommitFailure", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.txMaxRetries = 3
+
+		// The first commit fails like it would if the transaction conflicted
+		// with another one, rolling back its insert.
+		var numBegins int
+		begin := bundle.apiServer.begin
+		bundle.apiServer.begin = func(ctx context.Context) (pgx.Tx, error) {
+			numBegins++
+			tx, err := begin(ctx)
+			if err != nil || numBegins > 1 {
+				return tx, err
+			}
+			return &failingCommitTx{Tx: tx, err: &pgconn.PgError{Code: "40001"}}, nil
+		}
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+		require.Equal(t, 2, numBegins)
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&numJobs))
+		require.Equal(t, 1, numJobs)
+	})
+
+	t.Run("NonRetryableCommitFailure", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.txMaxRetries = 3
+
+		var numBegins int
+		begin := bundle.apiServer.begin
+		bundle.apiServer.begin = func(ctx context.Context) (pgx.Tx, error) {
+			numBegins++
+			tx, err := begin(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return &failingCommitTx{Tx: tx, err: errors.New("commit failed")}, nil
+		}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.EqualError(t, err, "commit failed")
+		require.Equal(t, 1, numBegins)
+	})
+
+	t.Run("RequestTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.requestTimeout = 50 * time.Millisecond
+
+		// A database so slow that beginning a transaction takes longer than
+		// the timeout. It only returns once the request's context is canceled.
+		beginReturned := make(chan struct{})
+		bundle.apiServer.begin = func(ctx context.Context) (pgx.Tx, error) {
+			defer close(beginReturned)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		reqData, err := json.Marshal(testArgs(nil))
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/emails", bytes.NewReader(reqData))
+		req.Header.Set("Content-Type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		bundle.apiServer.ServeMux().ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		require.JSONEq(t, `{"error_code":"request_timeout","message":"Request timed out."}`, recorder.Body.String())
+
+		select {
+		case <-beginReturned:
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "Timed out waiting for begin to see its context canceled")
+		}
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&numJobs))
+		require.Zero(t, numJobs)
+	})
+
+	t.Run("MismatchedParametersError", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+
+		// Test each field in its own API request to make sure a mismatch produces the expected error.
+		for _, overrides := range []*HandleEmailCreateRequest{
+			{Bcc: []string{"audit@example.com"}},
+			{Body: "A different body"},
+			{BodyHTML: "<p>A different HTML body</p>"},
+			{Cc: []string{"manager@example.com"}},
+			{Charset: "iso-8859-1"},
+			{EmailRecipient: "different@example.com"},
+			{EmailSender: "different@example.com"},
+			{Headers: map[string]string{"X-Campaign": "spring"}},
+			{ReplyTo: "support@example.com"},
+			{ReturnPath: "bounces@example.com"},
+			{SenderName: "Acme Support"},
+			{Subject: "A different subject"},
+			{Track: true},
+			{UnsubscribeURL: "https://example.com/unsubscribe"},
+		} {
+			_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(overrides))
+			require.Equal(t, &APIError{
+				Code:       "idempotency_key_reuse",
+				Message:    "Incoming parameters don't match those of queued email. You may have a bug.",
+				StatusCode: http.StatusConflict,
+			}, err)
+		}
+	})
+
+	t.Run("IdempotencyScopeAccountKey", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.idempotencyScope = IdempotencyScopeAccountKey
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+
+		// The same key from another account is a different email.
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{AccountID: uuid.New()}))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&numJobs))
+		require.Equal(t, 2, numJobs)
+	})
+
+	t.Run("IdempotencyScopeKey", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.idempotencyScope = IdempotencyScopeKey
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+
+		// The same key from another account collides with the first email
+		// rather than being taken as a retry of it.
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{AccountID: uuid.New()}))
+		require.Equal(t, errMismatchedParameters, err)
+
+		var (
+			encodedArgs []byte
+			numJobs     int
+		)
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args, count(*) OVER () FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&encodedArgs, &numJobs))
+		require.Equal(t, 1, numJobs)
+
+		// Jobs are encoded the same as in the default scope.
+		var args SendEmailArgs
+		require.NoError(t, json.Unmarshal(encodedArgs, &args))
+		require.Equal(t, accountID, args.AccountID)
+		require.Equal(t, idempotencyKey, args.IdempotencyKey)
+	})
+
+	t.Run("DedupeByContent", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.dedupeByContentPeriod = 10 * time.Minute
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+		location, messageID := resp.Location, resp.MessageID
+
+		// The same email under a new key is a duplicate of the first.
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailCreateResponse{Location: location, Message: "An identical email was already queued for this recipient; email not queued.", MessageID: messageID, StatusCode: http.StatusOK}, resp)
+		require.InDelta(t, 1, testutil.ToFloat64(bundle.apiServer.metrics.emailsDuplicate.WithLabelValues("same_content")), 0)
+
+		// Retries with the first key are still deduplicated by it.
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+
+		// Different content, or the same content from or to someone else,
+		// isn't a duplicate.
+		for _, overrides := range []*HandleEmailCreateRequest{
+			{Body: "A different body", IdempotencyKey: uuid.NewString()},
+			{EmailRecipient: "different@example.com", IdempotencyKey: uuid.NewString()},
+			{EmailSender: "different@example.com", IdempotencyKey: uuid.NewString()},
+			{IdempotencyKey: uuid.NewString(), Subject: "A different subject"},
+			{AccountID: uuid.New(), IdempotencyKey: uuid.NewString()},
+			{IdempotencyKey: uuid.NewString(), SenderName: "Acme Support"},
+			{IdempotencyKey: uuid.NewString(), ReplyTo: "support@example.com"},
+			{Headers: map[string]string{"X-Campaign-ID": "123"}, IdempotencyKey: uuid.NewString()},
+			{IdempotencyKey: uuid.NewString(), InReplyTo: "<first@example.com>"},
+			{IdempotencyKey: uuid.NewString(), References: []string{"<first@example.com>"}},
+		} {
+			resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(overrides))
+			require.NoError(t, err)
+			requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+		}
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&numJobs))
+		require.Equal(t, 11, numJobs)
+
+		// Content dedupe jobs never wait for a worker.
+		var dedupeJobStates []string
+		rows, err := bundle.tx.Query(ctx, "SELECT DISTINCT state FROM river_job WHERE kind = $1", (ContentDedupeArgs{}).Kind())
+		require.NoError(t, err)
+		dedupeJobStates, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		require.NoError(t, err)
+		require.Equal(t, []string{string(rivertype.JobStateCompleted)}, dedupeJobStates)
+	})
+
+	t.Run("DedupeByContentFirstCancelled", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.dedupeByContentPeriod = 10 * time.Minute
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(nil))
+		require.NoError(t, err)
+
+		firstJobID, err := strconv.ParseInt(strings.TrimPrefix(resp.Location, "/emails/"), 10, 64)
+		require.NoError(t, err)
+		_, err = bundle.apiServer.riverClient.JobCancelTx(ctx, bundle.tx, firstJobID)
+		require.NoError(t, err)
+
+		// The first email won't be sent, so an identical one goes out instead.
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+		location := resp.Location
+
+		// Which later identical emails are then duplicates of.
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()}))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, location, resp.Location)
+	})
+
+	t.Run("DedupeByContentRecipients", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.dedupeByContentPeriod = 10 * time.Minute
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{EmailRecipient: "receiver1@example.com"}))
+		require.NoError(t, err)
+
+		req := testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()})
+		req.EmailRecipient = ""
+		req.Recipients = []string{"receiver1@example.com", "receiver2@example.com"}
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailCreateJobCounts{Duplicate: 1, Queued: 1}, resp.Jobs)
+	})
+
+	t.Run("DedupeByContentDisabled", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		for range 2 {
+			resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{IdempotencyKey: uuid.NewString()}))
+			require.NoError(t, err)
+			requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, resp)
+		}
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&numJobs))
+		require.Equal(t, 2, numJobs)
+	})
+
+	t.Run("EncryptedAtRest", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		encrypter, err := newEmailEncrypter(generateEncryptionKey(t))
+		require.NoError(t, err)
+		bundle.apiServer.encrypter = encrypter
+
+		req := testArgs(&HandleEmailCreateRequest{Body: "Your password reset code is 314159."})
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		var encodedArgs []byte
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&encodedArgs))
+		require.NotContains(t, string(encodedArgs), "314159")
+		require.NotContains(t, string(encodedArgs), "receiver@example.com")
+
+		// The unique key is still in plaintext, so retries are deduplicated
+		// and compared against the decrypted email.
+		var storedArgs SendEmailArgs
+		require.NoError(t, json.Unmarshal(encodedArgs, &storedArgs))
+		require.Equal(t, accountID, storedArgs.AccountID)
+		require.Equal(t, idempotencyKey, storedArgs.IdempotencyKey)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{Body: "Your password reset code is 271828."}))
+		require.Equal(t, errMismatchedParameters, err)
+
+		// The worker decrypts the email to send it.
+		sender := &fakeEmailSender{}
+		worker := &SendEmailWorker{encrypter: encrypter, sender: sender, tracer: testTracer}
+		require.NoError(t, worker.Work(ctx, &river.Job[SendEmailArgs]{JobRow: &rivertype.JobRow{}, Args: storedArgs}))
+		require.Len(t, sender.sent, 1)
+		require.Equal(t, []string{"receiver@example.com"}, sender.sent[0].To)
+		require.Contains(t, string(sender.sent[0].Message), "Your password reset code is 314159.")
+	})
+
+	t.Run("SubjectPrefixNotStored", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := testArgs(nil)
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		var (
+			encodedArgs []byte
+			uniqueKey   []byte
+		)
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args, unique_key FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&encodedArgs, &uniqueKey))
+		require.NotContains(t, string(encodedArgs), "[STAGING]")
+		require.NotContains(t, string(uniqueKey), "[STAGING]")
+
+		var storedArgs SendEmailArgs
+		require.NoError(t, json.Unmarshal(encodedArgs, &storedArgs))
+		require.Equal(t, "Hello.", storedArgs.Subject)
+
+		// The prefix is only added to the sent message.
+		sender := &fakeEmailSender{}
+		worker := &SendEmailWorker{sender: sender, subjectPrefix: "[STAGING]", tracer: testTracer}
+		require.NoError(t, worker.Work(ctx, &river.Job[SendEmailArgs]{JobRow: &rivertype.JobRow{}, Args: storedArgs}))
+		require.Len(t, sender.sent, 1)
+		require.Contains(t, string(sender.sent[0].Message), "Subject: [STAGING] Hello.\r\n")
+
+		// So the same email still deduplicates.
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		requireEmailCreateResponse(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", StatusCode: http.StatusOK}, resp)
+	})
+
+	t.Run("LogsRedacted", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		var logBuf bytes.Buffer
+		logger, err := newLogger(&logBuf, LogRedactTruncate)
+		require.NoError(t, err)
+		bundle.apiServer.logger = logger
+
+		body := strings.Repeat("Hello from River's idempotent mail demo. ", 3)
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{Body: body}))
+		require.NoError(t, err)
+
+		var logged struct {
+			Email struct {
+				Body           string `json:"body"`
+				EmailRecipient string `json:"email_recipient"`
+			} `json:"email"`
+			JobID int64  `json:"job_id"`
+			Msg   string `json:"msg"`
+		}
+		require.NoError(t, json.Unmarshal(logBuf.Bytes(), &logged))
+		require.Equal(t, "Queued email", logged.Msg)
+		require.Equal(t, "Hello from River's idempotent ma…", logged.Email.Body)
+		require.Equal(t, "r…@example.com", logged.Email.EmailRecipient)
+
+		// The queued email has its full content.
+		var queuedBody, queuedRecipient string
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args->>'body', args->>'email_recipient' FROM river_job WHERE id = $1", logged.JobID).Scan(&queuedBody, &queuedRecipient))
+		require.Equal(t, body, queuedBody)
+		require.Equal(t, "receiver@example.com", queuedRecipient)
+
+		// Duplicates weren't queued, so they aren't logged.
+		logBuf.Reset()
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, testArgs(&HandleEmailCreateRequest{Body: body}))
+		require.NoError(t, err)
+		require.Empty(t, logBuf.String())
+	})
+}
+
+func TestEmailArgsMatch(t *testing.T) {
+	t.Parallel()
+
+	args := &SendEmailArgs{
+		AccountID:      uuid.New(),
+		Body:           "Hello from River's idempotent mail demo.",
+		EmailRecipient: "receiver@example.com",
+		EmailSender:    "sender@example.com",
+		IdempotencyKey: uuid.NewString(),
+		Subject:        "Hello.",
+		TraceContext:   map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+	}
+
+	t.Run("Identical", func(t *testing.T) {
+		t.Parallel()
+
+		existingArgs := *args
+		match, err := emailArgsMatch(args, &existingArgs)
+		require.NoError(t, err)
+		require.True(t, match)
+	})
+
+	t.Run("IgnoresMetadata", func(t *testing.T) {
+		t.Parallel()
+
+		existingArgs := *args
+		existingArgs.TraceContext = map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+
+		match, err := emailArgsMatch(args, &existingArgs)
+		require.NoError(t, err)
+		require.True(t, match)
+	})
+
+	t.Run("EmptyEqualsUnset", func(t *testing.T) {
+		t.Parallel()
+
+		existingArgs := *args
+		existingArgs.Headers = map[string]string{}
+
+		match, err := emailArgsMatch(args, &existingArgs)
+		require.NoError(t, err)
+		require.True(t, match)
+	})
+
+	// Sets each field other than the ignored ones in turn, so that any field
+	// added to SendEmailArgs later is checked automatically.
+	t.Run("EveryContentFieldCompared", func(t *testing.T) {
+		t.Parallel()
+
+		argsType := reflect.TypeFor[SendEmailArgs]()
+		for i := range argsType.NumField() {
+			field := argsType.Field(i)
+			jsonKey, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if slices.Contains(emailArgsIgnoredKeys, jsonKey) {
+				continue
+			}
+
+			changedArgs := *args
+			value := reflect.ValueOf(&changedArgs).Elem().Field(i)
+			switch value.Kind() { //nolint:exhaustive
+			case reflect.Array: // like uuid.UUID
+				value.Index(0).SetUint(value.Index(0).Uint() + 1)
+			case reflect.Bool:
+				value.SetBool(!value.Bool())
+			case reflect.Int, reflect.Int64:
+				value.SetInt(value.Int() + 1)
+			case reflect.Map:
+				value.Set(reflect.MakeMapWithSize(field.Type, 1))
+				value.SetMapIndex(reflect.ValueOf("changed"), reflect.New(field.Type.Elem()).Elem())
+			case reflect.Slice:
+				value.Set(reflect.Append(value, reflect.New(field.Type.Elem()).Elem()))
+			case reflect.String:
+				value.SetString(value.String() + "changed")
+			default:
+				require.FailNow(t, "Unhandled field kind", "Field %s has kind %s; add a case for it", field.Name, value.Kind())
+			}
+
+			match, err := emailArgsMatch(&changedArgs, args)
+			require.NoError(t, err)
+			require.False(t, match, "Expected a change to %s to be a mismatch", field.Name)
+		}
+	})
+}
+
+func TestEmailMessageID(t *testing.T) {
+	t.Parallel()
+
+	args := &SendEmailArgs{
+		AccountID:      uuid.New(),
+		EmailSender:    "sender@brand.example.com",
+		IdempotencyKey: uuid.NewString(),
+	}
+
+	messageID := emailMessageID(args)
+	require.Regexp(t, `^<[0-9a-f-]{36}@brand\.example\.com>$`, messageID)
+
+	// It's the same for the same email, and different for any other.
+	require.Equal(t, messageID, emailMessageID(&SendEmailArgs{AccountID: args.AccountID, EmailSender: args.EmailSender, IdempotencyKey: args.IdempotencyKey, Subject: "Changed"}))
+	require.NotEqual(t, messageID, emailMessageID(&SendEmailArgs{AccountID: uuid.New(), EmailSender: args.EmailSender, IdempotencyKey: args.IdempotencyKey}))
+	require.NotEqual(t, messageID, emailMessageID(&SendEmailArgs{AccountID: args.AccountID, EmailSender: args.EmailSender, IdempotencyKey: uuid.NewString()}))
+
+	// Raw messages have their own headers.
+	require.Empty(t, emailMessageID(&SendEmailArgs{AccountID: args.AccountID, EmailSender: args.EmailSender, IdempotencyKey: args.IdempotencyKey, RawMessage: []byte("Subject: Hello.\r\n\r\nHello.\r\n")}))
+}
+
+func TestSameUniqueness(t *testing.T) {
+	t.Parallel()
+
+	args := SendEmailArgs{
+		AccountID:      uuid.New(),
+		EmailRecipient: "receiver@example.com",
+		IdempotencyKey: uuid.NewString(),
+		Subject:        "Hello.",
+	}
+
+	otherContent := args
+	otherContent.Subject = "Goodbye."
+	require.True(t, sameUniqueness(args, otherContent))
+
+	otherAccount := args
+	otherAccount.AccountID = uuid.New()
+	require.False(t, sameUniqueness(args, otherAccount))
+
+	otherKey := args
+	otherKey.IdempotencyKey = uuid.NewString()
+	require.False(t, sameUniqueness(args, otherKey))
+}
+
+func TestAPIServiceEmailGet(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		apiServer *APIService
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			apiServer: &APIService{
+				begin:       tx.Begin,
+				metrics:     newMetrics(),
+				riverClient: riverClient,
+				tracer:      testTracer,
+			},
+			tx: tx,
+		}, ctx
+	}
+
+	t.Run("ReturnsState", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		idempotencyKey := uuid.NewString()
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: idempotencyKey,
+			Subject:        "Hello.",
+		})
+		require.NoError(t, err)
+
+		var jobID int64
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT id FROM river_job WHERE args->>'idempotency_key' = $1", idempotencyKey).Scan(&jobID))
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailGet, &HandleEmailGetRequest{ID: jobID})
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailGetResponse{ID: jobID, State: rivertype.JobStateAvailable}, resp)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailGet, &HandleEmailGetRequest{ID: 123_456_789})
+		require.Equal(t, &APIError{Code: "not_found", StatusCode: http.StatusNotFound, Message: "Email not found."}, err)
+	})
+}
+
+func TestAPIServiceEmailRetry(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		apiServer *APIService
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			apiServer: &APIService{
+				begin:       tx.Begin,
+				metrics:     newMetrics(),
+				riverClient: riverClient,
+				tracer:      testTracer,
+			},
+			tx: tx,
+		}, ctx
+	}
+
+	// Queues an email through the API and returns the ID of its job.
+	createEmail := func(ctx context.Context, t *testing.T, bundle *testBundle) int64 {
+		t.Helper()
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		})
+		require.NoError(t, err)
+
+		var jobID int64
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT id FROM river_job WHERE kind = $1 ORDER BY id DESC LIMIT 1", (SendEmailArgs{}).Kind()).Scan(&jobID))
+		return jobID
+	}
+
+	t.Run("RetriesDiscardedEmail", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		jobID := createEmail(ctx, t, bundle)
+
+		// Cheat by setting the job row directly to discarded as if it'd
+		// exhausted all its attempts.
+		_, err := bundle.tx.Exec(ctx, "UPDATE river_job SET finalized_at = now(), state = 'discarded' WHERE id = $1", jobID)
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailRetry, &HandleEmailRetryRequest{ID: jobID})
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailRetryResponse{ID: jobID, State: rivertype.JobStateAvailable}, resp)
+
+		job, err := bundle.apiServer.riverClient.JobGetTx(ctx, bundle.tx, jobID)
+		require.NoError(t, err)
+		require.Equal(t, rivertype.JobStateAvailable, job.State)
+	})
+
+	t.Run("NotRetryableState", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		jobID := createEmail(ctx, t, bundle)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailRetry, &HandleEmailRetryRequest{ID: jobID})
+		require.Equal(t, &APIError{Code: "invalid_state", StatusCode: http.StatusConflict, Message: `Email can't be retried from state "available"; only cancelled or discarded emails can be retried.`}, err)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailRetry, &HandleEmailRetryRequest{ID: 123_456_789})
+		require.Equal(t, &APIError{Code: "not_found", StatusCode: http.StatusNotFound, Message: "Email not found."}, err)
+	})
+}
+
+// Integration tests that exercise the entire HTTP stack.
+func TestAPIServiceEmailCancelByAccount(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		apiServer *APIService
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			apiServer: &APIService{
+				begin:       tx.Begin,
+				metrics:     newMetrics(),
+				riverClient: riverClient,
+				tracer:      testTracer,
+			},
+			tx: tx,
+		}, ctx
+	}
+
+	// Queues an email for an account and puts its job in the given state.
+	createEmail := func(ctx context.Context, t *testing.T, bundle *testBundle, accountID uuid.UUID, state rivertype.JobState) int64 {
+		t.Helper()
+
+		idempotencyKey := uuid.NewString()
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      accountID,
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: idempotencyKey,
+			Subject:        "Hello.",
+		})
+		require.NoError(t, err)
+
+		var jobID int64
+		require.NoError(t, bundle.tx.QueryRow(ctx, `
+			UPDATE river_job
+			SET finalized_at = CASE WHEN $1 = 'completed' THEN now() END,
+				state = $1::river_job_state
+			WHERE args->>'idempotency_key' = $2
+			RETURNING id`,
+			string(state), idempotencyKey,
+		).Scan(&jobID))
+		return jobID
+	}
+
+	requireState := func(ctx context.Context, t *testing.T, bundle *testBundle, jobID int64, expected rivertype.JobState) {
+		t.Helper()
+
+		job, err := bundle.apiServer.riverClient.JobGetTx(ctx, bundle.tx, jobID)
+		require.NoError(t, err)
+		require.Equal(t, expected, job.State, "Unexpected state for job %d", jobID)
+	}
+
+	t.Run("CancelsUnsentEmails", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		var (
+			accountID      = uuid.New()
+			otherAccountID = uuid.New()
+		)
+
+		var unsentJobIDs []int64
+		for _, state := range []rivertype.JobState{rivertype.JobStateAvailable, rivertype.JobStateAvailable, rivertype.JobStateRetryable, rivertype.JobStateScheduled} {
+			unsentJobIDs = append(unsentJobIDs, createEmail(ctx, t, bundle, accountID, state))
+		}
+
+		var (
+			completedJobID    = createEmail(ctx, t, bundle, accountID, rivertype.JobStateCompleted)
+			otherAccountJobID = createEmail(ctx, t, bundle, otherAccountID, rivertype.JobStateAvailable)
+		)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCancelByAccount, &HandleCancelByAccountRequest{AccountID: accountID})
+		require.NoError(t, err)
+		require.Equal(t, &HandleCancelByAccountResponse{Cancelled: 4, Message: "4 unsent email(s) cancelled."}, resp)
+
+		for _, jobID := range unsentJobIDs {
+			requireState(ctx, t, bundle, jobID, rivertype.JobStateCancelled)
+		}
+		requireState(ctx, t, bundle, completedJobID, rivertype.JobStateCompleted)
+		requireState(ctx, t, bundle, otherAccountJobID, rivertype.JobStateAvailable)
+
+		// Nothing's left to cancel the second time.
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailCancelByAccount, &HandleCancelByAccountRequest{AccountID: accountID})
+		require.NoError(t, err)
+		require.Equal(t, &HandleCancelByAccountResponse{Cancelled: 0, Message: "0 unsent email(s) cancelled."}, resp)
+	})
+
+	t.Run("MissingAccountID", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCancelByAccount, &HandleCancelByAccountRequest{})
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "account_id", Message: "account_id is required.", Rule: "required"},
+			},
+		}, err)
+	})
+}
+
+func TestAPIServiceServeMux(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		mux *http.ServeMux
+		tx  pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			mux: (&APIService{
+				begin:       tx.Begin,
+				metrics:     newMetrics(),
+				riverClient: riverClient,
+				tracer:      testTracer,
+			}).ServeMux(),
+			tx: tx,
+		}, ctx
+	}
+
+	mustMarshalJSON := func(t *testing.T, value any) []byte {
+		t.Helper()
+
+		data, err := json.Marshal(value)
+		require.NoError(t, err)
+
+		return data
+	}
+
+	// Makes a request with a JSON body and content type.
+	newJSONRequest := func(t *testing.T, method, target string, value any) *http.Request {
+		t.Helper()
+
+		req := httptest.NewRequest(method, target, bytes.NewReader(mustMarshalJSON(t, value)))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	requireStatus := func(t *testing.T, expected int, recorder *httptest.ResponseRecorder) {
+		t.Helper()
+
+		require.Equal(t, expected, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+	}
+
+	t.Run("EmailCreate", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		var (
+			accountID      = uuid.New()
+			idempotencyKey = uuid.NewString()
+			messageID      = emailMessageID(&SendEmailArgs{AccountID: accountID, EmailSender: "sender@example.com", IdempotencyKey: idempotencyKey})
+		)
+
+		recorder := httptest.NewRecorder()
+
+		bundle.mux.ServeHTTP(recorder, newJSONRequest(t, http.MethodPost, "/emails", &HandleEmailCreateRequest{
+			AccountID:      accountID,
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: idempotencyKey,
+			Subject:        "Hello.",
+		}))
+		requireStatus(t, http.StatusCreated, recorder)
+		require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		require.Equal(t,
+			string(mustMarshalJSON(t, &HandleEmailCreateResponse{Message: "Email has been queued for sending.", MessageID: messageID, StatusCode: http.StatusCreated})),
+			recorder.Body.String(),
+		)
+
+		var jobID int64
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT id FROM river_job WHERE args->>'account_id' = $1", accountID.String()).Scan(&jobID))
+		require.Equal(t, "/emails/"+strconv.FormatInt(jobID, 10), recorder.Header().Get("Location"))
+	})
+
+	t.Run("EmailCreateDuplicate", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		req := &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		}
+
+		recorder := httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, newJSONRequest(t, http.MethodPost, "/emails", req))
+		requireStatus(t, http.StatusCreated, recorder)
+		location := recorder.Header().Get("Location")
+		require.Regexp(t, `^/emails/[0-9]+$`, location)
+
+		// A duplicate points at the email that was already queued.
+		recorder = httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, newJSONRequest(t, http.MethodPost, "/emails", req))
+		requireStatus(t, http.StatusOK, recorder)
+		require.Equal(t,
+			string(mustMarshalJSON(t, &HandleEmailCreateResponse{Message: "Email was already queued and is pending send.", MessageID: emailMessageID(&SendEmailArgs{AccountID: req.AccountID, EmailSender: req.EmailSender, IdempotencyKey: req.IdempotencyKey})})),
+			recorder.Body.String(),
+		)
+		require.Equal(t, location, recorder.Header().Get("Location"))
+
+		// The location serves the email's status.
+		recorder = httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, location, nil))
+		requireStatus(t, http.StatusOK, recorder)
+	})
+
+	t.Run("EmailCreateMismatchedParameters", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		req := &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		}
+
+		recorder := httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, newJSONRequest(t, http.MethodPost, "/emails", req))
+		requireStatus(t, http.StatusCreated, recorder)
+
+		req.Subject = "A different subject"
+
+		recorder = httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, newJSONRequest(t, http.MethodPost, "/emails", req))
+		requireStatus(t, http.StatusConflict, recorder)
+		require.JSONEq(t, `{
+			"error_code": "idempotency_key_reuse",
+			"message": "Incoming parameters don't match those of queued email. You may have a bug."
+		}`, recorder.Body.String())
+	})
+
+	t.Run("EmailCreateIdempotencyKeyHeader", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		idempotencyKey := uuid.NewString()
+
+		// Key only in the header.
+		makeReq := func() *http.Request {
+			req := newJSONRequest(t, http.MethodPost, "/emails", &HandleEmailCreateRequest{
+				AccountID:      uuid.New(),
+				Body:           "Hello from River's idempotent mail demo.",
+				EmailRecipient: "receiver@example.com",
+				EmailSender:    "sender@example.com",
+				Subject:        "Hello.",
+			})
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+			return req
+		}
+
+		recorder := httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, makeReq())
+		requireStatus(t, http.StatusCreated, recorder)
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(t.Context(), "SELECT count(*) FROM river_job WHERE args->>'idempotency_key' = $1", idempotencyKey).Scan(&numJobs))
+		require.Equal(t, 1, numJobs)
+	})
+
+	t.Run("EmailCreateIdempotencyKeyHeaderDedupesWithBody", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		var (
+			accountID      = uuid.New()
+			idempotencyKey = uuid.NewString()
+		)
+
+		makeReq := func(bodyKey string) *HandleEmailCreateRequest {
+			return &HandleEmailCreateRequest{
+				AccountID:      accountID,
+				Body:           "Hello from River's idempotent mail demo.",
+				EmailRecipient: "receiver@example.com",
+				EmailSender:    "sender@example.com",
+				IdempotencyKey: bodyKey,
+				Subject:        "Hello.",
+			}
+		}
+
+		// Key only in the body.
+		recorder := httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, newJSONRequest(t, http.MethodPost, "/emails", makeReq(idempotencyKey)))
+		requireStatus(t, http.StatusCreated, recorder)
+
+		// Same key only in the header is a duplicate.
+		req := newJSONRequest(t, http.MethodPost, "/emails", makeReq(""))
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+
+		recorder = httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, req)
+		requireStatus(t, http.StatusOK, recorder)
+
+		// Same key in both places that agree is also fine.
+		req = newJSONRequest(t, http.MethodPost, "/emails", makeReq(idempotencyKey))
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+
+		recorder = httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, req)
+		requireStatus(t, http.StatusOK, recorder)
+	})
+
+	t.Run("EmailCreateIdempotencyKeyHeaderConflict", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		req := newJSONRequest(t, http.MethodPost, "/emails", &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		})
+		req.Header.Set("Idempotency-Key", uuid.NewString())
+
+		recorder := httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, req)
+		requireStatus(t, http.StatusBadRequest, recorder)
+		require.Equal(t,
+			string(mustMarshalJSON(t, &APIError{Code: "invalid_request", Message: "Idempotency-Key header doesn't match idempotency_key in request body."})),
+			recorder.Body.String(),
+		)
+	})
+
+	t.Run("EmailCreateIdempotencyKeyHeaderInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		req := newJSONRequest(t, http.MethodPost, "/emails", &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			Subject:        "Hello.",
+		})
+		req.Header.Set("Idempotency-Key", strings.Repeat("x", 256))
+
+		recorder := httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, req)
+		requireStatus(t, http.StatusBadRequest, recorder)
+		require.JSONEq(t, `{
+			"error_code": "validation_failed",
+			"message": "Invalid parameters.",
+			"validation_errors": [
+				{"field": "idempotency_key", "message": "idempotency_key must be at most 255.", "rule": "max"}
+			]
+		}`, recorder.Body.String())
+	})
+
+	t.Run("EmailCreateContentTypeWithCharset", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		recorder := httptest.NewRecorder()
+
+		req := newJSONRequest(t, http.MethodPost, "/emails", &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		})
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+		bundle.mux.ServeHTTP(recorder, req)
+		requireStatus(t, http.StatusCreated, recorder)
+	})
+
+	t.Run("EmailCreateUnsupportedContentType", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		for _, contentType := range []string{"", "application/x-www-form-urlencoded", "application/xml", "text/plain"} {
+			recorder := httptest.NewRecorder()
+
+			req := httptest.NewRequest(http.MethodPost, "/emails", strings.NewReader("account_id=abc"))
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+
+			bundle.mux.ServeHTTP(recorder, req)
+			requireStatus(t, http.StatusUnsupportedMediaType, recorder)
+			require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+			require.Equal(t,
+				string(mustMarshalJSON(t, &APIError{Code: "unsupported_media_type", Message: "Request body must be JSON with a content type of application/json."})),
+				recorder.Body.String(),
+			)
+		}
+	})
+
+	t.Run("EmailCreateUnknownField", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		recorder := httptest.NewRecorder()
+
+		req := httptest.NewRequest(http.MethodPost, "/emails", strings.NewReader(`{
+			"account_id": "`+uuid.NewString()+`",
+			"body": "Hello from River's idempotent mail demo.",
+			"email_reciptient": "receiver@example.com",
+			"email_sender": "sender@example.com",
+			"idempotency_key": "`+uuid.NewString()+`",
+			"subject": "Hello."
+		}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		bundle.mux.ServeHTTP(recorder, req)
+		requireStatus(t, http.StatusBadRequest, recorder)
+		require.JSONEq(t, `{"error_code":"invalid_request","message":"Unknown field in request: \"email_reciptient\"."}`, recorder.Body.String())
+	})
+
+	t.Run("EmailCreateOptionalFields", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		recorder := httptest.NewRecorder()
+
+		req := httptest.NewRequest(http.MethodPost, "/emails", strings.NewReader(`{
+			"account_id": "`+uuid.NewString()+`",
+			"body": "Hello from River's idempotent mail demo.",
+			"body_html": "<p>Hello from River's idempotent mail demo.</p>",
+			"email_recipient": "receiver@example.com",
+			"email_sender": "sender@example.com",
+			"headers": {"X-Campaign": "welcome"},
+			"idempotency_key": "`+uuid.NewString()+`",
+			"reply_to": "support@example.com",
+			"sender_name": "River Demo",
+			"subject": "Hello."
+		}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		bundle.mux.ServeHTTP(recorder, req)
+		requireStatus(t, http.StatusCreated, recorder)
+	})
+
+	t.Run("EmailCreateTrailingData", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		recorder := httptest.NewRecorder()
+
+		req := httptest.NewRequest(http.MethodPost, "/emails", strings.NewReader(`{"account_id":"`+uuid.NewString()+`"} {}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		bundle.mux.ServeHTTP(recorder, req)
+		requireStatus(t, http.StatusBadRequest, recorder)
+		require.JSONEq(t, `{"error_code":"invalid_request","message":"Error unmarshaling request: unexpected data after top-level value"}`, recorder.Body.String())
+	})
+
+	t.Run("ErrorHasJSONContentType", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		recorder := httptest.NewRecorder()
+
+		bundle.mux.ServeHTTP(recorder, newJSONRequest(t, http.MethodPost, "/emails", &HandleEmailCreateRequest{}))
+		requireStatus(t, http.StatusBadRequest, recorder)
+		require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	})
+
+	t.Run("EmailCreateValidationErrors", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		recorder := httptest.NewRecorder()
+
+		bundle.mux.ServeHTTP(recorder, newJSONRequest(t, http.MethodPost, "/emails", map[string]any{
+			"account_id":      uuid.New(),
+			"email_recipient": "receiver@example.com",
+			"idempotency_key": uuid.New(),
+			"reply_to":        "not-an-email",
+		}))
+		requireStatus(t, http.StatusBadRequest, recorder)
+		require.JSONEq(t, `{
+			"error_code": "validation_failed",
+			"message": "Invalid parameters.",
+			"validation_errors": [
+				{"field": "reply_to", "message": "reply_to must be a valid email address.", "rule": "email"}
+			]
+		}`, recorder.Body.String())
+
+		// Body and subject are only found missing after defaults have been
+		// resolved, once the request is otherwise valid.
+		recorder = httptest.NewRecorder()
+
+		bundle.mux.ServeHTTP(recorder, newJSONRequest(t, http.MethodPost, "/emails", map[string]any{
+			"account_id":      uuid.New(),
+			"email_recipient": "receiver@example.com",
+			"idempotency_key": uuid.New(),
+		}))
+		requireStatus(t, http.StatusBadRequest, recorder)
+		require.JSONEq(t, `{
+			"error_code": "validation_failed",
+			"message": "Invalid parameters.",
+			"validation_errors": [
+				{"field": "body", "message": "body is required unless template or raw_message is set.", "rule": "required_without_all"},
+				{"field": "subject", "message": "subject is required unless template or raw_message is set.", "rule": "required_without_all"}
+			]
+		}`, recorder.Body.String())
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		req := &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		}
+
+		for range 2 {
+			bundle.mux.ServeHTTP(httptest.NewRecorder(), newJSONRequest(t, http.MethodPost, "/emails", req))
+		}
+
+		recorder := httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		requireStatus(t, http.StatusOK, recorder)
+		require.Contains(t, recorder.Body.String(), `emails_duplicate_total{state="still_pending"} 1`)
+	})
+
+	t.Run("EmailRetry", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		recorder := httptest.NewRecorder()
+
+		bundle.mux.ServeHTTP(recorder, newJSONRequest(t, http.MethodPost, "/emails", &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		}))
+		requireStatus(t, http.StatusCreated, recorder)
+
+		var jobID int64
+		require.NoError(t, bundle.tx.QueryRow(ctx, "UPDATE river_job SET finalized_at = now(), state = 'discarded' WHERE kind = $1 RETURNING id", (SendEmailArgs{}).Kind()).Scan(&jobID))
+
+		recorder = httptest.NewRecorder()
+
+		bundle.mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/emails/%d/retry", jobID), nil))
+		requireStatus(t, http.StatusOK, recorder)
+		require.Equal(t,
+			string(mustMarshalJSON(t, &HandleEmailRetryResponse{ID: jobID, State: rivertype.JobStateAvailable})),
+			recorder.Body.String(),
+		)
+	})
+
+	t.Run("EmailRetryInvalidID", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		recorder := httptest.NewRecorder()
+
+		bundle.mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/emails/not-an-id/retry", nil))
+		requireStatus(t, http.StatusBadRequest, recorder)
+	})
+}
+
+func TestQuietHoursScheduledAt(t *testing.T) {
+	t.Parallel()
+
+	loc, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name     string
+		now      time.Time
+		expected time.Time
+	}{
+		{name: "BeforeWindow", now: time.Date(2025, 3, 4, 6, 30, 0, 0, loc), expected: time.Date(2025, 3, 4, 8, 0, 0, 0, loc)},
+		{name: "WindowStart", now: time.Date(2025, 3, 4, 8, 0, 0, 0, loc), expected: time.Time{}},
+		{name: "InWindow", now: time.Date(2025, 3, 4, 13, 15, 0, 0, loc), expected: time.Time{}},
+		{name: "WindowEnd", now: time.Date(2025, 3, 4, 20, 0, 0, 0, loc), expected: time.Date(2025, 3, 5, 8, 0, 0, 0, loc)},
+		{name: "AfterWindowEndOfMonth", now: time.Date(2025, 3, 31, 23, 0, 0, 0, loc), expected: time.Date(2025, 4, 1, 8, 0, 0, 0, loc)},
+		{name: "OtherZone", now: time.Date(2025, 3, 4, 12, 0, 0, 0, time.UTC), expected: time.Date(2025, 3, 4, 8, 0, 0, 0, loc)}, // 7am in New York
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.True(t, tt.expected.Equal(quietHoursScheduledAt(tt.now, loc)), "Expected %s, got %s", tt.expected, quietHoursScheduledAt(tt.now, loc))
+		})
+	}
+}
+
+// zoneWithLocalHour returns the name of a fixed offset time zone in which it's
+// the given hour at now, so that tests can be in or out of quiet hours
+// regardless of when they run.
+func zoneWithLocalHour(now time.Time, hour int) string {
+	offset := ((hour-now.UTC().Hour())%24+24+12)%24 - 12
+
+	// Signs of Etc/GMT zones are inverted, so Etc/GMT-5 is UTC+5.
+	switch {
+	case offset > 0:
+		return fmt.Sprintf("Etc/GMT-%d", offset)
+	case offset < 0:
+		return fmt.Sprintf("Etc/GMT+%d", -offset)
+	}
+	return "Etc/GMT"
+}
+
+func TestMakeDBPoolConfig(t *testing.T) {
+	t.Parallel()
+
+	loadConfig := func(t *testing.T, env map[string]string) *EnvConfig {
+		t.Helper()
+
+		config, err := loadEnvConfig(t.Context(), envconfig.MapLookuper(env))
+		require.NoError(t, err)
+		return config
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		t.Parallel()
+
+		poolConfig, err := makeDBPoolConfig(loadConfig(t, map[string]string{
+			"DATABASE_URL": "postgres://localhost/river_test",
+		}))
+		require.NoError(t, err)
+
+		defaultConfig, err := pgxpool.ParseConfig("postgres://localhost/river_test")
+		require.NoError(t, err)
+		require.Equal(t, defaultConfig.MaxConnLifetime, poolConfig.MaxConnLifetime)
+		require.Equal(t, defaultConfig.MaxConns, poolConfig.MaxConns)
+		require.Equal(t, defaultConfig.MinConns, poolConfig.MinConns)
+	})
+
+	t.Run("Configured", func(t *testing.T) {
+		t.Parallel()
+
+		poolConfig, err := makeDBPoolConfig(loadConfig(t, map[string]string{
+			"DATABASE_URL":         "postgres://localhost/river_test",
+			"DB_MAX_CONN_LIFETIME": "15m",
+			"DB_MAX_CONNS":         "50",
+			"DB_MIN_CONNS":         "5",
+		}))
+		require.NoError(t, err)
+		require.Equal(t, 15*time.Minute, poolConfig.MaxConnLifetime)
+		require.Equal(t, int32(50), poolConfig.MaxConns)
+		require.Equal(t, int32(5), poolConfig.MinConns)
+		require.Equal(t, "localhost", poolConfig.ConnConfig.Host)
+	})
+
+	t.Run("OverridesURLParameters", func(t *testing.T) {
+		t.Parallel()
+
+		poolConfig, err := makeDBPoolConfig(loadConfig(t, map[string]string{
+			"DATABASE_URL": "postgres://localhost/river_test?pool_max_conns=10&pool_min_conns=2",
+			"DB_MAX_CONNS": "20",
+		}))
+		require.NoError(t, err)
+		require.Equal(t, int32(20), poolConfig.MaxConns)
+		require.Equal(t, int32(2), poolConfig.MinConns)
+	})
+
+	t.Run("Negative", func(t *testing.T) {
+		t.Parallel()
+
+		for env, expectedErr := range map[string]string{
+			"DB_MAX_CONN_LIFETIME": "DB_MAX_CONN_LIFETIME must not be negative, but was -1s",
+			"DB_MAX_CONNS":         "DB_MAX_CONNS must not be negative, but was -1",
+			"DB_MIN_CONNS":         "DB_MIN_CONNS must not be negative, but was -1",
+		} {
+			value := "-1"
+			if env == "DB_MAX_CONN_LIFETIME" {
+				value = "-1s"
+			}
+
+			_, err := makeDBPoolConfig(loadConfig(t, map[string]string{
+				"DATABASE_URL": "postgres://localhost/river_test",
+				env:            value,
+			}))
+			require.EqualError(t, err, expectedErr)
+		}
+	})
+
+	t.Run("MinConnsMoreThanMax", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := makeDBPoolConfig(loadConfig(t, map[string]string{
+			"DATABASE_URL": "postgres://localhost/river_test",
+			"DB_MAX_CONNS": "5",
+			"DB_MIN_CONNS": "10",
+		}))
+		require.EqualError(t, err, "DB_MIN_CONNS must not be more than the pool's maximum of 5 connections, but was 10")
+	})
+
+	t.Run("InvalidURL", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := makeDBPoolConfig(loadConfig(t, map[string]string{
+			"DATABASE_URL": "postgres://localhost/river_test?pool_max_conns=many",
+		}))
+		require.ErrorContains(t, err, "error parsing DATABASE_URL: ")
+	})
+}
+
+func TestParseAccountSenders(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Parses", func(t *testing.T) {
+		t.Parallel()
+
+		accountID := uuid.New()
+		accountSenders, err := parseAccountSenders(&EnvConfig{AccountSenders: `{"` + accountID.String() + `": ["billing@example.com", "support@example.com"]}`})
+		require.NoError(t, err)
+		require.Equal(t, map[uuid.UUID][]string{accountID: {"billing@example.com", "support@example.com"}}, accountSenders)
+	})
+
+	t.Run("Unset", func(t *testing.T) {
+		t.Parallel()
+
+		accountSenders, err := parseAccountSenders(&EnvConfig{})
+		require.NoError(t, err)
+		require.Nil(t, accountSenders)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		t.Parallel()
+
+		accountID := uuid.New().String()
+		for _, tt := range []struct {
+			accountSenders string
+			wantErr        string
+		}{
+			{`["billing@example.com"]`, "ACCOUNT_SENDERS must be a JSON object of account IDs to sender addresses"},
+			{`{"not-a-uuid": ["billing@example.com"]}`, "ACCOUNT_SENDERS must be a JSON object of account IDs to sender addresses"},
+			{`{"` + accountID + `": []}`, "ACCOUNT_SENDERS must include at least one sender for account " + accountID},
+			{`{"` + accountID + `": ["billing"]}`, `ACCOUNT_SENDERS senders must be email addresses, but was "billing"`},
+		} {
+			_, err := parseAccountSenders(&EnvConfig{AccountSenders: tt.accountSenders})
+			require.ErrorContains(t, err, tt.wantErr)
+		}
+	})
+}
+
+func TestMakeRiverConfig(t *testing.T) {
+	t.Parallel()
+
+	// Returns an environment with the minimum required variables set, along
+	// with any overrides.
+	testEnv := func(overrides map[string]string) envconfig.Lookuper {
+		env := map[string]string{
+			"DATABASE_URL": "postgres://localhost/river_test",
+			"SMTP_HOST":    "example.com:1234",
+			"SMTP_PASS":    "not-a-pass",
+			"SMTP_USER":    "not-a-user",
+		}
+		maps.Copy(env, overrides)
+		return envconfig.MapLookuper(env)
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(nil))
+		require.NoError(t, err)
+
+		riverConfig, err := makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.NoError(t, err)
+		require.Equal(t, map[string]river.QueueConfig{
+			queueBulk:          {MaxWorkers: 20},
+			queueScheduled:     {MaxWorkers: 10},
+			queueTransactional: {MaxWorkers: 100},
+		}, riverConfig.Queues)
+	})
+
+	t.Run("MaxWorkersFromEnv", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"BULK_MAX_WORKERS":          "5",
+			"SCHEDULED_MAX_WORKERS":     "3",
+			"TRANSACTIONAL_MAX_WORKERS": "25",
+		}))
+		require.NoError(t, err)
+
+		riverConfig, err := makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.NoError(t, err)
+		require.Equal(t, map[string]river.QueueConfig{
+			queueBulk:          {MaxWorkers: 5},
+			queueScheduled:     {MaxWorkers: 3},
+			queueTransactional: {MaxWorkers: 25},
+		}, riverConfig.Queues)
+	})
+
+	t.Run("FetchDurationsDefaults", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(nil))
+		require.NoError(t, err)
+
+		riverConfig, err := makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.NoError(t, err)
+		require.Equal(t, 100*time.Millisecond, riverConfig.FetchCooldown)
+		require.Equal(t, 1*time.Second, riverConfig.FetchPollInterval)
+	})
+
+	t.Run("FetchDurationsFromEnv", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"FETCH_COOLDOWN":      "250ms",
+			"FETCH_POLL_INTERVAL": "5s",
+		}))
+		require.NoError(t, err)
+
+		riverConfig, err := makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.NoError(t, err)
+		require.Equal(t, 250*time.Millisecond, riverConfig.FetchCooldown)
+		require.Equal(t, 5*time.Second, riverConfig.FetchPollInterval)
+	})
+
+	t.Run("FetchDurationsInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		for _, envVar := range []string{"FETCH_COOLDOWN", "FETCH_POLL_INTERVAL"} {
+			_, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+				envVar: "not-a-duration",
+			}))
+			require.ErrorContains(t, err, `invalid duration "not-a-duration"`)
+		}
+	})
+
+	t.Run("FetchDurationsNonPositive", func(t *testing.T) {
+		t.Parallel()
+
+		for _, envVar := range []string{"FETCH_COOLDOWN", "FETCH_POLL_INTERVAL"} {
+			for _, duration := range []string{"0s", "-1s"} {
+				config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+					envVar: duration,
+				}))
+				require.NoError(t, err)
+
+				_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+				require.EqualError(t, err, envVar+" must be positive, but was "+duration)
+			}
+		}
+	})
+
+	t.Run("JobRetention", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(nil))
+		require.NoError(t, err)
+		require.Equal(t, 7*24*time.Hour, config.JobRetention)
+
+		config, err = loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"JOB_RETENTION": "72h",
+		}))
+		require.NoError(t, err)
+
+		riverConfig, err := makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.NoError(t, err)
+		require.Equal(t, 72*time.Hour, riverConfig.CompletedJobRetentionPeriod)
+		require.Len(t, riverConfig.PeriodicJobs, 1)
+
+		config.JobRetention = 0
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "JOB_RETENTION must be positive, but was 0s")
+	})
+
+	t.Run("JSONCase", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(nil))
+		require.NoError(t, err)
+		require.Equal(t, JSONCaseSnake, config.JSONCase)
+
+		config, err = loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"JSON_CASE": "kebab",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, `JSON_CASE must be "camel" or "snake", but was "kebab"`)
+	})
+
+	t.Run("DedupeByContentPeriodTooShort", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"DEDUPE_BY_CONTENT":        "true",
+			"DEDUPE_BY_CONTENT_PERIOD": "500ms",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "DEDUPE_BY_CONTENT_PERIOD must be at least 1s, but was 500ms")
+
+		// The period doesn't matter unless deduplication is on.
+		config.DedupeByContent = false
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.NoError(t, err)
+	})
+
+	t.Run("IdempotencyScope", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(nil))
+		require.NoError(t, err)
+		require.Equal(t, IdempotencyScopeAccountKey, config.IdempotencyScope)
+
+		config, err = loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"IDEMPOTENCY_SCOPE": "global",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, `IDEMPOTENCY_SCOPE must be "account_key" or "key", but was "global"`)
+	})
+
+	t.Run("DefaultSenderInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"DEFAULT_SENDER": "not-an-email",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, `DEFAULT_SENDER must be an email address, but was "not-an-email"`)
+	})
+
+	t.Run("AccessLogMaxMegabytesNegative", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"ACCESS_LOG_MAX_MEGABYTES": "-1",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "ACCESS_LOG_MAX_MEGABYTES must not be negative, but was -1")
+	})
+
+	t.Run("MaxConcurrentRequestsNegative", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"MAX_CONCURRENT_REQUESTS": "-1",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "MAX_CONCURRENT_REQUESTS must not be negative, but was -1")
+	})
+
+	t.Run("SMTPCooldownNegative", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"SMTP_COOLDOWN": "-1s",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "SMTP_COOLDOWN must not be negative, but was -1s")
+	})
+
+	t.Run("MaxRequestBytesInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"MAX_REQUEST_BYTES": "0",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "MAX_REQUEST_BYTES must be at least 1, but was 0")
+	})
+
+	t.Run("MaxUploadBytesInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"MAX_UPLOAD_BYTES": "0",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "MAX_UPLOAD_BYTES must be at least 1, but was 0")
+	})
+
+	t.Run("SpamPrecheckInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"SPAM_PRECHECK": "block",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, `SPAM_PRECHECK must be empty, "flag", or "reject", but was "block"`)
+	})
+
+	t.Run("RedirectAllToInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"REDIRECT_ALL_TO": "staging-inbox",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, `REDIRECT_ALL_TO must be an email address, but was "staging-inbox"`)
+	})
+
+	t.Run("SMTPMaxMessageBytes", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"SMTP_MAX_MESSAGE_BYTES": "-1",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "SMTP_MAX_MESSAGE_BYTES must not be negative, but was -1")
+	})
+
+	t.Run("SMTPSendRate", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"SMTP_SEND_RATE": "-1",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "SMTP_SEND_RATE must not be negative, but was -1")
+	})
+
+	t.Run("SMTPSendTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"SMTP_SEND_TIMEOUT": "-1s",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "SMTP_SEND_TIMEOUT must not be negative, but was -1s")
+	})
+
+	t.Run("PerDomainConcurrency", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"PER_DOMAIN_CONCURRENCY": "-1",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "PER_DOMAIN_CONCURRENCY must not be negative, but was -1")
+	})
+
+	t.Run("BatchJitter", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"BATCH_JITTER": "-1m",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "BATCH_JITTER must not be negative, but was -1m0s")
+	})
+
+	t.Run("RequestTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"REQUEST_TIMEOUT": "-1s",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "REQUEST_TIMEOUT must not be negative, but was -1s")
+	})
+
+	t.Run("MaxRecipients", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(nil))
+		require.NoError(t, err)
+		require.Equal(t, 50, config.MaxRecipients)
+
+		config.MaxRecipients = 0
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "MAX_RECIPIENTS must be at least 1, but was 0")
+	})
+
+	t.Run("TxMaxRetries", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(nil))
+		require.NoError(t, err)
+		require.Equal(t, 3, config.TxMaxRetries)
+
+		config.TxMaxRetries = -1
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "TX_MAX_RETRIES must not be negative, but was -1")
+	})
+
+	t.Run("SecretFromEnv", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(nil))
+		require.NoError(t, err)
+		require.Equal(t, "not-a-pass", config.SMTPPass)
+	})
+
+	t.Run("SecretFromFile", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "smtp-pass")
+		require.NoError(t, os.WriteFile(path, []byte("pass-from-file\n"), 0o600))
+
+		// The file takes precedence over SMTP_PASS, which testEnv also sets.
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"SMTP_PASS_FILE": path,
+		}))
+		require.NoError(t, err)
+		require.Equal(t, "pass-from-file", config.SMTPPass)
+	})
+
+	t.Run("SecretFileOnly", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "unsubscribe-secret")
+		require.NoError(t, os.WriteFile(path, []byte("secret-from-file \r\n"), 0o600))
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"UNSUBSCRIBE_SECRET_FILE": path,
+		}))
+		require.NoError(t, err)
+		require.Equal(t, "secret-from-file", config.UnsubscribeSecret)
+	})
+
+	t.Run("SecretFileMissing", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "does-not-exist")
+
+		_, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"SMTP_PASS_FILE": path,
+		}))
+		require.ErrorIs(t, err, os.ErrNotExist)
+		require.ErrorContains(t, err, "error reading SMTP_PASS_FILE")
+	})
+
+	t.Run("TLSCertFileWithoutKeyFile", func(t *testing.T) {
+		t.Parallel()
+
+		for _, env := range []map[string]string{
+			{"TLS_CERT_FILE": "cert.pem"},
+			{"TLS_KEY_FILE": "key.pem"},
+		} {
+			config, err := loadEnvConfig(t.Context(), testEnv(env))
+			require.NoError(t, err)
+
+			_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+			require.EqualError(t, err, "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+	})
+
+	t.Run("UnsubscribeSecretRequired", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+			"UNSUBSCRIBE_BASE_URL": "https://api.example.com/unsubscribe",
+		}))
+		require.NoError(t, err)
+
+		_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+		require.EqualError(t, err, "UNSUBSCRIBE_SECRET must be set when UNSUBSCRIBE_BASE_URL is")
+	})
+
+	t.Run("ReplacedQueueEnvVars", func(t *testing.T) {
+		t.Parallel()
+
+		for envVar, expectedErr := range map[string]string{
+			"MAX_WORKERS": "MAX_WORKERS is no longer supported; set BULK_MAX_WORKERS, SCHEDULED_MAX_WORKERS, and TRANSACTIONAL_MAX_WORKERS instead",
+			"QUEUE_NAME":  "QUEUE_NAME is no longer supported; emails are sent from the bulk, scheduled, and transactional queues",
+		} {
+			config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+				envVar: "bulk",
+			}))
+			require.NoError(t, err)
+
+			_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+			require.EqualError(t, err, expectedErr)
+		}
+	})
+
+	t.Run("NonPositiveMaxWorkers", func(t *testing.T) {
+		t.Parallel()
+
+		for _, envVar := range []string{"BULK_MAX_WORKERS", "SCHEDULED_MAX_WORKERS", "TRANSACTIONAL_MAX_WORKERS"} {
+			for _, maxWorkers := range []string{"0", "-1"} {
+				config, err := loadEnvConfig(t.Context(), testEnv(map[string]string{
+					envVar: maxWorkers,
+				}))
+				require.NoError(t, err)
+
+				_, err = makeRiverConfig(config, nil, nil, nil, nil, nil, nil, nil, testTracer)
+				require.EqualError(t, err, envVar+" must be positive, but was "+maxWorkers)
+			}
+		}
+	})
+}
+
+func TestStartRiverClient(t *testing.T) {
+	t.Parallel()
+
+	t.Run("DatabaseUnavailable", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := t.Context()
+
+		// Nothing's listening on a port that was just closed.
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		require.NoError(t, listener.Close())
+
+		dbPool, err := pgxpool.New(ctx, "postgres://user@"+listener.Addr().String()+"/river_test?connect_timeout=5")
+		require.NoError(t, err)
+		t.Cleanup(dbPool.Close)
+
+		config, err := loadEnvConfig(ctx, envconfig.MapLookuper(map[string]string{
+			"DATABASE_URL": "postgres://localhost/river_test",
+			"SMTP_HOST":    "example.com:1234",
+		}))
+		require.NoError(t, err)
+
+		riverConfig, err := makeRiverConfig(config, dbPool, nil, nil, nil, nil, nil, nil, testTracer)
+		require.NoError(t, err)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(dbPool), riverConfig)
+		require.NoError(t, err)
+
+		err = startRiverClient(ctx, riverClient)
+		require.ErrorContains(t, err, "error starting River client: error making initial connection to database")
+	})
+
+	t.Run("NoQueues", func(t *testing.T) {
+		t.Parallel()
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{})
+		require.NoError(t, err)
+
+		err = startRiverClient(t.Context(), riverClient)
+		require.ErrorContains(t, err, "error starting River client: ")
+	})
+}
+
+func TestCleanupEmailJobsWorker(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		riverClient *river.Client[pgx.Tx]
+		tx          pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*CleanupEmailJobsWorker, *testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &CleanupEmailJobsWorker{
+			batchSize: 2,
+			dbPool:    tx,
+			retention: 24 * time.Hour,
+		}, &testBundle{
+			riverClient: riverClient,
+			tx:          tx,
+		}, ctx
+	}
+
+	// Inserts an email job and puts it in the given state as if it'd been
+	// finalized at the given time.
+	insertJob := func(ctx context.Context, t *testing.T, bundle *testBundle, state rivertype.JobState, finalizedAt time.Time) int64 {
+		t.Helper()
+
+		insertRes, err := bundle.riverClient.InsertTx(ctx, bundle.tx, SendEmailArgs{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		}, nil)
+		require.NoError(t, err)
+
+		_, err = bundle.tx.Exec(ctx, "UPDATE river_job SET finalized_at = $1, state = $2 WHERE id = $3", finalizedAt, state, insertRes.Job.ID)
+		require.NoError(t, err)
+
+		return insertRes.Job.ID
+	}
+
+	t.Run("DeletesOldCompletedJobs", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle, ctx := setup(t)
+
+		var (
+			longAgo = time.Now().Add(-48 * time.Hour)
+			recent  = time.Now().Add(-1 * time.Hour)
+		)
+
+		// More old jobs than the batch size to make sure that all batches are
+		// run.
+		var oldJobIDs []int64
+		for range 5 {
+			oldJobIDs = append(oldJobIDs, insertJob(ctx, t, bundle, rivertype.JobStateCompleted, longAgo))
+		}
+
+		var (
+			recentJobID    = insertJob(ctx, t, bundle, rivertype.JobStateCompleted, recent)
+			discardedJobID = insertJob(ctx, t, bundle, rivertype.JobStateDiscarded, longAgo)
+		)
+
+		require.NoError(t, worker.Work(ctx, &river.Job[CleanupEmailJobsArgs]{JobRow: &rivertype.JobRow{}}))
+
+		for _, jobID := range oldJobIDs {
+			_, err := bundle.riverClient.JobGetTx(ctx, bundle.tx, jobID)
+			require.ErrorIs(t, err, river.ErrNotFound)
+		}
+
+		for _, jobID := range []int64{recentJobID, discardedJobID} {
+			_, err := bundle.riverClient.JobGetTx(ctx, bundle.tx, jobID)
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("DeletesOldIdempotencyResponses", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+
+		insertResponse := func(idempotencyKey string, createdAt time.Time) {
+			_, err := bundle.tx.Exec(ctx, `
+				INSERT INTO idempotency_responses (account_id, idempotency_key, status_code, response, created_at)
+				VALUES ($1, $2, 201, '{}', $3)`,
+				accountID, idempotencyKey, createdAt,
+			)
+			require.NoError(t, err)
+		}
+
+		for i := range 5 {
+			insertResponse(fmt.Sprintf("old-%d", i), time.Now().Add(-48*time.Hour))
+		}
+		insertResponse("recent", time.Now().Add(-1*time.Hour))
+
+		require.NoError(t, worker.Work(ctx, &river.Job[CleanupEmailJobsArgs]{JobRow: &rivertype.JobRow{}}))
+
+		var idempotencyKeys []string
+		rows, err := bundle.tx.Query(ctx, "SELECT idempotency_key FROM idempotency_responses WHERE account_id = $1", accountID)
+		require.NoError(t, err)
+		idempotencyKeys, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		require.NoError(t, err)
+		require.Equal(t, []string{"recent"}, idempotencyKeys)
+	})
+
+	t.Run("DeletesOldIdempotencyKeys", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle, ctx := setup(t)
+
+		insertKey := func(uniqueKey string, updatedAt time.Time) {
+			_, err := bundle.tx.Exec(ctx, `
+				INSERT INTO idempotency_keys (unique_key, job_id, updated_at)
+				VALUES ($1, 1, $2)`,
+				[]byte(uniqueKey), updatedAt,
+			)
+			require.NoError(t, err)
+		}
+
+		// Keys outlive their jobs, so one that's only past the retention
+		// window is kept.
+		for i := range 5 {
+			insertKey(fmt.Sprintf("old-%d", i), time.Now().Add(-48*time.Hour-idempotencyKeyRetention))
+		}
+		insertKey("past-retention", time.Now().Add(-48*time.Hour))
+
+		require.NoError(t, worker.Work(ctx, &river.Job[CleanupEmailJobsArgs]{JobRow: &rivertype.JobRow{}}))
+
+		rows, err := bundle.tx.Query(ctx, "SELECT convert_from(unique_key, 'UTF8') FROM idempotency_keys WHERE job_id = 1")
+		require.NoError(t, err)
+		uniqueKeys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		require.NoError(t, err)
+		require.Equal(t, []string{"past-retention"}, uniqueKeys)
+	})
+}
+
+func TestSendEmailWorker(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		sender *fakeEmailSender
+	}
+
+	setup := func(t *testing.T) (*SendEmailWorker, *testBundle) {
+		t.Helper()
+
+		sender := &fakeEmailSender{}
+
+		return &SendEmailWorker{sender: sender, tracer: testTracer}, &testBundle{sender: sender}
+	}
+
+	testJob := func(overrides *SendEmailArgs) *river.Job[SendEmailArgs] {
+		if overrides == nil {
+			overrides = &SendEmailArgs{}
+		}
+
+		return &river.Job[SendEmailArgs]{
+			JobRow: &rivertype.JobRow{ID: 123},
+			Args: SendEmailArgs{
+				AccountID:      cmp.Or(overrides.AccountID, uuid.New()),
+				Attachments:    overrides.Attachments,
+				Bcc:            overrides.Bcc,
+				Body:           cmp.Or(overrides.Body, "Hello from River's idempotent mail demo."),
+				BodyHTML:       overrides.BodyHTML,
+				Cc:             overrides.Cc,
+				Charset:        overrides.Charset,
+				EmailRecipient: cmp.Or(overrides.EmailRecipient, "receiver@example.com"),
+				EmailSender:    cmp.Or(overrides.EmailSender, "sender@example.com"),
+				Headers:        overrides.Headers,
+				IdempotencyKey: cmp.Or(overrides.IdempotencyKey, uuid.NewString()),
+				InReplyTo:      overrides.InReplyTo,
+				MessageID:      overrides.MessageID,
+				RawMessage:     overrides.RawMessage,
+				References:     overrides.References,
+				ReplyTo:        overrides.ReplyTo,
+				ReturnPath:     overrides.ReturnPath,
+				SenderName:     overrides.SenderName,
+				Subject:        cmp.Or(overrides.Subject, "Hello."),
+				Template:       overrides.Template,
+				TemplateData:   overrides.TemplateData,
+				TemplateLocale: overrides.TemplateLocale,
+				TraceContext:   overrides.TraceContext,
+				Track:          overrides.Track,
+				UnsubscribeURL: overrides.UnsubscribeURL,
+			},
+		}
+	}
+
+	// Parses a sent multipart message into the bodies of its parts, keyed by
+	// content type.
+	messageParts := func(t *testing.T, sent *fakeSentEmail) map[string]string {
+		t.Helper()
+
+		msg, err := mail.ReadMessage(bytes.NewReader(sent.Message))
+		require.NoError(t, err)
+
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		require.Equal(t, "multipart/alternative", mediaType)
+
+		parts := make(map[string]string)
+		reader := multipart.NewReader(msg.Body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+
+			body, err := io.ReadAll(part)
+			require.NoError(t, err)
+			parts[part.Header.Get("Content-Type")] = string(body)
+		}
+		return parts
+	}
+
+	t.Run("SendsEmail", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(nil)))
+		require.Equal(t, []*fakeSentEmail{
+			{
+				From: "sender@example.com",
+				To:   []string{"receiver@example.com"},
+				Message: []byte("From: sender@example.com\r\n" +
+					"To: receiver@example.com\r\n" +
+					"Subject: Hello.\r\n" +
+					"\r\n" +
+					"Hello from River's idempotent mail demo.\r\n"),
+			},
+		}, bundle.sender.sent)
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		encrypter, err := newEmailEncrypter(generateEncryptionKey(t))
+		require.NoError(t, err)
+		worker.encrypter = encrypter
+
+		job := testJob(&SendEmailArgs{Cc: []string{"manager@example.com"}})
+		require.NoError(t, encrypter.encrypt(&job.Args))
+		require.Empty(t, job.Args.Body)
+
+		require.NoError(t, worker.Work(t.Context(), job))
+		require.Equal(t, []*fakeSentEmail{
+			{
+				From: "sender@example.com",
+				To:   []string{"receiver@example.com", "manager@example.com"},
+				Message: []byte("From: sender@example.com\r\n" +
+					"To: receiver@example.com\r\n" +
+					"Cc: manager@example.com\r\n" +
+					"Subject: Hello.\r\n" +
+					"\r\n" +
+					"Hello from River's idempotent mail demo.\r\n"),
+			},
+		}, bundle.sender.sent)
+	})
+
+	t.Run("EncryptedWithoutKey", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		encrypter, err := newEmailEncrypter(generateEncryptionKey(t))
+		require.NoError(t, err)
+
+		job := testJob(nil)
+		require.NoError(t, encrypter.encrypt(&job.Args))
+
+		require.EqualError(t, worker.Work(t.Context(), job), "email is encrypted, but ENCRYPTION_KEY isn't set")
+		require.Empty(t, bundle.sender.sent)
+	})
+
+	t.Run("LogsRedacted", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		var logBuf bytes.Buffer
+		logger, err := newLogger(&logBuf, LogRedactTruncate)
+		require.NoError(t, err)
+		worker.logger = logger
+
+		body := strings.Repeat("Hello from River's idempotent mail demo. ", 3)
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{Body: body, Cc: []string{"manager@example.com"}})))
+
+		var logged struct {
+			Email struct {
+				Body           string   `json:"body"`
+				Cc             []string `json:"cc"`
+				EmailRecipient string   `json:"email_recipient"`
+			} `json:"email"`
+			JobID int64  `json:"job_id"`
+			Msg   string `json:"msg"`
+		}
+		require.NoError(t, json.Unmarshal(logBuf.Bytes(), &logged))
+		require.Equal(t, "Sent email", logged.Msg)
+		require.Equal(t, int64(123), logged.JobID)
+		require.Equal(t, "Hello from River's idempotent ma…", logged.Email.Body)
+		require.Equal(t, []string{"m…@example.com"}, logged.Email.Cc)
+		require.Equal(t, "r…@example.com", logged.Email.EmailRecipient)
+
+		// What's sent is unaffected.
+		require.Len(t, bundle.sender.sent, 1)
+		require.Contains(t, string(bundle.sender.sent[0].Message), body)
+		require.Equal(t, []string{"receiver@example.com", "manager@example.com"}, bundle.sender.sent[0].To)
+	})
+
+	t.Run("DomainSenders", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		var (
+			senderA = &fakeEmailSender{}
+			senderB = &fakeEmailSender{}
+		)
+		worker.domainSenders = map[string]EmailSender{
+			"brand-a.example.com": senderA,
+			"brand-b.example.com": senderB,
+		}
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{EmailSender: "hello@brand-a.example.com"})))
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{EmailSender: "hello@Brand-B.example.com"})))
+
+		require.Len(t, senderA.sent, 1)
+		require.Equal(t, "hello@brand-a.example.com", senderA.sent[0].From)
+		require.Len(t, senderB.sent, 1)
+		require.Equal(t, "hello@Brand-B.example.com", senderB.sent[0].From)
+		require.Empty(t, bundle.sender.sent)
+	})
+
+	t.Run("DomainSendersUnconfiguredDomain", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		senderA := &fakeEmailSender{}
+		worker.domainSenders = map[string]EmailSender{"brand-a.example.com": senderA}
+
+		err := worker.Work(t.Context(), testJob(&SendEmailArgs{EmailSender: "hello@brand-c.example.com"}))
+		var cancelErr *river.JobCancelError
+		require.ErrorAs(t, err, &cancelErr)
+		require.ErrorContains(t, err, `sender domain "brand-c.example.com" isn't configured in SMTP_DOMAINS`)
+		require.Empty(t, senderA.sent)
+		require.Empty(t, bundle.sender.sent)
+	})
+
+	t.Run("DeliveryLatency", func(t *testing.T) {
+		t.Parallel()
+
+		worker, _ := setup(t)
+		worker.metrics = newMetrics()
+
+		job := testJob(nil)
+		job.CreatedAt = time.Now().Add(-3 * time.Second)
+
+		require.NoError(t, worker.Work(t.Context(), job))
+
+		var metric dto.Metric
+		require.NoError(t, worker.metrics.emailDeliveryLatency.Write(&metric))
+		require.Equal(t, uint64(1), metric.GetHistogram().GetSampleCount())
+		require.InDelta(t, 3, metric.GetHistogram().GetSampleSum(), 1)
+
+		// A failed send isn't a delivery.
+		worker.sender = &fakeEmailSender{err: errors.New("smtp error")}
+		require.Error(t, worker.Work(t.Context(), testJob(nil)))
+
+		require.NoError(t, worker.metrics.emailDeliveryLatency.Write(&metric))
+		require.Equal(t, uint64(1), metric.GetHistogram().GetSampleCount())
+	})
+
+	t.Run("CustomHeaders", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{Headers: map[string]string{
+			"X-Campaign-ID":    "spring-sale",
+			"List-Unsubscribe": "<https://example.com/unsubscribe>",
+		}})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, "From: sender@example.com\r\n"+
+			"To: receiver@example.com\r\n"+
+			"Subject: Hello.\r\n"+
+			"List-Unsubscribe: <https://example.com/unsubscribe>\r\n"+
+			"X-Campaign-ID: spring-sale\r\n"+
+			"\r\n"+
+			"Hello from River's idempotent mail demo.\r\n", string(bundle.sender.sent[0].Message))
+	})
+
+	t.Run("CustomHeadersDeniedSkipped", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{Headers: map[string]string{
+			"to": "attacker@example.com",
+		}})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.NotContains(t, string(bundle.sender.sent[0].Message), "attacker@example.com")
+	})
+
+	t.Run("ReplyTo", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{ReplyTo: "support@example.com"})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, "From: sender@example.com\r\n"+
+			"Reply-To: support@example.com\r\n"+
+			"To: receiver@example.com\r\n"+
+			"Subject: Hello.\r\n"+
+			"\r\n"+
+			"Hello from River's idempotent mail demo.\r\n", string(bundle.sender.sent[0].Message))
+	})
+
+	t.Run("MessageID", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{MessageID: "<0b6a3d4e-a5a8-5b8e-9a52-2c3e0a1b7f10@example.com>"})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, "From: sender@example.com\r\n"+
+			"To: receiver@example.com\r\n"+
+			"Subject: Hello.\r\n"+
+			"Message-ID: <0b6a3d4e-a5a8-5b8e-9a52-2c3e0a1b7f10@example.com>\r\n"+
+			"\r\n"+
+			"Hello from River's idempotent mail demo.\r\n", string(bundle.sender.sent[0].Message))
+	})
+
+	t.Run("ThreadingHeaders", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{
+			InReplyTo:  "<second@example.com>",
+			References: []string{"<first@example.com>", "<second@example.com>"},
+		})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, "From: sender@example.com\r\n"+
+			"To: receiver@example.com\r\n"+
+			"Subject: Hello.\r\n"+
+			"In-Reply-To: <second@example.com>\r\n"+
+			"References: <first@example.com> <second@example.com>\r\n"+
+			"\r\n"+
+			"Hello from River's idempotent mail demo.\r\n", string(bundle.sender.sent[0].Message))
+
+		msg, err := mail.ReadMessage(bytes.NewReader(bundle.sender.sent[0].Message))
+		require.NoError(t, err)
+		require.Equal(t, "<second@example.com>", msg.Header.Get("In-Reply-To"))
+	})
+
+	t.Run("RawMessage", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.trackingBaseURL = "https://track.example.com/open"
+		worker.unsubscribeBaseURL = "https://example.com/unsubscribe"
+
+		// Nothing is added to a raw message, even in the bulk queue where an
+		// unsubscribe URL would otherwise be.
+		rawMessage := []byte("Subject: Built elsewhere\r\n\r\nHello.\r\n")
+		job := testJob(&SendEmailArgs{Cc: []string{"manager@example.com"}, RawMessage: rawMessage})
+		job.Queue = queueBulk
+
+		require.NoError(t, worker.Work(t.Context(), job))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, "sender@example.com", bundle.sender.sent[0].From)
+		require.Equal(t, []string{"receiver@example.com", "manager@example.com"}, bundle.sender.sent[0].To)
+		require.Equal(t, rawMessage, bundle.sender.sent[0].Message)
+	})
+
+	t.Run("CcAndBcc", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{
+			Bcc: []string{"audit@example.com"},
+			Cc:  []string{"manager@example.com", "team@example.com"},
+		})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, []string{"receiver@example.com", "manager@example.com", "team@example.com", "audit@example.com"}, bundle.sender.sent[0].To)
+
+		// Bcc recipients get the message but aren't named in it.
+		require.Equal(t, "From: sender@example.com\r\n"+
+			"To: receiver@example.com\r\n"+
+			"Cc: manager@example.com, team@example.com\r\n"+
+			"Subject: Hello.\r\n"+
+			"\r\n"+
+			"Hello from River's idempotent mail demo.\r\n", string(bundle.sender.sent[0].Message))
+	})
+
+	t.Run("SenderName", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{SenderName: "Acme Support"})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.True(t, strings.HasPrefix(string(bundle.sender.sent[0].Message), "From: \"Acme Support\" <sender@example.com>\r\n"))
+		require.Equal(t, "sender@example.com", bundle.sender.sent[0].From)
+	})
+
+	t.Run("SenderNameUTF8", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{SenderName: "Café Zoë"})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.True(t, strings.HasPrefix(string(bundle.sender.sent[0].Message), "From: =?utf-8?q?Caf=C3=A9_Zo=C3=AB?= <sender@example.com>\r\n"))
+
+		msg, err := mail.ReadMessage(bytes.NewReader(bundle.sender.sent[0].Message))
+		require.NoError(t, err)
+		from, err := msg.Header.AddressList("From")
+		require.NoError(t, err)
+		require.Equal(t, []*mail.Address{{Name: "Café Zoë", Address: "sender@example.com"}}, from)
+	})
+
+	t.Run("SubjectASCII", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{Subject: "Your order (#123) has shipped!"})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Contains(t, string(bundle.sender.sent[0].Message), "\r\nSubject: Your order (#123) has shipped!\r\n")
+	})
+
+	t.Run("SubjectNonASCII", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{Subject: "Crème brûlée 🍮"})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Contains(t, string(bundle.sender.sent[0].Message), "\r\nSubject: =?utf-8?q?Cr=C3=A8me_br=C3=BBl=C3=A9e_=F0=9F=8D=AE?=\r\n")
+
+		msg, err := mail.ReadMessage(bytes.NewReader(bundle.sender.sent[0].Message))
+		require.NoError(t, err)
+		subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		require.NoError(t, err)
+		require.Equal(t, "Crème brûlée 🍮", subject)
+	})
+
+	t.Run("TemplateRenderedAtSend", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		var err error
+		worker.templates, err = loadEmailTemplates(testTemplatesFS)
+		require.NoError(t, err)
+
+		var (
+			accountID      = uuid.New()
+			idempotencyKey = uuid.NewString()
+			templateData   = map[string]any{"name": "Ada"}
+		)
+
+		rendered, err := worker.templates.render("welcome", "fr", templateData)
+		require.NoError(t, err)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{
+			AccountID:      accountID,
+			Body:           rendered.Body,
+			BodyHTML:       rendered.BodyHTML,
+			IdempotencyKey: idempotencyKey,
+			Subject:        rendered.Subject,
+		})))
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{
+			AccountID:      accountID,
+			IdempotencyKey: idempotencyKey,
+			Template:       "welcome",
+			TemplateData:   templateData,
+			TemplateLocale: "fr",
+		})))
+		require.Len(t, bundle.sender.sent, 2)
+
+		// The messages are the same apart from their multipart boundaries,
+		// which are random.
+		headers := make([]mail.Header, 2)
+		for i, sent := range bundle.sender.sent {
+			msg, err := mail.ReadMessage(bytes.NewReader(sent.Message))
+			require.NoError(t, err)
+			delete(msg.Header, "Content-Type")
+			headers[i] = msg.Header
+		}
+		require.Equal(t, headers[0], headers[1])
+		require.Equal(t, "Bienvenue, Ada !", headers[1].Get("Subject"))
+		require.Equal(t, messageParts(t, bundle.sender.sent[0]), messageParts(t, bundle.sender.sent[1]))
+	})
+
+	t.Run("TemplateRenderedAtSendUnknown", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		err := worker.Work(t.Context(), testJob(&SendEmailArgs{Template: "goodbye"}))
+		var cancelErr *river.JobCancelError
+		require.ErrorAs(t, err, &cancelErr)
+		require.ErrorContains(t, err, `Unknown template "goodbye".`)
+		require.Empty(t, bundle.sender.sent)
+	})
+
+	t.Run("SubjectPrefixAndSuffix", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.subjectPrefix = "[STAGING]"
+		worker.subjectSuffix = "(test)"
+
+		job := testJob(nil)
+		require.NoError(t, worker.Work(t.Context(), job))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Contains(t, string(bundle.sender.sent[0].Message), "Subject: [STAGING] Hello. (test)\r\n")
+
+		// The job's args are left alone so a retry isn't prefixed twice.
+		require.Equal(t, "Hello.", job.Args.Subject)
+	})
+
+	t.Run("SubjectPrefixSkipsRawMessage", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.subjectPrefix = "[STAGING]"
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{RawMessage: []byte("Subject: Hello.\r\n\r\nHello.\r\n")})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, "Subject: Hello.\r\n\r\nHello.\r\n", string(bundle.sender.sent[0].Message))
+	})
+
+	t.Run("RedirectAllTo", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.redirectAllTo = "staging-inbox@example.com"
+
+		job := testJob(&SendEmailArgs{Bcc: []string{"audit@example.com"}, Cc: []string{"manager@example.com"}})
+		require.NoError(t, worker.Work(t.Context(), job))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, []string{"staging-inbox@example.com"}, bundle.sender.sent[0].To)
+
+		msg := string(bundle.sender.sent[0].Message)
+		require.True(t, strings.HasPrefix(msg, "X-Original-To: receiver@example.com, manager@example.com, audit@example.com\r\n"), msg)
+		require.Contains(t, msg, "\r\nTo: receiver@example.com\r\n")
+
+		// The job keeps its real recipients.
+		require.Equal(t, "receiver@example.com", job.Args.EmailRecipient)
+		require.Equal(t, []string{"manager@example.com"}, job.Args.Cc)
+		require.Equal(t, []string{"audit@example.com"}, job.Args.Bcc)
+	})
+
+	t.Run("RedirectAllToRawMessage", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.redirectAllTo = "staging-inbox@example.com"
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{RawMessage: []byte("Subject: Hello.\r\n\r\nHello.\r\n")})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, []string{"staging-inbox@example.com"}, bundle.sender.sent[0].To)
+		require.Equal(t, "X-Original-To: receiver@example.com\r\nSubject: Hello.\r\n\r\nHello.\r\n", string(bundle.sender.sent[0].Message))
+	})
+
+	t.Run("RedirectAllToUnset", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(nil)))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, []string{"receiver@example.com"}, bundle.sender.sent[0].To)
+		require.NotContains(t, string(bundle.sender.sent[0].Message), "X-Original-To:")
+	})
+
+	t.Run("MaxMessageBytes", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		job := testJob(nil)
+		worker.maxMessageBytes = len(buildMessage(&job.Args))
+
+		require.NoError(t, worker.Work(t.Context(), job))
+		require.Len(t, bundle.sender.sent, 1)
+	})
+
+	t.Run("MaxMessageBytesExceeded", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		job := testJob(nil)
+		worker.maxMessageBytes = len(buildMessage(&job.Args)) - 1
+
+		err := worker.Work(t.Context(), job)
+		var cancelErr *river.JobCancelError
+		require.ErrorAs(t, err, &cancelErr)
+		require.ErrorContains(t, err, fmt.Sprintf("message is %d bytes, which is more than the SMTP_MAX_MESSAGE_BYTES limit of %d", worker.maxMessageBytes+1, worker.maxMessageBytes))
+		require.Empty(t, bundle.sender.sent)
+	})
+
+	t.Run("SendRateLimit", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		const (
+			numJobs  = 20
+			sendRate = 100
+		)
+		worker.limiter = rate.NewLimiter(sendRate, 1)
+
+		start := time.Now()
+
+		var wg sync.WaitGroup
+		for range numJobs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.NoError(t, worker.Work(t.Context(), testJob(nil)))
+			}()
+		}
+		wg.Wait()
+
+		elapsed := time.Since(start)
+		require.Len(t, bundle.sender.sent, numJobs)
+
+		// The first send goes out immediately and each after it waits its turn.
+		observedRate := float64(numJobs-1) / elapsed.Seconds()
+		require.LessOrEqual(t, observedRate, sendRate*1.05, "Sent %d emails in %s", numJobs, elapsed)
+	})
+
+	t.Run("SendRateLimitRespectsContext", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.limiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(nil)))
+
+		ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+		defer cancel()
+
+		require.Error(t, worker.Work(ctx, testJob(nil)))
+		require.Len(t, bundle.sender.sent, 1)
+	})
+
+	t.Run("PerDomainConcurrency", func(t *testing.T) {
+		t.Parallel()
+
+		worker, _ := setup(t)
+
+		const (
+			limit   = 3
+			numJobs = 20
+		)
+		worker.domainLimiter = newDomainLimiter(limit)
+
+		sender := &concurrencyTrackingSender{sendDuration: 5 * time.Millisecond}
+		worker.sender = sender
+
+		var wg sync.WaitGroup
+		for range numJobs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{EmailRecipient: "receiver@Example.com"})))
+			}()
+		}
+		wg.Wait()
+
+		require.Equal(t, numJobs, sender.numSent)
+		require.LessOrEqual(t, sender.maxInProgress, limit)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		t.Parallel()
+
+		worker, _ := setup(t)
+		require.Zero(t, worker.Timeout(testJob(nil)))
+
+		worker.sendTimeout = 30 * time.Second
+		require.Equal(t, 30*time.Second, worker.Timeout(testJob(nil)))
+	})
+
+	t.Run("HTMLBody", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{BodyHTML: "<p>Hello from River's idempotent mail demo.</p>"})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Contains(t, string(bundle.sender.sent[0].Message), "MIME-Version: 1.0\r\n")
+		require.Equal(t, map[string]string{
+			"text/plain; charset=utf-8": "Hello from River's idempotent mail demo.\r\n",
+			"text/html; charset=utf-8":  "<p>Hello from River's idempotent mail demo.</p>\r\n",
+		}, messageParts(t, bundle.sender.sent[0]))
+	})
+
+	t.Run("Attachments", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		content := bytes.Repeat([]byte("%PDF-1.7 "), 20)
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{Attachments: []*EmailAttachment{
+			{Content: content, ContentType: "application/pdf", Filename: "invoice.pdf"},
+			{Content: []byte("a,b\n"), Filename: "résumé.csv"},
+		}})))
+		require.Len(t, bundle.sender.sent, 1)
+
+		msg, err := mail.ReadMessage(bytes.NewReader(bundle.sender.sent[0].Message))
+		require.NoError(t, err)
+		require.Equal(t, "1.0", msg.Header.Get("MIME-Version"))
+
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		require.Equal(t, "multipart/mixed", mediaType)
+
+		var parts []*multipart.Part
+		var bodies []string
+		reader := multipart.NewReader(msg.Body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+
+			body, err := io.ReadAll(part)
+			require.NoError(t, err)
+			parts, bodies = append(parts, part), append(bodies, string(body))
+		}
+		require.Len(t, parts, 3)
+
+		require.Equal(t, "text/plain; charset=utf-8", parts[0].Header.Get("Content-Type"))
+		require.Equal(t, "Hello from River's idempotent mail demo.\r\n", bodies[0])
+
+		require.Equal(t, "application/pdf", parts[1].Header.Get("Content-Type"))
+		require.Equal(t, "invoice.pdf", parts[1].FileName())
+		for _, line := range strings.Split(strings.TrimSuffix(bodies[1], "\r\n"), "\r\n") {
+			require.LessOrEqual(t, len(line), 76)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(bodies[1], "\r\n", ""))
+		require.NoError(t, err)
+		require.Equal(t, content, decoded)
+
+		require.Equal(t, attachmentContentTypeDefault, parts[2].Header.Get("Content-Type"))
+		require.Equal(t, "résumé.csv", parts[2].FileName())
+	})
+
+	t.Run("Charset", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{Body: "Café ouvert.", Charset: "iso-8859-1"})))
+		require.Len(t, bundle.sender.sent, 1)
+
+		msg, err := mail.ReadMessage(bytes.NewReader(bundle.sender.sent[0].Message))
+		require.NoError(t, err)
+		require.Equal(t, "text/plain; charset=iso-8859-1", msg.Header.Get("Content-Type"))
+
+		body, err := io.ReadAll(msg.Body)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Caf\xe9 ouvert.\r\n"), body)
+	})
+
+	t.Run("CharsetHTMLBody", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{
+			Body:     "Café ouvert.",
+			BodyHTML: "<p>Café ouvert.</p>",
+			Charset:  "iso-8859-1",
+		})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, map[string]string{
+			"text/plain; charset=iso-8859-1": "Caf\xe9 ouvert.\r\n",
+			"text/html; charset=iso-8859-1":  "<p>Caf\xe9 ouvert.</p>\r\n",
+		}, messageParts(t, bundle.sender.sent[0]))
+	})
+
+	t.Run("CharsetUnrepresentable", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		err := worker.Work(t.Context(), testJob(&SendEmailArgs{Body: "Hello 👋", Charset: "iso-8859-1"}))
+		var cancelErr *river.JobCancelError
+		require.ErrorAs(t, err, &cancelErr)
+		require.Empty(t, bundle.sender.sent)
+	})
+
+	t.Run("TrackingPixel", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.trackingBaseURL = "https://track.example.com/open"
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{
+			BodyHTML: "<html><body><p>Hello.</p></body></html>",
+			Track:    true,
+		})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t,
+			`<html><body><p>Hello.</p><img src="https://track.example.com/open/123" width="1" height="1" alt="" style="display:none"></body></html>`+"\r\n",
+			messageParts(t, bundle.sender.sent[0])["text/html; charset=utf-8"])
+	})
+
+	t.Run("TrackingPixelWithoutBodyTag", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.trackingBaseURL = "https://track.example.com/open"
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{
+			BodyHTML: "<p>Hello.</p>",
+			Track:    true,
+		})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t,
+			`<p>Hello.</p><img src="https://track.example.com/open/123" width="1" height="1" alt="" style="display:none">`+"\r\n",
+			messageParts(t, bundle.sender.sent[0])["text/html; charset=utf-8"])
+	})
+
+	t.Run("TrackingNotRequested", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.trackingBaseURL = "https://track.example.com/open"
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{BodyHTML: "<p>Hello.</p>"})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.NotContains(t, string(bundle.sender.sent[0].Message), "<img")
+	})
+
+	t.Run("TrackingNotConfigured", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{BodyHTML: "<p>Hello.</p>", Track: true})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.NotContains(t, string(bundle.sender.sent[0].Message), "<img")
+	})
+
+	t.Run("TrackingSkipsPlainText", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.trackingBaseURL = "https://track.example.com/open"
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{Track: true})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.NotContains(t, string(bundle.sender.sent[0].Message), "<img")
+	})
+
+	t.Run("UnsubscribeURL", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{UnsubscribeURL: "https://example.com/unsubscribe?id=abc"})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, "From: sender@example.com\r\n"+
+			"To: receiver@example.com\r\n"+
+			"Subject: Hello.\r\n"+
+			"List-Unsubscribe: <https://example.com/unsubscribe?id=abc>\r\n"+
+			"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n"+
+			"\r\n"+
+			"Hello from River's idempotent mail demo.\r\n", string(bundle.sender.sent[0].Message))
+	})
+
+	t.Run("UnsubscribeURLDerivedForBulk", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.unsubscribeBaseURL = "https://api.example.com/unsubscribe"
+		worker.unsubscribeSecret = []byte("a-secret")
+
+		job := testJob(nil)
+		job.Queue = queueBulk
+
+		require.NoError(t, worker.Work(t.Context(), job))
+		require.Len(t, bundle.sender.sent, 1)
+
+		msg, err := mail.ReadMessage(bytes.NewReader(bundle.sender.sent[0].Message))
+		require.NoError(t, err)
+		require.Equal(t, "List-Unsubscribe=One-Click", msg.Header.Get("List-Unsubscribe-Post"))
+
+		listUnsubscribe := msg.Header.Get("List-Unsubscribe")
+		require.True(t, strings.HasPrefix(listUnsubscribe, "<") && strings.HasSuffix(listUnsubscribe, ">"), "Header should be a bracketed URL: %s", listUnsubscribe)
+
+		unsubscribeURL, err := url.Parse(strings.Trim(listUnsubscribe, "<>"))
+		require.NoError(t, err)
+		require.Equal(t, "https://api.example.com/unsubscribe", unsubscribeURL.Scheme+"://"+unsubscribeURL.Host+unsubscribeURL.Path)
+
+		accountID, email, err := parseUnsubscribeToken(worker.unsubscribeSecret, unsubscribeURL.Query().Get("token"))
+		require.NoError(t, err)
+		require.Equal(t, job.Args.AccountID, accountID)
+		require.Equal(t, "receiver@example.com", email)
+	})
+
+	t.Run("UnsubscribeURLReplacesCustomHeaders", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{
+			Headers:        map[string]string{"list-unsubscribe": "<mailto:unsubscribe@example.com>"},
+			UnsubscribeURL: "https://example.com/unsubscribe?id=abc",
+		})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.NotContains(t, string(bundle.sender.sent[0].Message), "mailto:")
+		require.Contains(t, string(bundle.sender.sent[0].Message), "List-Unsubscribe: <https://example.com/unsubscribe?id=abc>\r\n")
+	})
+
+	t.Run("UnsubscribeURLNotDerivedWithCustomHeader", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.unsubscribeBaseURL = "https://api.example.com/unsubscribe"
+		worker.unsubscribeSecret = []byte("a-secret")
+
+		job := testJob(&SendEmailArgs{Headers: map[string]string{"List-Unsubscribe": "<mailto:unsubscribe@example.com>"}})
+		job.Queue = queueBulk
+
+		require.NoError(t, worker.Work(t.Context(), job))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Contains(t, string(bundle.sender.sent[0].Message), "List-Unsubscribe: <mailto:unsubscribe@example.com>\r\n")
+		require.NotContains(t, string(bundle.sender.sent[0].Message), "List-Unsubscribe-Post")
+	})
+
+	t.Run("UnsubscribeURLNotDerivedForTransactional", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.unsubscribeBaseURL = "https://api.example.com/unsubscribe"
+		worker.unsubscribeSecret = []byte("a-secret")
+
+		job := testJob(nil)
+		job.Queue = queueTransactional
+
+		require.NoError(t, worker.Work(t.Context(), job))
+		require.Len(t, bundle.sender.sent, 1)
+		require.NotContains(t, string(bundle.sender.sent[0].Message), "List-Unsubscribe")
+	})
+
+	t.Run("RecordsSpan", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+
+		exporter := tracetest.NewInMemoryExporter()
+		worker.tracer = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)).Tracer(tracerName)
+
+		// Trace context as it'd have been stored in args by EmailCreate.
+		ctx, parentSpan := sdktrace.NewTracerProvider().Tracer(tracerName).Start(t.Context(), "EmailCreate insert")
+		parentSpan.End()
+
+		traceContext := make(map[string]string)
+		tracePropagator.Inject(ctx, propagation.MapCarrier(traceContext))
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{TraceContext: traceContext})))
+		require.Len(t, bundle.sender.sent, 1)
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 1)
+		require.Equal(t, "SendEmailWorker send", spans[0].Name)
+		require.Equal(t, parentSpan.SpanContext().TraceID(), spans[0].SpanContext.TraceID())
+		require.Equal(t, parentSpan.SpanContext().SpanID(), spans[0].Parent.SpanID())
+	})
+
+	t.Run("ReturnPathFromConfig", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.returnPath = "bounces@example.com"
+
+		require.NoError(t, worker.Work(t.Context(), testJob(nil)))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, "bounces@example.com", bundle.sender.sent[0].From)
+		require.Contains(t, string(bundle.sender.sent[0].Message), "From: sender@example.com\r\n")
+	})
+
+	t.Run("ReturnPathFromArgs", func(t *testing.T) {
+		t.Parallel()
+
+		worker, bundle := setup(t)
+		worker.returnPath = "bounces@example.com"
+
+		require.NoError(t, worker.Work(t.Context(), testJob(&SendEmailArgs{ReturnPath: "message-bounces@example.com"})))
+		require.Len(t, bundle.sender.sent, 1)
+		require.Equal(t, "message-bounces@example.com", bundle.sender.sent[0].From)
+		require.Contains(t, string(bundle.sender.sent[0].Message), "From: sender@example.com\r\n")
+	})
+}
+
+// failingCommitTx is a transaction whose commit fails with err, rolling it
+// back instead.
+type failingCommitTx struct {
+	pgx.Tx
+	err error
+}
+
+func (tx *failingCommitTx) Commit(ctx context.Context) error {
+	if err := tx.Rollback(ctx); err != nil {
+		return err
+	}
+	return tx.err
+}
+
+// concurrencyTrackingSender is an EmailSender whose sends take a while,
+// tracking the most that were ever in progress at once.
+type concurrencyTrackingSender struct {
+	sendDuration time.Duration
+
+	mu            sync.Mutex
+	inProgress    int
+	maxInProgress int
+	numSent       int
+}
+
+func (s *concurrencyTrackingSender) SendMail(ctx context.Context, from string, to []string, msg []byte) error {
+	s.mu.Lock()
+	s.inProgress++
+	s.maxInProgress = max(s.maxInProgress, s.inProgress)
+	s.mu.Unlock()
+
+	time.Sleep(s.sendDuration)
+
+	s.mu.Lock()
+	s.inProgress--
+	s.numSent++
+	s.mu.Unlock()
+	return nil
+}
+
+// fakeEmailSender is an EmailSender that records messages instead of sending
+// them.
+type fakeEmailSender struct {
+	// err is returned from every send, which is then not recorded.
+	err error
+
+	mu   sync.Mutex
+	sent []*fakeSentEmail
+}
+
+type fakeSentEmail struct {
+	From    string
+	To      []string
+	Message []byte
+}
+
+func (s *fakeEmailSender) SendMail(ctx context.Context, from string, to []string, msg []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sent = append(s.sent, &fakeSentEmail{From: from, To: to, Message: msg})
+	return nil
+}
+
+func TestMakeHandlerCompression(t *testing.T) {
+	t.Parallel()
+
+	// Serves a preview response with a body of the given size.
+	serve := func(t *testing.T, bodySize int, acceptEncoding string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		handler := MakeHandler(func(ctx context.Context, req *HandleEmailPreviewRequest) (*HandleEmailPreviewResponse, error) {
+			return &HandleEmailPreviewResponse{Body: strings.Repeat("x", bodySize), Subject: "Hello."}, nil
+		}, nil)
+
+		req := httptest.NewRequest(http.MethodPost, "/emails/preview", strings.NewReader(`{"template":"welcome"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, "Accept-Encoding", recorder.Header().Get("Vary"))
+		return recorder
+	}
+
+	expectedJSON := func(bodySize int) string {
+		return `{"body":"` + strings.Repeat("x", bodySize) + `","subject":"Hello."}`
+	}
+
+	t.Run("LargeResponseGzipped", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := serve(t, 10_000, "gzip, deflate, br")
+		require.Equal(t, "gzip", recorder.Header().Get("Content-Encoding"))
+		require.Less(t, recorder.Body.Len(), 10_000)
+
+		gzipReader, err := gzip.NewReader(recorder.Body)
+		require.NoError(t, err)
+		data, err := io.ReadAll(gzipReader)
+		require.NoError(t, err)
+		require.JSONEq(t, expectedJSON(10_000), string(data))
+	})
+
+	t.Run("LargeResponseWithoutAcceptEncoding", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := serve(t, 10_000, "")
+		require.Empty(t, recorder.Header().Get("Content-Encoding"))
+		require.JSONEq(t, expectedJSON(10_000), recorder.Body.String())
+	})
+
+	t.Run("SmallResponseNotGzipped", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := serve(t, 10, "gzip")
+		require.Empty(t, recorder.Header().Get("Content-Encoding"))
+		require.JSONEq(t, expectedJSON(10), recorder.Body.String())
+	})
+}
+
+// readTracker is a request body that records whether it's been read.
+type readTracker struct {
+	io.Reader
+	read bool
+}
+
+func (r *readTracker) Read(p []byte) (int, error) {
+	r.read = true
+	return r.Reader.Read(p)
+}
+
+func TestMakeHandlerMaxRequestBytes(t *testing.T) {
+	t.Parallel()
+
+	// Makes a handler limited to 100 bytes, returning it along with whether
+	// its service function was called.
+	setup := func(t *testing.T) (http.Handler, *bool) {
+		t.Helper()
+
+		var called bool
+		return MakeHandler(func(ctx context.Context, req *HandleEmailPreviewRequest) (*HandleEmailPreviewResponse, error) {
+			called = true
+			return &HandleEmailPreviewResponse{Subject: "Hello."}, nil
+		}, &HandlerOpts{MaxRequestBytes: 100}), &called
+	}
+
+	// A JSON request with a body of about the given size.
+	testBody := func(size int) string {
+		return `{"template":"` + strings.Repeat("x", size-len(`{"template":""}`)) + `"}`
+	}
+
+	tooLargeErr := `{"error_code":"request_too_large","message":"Request body is larger than the limit of 100 bytes."}`
+
+	t.Run("UnderLimit", func(t *testing.T) {
+		t.Parallel()
+
+		handler, called := setup(t)
+
+		req := httptest.NewRequest(http.MethodPost, "/emails/preview", strings.NewReader(testBody(100)))
+		req.Header.Set("Content-Type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.True(t, *called)
+	})
+
+	t.Run("ContentLengthRejectedBeforeRead", func(t *testing.T) {
+		t.Parallel()
+
+		handler, called := setup(t)
+
+		body := &readTracker{Reader: strings.NewReader(testBody(101))}
+		req := httptest.NewRequest(http.MethodPost, "/emails/preview", body)
+		req.ContentLength = 101
+		req.Header.Set("Content-Type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+		require.JSONEq(t, tooLargeErr, recorder.Body.String())
+		require.False(t, body.read)
+		require.False(t, *called)
+	})
+
+	t.Run("ChunkedCutOff", func(t *testing.T) {
+		t.Parallel()
+
+		handler, called := setup(t)
+
+		reader := strings.NewReader(testBody(10_000))
+		body := &readTracker{Reader: reader}
+		req := httptest.NewRequest(http.MethodPost, "/emails/preview", body)
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		req.Header.Set("Content-Type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+		require.JSONEq(t, tooLargeErr, recorder.Body.String())
+		require.True(t, body.read)
+		require.False(t, *called)
+
+		// Reading stopped not long past the limit.
+		require.Positive(t, reader.Len())
+	})
+}
+
+func TestServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Hello."))
+	})
+
+	// Serves on an ephemeral port until the test is finished, returning the
+	// server's address.
+	startServer := func(t *testing.T, config *EnvConfig) string {
+		t.Helper()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		server := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+		go func() { _ = serveHTTP(server, listener, config) }()
+		t.Cleanup(func() { _ = server.Close() })
+
+		return listener.Addr().String()
+	}
+
+	t.Run("PlainHTTP", func(t *testing.T) {
+		t.Parallel()
+
+		addr := startServer(t, &EnvConfig{})
+
+		resp, err := http.Get("http://" + addr) //nolint:noctx
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Nil(t, resp.TLS)
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		t.Parallel()
+
+		certFile, keyFile, certPool := writeTestCertificate(t)
+
+		addr := startServer(t, &EnvConfig{TLSCertFile: certFile, TLSKeyFile: keyFile})
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certPool}}} //nolint:gosec
+		resp, err := client.Get("https://" + addr)                                                          //nolint:noctx
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NotNil(t, resp.TLS)
+		require.True(t, resp.TLS.HandshakeComplete)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "Hello.", string(body))
+	})
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key to a temporary directory, returning their paths and a pool trusting the
+// certificate.
+func writeTestCertificate(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Hour),
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	var (
+		dir      = t.TempDir()
+		certFile = filepath.Join(dir, "cert.pem")
+		keyFile  = filepath.Join(dir, "key.pem")
+	)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	cert, err := x509.ParseCertificate(certDER)
+	require.NoError(t, err)
+
+	certPool := x509.NewCertPool()
+	certPool.AddCert(cert)
+
+	return certFile, keyFile, certPool
+}
+
+func TestMakeHandlerJSONCase(t *testing.T) {
+	t.Parallel()
+
+	// Serves the same response struct, or an error when err is set, with the
+	// given handler options.
+	serve := func(t *testing.T, opts *HandlerOpts, err error) *httptest.ResponseRecorder {
+		t.Helper()
+
+		handler := MakeHandler(func(ctx context.Context, req *HandleCancelByAccountRequest) (*HandleCancelByAccountResponse, error) {
+			if err != nil {
+				return nil, err
+			}
+			return &HandleCancelByAccountResponse{Cancelled: 2, Message: "2 unsent email(s) cancelled."}, nil
+		}, opts)
+
+		req := httptest.NewRequest(http.MethodPost, "/emails/cancel-account", strings.NewReader(`{"account_id":"`+uuid.NewString()+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	validationErr := &APIError{
+		Code:             "validation_failed",
+		Message:          "Invalid parameters.",
+		StatusCode:       http.StatusBadRequest,
+		ValidationErrors: []*ValidationError{{Field: "email_sender", Message: "email_sender is required.", Rule: "required"}},
+	}
+
+	t.Run("SnakeByDefault", func(t *testing.T) {
+		t.Parallel()
+
+		for _, opts := range []*HandlerOpts{nil, {}, {JSONCase: JSONCaseSnake}} {
+			recorder := serve(t, opts, nil)
+			require.Equal(t, http.StatusOK, recorder.Code)
+			require.JSONEq(t, `{"cancelled":2,"message":"2 unsent email(s) cancelled."}`, recorder.Body.String())
+		}
+
+		recorder := serve(t, nil, validationErr)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+		require.JSONEq(t, `{
+			"error_code": "validation_failed",
+			"message": "Invalid parameters.",
+			"validation_errors": [{"field":"email_sender","message":"email_sender is required.","rule":"required"}]
+		}`, recorder.Body.String())
+	})
+
+	t.Run("Camel", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := serve(t, &HandlerOpts{JSONCase: JSONCaseCamel}, nil)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.JSONEq(t, `{"cancelled":2,"message":"2 unsent email(s) cancelled."}`, recorder.Body.String())
+
+		// Keys of nested objects are renamed too, but values like the field
+		// names of validation errors are left alone.
+		recorder = serve(t, &HandlerOpts{JSONCase: JSONCaseCamel}, validationErr)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+		require.JSONEq(t, `{
+			"errorCode": "validation_failed",
+			"message": "Invalid parameters.",
+			"validationErrors": [{"field":"email_sender","message":"email_sender is required.","rule":"required"}]
+		}`, recorder.Body.String())
+	})
+}
+
+func TestMakeHandlerEnvelope(t *testing.T) {
+	t.Parallel()
+
+	// Serves the same response struct, or an error when err is set, with the
+	// given handler options.
+	serve := func(t *testing.T, opts *HandlerOpts, err error) *httptest.ResponseRecorder {
+		t.Helper()
+
+		handler := MakeHandler(func(ctx context.Context, req *HandleEmailCreateRequest) (*HandleEmailCreateResponse, error) {
+			if err != nil {
+				return nil, err
+			}
+			return &HandleEmailCreateResponse{Message: "Email has been queued for sending.", StatusCode: http.StatusCreated}, nil
+		}, opts)
+
+		req := httptest.NewRequest(http.MethodPost, "/emails", strings.NewReader(`{"account_id":"`+uuid.NewString()+`","email_recipient":"receiver@example.com","idempotency_key":"key"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	notFoundErr := &APIError{Code: errorCodeNotFound, Message: "Email not found.", StatusCode: http.StatusNotFound}
+
+	t.Run("UnwrappedByDefault", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := serve(t, nil, nil)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+		require.JSONEq(t, `{"message":"Email has been queued for sending."}`, recorder.Body.String())
+
+		recorder = serve(t, &HandlerOpts{}, notFoundErr)
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+		require.JSONEq(t, `{"error_code":"not_found","message":"Email not found."}`, recorder.Body.String())
+	})
+
+	t.Run("Wrapped", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := serve(t, &HandlerOpts{Envelope: true}, nil)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+		require.JSONEq(t, `{"data":{"message":"Email has been queued for sending."},"error":null}`, recorder.Body.String())
+
+		recorder = serve(t, &HandlerOpts{Envelope: true}, notFoundErr)
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+		require.JSONEq(t, `{"data":null,"error":{"error_code":"not_found","message":"Email not found."}}`, recorder.Body.String())
+	})
+
+	t.Run("WrappedValidationError", func(t *testing.T) {
+		t.Parallel()
+
+		// Errors from before the service function is invoked are wrapped
+		// too, and keys in the envelope are renamed like any others.
+		req := httptest.NewRequest(http.MethodPost, "/emails", strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		MakeHandler(func(ctx context.Context, req *HandleEmailCreateRequest) (*HandleEmailCreateResponse, error) {
+			return nil, errors.New("shouldn't be invoked")
+		}, &HandlerOpts{Envelope: true, JSONCase: JSONCaseCamel}).ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+
+		var envelope struct {
+			Data  any            `json:"data"`
+			Error map[string]any `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &envelope))
+		require.Nil(t, envelope.Data)
+		require.Equal(t, errorCodeValidationFailed, envelope.Error["errorCode"])
+		require.NotEmpty(t, envelope.Error["validationErrors"])
+	})
+
+	t.Run("WrappedTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		slowHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})
+
+		recorder := httptest.NewRecorder()
+		timeoutHandler(slowHandler, time.Millisecond, &HandlerOpts{Envelope: true}).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		require.JSONEq(t, `{"data":null,"error":{"error_code":"request_timeout","message":"Request timed out."}}`, recorder.Body.String())
+	})
+
+	t.Run("ServiceEnvelopeResponses", func(t *testing.T) {
+		t.Parallel()
+
+		apiServer := &APIService{buildVersion: "v1.2.3", envelopeResponses: true, metrics: newMetrics()}
+
+		recorder := httptest.NewRecorder()
+		apiServer.ServeMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/version", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var envelope struct {
+			Data  *HandleVersionResponse `json:"data"`
+			Error *APIError              `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &envelope))
+		require.Equal(t, "v1.2.3", envelope.Data.Version)
+		require.Nil(t, envelope.Error)
+	})
+}
+
+func TestMarshalResponse(t *testing.T) {
+	t.Parallel()
+
+	resp := &HandleEmailPreviewResponse{Body: "Hello.", BodyHTML: "<p>Hello.</p>", Subject: "Hi."}
+
+	data, err := marshalResponse(resp, JSONCaseSnake)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"body":"Hello.","body_html":"<p>Hello.</p>","subject":"Hi."}`, string(data))
+
+	data, err = marshalResponse(resp, JSONCaseCamel)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"body":"Hello.","bodyHtml":"<p>Hello.</p>","subject":"Hi."}`, string(data))
+
+	// Large numbers survive the round trip intact.
+	data, err = marshalResponse(map[string]any{"job_id": int64(9007199254740993)}, JSONCaseCamel)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"jobId":9007199254740993}`, string(data))
+}
+
+func TestSnakeToCamel(t *testing.T) {
+	t.Parallel()
+
+	for name, expected := range map[string]string{
+		"":                  "",
+		"message":           "message",
+		"body_html":         "bodyHtml",
+		"validation_errors": "validationErrors",
+		"a_b_c":             "aBC",
+		"trailing_":         "trailing",
+		"double__underline": "doubleUnderline",
+	} {
+		require.Equal(t, expected, snakeToCamel(name), "Unexpected result for %q", name)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	t.Parallel()
+
+	t.Run("APIError", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := httptest.NewRecorder()
+		writeError(recorder, &APIError{Code: errorCodeNotFound, Message: "Email not found.", StatusCode: http.StatusNotFound})
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+		require.JSONEq(t, `{"error_code":"not_found","message":"Email not found."}`, recorder.Body.String())
+	})
+
+	t.Run("InternalError", func(t *testing.T) {
+		t.Parallel()
+
+		// Details of unexpected errors aren't sent to clients.
+		recorder := httptest.NewRecorder()
+		writeError(recorder, fmt.Errorf("error querying: %w", errors.New("connection refused")))
+		require.Equal(t, http.StatusInternalServerError, recorder.Code)
+		require.JSONEq(t, `{"error_code":"internal_error","message":"Internal server error."}`, recorder.Body.String())
+	})
+}
+
+func TestTimeoutHandler(t *testing.T) {
+	t.Parallel()
+
+	fastHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("done"))
+	})
+
+	t.Run("FinishesInTime", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := httptest.NewRecorder()
+		timeoutHandler(fastHandler, time.Minute, &HandlerOpts{}).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusCreated, recorder.Code)
+		require.Equal(t, "text/plain", recorder.Header().Get("Content-Type"))
+		require.Equal(t, "done", recorder.Body.String())
+	})
+
+	t.Run("TimesOutCamelCase", func(t *testing.T) {
+		t.Parallel()
+
+		slowHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})
+
+		recorder := httptest.NewRecorder()
+		timeoutHandler(slowHandler, time.Millisecond, &HandlerOpts{JSONCase: JSONCaseCamel}).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		require.JSONEq(t, `{"errorCode":"request_timeout","message":"Request timed out."}`, recorder.Body.String())
+	})
+
+	t.Run("ZeroTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		recorder := httptest.NewRecorder()
+		timeoutHandler(fastHandler, 0, &HandlerOpts{}).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusCreated, recorder.Code)
+	})
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	t.Parallel()
+
+	for acceptEncoding, expected := range map[string]bool{
+		"":                    false,
+		"br":                  false,
+		"deflate, br":         false,
+		"gzip":                true,
+		"GZIP":                true,
+		"br, gzip;q=0.5":      true,
+		"gzip;q=0":            false,
+		"gzip; q=0.0":         false,
+		"*":                   true,
+		"*;q=0":               false,
+		"*;q=0, gzip":         true,
+		"gzip;q=0, *":         false,
+		"identity, *;q=0.1":   true,
+		"x-gzip, deflate":     false,
+		"gzip;q=1.0, br;q=.8": true,
+	} {
+		require.Equal(t, expected, acceptsGzip(acceptEncoding), "Unexpected result for %q", acceptEncoding)
+	}
+}
+
+// requireEmailCreateResponse requires that resp is expected, pointing at the
+// status of whichever job was queued, which tests don't know the ID of ahead
+// of time. Unless expected has a Message-ID of its own, the response's only
+// has to look like one.
+func requireEmailCreateResponse(t *testing.T, expected, resp *HandleEmailCreateResponse) {
+	t.Helper()
+
+	require.NotNil(t, resp)
+	require.Regexp(t, `^/emails/[0-9]+$`, resp.Location)
+
+	expectedWithLocation := *expected
+	expectedWithLocation.Location = resp.Location
+	if expected.MessageID == "" && resp.MessageID != "" {
+		require.Regexp(t, `^<[0-9a-f-]{36}@[^<>@]+>$`, resp.MessageID)
+		expectedWithLocation.MessageID = resp.MessageID
+	}
+	if expected.EstimatedSendAt == nil {
+		expectedWithLocation.EstimatedSendAt = resp.EstimatedSendAt
+	}
+	require.Equal(t, &expectedWithLocation, resp)
+}
+
+// invokeHandler invokes a service handler and returns its results.
+//
+// Service handlers are normal functions and can be invoked directly, but it's
+// preferable to invoke them with this function because a few extra niceties are
+// observed that are normally only available from the API framework:
+//
+//   - Incoming request structs are validated and an API error is emitted in case
+//     they're invalid (any `validate` tags are checked).
+//   - Outgoing response structs are validated.
+//
+// Sample invocation:
+//
+//	endpoint := &testEndpoint{}
+//	resp, err := apitest.InvokeHandler(ctx, endpoint.Execute, &testRequest{ReqField: "string"})
+//	require.NoError(t, err)
+func invokeHandler[TReq any, TResp any](ctx context.Context, handler func(context.Context, *TReq) (*TResp, error), req *TReq) (*TResp, error) {
+	if err := validateRequest(ctx, req); err != nil {
+		return nil, err
 	}
 
 	resp, err := handler(ctx, req)
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// maintenanceRetryAfter is how long clients are asked to wait before trying
+// again when email is rejected for maintenance.
+const maintenanceRetryAfter = 5 * time.Minute
+
+// errMaintenanceMode is returned for new emails while maintenance mode is on.
+var errMaintenanceMode = &APIError{ //nolint:gochecknoglobals
+	Code:       errorCodeMaintenanceMode,
+	Message:    "Service is down for maintenance and isn't accepting new email. Try again later.",
+	RetryAfter: maintenanceRetryAfter,
+	StatusCode: http.StatusServiceUnavailable,
+}
+
+type HandleMaintenanceSetRequest struct {
+	Enabled *bool `json:"enabled" validate:"required"`
+}
+
+type HandleMaintenanceSetResponse struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+}
+
+// MaintenanceSet turns maintenance mode on or off. While it's on, new emails
+// are rejected, but everything else, like looking up the state of queued
+// emails, keeps working. This only affects the process that receives the
+// request.
+func (s *APIService) MaintenanceSet(ctx context.Context, req *HandleMaintenanceSetRequest) (*HandleMaintenanceSetResponse, error) {
+	s.maintenanceMode.Store(*req.Enabled)
+
+	if *req.Enabled {
+		return &HandleMaintenanceSetResponse{Enabled: true, Message: "Maintenance mode is on; new email will be rejected."}, nil
+	}
+	return &HandleMaintenanceSetResponse{Enabled: false, Message: "Maintenance mode is off; new email will be accepted."}, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+)
+
+func TestAPIServiceMaintenanceMode(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		apiServer *APIService
+		mux       *http.ServeMux
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		apiServer := &APIService{
+			begin:       tx.Begin,
+			metrics:     newMetrics(),
+			riverClient: riverClient,
+			tracer:      testTracer,
+		}
+
+		return &testBundle{
+			apiServer: apiServer,
+			mux:       apiServer.ServeMux(),
+			tx:        tx,
+		}, ctx
+	}
+
+	serve := func(t *testing.T, bundle *testBundle, method, target string, value any) *httptest.ResponseRecorder {
+		t.Helper()
+
+		var body []byte
+		if value != nil {
+			var err error
+			body, err = json.Marshal(value)
+			require.NoError(t, err)
+		}
+
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	createEmail := func(t *testing.T, bundle *testBundle) *httptest.ResponseRecorder {
+		t.Helper()
+
+		return serve(t, bundle, http.MethodPost, "/emails", &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		})
+	}
+
+	setMaintenance := func(t *testing.T, bundle *testBundle, enabled bool) {
+		t.Helper()
+
+		recorder := serve(t, bundle, http.MethodPost, "/admin/maintenance", map[string]bool{"enabled": enabled})
+		require.Equal(t, http.StatusOK, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+	}
+
+	t.Run("RejectsCreateButServesLookups", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		recorder := createEmail(t, bundle)
+		require.Equal(t, http.StatusCreated, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+
+		var jobID int64
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT id FROM river_job WHERE kind = $1 ORDER BY id DESC LIMIT 1", (SendEmailArgs{}).Kind()).Scan(&jobID))
+
+		setMaintenance(t, bundle, true)
+
+		recorder = createEmail(t, bundle)
+		require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		require.Equal(t, "300", recorder.Header().Get("Retry-After"))
+		require.JSONEq(t, `{"error_code":"maintenance_mode","message":"Service is down for maintenance and isn't accepting new email. Try again later."}`, recorder.Body.String())
+
+		recorder = serve(t, bundle, http.MethodGet, "/emails/"+strconv.FormatInt(jobID, 10), nil)
+		require.Equal(t, http.StatusOK, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+		require.JSONEq(t, `{"id":`+strconv.FormatInt(jobID, 10)+`,"state":"available"}`, recorder.Body.String())
+	})
+
+	t.Run("TurningOffRestoresCreate", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		setMaintenance(t, bundle, true)
+
+		recorder := createEmail(t, bundle)
+		require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+		setMaintenance(t, bundle, false)
+
+		recorder = createEmail(t, bundle)
+		require.Equal(t, http.StatusCreated, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+	})
+
+	t.Run("FromConfig", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.maintenanceMode.Store(true)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		})
+		require.Equal(t, errMaintenanceMode, err)
+	})
+
+	t.Run("EnabledRequired", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.MaintenanceSet, &HandleMaintenanceSetRequest{})
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "enabled", Message: "enabled is required.", Rule: "required"},
+			},
+		}, err)
+	})
+}
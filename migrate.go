@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivermigrate"
+)
+
+// schemaSQL creates the demo's own tables. It's idempotent, so it can be run
+// against a database that already has them.
+//
+//go:embed schema.sql
+var schemaSQL string
+
+// schemaTables are the tables created by schemaSQL.
+var schemaTables = []string{"audit_events", "bounces", "idempotency_keys", "idempotency_responses", "suppression_history", "suppressions", "unsubscribes"} //nolint:gochecknoglobals
+
+// migrateDatabase checks that River's migrations and the demo's own schema
+// have been applied, so that a database that's missing them fails at startup
+// instead of on the first insert. With autoMigrate, they're applied instead.
+func migrateDatabase(ctx context.Context, tx pgx.Tx, autoMigrate bool) error {
+	migrator, err := rivermigrate.New(riverpgxv5.New(nil), nil)
+	if err != nil {
+		return err
+	}
+
+	if autoMigrate {
+		if _, err := migrator.MigrateTx(ctx, tx, rivermigrate.DirectionUp, nil); err != nil {
+			return fmt.Errorf("error running River migrations: %w", err)
+		}
+		if _, err := tx.Exec(ctx, schemaSQL); err != nil {
+			return fmt.Errorf("error applying schema.sql: %w", err)
+		}
+		return nil
+	}
+
+	validateRes, err := migrator.ValidateTx(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("error checking River migrations: %w", err)
+	}
+	if !validateRes.OK {
+		return fmt.Errorf("River migrations haven't been applied (%s); run `river migrate-up` or set AUTO_MIGRATE=true",
+			strings.Join(validateRes.Messages, "; "))
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT name
+		FROM unnest($1::text[]) AS name
+		WHERE to_regclass(name) IS NULL
+		ORDER BY name`,
+		schemaTables,
+	)
+	if err != nil {
+		return err
+	}
+	missingTables, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	if len(missingTables) > 0 {
+		return fmt.Errorf("tables from schema.sql are missing (%s); apply it with psql or set AUTO_MIGRATE=true",
+			strings.Join(missingTables, ", "))
+	}
+
+	return nil
+}
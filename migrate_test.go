@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+)
+
+func TestMigrateDatabase(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx = t.Context()
+		tx  = riversharedtest.TestTx(ctx, t)
+	)
+
+	// Point the test transaction at an empty schema so it looks like a fresh
+	// database. Both are rolled back when the test finishes.
+	_, err := tx.Exec(ctx, "CREATE SCHEMA migrate_test")
+	require.NoError(t, err)
+	_, err = tx.Exec(ctx, "SET LOCAL search_path TO migrate_test")
+	require.NoError(t, err)
+
+	err = migrateDatabase(ctx, tx, false)
+	require.ErrorContains(t, err, "River migrations haven't been applied")
+	require.ErrorContains(t, err, "AUTO_MIGRATE=true")
+
+	require.NoError(t, migrateDatabase(ctx, tx, true))
+	require.NoError(t, migrateDatabase(ctx, tx, false))
+
+	// Auto-migrating an up to date database is a no-op.
+	require.NoError(t, migrateDatabase(ctx, tx, true))
+
+	_, err = tx.Exec(ctx, "DROP TABLE suppressions")
+	require.NoError(t, err)
+
+	err = migrateDatabase(ctx, tx, false)
+	require.EqualError(t, err, "tables from schema.sql are missing (suppressions); apply it with psql or set AUTO_MIGRATE=true")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// multipartMaxMemoryBytes is how much of a multipart form is held in memory
+// while it's parsed. Files past it are buffered to temporary files instead.
+const multipartMaxMemoryBytes = 10 << 20
+
+// multipartEmailFields are the fields of HandleEmailCreateRequest by their
+// JSON names, which are also the names of their multipart form fields.
+var multipartEmailFields = jsonFieldsByName(reflect.TypeFor[HandleEmailCreateRequest]()) //nolint:gochecknoglobals
+
+// jsonFieldsByName returns the exported fields of a struct type by the names
+// they're given in JSON.
+func jsonFieldsByName(structType reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for _, field := range reflect.VisibleFields(structType) {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+// newMultipartEmailHandler lets `POST /emails` be posted as a
+// multipart/form-data form, like from a browser or `curl -F`, so that
+// attachments can be uploaded as files instead of being base64 encoded into
+// JSON. Form fields are named like the request's JSON keys. Files are uploaded
+// as `attachments`, and may be repeated.
+//
+// The form is converted into the JSON request it stands for and passed on to
+// next, so it goes through the same binding, validation, and EmailCreate as
+// any other. Requests that aren't multipart are passed on as they are.
+func newMultipartEmailHandler(next http.Handler, maxUploadBytes int, opts *HandlerOpts) http.Handler {
+	if opts == nil {
+		opts = &HandlerOpts{}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "multipart/form-data" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadBytes))
+		if err := r.ParseMultipartForm(multipartMaxMemoryBytes); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeErrorWithOpts(w, opts, errRequestTooLarge(maxUploadBytes))
+				return
+			}
+			writeErrorWithOpts(w, opts, &APIError{Code: errorCodeInvalidRequest, Message: "Invalid multipart form: " + err.Error(), StatusCode: http.StatusBadRequest})
+			return
+		}
+		defer func() { _ = r.MultipartForm.RemoveAll() }()
+
+		reqData, err := multipartEmailRequest(r.MultipartForm)
+		if err != nil {
+			writeErrorWithOpts(w, opts, err)
+			return
+		}
+
+		// The form was limited by maxUploadBytes, while its JSON may well be
+		// bigger than the limit on JSON bodies, with its files base64
+		// encoded.
+		r = r.WithContext(context.WithValue(r.Context(), requestBodyLimitedKey{}, true))
+		r.Body = io.NopCloser(bytes.NewReader(reqData))
+		r.ContentLength = int64(len(reqData))
+		r.Header.Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// multipartEmailRequest converts a multipart form into the JSON body of a
+// HandleEmailCreateRequest. Values are converted according to the type of the
+// field they're for, save for maps and lists of anything other than strings,
+// like template_data, which are sent as JSON.
+func multipartEmailRequest(form *multipart.Form) ([]byte, error) {
+	fields := make(map[string]any, len(form.Value)+1)
+
+	for name, values := range form.Value {
+		field, ok := multipartEmailFields[name]
+		if !ok {
+			return nil, &APIError{Code: errorCodeInvalidRequest, Message: fmt.Sprintf("Unknown field in request: %q.", name), StatusCode: http.StatusBadRequest}
+		}
+
+		value, err := multipartFieldValue(field, values)
+		if err != nil {
+			return nil, &APIError{Code: errorCodeInvalidRequest, Message: fmt.Sprintf("Invalid %s: %s", name, values[0]), StatusCode: http.StatusBadRequest}
+		}
+		fields[name] = value
+	}
+
+	for name, files := range form.File {
+		if name != "attachments" {
+			return nil, &APIError{Code: errorCodeInvalidRequest, Message: fmt.Sprintf("Files may only be uploaded as attachments, not %q.", name), StatusCode: http.StatusBadRequest}
+		}
+		if _, ok := fields["attachments"]; ok {
+			return nil, &APIError{Code: errorCodeInvalidRequest, Message: "attachments may be uploaded as files or sent as JSON, but not both.", StatusCode: http.StatusBadRequest}
+		}
+
+		attachments := make([]*EmailAttachment, len(files))
+		for i, fileHeader := range files {
+			attachment, err := multipartAttachment(fileHeader)
+			if err != nil {
+				return nil, err
+			}
+			attachments[i] = attachment
+		}
+		fields["attachments"] = attachments
+	}
+
+	return json.Marshal(fields)
+}
+
+// multipartFieldValue converts a form field's values into what JSON would
+// have for the struct field they're for.
+func multipartFieldValue(field reflect.StructField, values []string) (any, error) {
+	switch {
+	case field.Type.Kind() == reflect.Bool:
+		return strconv.ParseBool(values[0])
+
+	case field.Type.Kind() == reflect.Int:
+		return strconv.Atoi(values[0])
+
+	// Bytes like raw_message are sent as they are, rather than base64
+	// encoded like they would be in JSON.
+	case field.Type == reflect.TypeFor[[]byte]():
+		return []byte(values[0]), nil
+
+	// Lists of addresses and the like are sent as repeated fields.
+	case field.Type == reflect.TypeFor[[]string]():
+		return values, nil
+
+	case field.Type.Kind() == reflect.Map, field.Type.Kind() == reflect.Slice:
+		if !json.Valid([]byte(values[0])) {
+			return nil, errors.New("value isn't valid JSON")
+		}
+		return json.RawMessage(values[0]), nil
+
+	// Strings, along with anything that's a string in JSON, like account_id.
+	default:
+		return values[0], nil
+	}
+}
+
+// multipartAttachment reads an uploaded file into an attachment. Its content
+// type is the one its part was sent with, which clients like curl guess from
+// the file's name.
+func multipartAttachment(fileHeader *multipart.FileHeader) (*EmailAttachment, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EmailAttachment{
+		Content:     content,
+		ContentType: fileHeader.Header.Get("Content-Type"),
+		Filename:    fileHeader.Filename,
+	}, nil
+}
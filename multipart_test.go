@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+)
+
+// newMultipartRequest builds a `POST /emails` request from form fields and
+// files, which are keyed by their form field name and then their filename.
+func newMultipartRequest(t *testing.T, fields map[string][]string, files map[string]map[string][]byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, values := range fields {
+		for _, value := range values {
+			require.NoError(t, mw.WriteField(name, value))
+		}
+	}
+	for name, namedFiles := range files {
+		for filename, content := range namedFiles {
+			fileWriter, err := mw.CreateFormFile(name, filename)
+			require.NoError(t, err)
+			_, err = fileWriter.Write(content)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/emails", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestMultipartEmailHandler(t *testing.T) {
+	t.Parallel()
+
+	// Returns a handler that records the body of the request passed to it,
+	// along with that body's content type.
+	setup := func(t *testing.T, maxUploadBytes int) (http.Handler, *http.Request) {
+		t.Helper()
+
+		passedReq := &http.Request{}
+		return newMultipartEmailHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+
+			*passedReq = *r
+			passedReq.Body = io.NopCloser(bytes.NewReader(body))
+			w.WriteHeader(http.StatusCreated)
+		}), maxUploadBytes, &HandlerOpts{}), passedReq
+	}
+
+	t.Run("ConvertsToJSON", func(t *testing.T) {
+		t.Parallel()
+
+		handler, passedReq := setup(t, 1<<20)
+
+		accountID := uuid.New()
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newMultipartRequest(t, map[string][]string{
+			"account_id":      {accountID.String()},
+			"cc":              {"manager@example.com", "audit@example.com"},
+			"dry_run":         {"true"},
+			"email_recipient": {"receiver@example.com"},
+			"job_priority":    {"2"},
+			"subject":         {"Your invoice"},
+			"template_data":   {`{"name":"Ada"}`},
+		}, map[string]map[string][]byte{
+			"attachments": {"invoice.pdf": []byte("%PDF-1.7")},
+		}))
+		require.Equal(t, http.StatusCreated, recorder.Code)
+		require.Equal(t, "application/json", passedReq.Header.Get("Content-Type"))
+
+		reqData, err := io.ReadAll(passedReq.Body)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(reqData)), passedReq.ContentLength)
+
+		var req HandleEmailCreateRequest
+		require.NoError(t, unmarshalRequest(reqData, &req))
+		require.Equal(t, HandleEmailCreateRequest{
+			AccountID: accountID,
+			Attachments: []*EmailAttachment{
+				{Content: []byte("%PDF-1.7"), ContentType: "application/octet-stream", Filename: "invoice.pdf"},
+			},
+			Cc:             []string{"manager@example.com", "audit@example.com"},
+			DryRun:         true,
+			EmailRecipient: "receiver@example.com",
+			JobPriority:    2,
+			Subject:        "Your invoice",
+			TemplateData:   map[string]any{"name": "Ada"},
+		}, req)
+	})
+
+	t.Run("JSONNotLimitedAgain", func(t *testing.T) {
+		t.Parallel()
+
+		// The form fits under MAX_UPLOAD_BYTES, but its JSON, with its file
+		// base64 encoded, doesn't fit under MAX_REQUEST_BYTES.
+		handler := newMultipartEmailHandler(MakeHandler(func(ctx context.Context, req *HandleEmailCreateRequest) (*HandleEmailCreateResponse, error) {
+			return &HandleEmailCreateResponse{Message: "Email queued for sending.", StatusCode: http.StatusCreated}, nil
+		}, &HandlerOpts{MaxRequestBytes: 1024}), 1<<20, nil)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newMultipartRequest(t, map[string][]string{
+			"account_id":      {uuid.NewString()},
+			"email_recipient": {"receiver@example.com"},
+			"idempotency_key": {uuid.NewString()},
+			"subject":         {"Your invoice"},
+		}, map[string]map[string][]byte{
+			"attachments": {"invoice.pdf": bytes.Repeat([]byte("%PDF-1.7 "), 200)},
+		}))
+		require.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+	})
+
+	t.Run("NotMultipart", func(t *testing.T) {
+		t.Parallel()
+
+		handler, passedReq := setup(t, 1)
+
+		req := httptest.NewRequest(http.MethodPost, "/emails", strings.NewReader(`{"subject":"Hello."}`))
+		req.Header.Set("Content-Type", "application/json")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		reqData, err := io.ReadAll(passedReq.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"subject":"Hello."}`, string(reqData))
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		t.Parallel()
+
+		handler, _ := setup(t, 1024)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newMultipartRequest(t, nil, map[string]map[string][]byte{
+			"attachments": {"large.bin": bytes.Repeat([]byte{0}, 2048)},
+		}))
+		require.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+
+		var apiErr APIError
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &apiErr))
+		require.Equal(t, errorCodeRequestTooLarge, apiErr.Code)
+		require.Equal(t, "Request body is larger than the limit of 1024 bytes.", apiErr.Message)
+	})
+
+	t.Run("UnknownField", func(t *testing.T) {
+		t.Parallel()
+
+		handler, _ := setup(t, 1<<20)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newMultipartRequest(t, map[string][]string{"email_reciptient": {"receiver@example.com"}}, nil))
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+		require.Contains(t, recorder.Body.String(), `Unknown field in request: \"email_reciptient\".`)
+	})
+
+	t.Run("InvalidValue", func(t *testing.T) {
+		t.Parallel()
+
+		handler, _ := setup(t, 1<<20)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newMultipartRequest(t, map[string][]string{"job_priority": {"high"}}, nil))
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+		require.Contains(t, recorder.Body.String(), "Invalid job_priority: high")
+	})
+
+	t.Run("FileNotAttachment", func(t *testing.T) {
+		t.Parallel()
+
+		handler, _ := setup(t, 1<<20)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newMultipartRequest(t, nil, map[string]map[string][]byte{
+			"body": {"body.txt": []byte("Hello.")},
+		}))
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+		require.Contains(t, recorder.Body.String(), `Files may only be uploaded as attachments, not \"body\".`)
+	})
+}
+
+func TestAPIServiceEmailCreateMultipart(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	tx := riversharedtest.TestTx(ctx, t)
+
+	riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+		TestOnly: true,
+		Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+	})
+	require.NoError(t, err)
+
+	apiServer := &APIService{
+		begin:       tx.Begin,
+		metrics:     newMetrics(),
+		riverClient: riverClient,
+		tracer:      testTracer,
+	}
+	handler := newMultipartEmailHandler(MakeHandler(apiServer.EmailCreate, nil), 1<<20, nil)
+
+	req := newMultipartRequest(t, map[string][]string{
+		"account_id":      {uuid.NewString()},
+		"body":            {"Your invoice is attached."},
+		"email_recipient": {"receiver@example.com"},
+		"email_sender":    {"sender@example.com"},
+		"subject":         {"Your invoice"},
+	}, map[string]map[string][]byte{
+		"attachments": {"invoice.pdf": []byte("%PDF-1.7 invoice")},
+	})
+	req.Header.Set("Idempotency-Key", uuid.NewString())
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+
+	var resp HandleEmailCreateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+
+	jobID, err := strconv.ParseInt(strings.TrimPrefix(resp.Location, "/emails/"), 10, 64)
+	require.NoError(t, err)
+
+	var args SendEmailArgs
+	require.NoError(t, tx.QueryRow(ctx, "SELECT args FROM river_job WHERE id = $1", jobID).Scan(&args))
+	require.Equal(t, []*EmailAttachment{
+		{Content: []byte("%PDF-1.7 invoice"), ContentType: "application/octet-stream", Filename: "invoice.pdf"},
+	}, args.Attachments)
+	require.Equal(t, "Your invoice", args.Subject)
+}
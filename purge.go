@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// errPurgeDisabled is returned for purges unless PURGE_ENABLED is on.
+var errPurgeDisabled = &APIError{ //nolint:gochecknoglobals
+	Code:       errorCodePurgeDisabled,
+	Message:    "Purging accounts isn't enabled; set PURGE_ENABLED to allow it.",
+	StatusCode: http.StatusForbidden,
+}
+
+type HandlePurgeRequest struct {
+	AccountID uuid.UUID `json:"account_id" validate:"required"`
+}
+
+type HandlePurgeResponse struct {
+	AuditEvents          int64  `json:"audit_events"`
+	Bounces              int64  `json:"bounces"`
+	Emails               int64  `json:"emails"`
+	IdempotencyResponses int64  `json:"idempotency_responses"`
+	Message              string `json:"message"`
+	SuppressionHistory   int64  `json:"suppression_history"`
+	Suppressions         int64  `json:"suppressions"`
+	Unsubscribes         int64  `json:"unsubscribes"`
+}
+
+// EmailPurgeAccount deletes everything kept about an account's email, like
+// to erase it on request or to start a test over: its email jobs in every
+// state, the content dedupe jobs that go with them, its audit log, its
+// suppressions and their history, and its unsubscribes, bounces, and stored
+// idempotent responses.
+// Idempotency keys the account has used are free to be used again afterwards.
+// An email being sent at this moment can't be stopped partway, but its job is
+// deleted all the same.
+//
+// It can't be undone, so it's refused unless purgeEnabled is set.
+func (s *APIService) EmailPurgeAccount(ctx context.Context, req *HandlePurgeRequest) (*HandlePurgeResponse, error) {
+	if !s.purgeEnabled {
+		return nil, errPurgeDisabled
+	}
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// River's job list can't filter on args, so jobs are deleted directly.
+	rows, err := tx.Query(ctx, `
+		DELETE FROM river_job
+		WHERE kind = $1
+			AND args->>'account_id' = $2
+		RETURNING id`,
+		(SendEmailArgs{}).Kind(), req.AccountID.String(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	jobIDs, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, err
+	}
+
+	// Content dedupe jobs hold a hash of their email's content, but not its
+	// account, so they're found through the email's job.
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM river_job
+		WHERE kind = $1
+			AND (args->>'email_job_id')::bigint = ANY($2::bigint[])`,
+		(ContentDedupeArgs{}).Kind(), jobIDs,
+	); err != nil {
+		return nil, err
+	}
+
+	// Forgetting the account's keys is what frees them to be used again
+	// without being reported as expired.
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM idempotency_keys
+		WHERE job_id = ANY($1::bigint[])`,
+		jobIDs,
+	); err != nil {
+		return nil, err
+	}
+
+	// The audit log is otherwise append-only, and its trigger only allows
+	// deletes while this is set. It's set for the rest of the transaction
+	// alone, so nothing else that runs in it can delete events.
+	if _, err := tx.Exec(ctx, "SELECT set_config('idempotent_email.purging', 'on', true)"); err != nil {
+		return nil, err
+	}
+
+	resp := &HandlePurgeResponse{Emails: int64(len(jobIDs))}
+	for _, table := range []struct {
+		count *int64
+		name  string
+	}{
+		{&resp.AuditEvents, "audit_events"},
+		{&resp.Bounces, "bounces"},
+		{&resp.IdempotencyResponses, "idempotency_responses"},
+		{&resp.SuppressionHistory, "suppression_history"},
+		{&resp.Suppressions, "suppressions"},
+		{&resp.Unsubscribes, "unsubscribes"},
+	} {
+		tag, err := tx.Exec(ctx, "DELETE FROM "+table.name+" WHERE account_id = $1", req.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		*table.count = tag.RowsAffected()
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	resp.Message = fmt.Sprintf("%d email(s) and all other records for the account purged.", resp.Emails)
+	return resp, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+)
+
+func TestAPIServiceEmailPurgeAccount(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		apiServer *APIService
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			apiServer: &APIService{
+				begin:                 tx.Begin,
+				dedupeByContentPeriod: time.Hour,
+				idempotentResponses:   true,
+				metrics:               newMetrics(),
+				purgeEnabled:          true,
+				riverClient:           riverClient,
+				tracer:                testTracer,
+			},
+			tx: tx,
+		}, ctx
+	}
+
+	// Gives an account an email along with one of every other kind of record
+	// that's kept about it.
+	createAccountData := func(ctx context.Context, t *testing.T, bundle *testBundle, accountID uuid.UUID) {
+		t.Helper()
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      accountID,
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		})
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.BounceCreate, &HandleBounceCreateRequest{AccountID: accountID, Email: "bounced@example.com", Type: "hard"})
+		require.NoError(t, err)
+
+		_, err = bundle.tx.Exec(ctx, "INSERT INTO unsubscribes (account_id, email) VALUES ($1, $2)", accountID, "unsubscribed@example.com")
+		require.NoError(t, err)
+	}
+
+	// Counts the records kept about an account in each place they're kept.
+	countAccountData := func(ctx context.Context, t *testing.T, bundle *testBundle, accountID uuid.UUID) map[string]int {
+		t.Helper()
+
+		counts := make(map[string]int)
+		for name, query := range map[string]string{
+			"audit_events":          "SELECT count(*) FROM audit_events WHERE account_id = $1",
+			"bounces":               "SELECT count(*) FROM bounces WHERE account_id = $1",
+			"content_dedupe_jobs":   "SELECT count(*) FROM river_job WHERE kind = 'email_content_dedupe' AND (args->>'email_job_id')::bigint IN (SELECT id FROM river_job WHERE kind = 'send_email' AND args->>'account_id' = $1::text)",
+			"emails":                "SELECT count(*) FROM river_job WHERE kind = 'send_email' AND args->>'account_id' = $1::text",
+			"idempotency_responses": "SELECT count(*) FROM idempotency_responses WHERE account_id = $1",
+			"suppression_history":   "SELECT count(*) FROM suppression_history WHERE account_id = $1",
+			"suppressions":          "SELECT count(*) FROM suppressions WHERE account_id = $1",
+			"unsubscribes":          "SELECT count(*) FROM unsubscribes WHERE account_id = $1",
+		} {
+			var count int
+			require.NoError(t, bundle.tx.QueryRow(ctx, query, accountID).Scan(&count))
+			counts[name] = count
+		}
+		return counts
+	}
+
+	t.Run("PurgesOnlyAccount", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID, otherAccountID := uuid.New(), uuid.New()
+		createAccountData(ctx, t, bundle, accountID)
+		createAccountData(ctx, t, bundle, otherAccountID)
+
+		var contentDedupeJobsBefore int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE kind = 'email_content_dedupe'").Scan(&contentDedupeJobsBefore))
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailPurgeAccount, &HandlePurgeRequest{AccountID: accountID})
+		require.NoError(t, err)
+		require.Equal(t, &HandlePurgeResponse{
+			AuditEvents:          1,
+			Bounces:              1,
+			Emails:               1,
+			IdempotencyResponses: 1,
+			Message:              "1 email(s) and all other records for the account purged.",
+			SuppressionHistory:   1,
+			Suppressions:         1,
+			Unsubscribes:         1,
+		}, resp)
+
+		require.Equal(t, map[string]int{
+			"audit_events":          0,
+			"bounces":               0,
+			"content_dedupe_jobs":   0,
+			"emails":                0,
+			"idempotency_responses": 0,
+			"suppression_history":   0,
+			"suppressions":          0,
+			"unsubscribes":          0,
+		}, countAccountData(ctx, t, bundle, accountID))
+
+		// The other account's data is untouched.
+		require.Equal(t, map[string]int{
+			"audit_events":          1,
+			"bounces":               1,
+			"content_dedupe_jobs":   1,
+			"emails":                1,
+			"idempotency_responses": 1,
+			"suppression_history":   1,
+			"suppressions":          1,
+			"unsubscribes":          1,
+		}, countAccountData(ctx, t, bundle, otherAccountID))
+
+		var contentDedupeJobsAfter int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job WHERE kind = 'email_content_dedupe'").Scan(&contentDedupeJobsAfter))
+		require.Equal(t, contentDedupeJobsBefore-1, contentDedupeJobsAfter)
+	})
+
+	t.Run("FreesIdempotencyKeys", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailPurgeAccount, &HandlePurgeRequest{AccountID: req.AccountID})
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		require.False(t, resp.KeyExpired)
+	})
+
+	t.Run("NothingToPurge", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailPurgeAccount, &HandlePurgeRequest{AccountID: uuid.New()})
+		require.NoError(t, err)
+		require.Equal(t, &HandlePurgeResponse{Message: "0 email(s) and all other records for the account purged."}, resp)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.purgeEnabled = false
+
+		accountID := uuid.New()
+		createAccountData(ctx, t, bundle, accountID)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailPurgeAccount, &HandlePurgeRequest{AccountID: accountID})
+		require.Equal(t, &APIError{
+			Code:       errorCodePurgeDisabled,
+			Message:    "Purging accounts isn't enabled; set PURGE_ENABLED to allow it.",
+			StatusCode: http.StatusForbidden,
+		}, err)
+
+		require.Equal(t, 1, countAccountData(ctx, t, bundle, accountID)["emails"])
+	})
+}
@@ -0,0 +1,158 @@
+-- Tables used by the demo beyond River's own, which are created by River's
+-- migrations. Apply after migrating River:
+--
+--     psql -f schema.sql "$DATABASE_URL"
+
+-- Recipients who've unsubscribed from an account's email.
+CREATE TABLE IF NOT EXISTS unsubscribes (
+    account_id uuid NOT NULL,
+    email text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (account_id, email)
+);
+
+-- Recipients that must never be emailed on behalf of an account, like because
+-- mail to them has hard bounced. Unlike unsubscribes, which only apply to bulk
+-- email, suppressions apply to all email.
+CREATE TABLE IF NOT EXISTS suppressions (
+    account_id uuid NOT NULL,
+    email text NOT NULL,
+    reason text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (account_id, email)
+);
+
+-- Added after the table was. Suppressions that are removed are kept, marked
+-- with when and why, rather than deleted.
+ALTER TABLE suppressions ADD COLUMN IF NOT EXISTS removed_at timestamptz;
+ALTER TABLE suppressions ADD COLUMN IF NOT EXISTS removal_reason text;
+
+-- Each time an address was added to or removed from an account's suppression
+-- list, for auditing.
+CREATE TABLE IF NOT EXISTS suppression_history (
+    id bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    account_id uuid NOT NULL,
+    email text NOT NULL,
+    action text NOT NULL,
+    reason text,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS suppression_history_account_id_email_idx ON suppression_history (account_id, email);
+
+-- Suppressions added before there was a history start theirs off.
+INSERT INTO suppression_history (account_id, email, action, reason, created_at)
+SELECT account_id, email, 'added', reason, created_at
+FROM suppressions
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM suppression_history
+    WHERE suppression_history.account_id = suppressions.account_id
+        AND suppression_history.email = suppressions.email
+);
+
+-- Addresses are stored in lower case so that they're compared without regard
+-- to case. Ones stored before they were are lowered, and where that makes two
+-- the same, an active suppression wins over one that was removed.
+INSERT INTO suppressions (account_id, email, reason, created_at, removed_at, removal_reason)
+SELECT DISTINCT ON (account_id, lower(email)) account_id, lower(email), reason, created_at, removed_at, removal_reason
+FROM suppressions
+WHERE email <> lower(email)
+ORDER BY account_id, lower(email), removed_at IS NOT NULL, created_at DESC
+ON CONFLICT (account_id, email) DO UPDATE
+SET created_at = EXCLUDED.created_at,
+    reason = EXCLUDED.reason,
+    removal_reason = NULL,
+    removed_at = NULL
+WHERE suppressions.removed_at IS NOT NULL
+    AND EXCLUDED.removed_at IS NULL;
+
+DELETE FROM suppressions WHERE email <> lower(email);
+
+UPDATE suppression_history SET email = lower(email) WHERE email <> lower(email);
+
+INSERT INTO unsubscribes (account_id, email, created_at)
+SELECT account_id, lower(email), min(created_at)
+FROM unsubscribes
+WHERE email <> lower(email)
+GROUP BY account_id, lower(email)
+ON CONFLICT DO NOTHING;
+
+DELETE FROM unsubscribes WHERE email <> lower(email);
+
+-- Each transition in an email's lifecycle, like being queued, sent, or
+-- cancelled, for compliance. Events are kept after their email's job is
+-- cleaned up, and can't be changed or deleted once they're written, except by
+-- a purge of their account, which sets idempotent_email.purging to allow it.
+CREATE TABLE IF NOT EXISTS audit_events (
+    id bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    account_id uuid NOT NULL,
+    job_id bigint NOT NULL,
+    action text NOT NULL,
+    attempt int,
+    detail text,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_job_id_idx ON audit_events (job_id);
+
+CREATE OR REPLACE FUNCTION audit_events_immutable() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' AND current_setting('idempotent_email.purging', true) = 'on' THEN
+        RETURN OLD;
+    END IF;
+    RAISE EXCEPTION 'audit_events can''t be changed or deleted';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_events_immutable ON audit_events;
+CREATE TRIGGER audit_events_immutable
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION audit_events_immutable();
+
+-- Bounce notifications received from SMTP providers, kept for monitoring.
+-- Hard bounces also add the address to suppressions.
+CREATE TABLE IF NOT EXISTS bounces (
+    id bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    account_id uuid NOT NULL,
+    email text NOT NULL,
+    type text NOT NULL,
+    diagnostic text,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- Responses to email creates, stored when IDEMPOTENT_RESPONSES is on so that a
+-- retry with the same idempotency key gets back exactly the original response.
+-- The response is kept as text rather than jsonb so that it's byte-identical.
+CREATE TABLE IF NOT EXISTS idempotency_responses (
+    account_id uuid NOT NULL,
+    idempotency_key text NOT NULL,
+    location text,
+    status_code int NOT NULL,
+    response text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (account_id, idempotency_key)
+);
+
+-- Added after the table was, so databases that already have it get it too.
+ALTER TABLE idempotency_responses ADD COLUMN IF NOT EXISTS location text;
+
+-- Hash of the email a response was for, so that it's only replayed to a
+-- request for the same email. Added after the table was too, and NULL for
+-- responses stored before it was, which are replayed without checking.
+ALTER TABLE idempotency_responses ADD COLUMN IF NOT EXISTS args_hash text;
+
+-- Finds the earlier emails of a reused idempotency key once River's own unique
+-- index no longer covers them, like after they're discarded, so that clients
+-- can be told that a key expired.
+CREATE INDEX IF NOT EXISTS river_job_unique_key_idx_all_states ON river_job (unique_key) WHERE unique_key IS NOT NULL;
+
+-- Unique keys of queued emails, so that a reused idempotency key can be told
+-- apart from a new one after its earlier email's job has been cleaned up. Kept
+-- for idempotencyKeyRetention past JOB_RETENTION.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    unique_key bytea PRIMARY KEY,
+    job_id bigint NOT NULL,
+    previous_job_id bigint,
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/riverqueue/river/rivertype"
+)
+
+// sendDurationEstimate is about how long a worker takes to send an email,
+// from taking its job to the SMTP server accepting it, which is what the
+// throughput of a queue without SMTP_SEND_RATE is estimated from.
+const sendDurationEstimate = time.Second
+
+// estimatedSendRates returns how many emails per second each queue's workers
+// are expected to send, with each sending an email every
+// sendDurationEstimate. SMTP_SEND_RATE may hold queues to less, which is
+// accounted for by queueSendRate.
+func estimatedSendRates(config *EnvConfig) map[string]float64 {
+	return map[string]float64{
+		queueBulk:          float64(config.BulkMaxWorkers) / sendDurationEstimate.Seconds(),
+		queueScheduled:     float64(config.ScheduledMaxWorkers) / sendDurationEstimate.Seconds(),
+		queueTransactional: float64(config.TransactionalMaxWorkers) / sendDurationEstimate.Seconds(),
+	}
+}
+
+// queueSendRate returns how many emails per second a queue is expected to
+// send when numBusyQueues queues, including it, have emails waiting.
+// SMTP_SEND_RATE is shared by all queues, so if it's set, each busy queue is
+// assumed to get an equal part of it, unless its workers can't send that
+// many.
+func queueSendRate(workersRate, smtpSendRate float64, numBusyQueues int) float64 {
+	if smtpSendRate <= 0 {
+		return workersRate
+	}
+	return min(workersRate, smtpSendRate/float64(max(numBusyQueues, 1)))
+}
+
+// estimateSendAt returns when an email that was just queued is expected to
+// be sent. One scheduled for later is sent when it's scheduled for, and one
+// that's available now waits its turn behind the emails already available in
+// its queue. It's only an estimate: it doesn't account for job priorities,
+// retries, or emails that are scheduled to become available in the meantime.
+func (s *APIService) estimateSendAt(ctx context.Context, job *rivertype.JobRow) (time.Time, error) {
+	if job.State == rivertype.JobStateScheduled {
+		return job.ScheduledAt, nil
+	}
+
+	tx, err := s.beginEmailTx(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// Queues other than the email's only matter for how they share
+	// SMTP_SEND_RATE.
+	var numAhead, numBusyQueues int
+	if err := tx.QueryRow(ctx, `
+		SELECT count(*) FILTER (WHERE queue = $2 AND id < $3), count(DISTINCT queue)
+		FROM river_job
+		WHERE kind = $1
+			AND state = 'available'`,
+		(SendEmailArgs{}).Kind(), job.Queue, job.ID,
+	).Scan(&numAhead, &numBusyQueues); err != nil {
+		return time.Time{}, err
+	}
+
+	return sendAtAfter(time.Now(), numAhead, queueSendRate(s.sendRates[job.Queue], s.smtpSendRate, numBusyQueues)), nil
+}
+
+// sendAtAfter returns when an email will be sent if numAhead emails are sent
+// before it, at sendRate emails per second, starting from now. Without a rate
+// to go on, it's assumed to be sent right away.
+func sendAtAfter(now time.Time, numAhead int, sendRate float64) time.Time {
+	if sendRate <= 0 {
+		return now
+	}
+	return now.Add(time.Duration(float64(numAhead) / sendRate * float64(time.Second)))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimatedSendRates(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, map[string]float64{
+		queueBulk:          20,
+		queueScheduled:     10,
+		queueTransactional: 100,
+	}, estimatedSendRates(&EnvConfig{BulkMaxWorkers: 20, ScheduledMaxWorkers: 10, TransactionalMaxWorkers: 100}))
+}
+
+func TestQueueSendRate(t *testing.T) {
+	t.Parallel()
+
+	t.Run("WorkersWithoutSMTPSendRate", func(t *testing.T) {
+		t.Parallel()
+
+		require.InDelta(t, 100, queueSendRate(100, 0, 3), 0)
+	})
+
+	t.Run("SMTPSendRateSharedByBusyQueues", func(t *testing.T) {
+		t.Parallel()
+
+		require.InDelta(t, 30, queueSendRate(100, 30, 1), 0)
+		require.InDelta(t, 10, queueSendRate(100, 30, 3), 0)
+		require.InDelta(t, 30, queueSendRate(100, 30, 0), 0)
+	})
+
+	t.Run("WorkersLessThanShare", func(t *testing.T) {
+		t.Parallel()
+
+		require.InDelta(t, 2, queueSendRate(2, 30, 2), 0)
+	})
+}
+
+func TestSendAtAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	require.Equal(t, now, sendAtAfter(now, 0, 10))
+	require.Equal(t, now.Add(2500*time.Millisecond), sendAtAfter(now, 25, 10))
+
+	// Without a rate, an email is assumed to go out right away.
+	require.Equal(t, now, sendAtAfter(now, 25, 0))
+}
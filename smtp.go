@@ -0,0 +1,618 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// smtpEndpoint is an SMTP server and the credentials used to authenticate
+// with it.
+type smtpEndpoint struct {
+	addr, pass, user string
+}
+
+// parseSMTPHosts parses a comma-separated list of SMTP endpoints like
+// `user:pass@smtp1.example.com:587,smtp2.example.com:587`. Endpoints without
+// credentials of their own use the given defaults. Credentials containing `@`,
+// `:`, or `,` must be percent-encoded.
+func parseSMTPHosts(hosts, defaultUser, defaultPass string) ([]smtpEndpoint, error) {
+	var endpoints []smtpEndpoint
+	for entry := range strings.SplitSeq(hosts, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		hostURL, err := url.Parse("smtp://" + entry)
+		if err != nil || hostURL.Host == "" || hostURL.Path != "" {
+			return nil, fmt.Errorf("SMTP_HOSTS entry %q should look like user:pass@host:port", entry)
+		}
+
+		endpoint := smtpEndpoint{addr: hostURL.Host, pass: defaultPass, user: defaultUser}
+		if hostURL.User != nil {
+			endpoint.user = hostURL.User.Username()
+			endpoint.pass, _ = hostURL.User.Password()
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// SMTP authentication mechanisms that can be selected with SMTP_AUTH.
+const (
+	smtpAuthCRAMMD5 = "cram-md5"
+	smtpAuthNone    = "none" // for relays on a trusted network that don't authenticate
+	smtpAuthPlain   = "plain"
+)
+
+// makeSMTPAuth makes an smtp.Auth for the given mechanism, or returns nil if
+// the mechanism is smtpAuthNone.
+func makeSMTPAuth(mechanism, user, pass, host string) (smtp.Auth, error) {
+	switch mechanism {
+	case smtpAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(user, pass), nil
+	case smtpAuthNone:
+		return nil, nil //nolint:nilnil
+	case smtpAuthPlain:
+		return smtp.PlainAuth("", user, pass, host), nil
+	}
+	return nil, fmt.Errorf("SMTP_AUTH must be one of %s, %s, or %s, but was %q", smtpAuthCRAMMD5, smtpAuthNone, smtpAuthPlain, mechanism)
+}
+
+// TLS modes that can be selected with SMTP_TLS_MODE.
+const (
+	smtpTLSModeImplicit = "implicit" // TLS from the start of the connection, usually on port 465
+	smtpTLSModeNone     = "none"     // plaintext only, for relays on a trusted network
+	smtpTLSModeSTARTTLS = "starttls" // upgraded with STARTTLS when the server offers it, usually on port 587
+)
+
+// smtpTLSConfig returns the TLS configuration of connections to SMTP servers.
+// SMTP_TLS_INSECURE_SKIP_VERIFY turns off certificate verification, for a
+// local server like Mailpit with a self-signed certificate.
+func smtpTLSConfig(config *EnvConfig) *tls.Config {
+	return &tls.Config{InsecureSkipVerify: config.SMTPInsecureSkipVerify} //nolint:gosec
+}
+
+// smtpAddr returns the address to dial for an SMTP host, which gets SMTP_PORT
+// if it doesn't include a port of its own. It checks that the port goes with
+// SMTP_TLS_MODE, since a server on the standard port for one mode won't
+// understand a client expecting the other.
+func smtpAddr(config *EnvConfig, hostPort string) (string, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		if config.SMTPPort == 0 {
+			return "", fmt.Errorf("SMTP host %q must include a port, like %s:587, unless SMTP_PORT is set", hostPort, hostPort)
+		}
+		host, port = hostPort, strconv.Itoa(config.SMTPPort)
+	}
+
+	tlsMode := cmp.Or(config.SMTPTLSMode, smtpTLSModeSTARTTLS)
+	switch {
+	case tlsMode == smtpTLSModeImplicit && (port == "25" || port == "587"):
+		return "", fmt.Errorf("SMTP_TLS_MODE %s doesn't work with SMTP host %s, whose port expects STARTTLS; use port 465 or SMTP_TLS_MODE %s", tlsMode, net.JoinHostPort(host, port), smtpTLSModeSTARTTLS)
+	case tlsMode != smtpTLSModeImplicit && port == "465":
+		return "", fmt.Errorf("SMTP_TLS_MODE %s doesn't work with SMTP host %s, whose port expects implicit TLS; use SMTP_TLS_MODE %s", tlsMode, net.JoinHostPort(host, port), smtpTLSModeImplicit)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// makeEmailSender makes an EmailSender from environment configuration. Mail
+// goes through the providers in SMTP_HOSTS, or through SMTP_HOST if that's not
+// set.
+func makeEmailSender(config *EnvConfig, metrics *metrics) (EmailSender, error) {
+	if config.SMTPPoolSize < 1 {
+		return nil, fmt.Errorf("SMTP_POOL_SIZE must be positive, but was %d", config.SMTPPoolSize)
+	}
+	if config.SMTPPort < 0 || config.SMTPPort > 65535 {
+		return nil, fmt.Errorf("SMTP_PORT must be a port from 1 to 65535, but was %d", config.SMTPPort)
+	}
+	switch config.SMTPTLSMode {
+	case "", smtpTLSModeImplicit, smtpTLSModeNone, smtpTLSModeSTARTTLS:
+	default:
+		return nil, fmt.Errorf("SMTP_TLS_MODE must be one of %s, %s, or %s, but was %q", smtpTLSModeImplicit, smtpTLSModeNone, smtpTLSModeSTARTTLS, config.SMTPTLSMode)
+	}
+
+	endpoints, err := parseSMTPHosts(config.SMTPHosts, config.SMTPUser, config.SMTPPass)
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoints) < 1 {
+		if config.SMTPHost == "" {
+			// Every email is sent with its domain's credentials when there
+			// are domains, so no others are needed.
+			if config.SMTPDomains != "" {
+				return nil, nil //nolint:nilnil
+			}
+			return nil, errors.New("SMTP_HOST, SMTP_HOSTS, or SMTP_DOMAINS must be set")
+		}
+		endpoints = []smtpEndpoint{{addr: config.SMTPHost, pass: config.SMTPPass, user: config.SMTPUser}}
+	}
+
+	if config.SMTPHELOHost != "" {
+		if err := validate.Var(config.SMTPHELOHost, "hostname_rfc1123"); err != nil {
+			return nil, fmt.Errorf("SMTP_HELO_HOST must be a hostname, but was %q", config.SMTPHELOHost)
+		}
+	}
+
+	if len(config.SMTPWeights) > 0 {
+		if len(config.SMTPWeights) != len(endpoints) {
+			return nil, fmt.Errorf("SMTP_WEIGHTS has %d weights, but there are %d SMTP providers", len(config.SMTPWeights), len(endpoints))
+		}
+		var totalWeight int
+		for _, weight := range config.SMTPWeights {
+			if weight < 0 {
+				return nil, fmt.Errorf("SMTP_WEIGHTS must not be negative, but was %d", weight)
+			}
+			totalWeight += weight
+		}
+		if totalWeight < 1 {
+			return nil, errors.New("SMTP_WEIGHTS must include at least one positive weight")
+		}
+	}
+
+	providers := make([]*smtpProvider, len(endpoints))
+	for i, endpoint := range endpoints {
+		if endpoint.addr, err = smtpAddr(config, endpoint.addr); err != nil {
+			return nil, err
+		}
+
+		host, _, _ := net.SplitHostPort(endpoint.addr)
+		auth, err := makeSMTPAuth(config.SMTPAuth, endpoint.user, endpoint.pass, host)
+		if err != nil {
+			return nil, err
+		}
+
+		providers[i] = &smtpProvider{
+			name:   endpoint.addr,
+			sender: newSMTPPool(endpoint.addr, auth, config.SMTPHELOHost, config.SMTPPoolSize, config.SMTPTLSMode, smtpTLSConfig(config)),
+		}
+		if len(config.SMTPWeights) > 0 {
+			providers[i].weight = config.SMTPWeights[i]
+		}
+	}
+
+	return withDKIMSigning(config, newFailoverSender(metrics, providers))
+}
+
+// smtpDomainConfig is the SMTP server and credentials for one of the sender
+// domains in SMTP_DOMAINS.
+type smtpDomainConfig struct {
+	Host string `json:"host"`
+	Pass string `json:"pass"`
+	User string `json:"user"`
+}
+
+// makeDomainSenders makes an EmailSender for each sender domain in
+// SMTP_DOMAINS, a JSON object like `{"brand.example.com": {"host":
+// "smtp.brand.example.com:587", "user": "...", "pass": "..."}}`, keyed by the
+// domain in lowercase. It returns nil if SMTP_DOMAINS isn't set.
+func makeDomainSenders(config *EnvConfig, metrics *metrics) (map[string]EmailSender, error) {
+	if config.SMTPDomains == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	var domainConfigs map[string]smtpDomainConfig
+	if err := json.Unmarshal([]byte(config.SMTPDomains), &domainConfigs); err != nil {
+		return nil, fmt.Errorf("SMTP_DOMAINS must be a JSON object of domains to SMTP configuration: %w", err)
+	}
+	if len(domainConfigs) < 1 {
+		return nil, errors.New("SMTP_DOMAINS must include at least one domain")
+	}
+
+	senders := make(map[string]EmailSender, len(domainConfigs))
+	for domain, domainConfig := range domainConfigs {
+		if err := validate.Var(domain, "fqdn"); err != nil {
+			return nil, fmt.Errorf("SMTP_DOMAINS keys must be domains, but was %q", domain)
+		}
+		host, _, err := net.SplitHostPort(domainConfig.Host)
+		if err != nil {
+			return nil, fmt.Errorf("SMTP_DOMAINS host for %s must look like host:port, but was %q", domain, domainConfig.Host)
+		}
+		if _, err := smtpAddr(config, domainConfig.Host); err != nil {
+			return nil, err
+		}
+
+		auth, err := makeSMTPAuth(config.SMTPAuth, domainConfig.User, domainConfig.Pass, host)
+		if err != nil {
+			return nil, err
+		}
+
+		sender, err := withDKIMSigning(config, newFailoverSender(metrics, []*smtpProvider{{
+			name:   domainConfig.Host,
+			sender: newSMTPPool(domainConfig.Host, auth, config.SMTPHELOHost, config.SMTPPoolSize, config.SMTPTLSMode, smtpTLSConfig(config)),
+		}}))
+		if err != nil {
+			return nil, err
+		}
+		senders[strings.ToLower(domain)] = sender
+	}
+
+	return senders, nil
+}
+
+// withDKIMSigning wraps sender to DKIM sign messages if DKIM is configured.
+// Signing happens once, outside of failover, so that a message tried through
+// several providers has the same signature at each.
+func withDKIMSigning(config *EnvConfig, sender EmailSender) (EmailSender, error) {
+	if config.DKIMDomain == "" && config.DKIMPrivateKey == "" && config.DKIMSelector == "" {
+		return sender, nil
+	}
+
+	if config.DKIMDomain == "" || config.DKIMPrivateKey == "" || config.DKIMSelector == "" {
+		return nil, errors.New("DKIM_DOMAIN, DKIM_PRIVATE_KEY (or DKIM_PRIVATE_KEY_FILE), and DKIM_SELECTOR must be set together")
+	}
+	if err := validate.Var(config.DKIMDomain, "fqdn"); err != nil {
+		return nil, fmt.Errorf("DKIM_DOMAIN must be a domain, but was %q", config.DKIMDomain)
+	}
+
+	signer, err := newDKIMSigner(config.DKIMDomain, config.DKIMSelector, []byte(config.DKIMPrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return &dkimSigningSender{sender: sender, signer: signer}, nil
+}
+
+// smtpProvider is a named EmailSender that's one of several that email can
+// be delivered through.
+type smtpProvider struct {
+	name   string
+	sender EmailSender
+
+	// weight is the provider's share of email relative to other providers.
+	// A provider with a weight of zero is only used when others fail.
+	weight int
+}
+
+// failoverSender is an EmailSender that delivers through one of several
+// providers, and tries the others when it fails so an outage at one provider
+// doesn't stop all email.
+//
+// When providers have weights, the provider tried first is picked in a
+// weighted round-robin so that volume is spread across providers according
+// to their weights. Otherwise, providers are always tried in order.
+type failoverSender struct {
+	metrics     *metrics
+	next        atomic.Uint64
+	providers   []*smtpProvider
+	totalWeight uint64
+}
+
+func newFailoverSender(metrics *metrics, providers []*smtpProvider) *failoverSender {
+	var totalWeight uint64
+	for _, provider := range providers {
+		totalWeight += uint64(provider.weight) //nolint:gosec
+	}
+
+	return &failoverSender{metrics: metrics, providers: providers, totalWeight: totalWeight}
+}
+
+func (s *failoverSender) SendMail(ctx context.Context, from string, to []string, msg []byte) error {
+	start := s.pick()
+
+	errs := make([]error, 0, len(s.providers))
+	for i := range s.providers {
+		provider := s.providers[(start+i)%len(s.providers)]
+		if err := provider.sender.SendMail(ctx, from, to, msg); err != nil {
+			errs = append(errs, fmt.Errorf("provider %s: %w", provider.name, err))
+			continue
+		}
+
+		s.metrics.emailsDelivered.WithLabelValues(provider.name).Inc()
+		return nil
+	}
+
+	return fmt.Errorf("all SMTP providers failed: %w", errors.Join(errs...))
+}
+
+// pick returns the index of the provider to try first for a send.
+func (s *failoverSender) pick() int {
+	if s.totalWeight == 0 {
+		return 0
+	}
+
+	// Each send takes the next of totalWeight slots, and each provider owns
+	// as many consecutive slots as its weight.
+	slot := int((s.next.Add(1) - 1) % s.totalWeight) //nolint:gosec
+	for i, provider := range s.providers {
+		if slot < provider.weight {
+			return i
+		}
+		slot -= provider.weight
+	}
+	return 0
+}
+
+const (
+	// smtpSendAttempts is how many times a message is sent on a connection
+	// before giving up, when the server turns it away with a transient error.
+	// Only the message's transaction is tried again, on the connection that's
+	// already open and authenticated, which is much cheaper than a new one.
+	smtpSendAttempts = 3
+
+	// smtpSendRetryDelay is how long a message waits before it's sent again
+	// after a transient error.
+	smtpSendRetryDelay = 100 * time.Millisecond
+)
+
+// smtpPool is an EmailSender that keeps a pool of connected and authenticated
+// SMTP clients so that each send doesn't pay the cost of dialing, negotiating
+// TLS, and authenticating from scratch. Up to size connections are open at
+// once, and a send waits for one to become free if they're all in use.
+type smtpPool struct {
+	addr string
+	auth smtp.Auth // nil to skip authentication
+	host string
+
+	// heloHost is the name the pool's connections introduce themselves with
+	// in EHLO. net/smtp sends `localhost` if it's empty.
+	heloHost string
+
+	// idle holds connections that aren't in use.
+	idle chan *smtpConn
+
+	// tlsConfig is the configuration of TLS connections to the server, and
+	// tlsMode how they're made, one of the smtpTLSMode* constants.
+	tlsConfig *tls.Config
+	tlsMode   string
+
+	// slots holds a value for each connection that's checked out, limiting
+	// the number of open connections to the pool's size.
+	slots chan struct{}
+}
+
+// smtpConn is an SMTP client along with its underlying connection, which is
+// kept so that deadlines can be set on it.
+type smtpConn struct {
+	*smtp.Client
+	conn net.Conn
+}
+
+// newSMTPPool makes a pool of connections to addr. tlsConfig may be nil for
+// the default TLS configuration, and the server's name is set on it either
+// way.
+func newSMTPPool(addr string, auth smtp.Auth, heloHost string, size int, tlsMode string, tlsConfig *tls.Config) *smtpPool {
+	host, _, _ := net.SplitHostPort(addr)
+
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{} //nolint:gosec
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ServerName = host
+
+	return &smtpPool{
+		addr:      addr,
+		auth:      auth,
+		heloHost:  heloHost,
+		host:      host,
+		idle:      make(chan *smtpConn, size),
+		slots:     make(chan struct{}, size),
+		tlsConfig: tlsConfig,
+		tlsMode:   cmp.Or(tlsMode, smtpTLSModeSTARTTLS),
+	}
+}
+
+func (p *smtpPool) SendMail(ctx context.Context, from string, to []string, msg []byte) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	// Connecting and authenticating is done once, by get, however many times
+	// the message is sent.
+	client, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := client.withContext(ctx, func() error { return sendMessage(client.Client, from, to, msg) })
+		if err == nil {
+			break
+		}
+
+		// Past its last attempt, or after an error that isn't transient, the
+		// job's own retries take over. The connection may be in an unknown
+		// state, so it isn't reused.
+		if attempt >= smtpSendAttempts || !isSMTPTransient(err) {
+			_ = client.Close()
+			return err
+		}
+
+		// The failed transaction is reset so that the next one starts over
+		// with MAIL.
+		if err := client.withContext(ctx, client.Reset); err != nil {
+			_ = client.Close()
+			return err
+		}
+
+		select {
+		case <-time.After(smtpSendRetryDelay):
+		case <-ctx.Done():
+			_ = client.Close()
+			return ctx.Err()
+		}
+	}
+
+	// If the context finished while sending, the connection's deadline may
+	// have been moved into the past, so it can't be reused.
+	if ctx.Err() != nil {
+		_ = client.Close()
+		return nil
+	}
+
+	p.put(client)
+	return nil
+}
+
+// Close closes all idle connections.
+func (p *smtpPool) Close() error {
+	for {
+		select {
+		case client := <-p.idle:
+			_ = client.Quit()
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *smtpPool) dial(ctx context.Context) (*smtpConn, error) {
+	// In implicit mode the TLS handshake comes before the server's greeting,
+	// so the connection is TLS from the start instead of being upgraded.
+	var dialer interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	} = &net.Dialer{}
+	if p.tlsMode == smtpTLSModeImplicit {
+		dialer = &tls.Dialer{Config: p.tlsConfig}
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &smtpConn{conn: conn}
+	if err := client.withContext(ctx, func() error {
+		// Reads the server's greeting.
+		client.Client, err = smtp.NewClient(conn, p.host)
+		if err != nil {
+			return err
+		}
+
+		// Must come before any other command, which would otherwise send
+		// EHLO with the default name.
+		if p.heloHost != "" {
+			if err := client.Hello(p.heloHost); err != nil {
+				return err
+			}
+		}
+
+		// Same negotiation as smtp.SendMail: upgrade to TLS and authenticate
+		// if the server supports it.
+		if ok, _ := client.Extension("STARTTLS"); ok && p.tlsMode == smtpTLSModeSTARTTLS {
+			if err := client.StartTLS(p.tlsConfig); err != nil {
+				return err
+			}
+		}
+
+		if ok, _ := client.Extension("AUTH"); ok && p.auth != nil {
+			if err := client.Auth(p.auth); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// get returns an idle connection, or dials a new one if there are none. A
+// server may close a connection that's been idle for a while, so idle
+// connections are checked first and discarded if they're stale.
+func (p *smtpPool) get(ctx context.Context) (*smtpConn, error) {
+	for {
+		select {
+		case client := <-p.idle:
+			if err := client.withContext(ctx, client.Noop); err != nil {
+				_ = client.Close()
+				if ctx.Err() != nil {
+					return nil, err
+				}
+				continue
+			}
+			return client, nil
+		default:
+			return p.dial(ctx)
+		}
+	}
+}
+
+// put returns a connection to the pool after use.
+func (p *smtpPool) put(client *smtpConn) {
+	select {
+	case p.idle <- client:
+	default:
+		_ = client.Quit()
+	}
+}
+
+// withContext runs f, which does I/O on the connection, so that it's
+// aborted when ctx is cancelled or its deadline passes. net/smtp doesn't take
+// a context, so this is done by moving the connection's deadline to the
+// context's, or into the past as soon as the context is cancelled, which
+// fails any blocked reads or writes. Errors are replaced by the context's
+// error when it's the reason they happened.
+func (c *smtpConn) withContext(ctx context.Context, f func() error) error {
+	deadline, _ := ctx.Deadline() // zero for no deadline
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = c.conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if err := f(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// The deadline may be reached a moment before the context notices.
+		if !deadline.IsZero() && errors.Is(err, os.ErrDeadlineExceeded) {
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+
+	return nil
+}
+
+// isSMTPTransient returns true if err is a transient reply from an SMTP
+// server, which is one in the 4xx range, like a 451 for a local error, that
+// leaves the connection open. A 421 is transient too, but the server closes
+// the connection after it.
+func isSMTPTransient(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 400 && protoErr.Code < 500 && protoErr.Code != smtpCodeServiceUnavailable
+}
+
+// sendMessage sends a single message on an open connection.
+func sendMessage(client *smtp.Client, from string, to []string, msg []byte) error {
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+
+	for _, addr := range to {
+		if err := client.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(msg); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
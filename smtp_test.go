@@ -0,0 +1,1173 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5" //nolint:gosec
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sethvargo/go-envconfig"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverSender(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		metrics   *metrics
+		primary   *fakeEmailSender
+		secondary *fakeEmailSender
+	}
+
+	setup := func(t *testing.T) (*failoverSender, *testBundle) {
+		t.Helper()
+
+		bundle := &testBundle{
+			metrics:   newMetrics(),
+			primary:   &fakeEmailSender{},
+			secondary: &fakeEmailSender{},
+		}
+
+		return &failoverSender{
+			metrics: bundle.metrics,
+			providers: []*smtpProvider{
+				{name: "primary", sender: bundle.primary},
+				{name: "secondary", sender: bundle.secondary},
+			},
+		}, bundle
+	}
+
+	send := func(t *testing.T, sender *failoverSender) error {
+		t.Helper()
+
+		return sender.SendMail(t.Context(), "sender@example.com", []string{"recipient@example.com"}, []byte("Hello."))
+	}
+
+	t.Run("SendsThroughFirstProvider", func(t *testing.T) {
+		t.Parallel()
+
+		sender, bundle := setup(t)
+
+		require.NoError(t, send(t, sender))
+		require.Len(t, bundle.primary.sent, 1)
+		require.Empty(t, bundle.secondary.sent)
+		require.InDelta(t, 1, testutil.ToFloat64(bundle.metrics.emailsDelivered.WithLabelValues("primary")), 0)
+	})
+
+	t.Run("FailsOverToNextProvider", func(t *testing.T) {
+		t.Parallel()
+
+		sender, bundle := setup(t)
+		bundle.primary.err = errors.New("connection refused")
+
+		require.NoError(t, send(t, sender))
+		require.Empty(t, bundle.primary.sent)
+		require.Len(t, bundle.secondary.sent, 1)
+		require.InDelta(t, 0, testutil.ToFloat64(bundle.metrics.emailsDelivered.WithLabelValues("primary")), 0)
+		require.InDelta(t, 1, testutil.ToFloat64(bundle.metrics.emailsDelivered.WithLabelValues("secondary")), 0)
+	})
+
+	t.Run("AllProvidersFail", func(t *testing.T) {
+		t.Parallel()
+
+		sender, bundle := setup(t)
+		bundle.primary.err = errors.New("connection refused")
+		bundle.secondary.err = errors.New("relay access denied")
+
+		err := send(t, sender)
+		require.ErrorContains(t, err, "all SMTP providers failed")
+		require.ErrorContains(t, err, "provider primary: connection refused")
+		require.ErrorContains(t, err, "provider secondary: relay access denied")
+		require.ErrorIs(t, err, bundle.secondary.err)
+	})
+
+	t.Run("WeightedDistribution", func(t *testing.T) {
+		t.Parallel()
+
+		_, bundle := setup(t)
+		sender := newFailoverSender(bundle.metrics, []*smtpProvider{
+			{name: "primary", sender: bundle.primary, weight: 3},
+			{name: "secondary", sender: bundle.secondary, weight: 1},
+		})
+
+		const numSends = 1_000
+
+		var wg sync.WaitGroup
+		for range numSends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.NoError(t, send(t, sender))
+			}()
+		}
+		wg.Wait()
+
+		require.InDelta(t, numSends*3/4, len(bundle.primary.sent), numSends*0.05)
+		require.InDelta(t, numSends*1/4, len(bundle.secondary.sent), numSends*0.05)
+	})
+
+	t.Run("WeightedFallsBackOnFailure", func(t *testing.T) {
+		t.Parallel()
+
+		_, bundle := setup(t)
+		bundle.secondary.err = errors.New("connection refused")
+		sender := newFailoverSender(bundle.metrics, []*smtpProvider{
+			{name: "primary", sender: bundle.primary, weight: 1},
+			{name: "secondary", sender: bundle.secondary, weight: 1},
+		})
+
+		for range 4 {
+			require.NoError(t, send(t, sender))
+		}
+		require.Len(t, bundle.primary.sent, 4)
+	})
+
+	t.Run("ZeroWeightOnlyUsedOnFailure", func(t *testing.T) {
+		t.Parallel()
+
+		_, bundle := setup(t)
+		sender := newFailoverSender(bundle.metrics, []*smtpProvider{
+			{name: "primary", sender: bundle.primary, weight: 1},
+			{name: "secondary", sender: bundle.secondary, weight: 0},
+		})
+
+		for range 4 {
+			require.NoError(t, send(t, sender))
+		}
+		require.Len(t, bundle.primary.sent, 4)
+		require.Empty(t, bundle.secondary.sent)
+
+		bundle.primary.err = errors.New("connection refused")
+		require.NoError(t, send(t, sender))
+		require.Len(t, bundle.secondary.sent, 1)
+	})
+}
+
+func TestMakeEmailSender(t *testing.T) {
+	t.Parallel()
+
+	providerNames := func(sender EmailSender) []string {
+		var names []string
+		for _, provider := range sender.(*failoverSender).providers { //nolint:forcetypeassert
+			names = append(names, provider.name)
+		}
+		return names
+	}
+
+	t.Run("SMTPHost", func(t *testing.T) {
+		t.Parallel()
+
+		sender, err := makeEmailSender(&EnvConfig{SMTPAuth: smtpAuthPlain, SMTPHost: "smtp.example.com:587", SMTPPoolSize: 1}, newMetrics())
+		require.NoError(t, err)
+		require.Equal(t, []string{"smtp.example.com:587"}, providerNames(sender))
+	})
+
+	t.Run("SMTPHostsTakesPrecedence", func(t *testing.T) {
+		t.Parallel()
+
+		sender, err := makeEmailSender(&EnvConfig{
+			SMTPAuth:     smtpAuthPlain,
+			SMTPHost:     "smtp.example.com:587",
+			SMTPHosts:    "a:pass@smtp1.example.com:587, smtp2.example.com:2525",
+			SMTPPoolSize: 1,
+		}, newMetrics())
+		require.NoError(t, err)
+		require.Equal(t, []string{"smtp1.example.com:587", "smtp2.example.com:2525"}, providerNames(sender))
+	})
+
+	t.Run("SMTPWeights", func(t *testing.T) {
+		t.Parallel()
+
+		config, err := loadEnvConfig(t.Context(), envconfig.MapLookuper(map[string]string{
+			"DATABASE_URL":   "postgres://localhost/river_test",
+			"SMTP_HOSTS":     "smtp1.example.com:587,smtp2.example.com:587",
+			"SMTP_POOL_SIZE": "1",
+			"SMTP_WEIGHTS":   "3,1",
+		}))
+		require.NoError(t, err)
+
+		sender, err := makeEmailSender(config, newMetrics())
+		require.NoError(t, err)
+
+		providers := sender.(*failoverSender).providers //nolint:forcetypeassert
+		require.Equal(t, 3, providers[0].weight)
+		require.Equal(t, 1, providers[1].weight)
+	})
+
+	t.Run("SMTPWeightsInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tt := range []struct {
+			weights []int
+			wantErr string
+		}{
+			{[]int{1}, "SMTP_WEIGHTS has 1 weights, but there are 2 SMTP providers"},
+			{[]int{1, -1}, "SMTP_WEIGHTS must not be negative, but was -1"},
+			{[]int{0, 0}, "SMTP_WEIGHTS must include at least one positive weight"},
+		} {
+			_, err := makeEmailSender(&EnvConfig{
+				SMTPAuth:     smtpAuthPlain,
+				SMTPHosts:    "smtp1.example.com:587,smtp2.example.com:587",
+				SMTPPoolSize: 1,
+				SMTPWeights:  tt.weights,
+			}, newMetrics())
+			require.EqualError(t, err, tt.wantErr)
+		}
+	})
+
+	t.Run("SMTPAuth", func(t *testing.T) {
+		t.Parallel()
+
+		// Sends an email through a fake server with the given SMTP_AUTH.
+		send := func(t *testing.T, authMechanism string) *fakeSMTPServer {
+			t.Helper()
+
+			server := startFakeSMTPServer(t)
+
+			sender, err := makeEmailSender(&EnvConfig{
+				SMTPAuth:     authMechanism,
+				SMTPHost:     server.Addr(),
+				SMTPPass:     "a-pass",
+				SMTPPoolSize: 1,
+				SMTPUser:     "a-user",
+			}, newMetrics())
+			require.NoError(t, err)
+
+			require.NoError(t, sender.SendMail(t.Context(), "sender@example.com", []string{"recipient@example.com"}, []byte("Subject: Hello\r\n\r\nHello.\r\n")))
+			require.Len(t, server.Messages(), 1)
+			return server
+		}
+
+		t.Run("Plain", func(t *testing.T) {
+			t.Parallel()
+
+			server := send(t, smtpAuthPlain)
+			require.Equal(t, []string{"PLAIN"}, server.AuthMechanisms())
+			require.Equal(t, []string{"\x00a-user\x00a-pass"}, server.Auths())
+		})
+
+		t.Run("CRAMMD5", func(t *testing.T) {
+			t.Parallel()
+
+			server := send(t, smtpAuthCRAMMD5)
+			require.Equal(t, []string{"CRAM-MD5"}, server.AuthMechanisms())
+
+			mac := hmac.New(md5.New, []byte("a-pass"))
+			mac.Write([]byte(fakeSMTPChallenge))
+			require.Equal(t, []string{"a-user " + hex.EncodeToString(mac.Sum(nil))}, server.Auths())
+		})
+
+		t.Run("None", func(t *testing.T) {
+			t.Parallel()
+
+			server := send(t, smtpAuthNone)
+			require.Empty(t, server.AuthMechanisms())
+		})
+
+		t.Run("Invalid", func(t *testing.T) {
+			t.Parallel()
+
+			_, err := makeEmailSender(&EnvConfig{SMTPAuth: "login", SMTPHost: "smtp.example.com:587", SMTPPoolSize: 1}, newMetrics())
+			require.EqualError(t, err, `SMTP_AUTH must be one of cram-md5, none, or plain, but was "login"`)
+		})
+	})
+
+	t.Run("SMTPHELOHostInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := makeEmailSender(&EnvConfig{
+			SMTPAuth:     smtpAuthPlain,
+			SMTPHELOHost: "not a hostname",
+			SMTPHost:     "smtp.example.com:587",
+			SMTPPoolSize: 1,
+		}, newMetrics())
+		require.EqualError(t, err, `SMTP_HELO_HOST must be a hostname, but was "not a hostname"`)
+	})
+
+	t.Run("DKIM", func(t *testing.T) {
+		t.Parallel()
+
+		_, keyPEM := generateDKIMKey(t)
+		keyFile := filepath.Join(t.TempDir(), "dkim.pem")
+		require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+
+		config, err := loadEnvConfig(t.Context(), envconfig.MapLookuper(map[string]string{
+			"DATABASE_URL":          "postgres://localhost/river_test",
+			"DKIM_DOMAIN":           "example.com",
+			"DKIM_PRIVATE_KEY_FILE": keyFile,
+			"DKIM_SELECTOR":         "mail",
+			"SMTP_HOST":             "smtp.example.com:587",
+		}))
+		require.NoError(t, err)
+
+		sender, err := makeEmailSender(config, newMetrics())
+		require.NoError(t, err)
+		require.IsType(t, &dkimSigningSender{}, sender)
+		require.Equal(t, "example.com", sender.(*dkimSigningSender).signer.domain) //nolint:forcetypeassert
+		require.IsType(t, &failoverSender{}, sender.(*dkimSigningSender).sender)   //nolint:forcetypeassert
+	})
+
+	t.Run("DKIMIncomplete", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := makeEmailSender(&EnvConfig{
+			DKIMDomain:   "example.com",
+			DKIMSelector: "mail",
+			SMTPAuth:     smtpAuthPlain,
+			SMTPHost:     "smtp.example.com:587",
+			SMTPPoolSize: 1,
+		}, newMetrics())
+		require.EqualError(t, err, "DKIM_DOMAIN, DKIM_PRIVATE_KEY (or DKIM_PRIVATE_KEY_FILE), and DKIM_SELECTOR must be set together")
+	})
+
+	t.Run("DKIMDomainInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		_, keyPEM := generateDKIMKey(t)
+
+		_, err := makeEmailSender(&EnvConfig{
+			DKIMDomain:     "not a domain",
+			DKIMPrivateKey: string(keyPEM),
+			DKIMSelector:   "mail",
+			SMTPAuth:       smtpAuthPlain,
+			SMTPHost:       "smtp.example.com:587",
+			SMTPPoolSize:   1,
+		}, newMetrics())
+		require.EqualError(t, err, `DKIM_DOMAIN must be a domain, but was "not a domain"`)
+	})
+
+	t.Run("NoHosts", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := makeEmailSender(&EnvConfig{SMTPPoolSize: 1}, newMetrics())
+		require.EqualError(t, err, "SMTP_HOST, SMTP_HOSTS, or SMTP_DOMAINS must be set")
+	})
+
+	t.Run("NonPositivePoolSize", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := makeEmailSender(&EnvConfig{SMTPHost: "smtp.example.com:587"}, newMetrics())
+		require.EqualError(t, err, "SMTP_POOL_SIZE must be positive, but was 0")
+	})
+
+	t.Run("SMTPPort", func(t *testing.T) {
+		t.Parallel()
+
+		sender, err := makeEmailSender(&EnvConfig{
+			SMTPAuth:     smtpAuthPlain,
+			SMTPHosts:    "smtp1.example.com,smtp2.example.com:2525",
+			SMTPPoolSize: 1,
+			SMTPPort:     465,
+			SMTPTLSMode:  smtpTLSModeImplicit,
+		}, newMetrics())
+		require.NoError(t, err)
+		require.Equal(t, []string{"smtp1.example.com:465", "smtp2.example.com:2525"}, providerNames(sender))
+	})
+
+	t.Run("SMTPInsecureSkipVerify", func(t *testing.T) {
+		t.Parallel()
+
+		// Sends an email through a fake server with a self-signed
+		// certificate.
+		send := func(t *testing.T, insecureSkipVerify bool) (*fakeSMTPServer, error) {
+			t.Helper()
+
+			cert, _ := generateTLSCert(t)
+			server := startFakeSMTPServerWithSTARTTLS(t, cert)
+
+			sender, err := makeEmailSender(&EnvConfig{
+				SMTPAuth:               smtpAuthPlain,
+				SMTPHost:               server.Addr(),
+				SMTPInsecureSkipVerify: insecureSkipVerify,
+				SMTPPass:               "a-pass",
+				SMTPPoolSize:           1,
+				SMTPUser:               "a-user",
+			}, newMetrics())
+			require.NoError(t, err)
+
+			return server, sender.SendMail(t.Context(), "sender@example.com", []string{"recipient@example.com"}, []byte("Subject: Hello\r\n\r\nHello.\r\n"))
+		}
+
+		t.Run("Set", func(t *testing.T) {
+			t.Parallel()
+
+			server, err := send(t, true)
+			require.NoError(t, err)
+			require.Equal(t, []bool{true}, server.TLSConns())
+		})
+
+		t.Run("Unset", func(t *testing.T) {
+			t.Parallel()
+
+			server, err := send(t, false)
+			var certErr *tls.CertificateVerificationError
+			require.ErrorAs(t, err, &certErr)
+			require.Empty(t, server.Messages())
+		})
+	})
+
+	t.Run("SMTPPortMissing", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := makeEmailSender(&EnvConfig{SMTPAuth: smtpAuthPlain, SMTPHost: "smtp.example.com", SMTPPoolSize: 1}, newMetrics())
+		require.EqualError(t, err, `SMTP host "smtp.example.com" must include a port, like smtp.example.com:587, unless SMTP_PORT is set`)
+	})
+
+	t.Run("SMTPPortInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := makeEmailSender(&EnvConfig{SMTPAuth: smtpAuthPlain, SMTPHost: "smtp.example.com", SMTPPoolSize: 1, SMTPPort: 70000}, newMetrics())
+		require.EqualError(t, err, "SMTP_PORT must be a port from 1 to 65535, but was 70000")
+	})
+
+	t.Run("SMTPTLSMode", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tt := range []struct {
+			host    string
+			tlsMode string
+			wantErr string
+		}{
+			{"smtp.example.com:465", smtpTLSModeImplicit, ""},
+			{"smtp.example.com:587", smtpTLSModeSTARTTLS, ""},
+			{"smtp.example.com:2525", smtpTLSModeNone, ""},
+			{"smtp.example.com:587", "", ""},
+			{"smtp.example.com:587", smtpTLSModeImplicit, "SMTP_TLS_MODE implicit doesn't work with SMTP host smtp.example.com:587, whose port expects STARTTLS; use port 465 or SMTP_TLS_MODE starttls"},
+			{"smtp.example.com:465", smtpTLSModeSTARTTLS, "SMTP_TLS_MODE starttls doesn't work with SMTP host smtp.example.com:465, whose port expects implicit TLS; use SMTP_TLS_MODE implicit"},
+			{"smtp.example.com:465", "", "SMTP_TLS_MODE starttls doesn't work with SMTP host smtp.example.com:465, whose port expects implicit TLS; use SMTP_TLS_MODE implicit"},
+			{"smtp.example.com:587", "ssl", `SMTP_TLS_MODE must be one of implicit, none, or starttls, but was "ssl"`},
+		} {
+			_, err := makeEmailSender(&EnvConfig{SMTPAuth: smtpAuthPlain, SMTPHost: tt.host, SMTPPoolSize: 1, SMTPTLSMode: tt.tlsMode}, newMetrics())
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				continue
+			}
+			require.EqualError(t, err, tt.wantErr)
+		}
+	})
+}
+
+func TestMakeDomainSenders(t *testing.T) {
+	t.Parallel()
+
+	t.Run("PerDomainCredentials", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			serverA = startFakeSMTPServer(t)
+			serverB = startFakeSMTPServer(t)
+		)
+
+		senders, err := makeDomainSenders(&EnvConfig{
+			SMTPAuth: smtpAuthPlain,
+			SMTPDomains: fmt.Sprintf(`{
+				"brand-a.example.com": {"host": %q, "user": "a-user", "pass": "a-pass"},
+				"Brand-B.example.com": {"host": %q, "user": "b-user", "pass": "b-pass"}
+			}`, serverA.Addr(), serverB.Addr()),
+			SMTPPoolSize: 1,
+		}, newMetrics())
+		require.NoError(t, err)
+		require.Len(t, senders, 2)
+
+		msg := []byte("Subject: Hello\r\n\r\nHello.\r\n")
+		require.NoError(t, senders["brand-a.example.com"].SendMail(t.Context(), "sender@brand-a.example.com", []string{"recipient@example.com"}, msg))
+		require.NoError(t, senders["brand-b.example.com"].SendMail(t.Context(), "sender@brand-b.example.com", []string{"recipient@example.com"}, msg))
+
+		require.Equal(t, []string{"\x00a-user\x00a-pass"}, serverA.Auths())
+		require.Len(t, serverA.Messages(), 1)
+		require.Equal(t, []string{"\x00b-user\x00b-pass"}, serverB.Auths())
+		require.Len(t, serverB.Messages(), 1)
+	})
+
+	t.Run("NotSet", func(t *testing.T) {
+		t.Parallel()
+
+		senders, err := makeDomainSenders(&EnvConfig{SMTPAuth: smtpAuthPlain, SMTPPoolSize: 1}, newMetrics())
+		require.NoError(t, err)
+		require.Nil(t, senders)
+	})
+
+	t.Run("SMTPHostNotRequired", func(t *testing.T) {
+		t.Parallel()
+
+		sender, err := makeEmailSender(&EnvConfig{
+			SMTPAuth:     smtpAuthPlain,
+			SMTPDomains:  `{"brand-a.example.com": {"host": "smtp.brand-a.example.com:587"}}`,
+			SMTPPoolSize: 1,
+		}, newMetrics())
+		require.NoError(t, err)
+		require.Nil(t, sender)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tt := range []struct {
+			domains string
+			wantErr string
+		}{
+			{`["brand-a.example.com"]`, "SMTP_DOMAINS must be a JSON object of domains to SMTP configuration: json: cannot unmarshal array into Go value of type map[string]main.smtpDomainConfig"},
+			{`{}`, "SMTP_DOMAINS must include at least one domain"},
+			{`{"not a domain": {"host": "smtp.example.com:587"}}`, `SMTP_DOMAINS keys must be domains, but was "not a domain"`},
+			{`{"brand-a.example.com": {"host": "smtp.brand-a.example.com"}}`, `SMTP_DOMAINS host for brand-a.example.com must look like host:port, but was "smtp.brand-a.example.com"`},
+		} {
+			_, err := makeDomainSenders(&EnvConfig{SMTPAuth: smtpAuthPlain, SMTPDomains: tt.domains, SMTPPoolSize: 1}, newMetrics())
+			require.EqualError(t, err, tt.wantErr)
+		}
+	})
+}
+
+func TestParseSMTPHosts(t *testing.T) {
+	t.Parallel()
+
+	t.Run("PerHostCredentials", func(t *testing.T) {
+		t.Parallel()
+
+		endpoints, err := parseSMTPHosts("user1:pass1@smtp1.example.com:587,user2:p%40ss@smtp2.example.com:587", "", "")
+		require.NoError(t, err)
+		require.Equal(t, []smtpEndpoint{
+			{addr: "smtp1.example.com:587", pass: "pass1", user: "user1"},
+			{addr: "smtp2.example.com:587", pass: "p@ss", user: "user2"},
+		}, endpoints)
+	})
+
+	t.Run("DefaultCredentials", func(t *testing.T) {
+		t.Parallel()
+
+		endpoints, err := parseSMTPHosts("smtp1.example.com:587", "default-user", "default-pass")
+		require.NoError(t, err)
+		require.Equal(t, []smtpEndpoint{
+			{addr: "smtp1.example.com:587", pass: "default-pass", user: "default-user"},
+		}, endpoints)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		t.Parallel()
+
+		endpoints, err := parseSMTPHosts("", "", "")
+		require.NoError(t, err)
+		require.Empty(t, endpoints)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := parseSMTPHosts("smtp1.example.com:587,user@/path", "", "")
+		require.EqualError(t, err, `SMTP_HOSTS entry "user@/path" should look like user:pass@host:port`)
+	})
+}
+
+func TestSMTPPool(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		server *fakeSMTPServer
+	}
+
+	setup := func(t *testing.T, size int) (*smtpPool, *testBundle) {
+		t.Helper()
+
+		server := startFakeSMTPServer(t)
+
+		pool := newSMTPPool(server.Addr(), smtp.PlainAuth("", "a-user", "a-pass", "127.0.0.1"), "", size, smtpTLSModeSTARTTLS, nil)
+		t.Cleanup(func() { require.NoError(t, pool.Close()) })
+
+		return pool, &testBundle{server: server}
+	}
+
+	send := func(t *testing.T, pool *smtpPool, to string) error {
+		t.Helper()
+
+		return pool.SendMail(t.Context(), "sender@example.com", []string{to}, []byte("Subject: Hello\r\n\r\nHello.\r\n"))
+	}
+
+	t.Run("SendsEmail", func(t *testing.T) {
+		t.Parallel()
+
+		pool, bundle := setup(t, 1)
+
+		require.NoError(t, send(t, pool, "recipient@example.com"))
+
+		messages := bundle.server.Messages()
+		require.Len(t, messages, 1)
+		require.Equal(t, "sender@example.com", messages[0].From)
+		require.Equal(t, []string{"recipient@example.com"}, messages[0].To)
+		require.Equal(t, "Subject: Hello\r\n\r\nHello.\r\n", messages[0].Data)
+		require.Equal(t, []string{"\x00a-user\x00a-pass"}, bundle.server.Auths())
+	})
+
+	t.Run("HELOHost", func(t *testing.T) {
+		t.Parallel()
+
+		pool, bundle := setup(t, 1)
+		require.NoError(t, send(t, pool, "recipient@example.com"))
+		require.Equal(t, []string{"localhost"}, bundle.server.EHLOHosts())
+
+		server := startFakeSMTPServer(t)
+		pool = newSMTPPool(server.Addr(), smtp.PlainAuth("", "a-user", "a-pass", "127.0.0.1"), "mail.example.com", 1, smtpTLSModeSTARTTLS, nil)
+		t.Cleanup(func() { require.NoError(t, pool.Close()) })
+
+		require.NoError(t, send(t, pool, "recipient@example.com"))
+		require.Equal(t, []string{"mail.example.com"}, server.EHLOHosts())
+		require.Len(t, server.Auths(), 1)
+		require.Len(t, server.Messages(), 1)
+	})
+
+	t.Run("ImplicitTLS", func(t *testing.T) {
+		t.Parallel()
+
+		cert, rootCAs := generateTLSCert(t)
+		server := startFakeSMTPSServer(t, cert)
+
+		pool := newSMTPPool(server.Addr(), smtp.PlainAuth("", "a-user", "a-pass", "127.0.0.1"), "", 1, smtpTLSModeImplicit, &tls.Config{RootCAs: rootCAs}) //nolint:gosec
+		t.Cleanup(func() { require.NoError(t, pool.Close()) })
+
+		require.NoError(t, send(t, pool, "recipient@example.com"))
+		require.Len(t, server.Messages(), 1)
+		require.Equal(t, "Subject: Hello\r\n\r\nHello.\r\n", server.Messages()[0].Data)
+		require.Equal(t, []string{"\x00a-user\x00a-pass"}, server.Auths())
+		require.Equal(t, []bool{true}, server.TLSConns())
+	})
+
+	t.Run("ImplicitTLSAgainstPlaintextServer", func(t *testing.T) {
+		t.Parallel()
+
+		pool, bundle := setup(t, 1)
+		pool.tlsMode = smtpTLSModeImplicit
+
+		// A plaintext server's greeting isn't a TLS handshake.
+		require.Error(t, send(t, pool, "recipient@example.com"))
+		require.Empty(t, bundle.server.Messages())
+	})
+
+	t.Run("ReusesConnection", func(t *testing.T) {
+		t.Parallel()
+
+		pool, bundle := setup(t, 2)
+
+		for range 3 {
+			require.NoError(t, send(t, pool, "recipient@example.com"))
+		}
+
+		require.Len(t, bundle.server.Messages(), 3)
+		require.Equal(t, 1, bundle.server.NumConns())
+		require.Len(t, bundle.server.Auths(), 1)
+	})
+
+	t.Run("ConcurrentSendsLimitedToPoolSize", func(t *testing.T) {
+		t.Parallel()
+
+		pool, bundle := setup(t, 2)
+
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.NoError(t, send(t, pool, "recipient@example.com"))
+			}()
+		}
+		wg.Wait()
+
+		require.Len(t, bundle.server.Messages(), 10)
+		require.LessOrEqual(t, bundle.server.NumConns(), 2)
+	})
+
+	t.Run("ReconnectsStaleConnection", func(t *testing.T) {
+		t.Parallel()
+
+		pool, bundle := setup(t, 1)
+
+		require.NoError(t, send(t, pool, "recipient@example.com"))
+
+		// Simulates the server timing out an idle connection.
+		bundle.server.CloseConns()
+
+		require.NoError(t, send(t, pool, "recipient@example.com"))
+		require.Len(t, bundle.server.Messages(), 2)
+		require.Equal(t, 2, bundle.server.NumConns())
+	})
+
+	t.Run("ReconnectsAfterError", func(t *testing.T) {
+		t.Parallel()
+
+		pool, bundle := setup(t, 1)
+
+		require.ErrorContains(t, send(t, pool, fakeSMTPRejectedRecipient), "550")
+
+		require.NoError(t, send(t, pool, "recipient@example.com"))
+		require.Len(t, bundle.server.Messages(), 1)
+		require.Equal(t, 2, bundle.server.NumConns())
+	})
+
+	t.Run("RetriesTransientDataError", func(t *testing.T) {
+		t.Parallel()
+
+		pool, bundle := setup(t, 1)
+		bundle.server.FailData("451 4.3.0 Local error, try again")
+
+		require.NoError(t, send(t, pool, "recipient@example.com"))
+		require.Len(t, bundle.server.Messages(), 1)
+
+		// The message was sent again on the same connection, without
+		// authenticating again.
+		require.Len(t, bundle.server.Auths(), 1)
+		require.Equal(t, 1, bundle.server.NumConns())
+	})
+
+	t.Run("TransientDataErrorGivesUp", func(t *testing.T) {
+		t.Parallel()
+
+		pool, bundle := setup(t, 1)
+		bundle.server.FailData(slices.Repeat([]string{"451 4.3.0 Local error, try again"}, smtpSendAttempts)...)
+
+		require.ErrorContains(t, send(t, pool, "recipient@example.com"), "451")
+		require.Empty(t, bundle.server.Messages())
+		require.Len(t, bundle.server.Auths(), 1)
+
+		// The job's next attempt gets a new connection.
+		require.NoError(t, send(t, pool, "recipient@example.com"))
+		require.Equal(t, 2, bundle.server.NumConns())
+	})
+
+	t.Run("PermanentDataErrorNotRetried", func(t *testing.T) {
+		t.Parallel()
+
+		pool, bundle := setup(t, 1)
+		bundle.server.FailData("554 5.6.0 Message rejected")
+
+		require.ErrorContains(t, send(t, pool, "recipient@example.com"), "554")
+		require.Empty(t, bundle.server.Messages())
+	})
+
+	t.Run("StalledServerContextCancelled", func(t *testing.T) {
+		t.Parallel()
+
+		for _, verb := range []string{"EHLO", "DATA"} {
+			t.Run(verb, func(t *testing.T) {
+				t.Parallel()
+
+				pool, bundle := setup(t, 1)
+				bundle.server.StallOn(verb)
+
+				ctx, cancel := context.WithCancel(t.Context())
+				time.AfterFunc(50*time.Millisecond, cancel)
+
+				start := time.Now()
+				err := pool.SendMail(ctx, "sender@example.com", []string{"recipient@example.com"}, []byte("Subject: Hello\r\n\r\nHello.\r\n"))
+				require.ErrorIs(t, err, context.Canceled)
+				require.Less(t, time.Since(start), 5*time.Second)
+				require.Empty(t, bundle.server.Messages())
+			})
+		}
+	})
+
+	t.Run("StalledServerContextDeadline", func(t *testing.T) {
+		t.Parallel()
+
+		pool, bundle := setup(t, 1)
+		bundle.server.StallOn("DATA")
+
+		ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := pool.SendMail(ctx, "sender@example.com", []string{"recipient@example.com"}, []byte("Subject: Hello\r\n\r\nHello.\r\n"))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Less(t, time.Since(start), 5*time.Second)
+
+		// The stalled connection is discarded rather than reused.
+		bundle.server.StallOn("")
+		require.NoError(t, send(t, pool, "recipient@example.com"))
+		require.Equal(t, 2, bundle.server.NumConns())
+	})
+}
+
+// fakeSMTPRejectedRecipient is a recipient that fakeSMTPServer refuses.
+const fakeSMTPRejectedRecipient = "rejected@example.com"
+
+// fakeSMTPChallenge is the challenge fakeSMTPServer sends for CRAM-MD5.
+const fakeSMTPChallenge = "<1896.697170952@fake>"
+
+// fakeSMTPServer is a minimal SMTP server that accepts all mail (except for
+// fakeSMTPRejectedRecipient) and records it for tests to inspect.
+type fakeSMTPServer struct {
+	listener net.Listener
+
+	// startTLSConfig is the configuration that connections are upgraded
+	// with, if the server offers STARTTLS.
+	startTLSConfig *tls.Config
+
+	mu             sync.Mutex
+	authMechanisms []string
+	auths          []string
+	ehloHosts      []string
+	conns          []net.Conn
+	dataReplies    []string
+	mailReply      string
+	messages       []*fakeSMTPMessage
+	numConns       int
+	stallOn        string
+	tlsConns       []bool
+}
+
+type fakeSMTPMessage struct {
+	Data string
+	From string
+	To   []string
+}
+
+func startFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	return serveFakeSMTP(t, listener)
+}
+
+// startFakeSMTPSServer starts a fakeSMTPServer that serves implicit TLS with
+// the given certificate, like a server on port 465.
+func startFakeSMTPSServer(t *testing.T, cert tls.Certificate) *fakeSMTPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	return serveFakeSMTP(t, tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})) //nolint:gosec
+}
+
+// startFakeSMTPServerWithSTARTTLS starts a fakeSMTPServer that offers
+// STARTTLS with the given certificate, like a server on port 587.
+func startFakeSMTPServerWithSTARTTLS(t *testing.T, cert tls.Certificate) *fakeSMTPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := serveFakeSMTP(t, listener)
+	server.startTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}} //nolint:gosec
+	return server
+}
+
+func serveFakeSMTP(t *testing.T, listener net.Listener) *fakeSMTPServer {
+	t.Helper()
+
+	server := &fakeSMTPServer{listener: listener}
+	t.Cleanup(func() {
+		_ = listener.Close()
+		server.CloseConns()
+	})
+
+	go server.serve()
+
+	return server
+}
+
+func (s *fakeSMTPServer) Addr() string { return s.listener.Addr().String() }
+
+// AuthMechanisms returns the mechanism of each AUTH command received, like
+// `PLAIN`.
+func (s *fakeSMTPServer) AuthMechanisms() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.authMechanisms...)
+}
+
+// Auths returns the decoded credentials of each AUTH command received.
+func (s *fakeSMTPServer) Auths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.auths...)
+}
+
+// EHLOHosts returns the hostname sent with each EHLO command received.
+func (s *fakeSMTPServer) EHLOHosts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ehloHosts...)
+}
+
+// CloseConns closes all open connections from the server's side.
+func (s *fakeSMTPServer) CloseConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeSMTPServer) Messages() []*fakeSMTPMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*fakeSMTPMessage(nil), s.messages...)
+}
+
+// FailData makes the server answer the next DATA commands with the given
+// replies, one each, like `451 Try again`, before it accepts them again.
+func (s *fakeSMTPServer) FailData(replies ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dataReplies = append(s.dataReplies, replies...)
+}
+
+// RejectMail makes the server answer MAIL commands with the given reply, like
+// `421 Try again later`, instead of accepting them. An empty reply accepts
+// them again.
+func (s *fakeSMTPServer) RejectMail(reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mailReply = reply
+}
+
+// StallOn makes the server stop responding when it receives the given
+// command, like a server that's hung, until the client hangs up.
+func (s *fakeSMTPServer) StallOn(verb string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stallOn = verb
+}
+
+// TLSConns returns whether each message received came over TLS.
+func (s *fakeSMTPServer) TLSConns() []bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bool(nil), s.tlsConns...)
+}
+
+// NumConns returns the number of connections that have ever been accepted.
+func (s *fakeSMTPServer) NumConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.numConns
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.numConns++
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	reply := func(format string, args ...any) bool {
+		return text.PrintfLine(format, args...) == nil
+	}
+
+	if !reply("220 fake ESMTP") {
+		return
+	}
+
+	var message *fakeSMTPMessage
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+
+		s.mu.Lock()
+		stallOn := s.stallOn
+		s.mu.Unlock()
+		if strings.EqualFold(verb, stallOn) {
+			_, _ = io.Copy(io.Discard, conn)
+			return
+		}
+
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			s.mu.Lock()
+			s.ehloHosts = append(s.ehloHosts, arg)
+			s.mu.Unlock()
+			extensions := "250-fake\r\n"
+			if s.startTLSConfig != nil {
+				extensions += "250-STARTTLS\r\n"
+			}
+			if !reply("%s250 AUTH CRAM-MD5 PLAIN", extensions) {
+				return
+			}
+
+		case "STARTTLS":
+			if !reply("220 Ready to start TLS") {
+				return
+			}
+			tlsConn := tls.Server(conn, s.startTLSConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, text = tlsConn, textproto.NewConn(tlsConn)
+
+		case "HELO", "NOOP":
+			if !reply("250 OK") {
+				return
+			}
+
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			if strings.EqualFold(mechanism, "CRAM-MD5") {
+				if !reply("334 %s", base64.StdEncoding.EncodeToString([]byte(fakeSMTPChallenge))) {
+					return
+				}
+				if initial, err = text.ReadLine(); err != nil {
+					return
+				}
+			}
+			decoded, _ := base64.StdEncoding.DecodeString(initial)
+			s.mu.Lock()
+			s.authMechanisms = append(s.authMechanisms, strings.ToUpper(mechanism))
+			s.auths = append(s.auths, string(decoded))
+			s.mu.Unlock()
+			if !reply("235 Authentication successful") {
+				return
+			}
+
+		case "MAIL":
+			s.mu.Lock()
+			mailReply := s.mailReply
+			s.mu.Unlock()
+			if mailReply != "" {
+				if !reply("%s", mailReply) {
+					return
+				}
+				continue
+			}
+
+			message = &fakeSMTPMessage{From: fakeSMTPPath(arg)}
+			if !reply("250 OK") {
+				return
+			}
+
+		case "RCPT":
+			to := fakeSMTPPath(arg)
+			if to == fakeSMTPRejectedRecipient {
+				if !reply("550 No such user") {
+					return
+				}
+				continue
+			}
+			message.To = append(message.To, to)
+			if !reply("250 OK") {
+				return
+			}
+
+		case "DATA":
+			s.mu.Lock()
+			var dataReply string
+			if len(s.dataReplies) > 0 {
+				dataReply, s.dataReplies = s.dataReplies[0], s.dataReplies[1:]
+			}
+			s.mu.Unlock()
+			if dataReply != "" {
+				message = nil
+				if !reply("%s", dataReply) {
+					return
+				}
+				continue
+			}
+
+			if !reply("354 Go ahead") {
+				return
+			}
+			data, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			message.Data = strings.ReplaceAll(string(data), "\n", "\r\n")
+			_, isTLS := conn.(*tls.Conn)
+			s.mu.Lock()
+			s.messages = append(s.messages, message)
+			s.tlsConns = append(s.tlsConns, isTLS)
+			s.mu.Unlock()
+			message = nil
+			if !reply("250 OK") {
+				return
+			}
+
+		case "RSET":
+			message = nil
+			if !reply("250 OK") {
+				return
+			}
+
+		case "QUIT":
+			_ = reply("221 Bye")
+			return
+
+		default:
+			if !reply("502 Command not implemented: %s", verb) {
+				return
+			}
+		}
+	}
+}
+
+// fakeSMTPPath extracts an address from a MAIL or RCPT argument like
+// `FROM:<sender@example.com>`.
+func fakeSMTPPath(arg string) string {
+	_, path, _ := strings.Cut(arg, ":")
+	path, _, _ = strings.Cut(path, " ")
+	return strings.Trim(path, "<>")
+}
+
+// generateTLSCert generates a self-signed certificate for 127.0.0.1, along
+// with a pool of root CAs that trusts it.
+func generateTLSCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Minute),
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake SMTP server"},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	parsedCert, err := x509.ParseCertificate(certDER)
+	require.NoError(t, err)
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(parsedCert)
+
+	return tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: key}, rootCAs
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// Modes of SPAM_PRECHECK. Checks are off if it's empty.
+const (
+	SpamPrecheckFlag   = "flag"   // log emails that fail, but queue them anyway
+	SpamPrecheckReject = "reject" // reject emails that fail with a 400
+)
+
+// Rules checked by spamPrecheck, as they're named in the Rule of the
+// validation errors it returns.
+const (
+	spamRuleAllCapsBody    = "all_caps_body"
+	spamRuleAllCapsSubject = "all_caps_subject"
+	spamRuleEmptySubject   = "empty_subject"
+	spamRuleTooManyLinks   = "too_many_links"
+)
+
+const (
+	// spamMinCapsLetters is the fewest letters that text must have to be
+	// checked for being all caps, so that a short subject like "FYI" or
+	// "RSVP" isn't mistaken for shouting.
+	spamMinCapsLetters = 8
+
+	// spamMaxLinks is the most links that a body may have.
+	spamMaxLinks = 10
+)
+
+// spamLinkRegexp matches the start of each link in a plain text or HTML body.
+var spamLinkRegexp = regexp.MustCompile(`(?i)\b(?:https?://|www\.)`) //nolint:gochecknoglobals
+
+// spamPrecheck checks an email's content against simple rules for what's
+// obviously broken or looks like spam, both of which hurt the reputation of
+// the addresses it's sent from. It returns a validation error for each rule
+// the email breaks, or none if it's clean. These are heuristics, which is why
+// SPAM_PRECHECK can flag emails instead of rejecting them.
+func spamPrecheck(subject, body, bodyHTML string) []*ValidationError {
+	var validationErrors []*ValidationError
+
+	switch {
+	case strings.TrimSpace(subject) == "":
+		validationErrors = append(validationErrors, &ValidationError{Field: "subject", Message: "subject is empty or only whitespace.", Rule: spamRuleEmptySubject})
+	case allCaps(subject):
+		validationErrors = append(validationErrors, &ValidationError{Field: "subject", Message: "subject is all caps.", Rule: spamRuleAllCapsSubject})
+	}
+
+	if allCaps(body) {
+		validationErrors = append(validationErrors, &ValidationError{Field: "body", Message: "body is all caps.", Rule: spamRuleAllCapsBody})
+	}
+
+	// The HTML body is usually the same copy as the plain text one, so each
+	// is checked on its own rather than adding their links together.
+	for _, field := range []struct {
+		name, body string
+	}{{"body", body}, {"body_html", bodyHTML}} {
+		if numLinks := len(spamLinkRegexp.FindAllStringIndex(field.body, -1)); numLinks > spamMaxLinks {
+			validationErrors = append(validationErrors, &ValidationError{
+				Field:   field.name,
+				Message: fmt.Sprintf("%s has %d links, but at most %d are allowed.", field.name, numLinks, spamMaxLinks),
+				Rule:    spamRuleTooManyLinks,
+			})
+		}
+	}
+
+	return validationErrors
+}
+
+// allCaps returns true if text has at least spamMinCapsLetters letters and
+// none of them are lowercase. Letters without case, like in Chinese, don't
+// count toward it.
+func allCaps(text string) bool {
+	var numLetters int
+	for _, r := range text {
+		switch {
+		case unicode.IsLower(r):
+			return false
+		case unicode.IsUpper(r):
+			numLetters++
+		}
+	}
+	return numLetters >= spamMinCapsLetters
+}
+
+// checkSpam runs spamPrecheck on an email according to SPAM_PRECHECK,
+// returning an error if the email should be rejected.
+func (s *APIService) checkSpam(ctx context.Context, accountID uuid.UUID, subject, body, bodyHTML string) error {
+	if s.spamPrecheck == "" {
+		return nil
+	}
+
+	validationErrors := spamPrecheck(subject, body, bodyHTML)
+	if len(validationErrors) < 1 {
+		return nil
+	}
+
+	for _, validationErr := range validationErrors {
+		s.metrics.emailsSpamPrecheck.WithLabelValues(validationErr.Rule).Inc()
+	}
+
+	if s.spamPrecheck == SpamPrecheckFlag {
+		if s.logger != nil {
+			rules := make([]string, len(validationErrors))
+			for i, validationErr := range validationErrors {
+				rules[i] = validationErr.Rule
+			}
+			s.logger.WarnContext(ctx, "Email failed spam precheck", slog.String("account_id", accountID.String()), slog.Any("rules", rules))
+		}
+		return nil
+	}
+
+	return &APIError{
+		Code:             errorCodeSpamPrecheckFailed,
+		Message:          "Email looks like spam or is malformed; email not queued.",
+		StatusCode:       http.StatusBadRequest,
+		ValidationErrors: validationErrors,
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpamPrecheck(t *testing.T) {
+	t.Parallel()
+
+	const (
+		body    = "Hello from River's idempotent mail demo."
+		subject = "Hello."
+	)
+
+	links := func(n int) string {
+		return strings.Repeat("See https://example.com/page. ", n)
+	}
+
+	rules := func(validationErrors []*ValidationError) []string {
+		rules := make([]string, len(validationErrors))
+		for i, validationErr := range validationErrors {
+			rules[i] = validationErr.Rule
+		}
+		return rules
+	}
+
+	t.Run("Clean", func(t *testing.T) {
+		t.Parallel()
+
+		require.Empty(t, spamPrecheck(subject, body, "<p>"+body+"</p>"))
+	})
+
+	t.Run("CleanWithShortCapsAndSomeLinks", func(t *testing.T) {
+		t.Parallel()
+
+		require.Empty(t, spamPrecheck("RSVP", "OK "+links(spamMaxLinks), ""))
+	})
+
+	t.Run("EmptySubject", func(t *testing.T) {
+		t.Parallel()
+
+		require.Equal(t, []*ValidationError{
+			{Field: "subject", Message: "subject is empty or only whitespace.", Rule: spamRuleEmptySubject},
+		}, spamPrecheck(" \t\n", body, ""))
+	})
+
+	t.Run("AllCapsSubject", func(t *testing.T) {
+		t.Parallel()
+
+		require.Equal(t, []*ValidationError{
+			{Field: "subject", Message: "subject is all caps.", Rule: spamRuleAllCapsSubject},
+		}, spamPrecheck("ACT NOW, LIMITED OFFER!!!", body, ""))
+	})
+
+	t.Run("AllCapsBody", func(t *testing.T) {
+		t.Parallel()
+
+		require.Equal(t, []*ValidationError{
+			{Field: "body", Message: "body is all caps.", Rule: spamRuleAllCapsBody},
+		}, spamPrecheck(subject, strings.ToUpper(body), ""))
+	})
+
+	t.Run("TooManyLinks", func(t *testing.T) {
+		t.Parallel()
+
+		require.Equal(t, []*ValidationError{
+			{Field: "body", Message: "body has 11 links, but at most 10 are allowed.", Rule: spamRuleTooManyLinks},
+		}, spamPrecheck(subject, links(spamMaxLinks+1), ""))
+	})
+
+	t.Run("TooManyLinksHTML", func(t *testing.T) {
+		t.Parallel()
+
+		bodyHTML := strings.Repeat(`<a href="http://example.com">Here</a> `, spamMaxLinks+1)
+		require.Equal(t, []string{spamRuleTooManyLinks}, rules(spamPrecheck(subject, body, bodyHTML)))
+	})
+
+	t.Run("LinksCountedPerBody", func(t *testing.T) {
+		t.Parallel()
+
+		require.Empty(t, spamPrecheck(subject, links(spamMaxLinks), links(spamMaxLinks)))
+	})
+
+	t.Run("SeveralRules", func(t *testing.T) {
+		t.Parallel()
+
+		require.Equal(t, []string{spamRuleAllCapsSubject, spamRuleAllCapsBody, spamRuleTooManyLinks},
+			rules(spamPrecheck("FREE MONEY INSIDE", strings.ToUpper(links(spamMaxLinks+1)), "")))
+	})
+}
+
+func TestAPIServiceCheckSpam(t *testing.T) {
+	t.Parallel()
+
+	const spammySubject = "FREE MONEY INSIDE"
+
+	setup := func(t *testing.T, spamPrecheck string) *APIService {
+		t.Helper()
+
+		return &APIService{
+			logger:       slog.New(slog.DiscardHandler),
+			metrics:      newMetrics(),
+			spamPrecheck: spamPrecheck,
+		}
+	}
+
+	t.Run("Off", func(t *testing.T) {
+		t.Parallel()
+
+		apiServer := setup(t, "")
+		require.NoError(t, apiServer.checkSpam(t.Context(), uuid.New(), spammySubject, "Hello.", ""))
+		require.Zero(t, testutil.ToFloat64(apiServer.metrics.emailsSpamPrecheck.WithLabelValues(spamRuleAllCapsSubject)))
+	})
+
+	t.Run("Flag", func(t *testing.T) {
+		t.Parallel()
+
+		apiServer := setup(t, SpamPrecheckFlag)
+		require.NoError(t, apiServer.checkSpam(t.Context(), uuid.New(), spammySubject, "Hello.", ""))
+		require.InDelta(t, 1.0, testutil.ToFloat64(apiServer.metrics.emailsSpamPrecheck.WithLabelValues(spamRuleAllCapsSubject)), 0)
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		t.Parallel()
+
+		apiServer := setup(t, SpamPrecheckReject)
+		err := apiServer.checkSpam(t.Context(), uuid.New(), spammySubject, "Hello.", "")
+		require.Equal(t, &APIError{
+			Code:       errorCodeSpamPrecheckFailed,
+			Message:    "Email looks like spam or is malformed; email not queued.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "subject", Message: "subject is all caps.", Rule: spamRuleAllCapsSubject},
+			},
+		}, err)
+		require.InDelta(t, 1.0, testutil.ToFloat64(apiServer.metrics.emailsSpamPrecheck.WithLabelValues(spamRuleAllCapsSubject)), 0)
+	})
+
+	t.Run("RejectClean", func(t *testing.T) {
+		t.Parallel()
+
+		apiServer := setup(t, SpamPrecheckReject)
+		require.NoError(t, apiServer.checkSpam(t.Context(), uuid.New(), "Hello.", "Hello from River's idempotent mail demo.", ""))
+	})
+}
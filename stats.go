@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/riverqueue/river/rivertype"
+)
+
+type HandleStatsRequest struct {
+	AccountID uuid.UUID `json:"-"` // from an optional `account_id` query parameter; counts all accounts if unset
+}
+
+func (r *HandleStatsRequest) BindRequest(httpReq *http.Request) error {
+	accountID := httpReq.URL.Query().Get("account_id")
+	if accountID == "" {
+		return nil
+	}
+
+	var err error
+	if r.AccountID, err = uuid.Parse(accountID); err != nil {
+		return &APIError{Code: errorCodeInvalidRequest, Message: "Invalid account_id: " + accountID, StatusCode: http.StatusBadRequest}
+	}
+	return nil
+}
+
+// HandleStatsResponse counts emails by the state of their job.
+type HandleStatsResponse struct {
+	Available int `json:"available"` // queued to be sent as soon as a worker is free
+	Cancelled int `json:"cancelled"`
+	Completed int `json:"completed"` // sent
+	Discarded int `json:"discarded"` // ran out of attempts
+	Retryable int `json:"retryable"` // failed an attempt and will be tried again
+	Running   int `json:"running"`
+	Scheduled int `json:"scheduled"` // held until later, like for quiet hours
+}
+
+// EmailStats counts emails in each state for a quick summary on a dashboard,
+// either across all accounts or for one.
+func (s *APIService) EmailStats(ctx context.Context, req *HandleStatsRequest) (*HandleStatsResponse, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var accountID *string // NULL for all accounts
+	if req.AccountID != uuid.Nil {
+		accountIDStr := req.AccountID.String()
+		accountID = &accountIDStr
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT state::text, count(*)
+		FROM river_job
+		WHERE kind = $1
+			AND ($2::text IS NULL OR args->>'account_id' = $2)
+		GROUP BY state`,
+		(SendEmailArgs{}).Kind(), accountID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var resp HandleStatsResponse
+	for rows.Next() {
+		var (
+			count int
+			state rivertype.JobState
+		)
+		if err := rows.Scan(&state, &count); err != nil {
+			return nil, err
+		}
+
+		// Emails are never pending, a state for jobs that wait on something
+		// outside of River.
+		switch state { //nolint:exhaustive
+		case rivertype.JobStateAvailable:
+			resp.Available = count
+		case rivertype.JobStateCancelled:
+			resp.Cancelled = count
+		case rivertype.JobStateCompleted:
+			resp.Completed = count
+		case rivertype.JobStateDiscarded:
+			resp.Discarded = count
+		case rivertype.JobStateRetryable:
+			resp.Retryable = count
+		case rivertype.JobStateRunning:
+			resp.Running = count
+		case rivertype.JobStateScheduled:
+			resp.Scheduled = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+	"github.com/riverqueue/river/rivertype"
+)
+
+func TestAPIServiceEmailStats(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		apiServer *APIService
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			apiServer: &APIService{
+				begin:       tx.Begin,
+				metrics:     newMetrics(),
+				riverClient: riverClient,
+				tracer:      testTracer,
+			},
+			tx: tx,
+		}, ctx
+	}
+
+	// Queues an email for the account and then moves its job to the given
+	// state as if it'd been worked.
+	createEmail := func(ctx context.Context, t *testing.T, bundle *testBundle, accountID uuid.UUID, state rivertype.JobState) {
+		t.Helper()
+
+		idempotencyKey := uuid.NewString()
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      accountID,
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: idempotencyKey,
+			Subject:        "Hello.",
+		})
+		require.NoError(t, err)
+
+		_, err = bundle.tx.Exec(ctx, `
+			UPDATE river_job
+			SET finalized_at = CASE WHEN $2 IN ('cancelled', 'completed', 'discarded') THEN now() END,
+				scheduled_at = CASE WHEN $2 = 'scheduled' THEN now() + interval '1 hour' ELSE scheduled_at END,
+				state = $2::river_job_state
+			WHERE args->>'idempotency_key' = $1`,
+			idempotencyKey, string(state),
+		)
+		require.NoError(t, err)
+	}
+
+	t.Run("CountsByState", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+		for state, num := range map[rivertype.JobState]int{
+			rivertype.JobStateAvailable: 3,
+			rivertype.JobStateCancelled: 1,
+			rivertype.JobStateCompleted: 4,
+			rivertype.JobStateDiscarded: 2,
+			rivertype.JobStateRetryable: 1,
+			rivertype.JobStateRunning:   1,
+			rivertype.JobStateScheduled: 2,
+		} {
+			for range num {
+				createEmail(ctx, t, bundle, accountID, state)
+			}
+		}
+
+		// Jobs of other kinds aren't emails.
+		_, err := bundle.tx.Exec(ctx, "INSERT INTO river_job (args, kind, max_attempts, queue, state) VALUES ('{}', 'cleanup_email_jobs', 1, 'default', 'available')")
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailStats, &HandleStatsRequest{})
+		require.NoError(t, err)
+		require.Equal(t, &HandleStatsResponse{
+			Available: 3,
+			Cancelled: 1,
+			Completed: 4,
+			Discarded: 2,
+			Retryable: 1,
+			Running:   1,
+			Scheduled: 2,
+		}, resp)
+	})
+
+	t.Run("FilteredByAccount", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+		createEmail(ctx, t, bundle, accountID, rivertype.JobStateAvailable)
+		createEmail(ctx, t, bundle, accountID, rivertype.JobStateCompleted)
+		createEmail(ctx, t, bundle, uuid.New(), rivertype.JobStateCompleted)
+		createEmail(ctx, t, bundle, uuid.New(), rivertype.JobStateDiscarded)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailStats, &HandleStatsRequest{AccountID: accountID})
+		require.NoError(t, err)
+		require.Equal(t, &HandleStatsResponse{Available: 1, Completed: 1}, resp)
+
+		resp, err = invokeHandler(ctx, bundle.apiServer.EmailStats, &HandleStatsRequest{AccountID: uuid.New()})
+		require.NoError(t, err)
+		require.Equal(t, &HandleStatsResponse{}, resp)
+	})
+
+	t.Run("ServeMux", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+		createEmail(ctx, t, bundle, accountID, rivertype.JobStateCompleted)
+
+		recorder := httptest.NewRecorder()
+		bundle.apiServer.ServeMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/emails/stats?account_id="+accountID.String(), nil))
+		require.Equal(t, http.StatusOK, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+		require.JSONEq(t, `{
+			"available": 0,
+			"cancelled": 0,
+			"completed": 1,
+			"discarded": 0,
+			"retryable": 0,
+			"running": 0,
+			"scheduled": 0
+		}`, recorder.Body.String())
+	})
+
+	t.Run("InvalidAccountID", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		recorder := httptest.NewRecorder()
+		bundle.apiServer.ServeMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/emails/stats?account_id=not-a-uuid", nil))
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+		require.JSONEq(t, `{"error_code":"invalid_request","message":"Invalid account_id: not-a-uuid"}`, recorder.Body.String())
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+
+	"github.com/riverqueue/river/rivertype"
+)
+
+type HandleStatusBatchRequest struct {
+	IDs []int64 `json:"ids" validate:"required,min=1,max=100,dive,min=1"` // capped to keep lookups quick
+}
+
+type HandleStatusBatchResponse struct {
+	Emails []*HandleStatusBatchEmail `json:"emails"` // in the same order as the requested IDs
+}
+
+// HandleStatusBatchEmail is the state of one email in a status batch, or an
+// error code if it couldn't be looked up.
+type HandleStatusBatchEmail struct {
+	ErrorCode string             `json:"error_code,omitempty"` // errorCodeNotFound if there's no email with the ID
+	ID        int64              `json:"id"`
+	State     rivertype.JobState `json:"state,omitempty"`
+}
+
+// EmailStatusBatch looks up the states of many emails at once, like all those
+// queued in a batch, with a single query rather than one per email. Unknown
+// IDs are reported as not found without failing the others.
+func (s *APIService) EmailStatusBatch(ctx context.Context, req *HandleStatusBatchRequest) (*HandleStatusBatchResponse, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// River's job list can't filter on IDs, so jobs are found directly.
+	rows, err := tx.Query(ctx, `
+		SELECT id, state::text
+		FROM river_job
+		WHERE kind = $1
+			AND id = ANY($2::bigint[])`,
+		(SendEmailArgs{}).Kind(), req.IDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[int64]rivertype.JobState, len(req.IDs))
+	for rows.Next() {
+		var (
+			id    int64
+			state rivertype.JobState
+		)
+		if err := rows.Scan(&id, &state); err != nil {
+			return nil, err
+		}
+		states[id] = state
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	resp := &HandleStatusBatchResponse{Emails: make([]*HandleStatusBatchEmail, len(req.IDs))}
+	for i, id := range req.IDs {
+		state, ok := states[id]
+		if !ok {
+			resp.Emails[i] = &HandleStatusBatchEmail{ErrorCode: errorCodeNotFound, ID: id}
+			continue
+		}
+		resp.Emails[i] = &HandleStatusBatchEmail{ID: id, State: state}
+	}
+
+	return resp, nil
+}
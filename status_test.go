@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+	"github.com/riverqueue/river/rivertype"
+)
+
+func TestAPIServiceEmailStatusBatch(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		apiServer *APIService
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			apiServer: &APIService{
+				begin:       tx.Begin,
+				metrics:     newMetrics(),
+				riverClient: riverClient,
+				tracer:      testTracer,
+			},
+			tx: tx,
+		}, ctx
+	}
+
+	// Queues an email, returning the ID of its job.
+	createEmail := func(ctx context.Context, t *testing.T, bundle *testBundle) int64 {
+		t.Helper()
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+		})
+		require.NoError(t, err)
+
+		var jobID int64
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT max(id) FROM river_job WHERE kind = $1", (SendEmailArgs{}).Kind()).Scan(&jobID))
+		return jobID
+	}
+
+	t.Run("KnownAndUnknownIDs", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		var (
+			availableID = createEmail(ctx, t, bundle)
+			completedID = createEmail(ctx, t, bundle)
+		)
+		_, err := bundle.tx.Exec(ctx, "UPDATE river_job SET finalized_at = now(), state = 'completed' WHERE id = $1", completedID)
+		require.NoError(t, err)
+
+		// Jobs of other kinds aren't emails.
+		var otherJobID int64
+		require.NoError(t, bundle.tx.QueryRow(ctx, "INSERT INTO river_job (args, kind, max_attempts, queue, state) VALUES ('{}', 'cleanup_email_jobs', 1, 'default', 'available') RETURNING id").Scan(&otherJobID))
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailStatusBatch, &HandleStatusBatchRequest{
+			IDs: []int64{completedID, 123_456_789, availableID, otherJobID},
+		})
+		require.NoError(t, err)
+		require.Equal(t, &HandleStatusBatchResponse{
+			Emails: []*HandleStatusBatchEmail{
+				{ID: completedID, State: rivertype.JobStateCompleted},
+				{ErrorCode: errorCodeNotFound, ID: 123_456_789},
+				{ID: availableID, State: rivertype.JobStateAvailable},
+				{ErrorCode: errorCodeNotFound, ID: otherJobID},
+			},
+		}, resp)
+	})
+}
+
+func TestHandleStatusBatchRequestValidation(t *testing.T) {
+	t.Parallel()
+
+	ids := make([]int64, 101)
+	for i := range ids {
+		ids[i] = int64(i + 1)
+	}
+
+	for _, tt := range []struct {
+		ids        []int64
+		wantErrors []*ValidationError
+	}{
+		{nil, []*ValidationError{{Field: "ids", Message: "ids is required.", Rule: "required"}}},
+		{ids, []*ValidationError{{Field: "ids", Message: "ids must have at most 100 items.", Rule: "max"}}},
+		{[]int64{1, 0}, []*ValidationError{{Field: "ids[1]", Message: "ids[1] must be at least 1.", Rule: "min"}}},
+	} {
+		err := validateRequest(t.Context(), &HandleStatusBatchRequest{IDs: tt.ids})
+		require.Equal(t, &APIError{
+			Code:             errorCodeValidationFailed,
+			Message:          "Invalid parameters.",
+			StatusCode:       http.StatusBadRequest,
+			ValidationErrors: tt.wantErrors,
+		}, err)
+	}
+}
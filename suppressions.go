@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Reasons that an address is on an account's suppression list.
+const (
+	suppressionReasonHardBounce = "hard_bounce"
+	suppressionReasonManual     = "manual"
+)
+
+// Actions recorded in an address's suppression history.
+const (
+	suppressionActionAdded   = "added"
+	suppressionActionRemoved = "removed"
+)
+
+// normalizeAddress returns an address in the form it's stored in and compared
+// with in suppressions, their history, and unsubscribes. Mail servers treat
+// addresses without regard to case in practice, so one that differs from a
+// suppressed address only by case is the same recipient.
+func normalizeAddress(email string) string {
+	return strings.ToLower(email)
+}
+
+// isSuppressed returns true if email shouldn't be sent to a recipient on
+// behalf of an account because they're on its suppression list, or for bulk
+// email, because they've unsubscribed.
+func isSuppressed(ctx context.Context, tx pgx.Tx, accountID uuid.UUID, email string, bulk bool) (bool, error) {
+	var suppressed bool
+	if err := tx.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1
+			FROM suppressions
+			WHERE account_id = $1
+				AND email = $2
+				AND removed_at IS NULL
+		) OR ($3 AND EXISTS (
+			SELECT 1
+			FROM unsubscribes
+			WHERE account_id = $1
+				AND email = $2
+		))`,
+		accountID, normalizeAddress(email), bulk,
+	).Scan(&suppressed); err != nil {
+		return false, err
+	}
+	return suppressed, nil
+}
+
+type HandleSuppressionCreateRequest struct {
+	AccountID uuid.UUID `json:"account_id" validate:"required"`
+	Email     string    `json:"email"      validate:"required,email"`
+}
+
+type HandleSuppressionCreateResponse struct {
+	Message    string `json:"message"`
+	StatusCode int    `json:"-"`
+}
+
+func (r *HandleSuppressionCreateResponse) ResponseStatusCode() int { return r.StatusCode }
+
+// SuppressionCreate adds an address to an account's suppression list so that
+// it won't be emailed again. Adding an address that's already suppressed is
+// a no-op.
+func (s *APIService) SuppressionCreate(ctx context.Context, req *HandleSuppressionCreateRequest) (*HandleSuppressionCreateResponse, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	added, err := addSuppression(ctx, tx, req.AccountID, req.Email, suppressionReasonManual)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	if !added {
+		return &HandleSuppressionCreateResponse{Message: "Address was already suppressed.", StatusCode: http.StatusOK}, nil
+	}
+
+	return &HandleSuppressionCreateResponse{Message: "Address has been suppressed.", StatusCode: http.StatusCreated}, nil
+}
+
+// addSuppression adds an address to an account's suppression list, and to
+// its history, returning false if it was already suppressed. An address that
+// was removed from the list is suppressed again with the new reason.
+func addSuppression(ctx context.Context, tx pgx.Tx, accountID uuid.UUID, email, reason string) (bool, error) {
+	email = normalizeAddress(email)
+
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO suppressions (account_id, email, reason)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (account_id, email) DO UPDATE
+		SET created_at = now(),
+			reason = EXCLUDED.reason,
+			removal_reason = NULL,
+			removed_at = NULL
+		WHERE suppressions.removed_at IS NOT NULL`,
+		accountID, email, reason,
+	)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() < 1 {
+		return false, nil
+	}
+
+	if err := recordSuppressionEvent(ctx, tx, accountID, email, suppressionActionAdded, reason); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recordSuppressionEvent adds an address being added to or removed from an
+// account's suppression list to its history.
+func recordSuppressionEvent(ctx context.Context, tx pgx.Tx, accountID uuid.UUID, email, action, reason string) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO suppression_history (account_id, email, action, reason)
+		VALUES ($1, $2, $3, NULLIF($4, ''))`,
+		accountID, normalizeAddress(email), action, reason,
+	)
+	return err
+}
+
+type HandleSuppressionDeleteRequest struct {
+	AccountID uuid.UUID `json:"account_id" validate:"required"`
+	Address   string    `json:"-"          validate:"required,email"`
+	Reason    string    `json:"reason"     validate:"max=1000"` // why the address is no longer suppressed, kept in its history
+}
+
+func (r *HandleSuppressionDeleteRequest) BindRequest(httpReq *http.Request) error {
+	r.Address = httpReq.PathValue("address")
+	return nil
+}
+
+type HandleSuppressionDeleteResponse struct {
+	Message string `json:"message"`
+}
+
+// SuppressionDelete removes an address from an account's suppression list so
+// that it can be emailed again. The suppression isn't deleted, but is marked
+// removed, so that it stays in the address's history.
+func (s *APIService) SuppressionDelete(ctx context.Context, req *HandleSuppressionDeleteRequest) (*HandleSuppressionDeleteResponse, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE suppressions
+		SET removal_reason = NULLIF($3, ''),
+			removed_at = now()
+		WHERE account_id = $1
+			AND email = $2
+			AND removed_at IS NULL`,
+		req.AccountID, normalizeAddress(req.Address), req.Reason,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if tag.RowsAffected() < 1 {
+		return nil, &APIError{Code: errorCodeNotFound, Message: "Address isn't suppressed.", StatusCode: http.StatusNotFound}
+	}
+
+	if err := recordSuppressionEvent(ctx, tx, req.AccountID, req.Address, suppressionActionRemoved, req.Reason); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return &HandleSuppressionDeleteResponse{Message: "Address is no longer suppressed."}, nil
+}
+
+type HandleSuppressionHistoryRequest struct {
+	AccountID uuid.UUID `json:"-"` // from the required `account_id` query parameter
+	Address   string    `json:"-" validate:"required,email"`
+}
+
+func (r *HandleSuppressionHistoryRequest) BindRequest(httpReq *http.Request) error {
+	r.Address = httpReq.PathValue("address")
+
+	accountID := httpReq.URL.Query().Get("account_id")
+
+	var err error
+	if r.AccountID, err = uuid.Parse(accountID); err != nil {
+		return &APIError{Code: errorCodeInvalidRequest, Message: "Invalid account_id: " + accountID, StatusCode: http.StatusBadRequest}
+	}
+	return nil
+}
+
+type HandleSuppressionHistoryResponse struct {
+	Events     []*HandleSuppressionHistoryEvent `json:"events"`
+	Suppressed bool                             `json:"suppressed"` // whether the address is suppressed now
+}
+
+type HandleSuppressionHistoryEvent struct {
+	Action    string    `json:"action"` // added or removed
+	CreatedAt time.Time `json:"created_at"`
+	Reason    string    `json:"reason,omitempty"` // like hard_bounce for an address that was added, or the reason given for one that was removed
+}
+
+// SuppressionHistory lists the times that an address was added to and
+// removed from an account's suppression list, oldest first, for auditing
+// who's been emailed and why.
+func (s *APIService) SuppressionHistory(ctx context.Context, req *HandleSuppressionHistoryRequest) (*HandleSuppressionHistoryResponse, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	rows, err := tx.Query(ctx, `
+		SELECT action, created_at, coalesce(reason, '')
+		FROM suppression_history
+		WHERE account_id = $1
+			AND email = $2
+		ORDER BY id`,
+		req.AccountID, normalizeAddress(req.Address),
+	)
+	if err != nil {
+		return nil, err
+	}
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*HandleSuppressionHistoryEvent, error) {
+		var event HandleSuppressionHistoryEvent
+		err := row.Scan(&event.Action, &event.CreatedAt, &event.Reason)
+		return &event, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(events) < 1 {
+		return nil, &APIError{Code: errorCodeNotFound, Message: "Address has never been suppressed.", StatusCode: http.StatusNotFound}
+	}
+
+	return &HandleSuppressionHistoryResponse{
+		Events:     events,
+		Suppressed: events[len(events)-1].Action == suppressionActionAdded,
+	}, nil
+}
+
+// Types of bounce that a provider can report.
+const (
+	bounceTypeHard = "hard"
+	bounceTypeSoft = "soft"
+)
+
+type HandleBounceCreateRequest struct {
+	AccountID  uuid.UUID `json:"account_id" validate:"required"`
+	Diagnostic string    `json:"diagnostic"` // provider's explanation, like an SMTP reply
+	Email      string    `json:"email"      validate:"required,email"`
+	Type       string    `json:"type"       validate:"required,oneof=hard soft"`
+}
+
+type HandleBounceCreateResponse struct {
+	Message string `json:"message"`
+}
+
+// BounceCreate records a bounce reported by an SMTP provider. A hard bounce
+// means that mail to the address will never be delivered, so it's added to
+// the account's suppression list. Soft bounces are only recorded.
+func (s *APIService) BounceCreate(ctx context.Context, req *HandleBounceCreateRequest) (*HandleBounceCreateResponse, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO bounces (account_id, email, type, diagnostic)
+		VALUES ($1, $2, $3, NULLIF($4, ''))`,
+		req.AccountID, req.Email, req.Type, req.Diagnostic,
+	); err != nil {
+		return nil, err
+	}
+
+	if req.Type == bounceTypeHard {
+		if _, err := addSuppression(ctx, tx, req.AccountID, req.Email, suppressionReasonHardBounce); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	s.metrics.emailsBounced.WithLabelValues(req.Type).Inc()
+
+	if req.Type == bounceTypeHard {
+		return &HandleBounceCreateResponse{Message: "Hard bounce recorded; address has been suppressed."}, nil
+	}
+	return &HandleBounceCreateResponse{Message: "Soft bounce recorded."}, nil
+}
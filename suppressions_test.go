@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+)
+
+func TestAPIServiceSuppressions(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		apiServer *APIService
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		return &testBundle{
+			apiServer: &APIService{
+				begin:       tx.Begin,
+				metrics:     newMetrics(),
+				riverClient: riverClient,
+				tracer:      testTracer,
+			},
+			tx: tx,
+		}, ctx
+	}
+
+	emailCreateReq := func(accountID uuid.UUID, priority string) *HandleEmailCreateRequest {
+		return &HandleEmailCreateRequest{
+			AccountID:      accountID,
+			Body:           "Hello from River's idempotent mail demo.",
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Priority:       priority,
+			Subject:        "Hello.",
+		}
+	}
+
+	suppressedErr := &APIError{
+		Code:       "recipient_suppressed",
+		Message:    "Recipient has opted out of email from this account or is on its suppression list; email not queued.",
+		StatusCode: http.StatusUnprocessableEntity,
+	}
+
+	t.Run("SuppressedAddressBlocked", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.SuppressionCreate, &HandleSuppressionCreateRequest{AccountID: accountID, Email: "receiver@example.com"})
+		require.NoError(t, err)
+		require.Equal(t, &HandleSuppressionCreateResponse{Message: "Address has been suppressed.", StatusCode: http.StatusCreated}, resp)
+
+		for _, priority := range []string{PriorityBulk, PriorityTransactional} {
+			_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, emailCreateReq(accountID, priority))
+			require.Equal(t, suppressedErr, err)
+		}
+
+		// Other accounts can still email the address.
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, emailCreateReq(uuid.New(), PriorityTransactional))
+		require.NoError(t, err)
+	})
+
+	t.Run("SuppressionIgnoresCase", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+
+		_, err := invokeHandler(ctx, bundle.apiServer.SuppressionCreate, &HandleSuppressionCreateRequest{AccountID: accountID, Email: "Receiver@Example.com"})
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.SuppressionCreate, &HandleSuppressionCreateRequest{AccountID: accountID, Email: "receiver@example.com"})
+		require.NoError(t, err)
+		require.Equal(t, &HandleSuppressionCreateResponse{Message: "Address was already suppressed.", StatusCode: http.StatusOK}, resp)
+
+		for _, recipient := range []string{"receiver@example.com", "RECEIVER@EXAMPLE.COM"} {
+			req := emailCreateReq(accountID, PriorityTransactional)
+			req.EmailRecipient = recipient
+
+			_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, req)
+			require.Equal(t, suppressedErr, err)
+		}
+
+		_, err = invokeHandler(ctx, bundle.apiServer.SuppressionDelete, &HandleSuppressionDeleteRequest{AccountID: accountID, Address: "RECEIVER@example.com"})
+		require.NoError(t, err)
+
+		historyResp, err := invokeHandler(ctx, bundle.apiServer.SuppressionHistory, &HandleSuppressionHistoryRequest{AccountID: accountID, Address: "receiver@EXAMPLE.com"})
+		require.NoError(t, err)
+		require.Len(t, historyResp.Events, 2)
+		require.False(t, historyResp.Suppressed)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, emailCreateReq(accountID, PriorityTransactional))
+		require.NoError(t, err)
+	})
+
+	t.Run("SuppressionCreateIdempotent", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		req := &HandleSuppressionCreateRequest{AccountID: uuid.New(), Email: "receiver@example.com"}
+
+		_, err := invokeHandler(ctx, bundle.apiServer.SuppressionCreate, req)
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.SuppressionCreate, req)
+		require.NoError(t, err)
+		require.Equal(t, &HandleSuppressionCreateResponse{Message: "Address was already suppressed.", StatusCode: http.StatusOK}, resp)
+	})
+
+	t.Run("SuppressionDeleteUnblocks", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+
+		_, err := invokeHandler(ctx, bundle.apiServer.SuppressionCreate, &HandleSuppressionCreateRequest{AccountID: accountID, Email: "receiver@example.com"})
+		require.NoError(t, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.SuppressionDelete, &HandleSuppressionDeleteRequest{AccountID: accountID, Address: "receiver@example.com"})
+		require.NoError(t, err)
+		require.Equal(t, &HandleSuppressionDeleteResponse{Message: "Address is no longer suppressed."}, resp)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, emailCreateReq(accountID, PriorityTransactional))
+		require.NoError(t, err)
+	})
+
+	t.Run("SuppressionDeleteKeepsHistory", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+
+		_, err := invokeHandler(ctx, bundle.apiServer.SuppressionCreate, &HandleSuppressionCreateRequest{AccountID: accountID, Email: "receiver@example.com"})
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.SuppressionDelete, &HandleSuppressionDeleteRequest{AccountID: accountID, Address: "receiver@example.com", Reason: "Customer asked to hear from us again."})
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, emailCreateReq(accountID, PriorityTransactional))
+		require.NoError(t, err)
+
+		// The suppression is marked removed rather than deleted.
+		var removalReason string
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT removal_reason FROM suppressions WHERE account_id = $1 AND email = $2 AND removed_at IS NOT NULL", accountID, "receiver@example.com").Scan(&removalReason))
+		require.Equal(t, "Customer asked to hear from us again.", removalReason)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.SuppressionHistory, &HandleSuppressionHistoryRequest{AccountID: accountID, Address: "receiver@example.com"})
+		require.NoError(t, err)
+		require.False(t, resp.Suppressed)
+		require.Len(t, resp.Events, 2)
+		require.Equal(t, suppressionActionAdded, resp.Events[0].Action)
+		require.Equal(t, suppressionReasonManual, resp.Events[0].Reason)
+		require.Equal(t, suppressionActionRemoved, resp.Events[1].Action)
+		require.Equal(t, "Customer asked to hear from us again.", resp.Events[1].Reason)
+		require.WithinDuration(t, time.Now(), resp.Events[1].CreatedAt, time.Minute)
+
+		// A second removal finds nothing left to remove.
+		_, err = invokeHandler(ctx, bundle.apiServer.SuppressionDelete, &HandleSuppressionDeleteRequest{AccountID: accountID, Address: "receiver@example.com"})
+		require.Equal(t, &APIError{Code: "not_found", Message: "Address isn't suppressed.", StatusCode: http.StatusNotFound}, err)
+	})
+
+	t.Run("SuppressionReadded", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+
+		_, err := invokeHandler(ctx, bundle.apiServer.SuppressionCreate, &HandleSuppressionCreateRequest{AccountID: accountID, Email: "receiver@example.com"})
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.SuppressionDelete, &HandleSuppressionDeleteRequest{AccountID: accountID, Address: "receiver@example.com"})
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.BounceCreate, &HandleBounceCreateRequest{AccountID: accountID, Email: "receiver@example.com", Type: bounceTypeHard})
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, emailCreateReq(accountID, PriorityTransactional))
+		require.Equal(t, suppressedErr, err)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.SuppressionHistory, &HandleSuppressionHistoryRequest{AccountID: accountID, Address: "receiver@example.com"})
+		require.NoError(t, err)
+		require.True(t, resp.Suppressed)
+		require.Len(t, resp.Events, 3)
+		require.Equal(t, suppressionActionRemoved, resp.Events[1].Action)
+		require.Empty(t, resp.Events[1].Reason)
+		require.Equal(t, suppressionActionAdded, resp.Events[2].Action)
+		require.Equal(t, suppressionReasonHardBounce, resp.Events[2].Reason)
+
+		// Suppressing an address that's already suppressed isn't history.
+		_, err = invokeHandler(ctx, bundle.apiServer.SuppressionCreate, &HandleSuppressionCreateRequest{AccountID: accountID, Email: "receiver@example.com"})
+		require.NoError(t, err)
+
+		resp, err = invokeHandler(ctx, bundle.apiServer.SuppressionHistory, &HandleSuppressionHistoryRequest{AccountID: accountID, Address: "receiver@example.com"})
+		require.NoError(t, err)
+		require.Len(t, resp.Events, 3)
+	})
+
+	t.Run("SuppressionHistoryNotFound", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.SuppressionHistory, &HandleSuppressionHistoryRequest{AccountID: uuid.New(), Address: "receiver@example.com"})
+		require.Equal(t, &APIError{Code: "not_found", Message: "Address has never been suppressed.", StatusCode: http.StatusNotFound}, err)
+	})
+
+	t.Run("SuppressionDeleteNotFound", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.SuppressionDelete, &HandleSuppressionDeleteRequest{AccountID: uuid.New(), Address: "receiver@example.com"})
+		require.Equal(t, &APIError{Code: "not_found", Message: "Address isn't suppressed.", StatusCode: http.StatusNotFound}, err)
+	})
+
+	t.Run("UnsubscribeBlocksOnlyBulk", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+
+		_, err := bundle.tx.Exec(ctx, "INSERT INTO unsubscribes (account_id, email) VALUES ($1, $2)", accountID, "receiver@example.com")
+		require.NoError(t, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, emailCreateReq(accountID, PriorityBulk))
+		require.Equal(t, suppressedErr, err)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, emailCreateReq(accountID, PriorityTransactional))
+		require.NoError(t, err)
+	})
+
+	t.Run("HardBounceSuppresses", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.BounceCreate, &HandleBounceCreateRequest{
+			AccountID:  accountID,
+			Diagnostic: "550 5.1.1 No such user",
+			Email:      "receiver@example.com",
+			Type:       bounceTypeHard,
+		})
+		require.NoError(t, err)
+		require.Equal(t, &HandleBounceCreateResponse{Message: "Hard bounce recorded; address has been suppressed."}, resp)
+		require.InDelta(t, 1, testutil.ToFloat64(bundle.apiServer.metrics.emailsBounced.WithLabelValues(bounceTypeHard)), 0)
+
+		var reason string
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT reason FROM suppressions WHERE account_id = $1 AND email = $2", accountID, "receiver@example.com").Scan(&reason))
+		require.Equal(t, suppressionReasonHardBounce, reason)
+
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, emailCreateReq(accountID, PriorityTransactional))
+		require.Equal(t, suppressedErr, err)
+	})
+
+	t.Run("SoftBounceRecorded", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.BounceCreate, &HandleBounceCreateRequest{
+			AccountID: accountID,
+			Email:     "receiver@example.com",
+			Type:      bounceTypeSoft,
+		})
+		require.NoError(t, err)
+		require.Equal(t, &HandleBounceCreateResponse{Message: "Soft bounce recorded."}, resp)
+		require.InDelta(t, 1, testutil.ToFloat64(bundle.apiServer.metrics.emailsBounced.WithLabelValues(bounceTypeSoft)), 0)
+
+		var numBounces int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM bounces WHERE account_id = $1 AND type = $2", accountID, bounceTypeSoft).Scan(&numBounces))
+		require.Equal(t, 1, numBounces)
+
+		// A soft bounce doesn't stop future email.
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, emailCreateReq(accountID, PriorityTransactional))
+		require.NoError(t, err)
+	})
+
+	t.Run("BounceInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.BounceCreate, &HandleBounceCreateRequest{
+			AccountID: uuid.New(),
+			Email:     "not-an-email",
+			Type:      "medium",
+		})
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "email", Message: "email must be a valid email address.", Rule: "email"},
+				{Field: "type", Message: "type must be one of: hard, soft.", Rule: "oneof"},
+			},
+		}, err)
+	})
+
+	t.Run("BounceMalformed", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		req := httptest.NewRequest(http.MethodPost, "/bounces", strings.NewReader(`{"email":`))
+		req.Header.Set("Content-Type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		bundle.apiServer.ServeMux().ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("ServeMux", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		var (
+			accountID = uuid.NewString()
+			mux       = bundle.apiServer.ServeMux()
+		)
+
+		serve := func(method, target, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, target, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		recorder := serve(http.MethodPost, "/suppressions", `{"account_id":"`+accountID+`","email":"receiver@example.com"}`)
+		require.Equal(t, http.StatusCreated, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+
+		recorder = serve(http.MethodDelete, "/suppressions/receiver@example.com", `{"account_id":"`+accountID+`"}`)
+		require.Equal(t, http.StatusOK, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+		require.JSONEq(t, `{"message":"Address is no longer suppressed."}`, recorder.Body.String())
+
+		recorder = serve(http.MethodGet, "/suppressions/history/receiver@example.com?account_id="+accountID, "")
+		require.Equal(t, http.StatusOK, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+		require.Contains(t, recorder.Body.String(), `"suppressed":false`)
+
+		recorder = serve(http.MethodGet, "/suppressions/history/receiver@example.com?account_id=not-a-uuid", "")
+		require.Equal(t, http.StatusBadRequest, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+	})
+}
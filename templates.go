@@ -0,0 +1,240 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	texttemplate "text/template"
+
+	"golang.org/x/text/language"
+)
+
+// templatesFS holds the email templates that ship with the service. Each
+// template is a directory under templates/ named for the template, containing
+// `subject.txt.tmpl`, `body.txt.tmpl`, and optionally `body.html.tmpl`.
+// Those are in the default locale. Translations go in subdirectories named
+// for their locale as a BCP 47 tag, like `welcome/fr` or `welcome/pt-BR`,
+// each containing the same files.
+//
+//go:embed templates
+var templatesFS embed.FS
+
+// emailTemplate is a parsed email template.
+type emailTemplate struct {
+	body     *texttemplate.Template
+	bodyHTML *htmltemplate.Template // nil if the template has no HTML body
+	subject  *texttemplate.Template
+
+	// locales are the template's translations, in the same order as the tags
+	// that localeMatcher matches after its first, which stands for the
+	// default locale. localeMatcher is nil if there aren't any.
+	localeMatcher language.Matcher
+	locales       []*emailTemplate
+}
+
+// localize returns the translation of the template that best matches a list
+// of preferred languages in the format of an `Accept-Language` header, like
+// `fr-CA, fr;q=0.9, en;q=0.8`. A single tag like `fr` works too. The
+// template itself, in the default locale, is returned if there's no
+// translation in any of the languages or none were given.
+func (t *emailTemplate) localize(preferred string) *emailTemplate {
+	if t.localeMatcher == nil || preferred == "" {
+		return t
+	}
+
+	tags, _, err := language.ParseAcceptLanguage(preferred)
+	if err != nil || len(tags) == 0 {
+		return t
+	}
+
+	_, index, confidence := t.localeMatcher.Match(tags...)
+	if confidence == language.No || index == 0 {
+		return t
+	}
+	return t.locales[index-1]
+}
+
+// emailTemplates are templates by name.
+type emailTemplates map[string]*emailTemplate
+
+// loadEmailTemplates parses every template in fsys, which is laid out like
+// templatesFS's templates directory. Templates are parsed once at startup so
+// that a broken one is found right away instead of on first use.
+func loadEmailTemplates(fsys fs.FS) (emailTemplates, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make(emailTemplates, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		name := entry.Name()
+
+		tmpl, err := loadEmailTemplate(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("error loading template %q: %w", name, err)
+		}
+
+		localeEntries, err := fs.ReadDir(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		// The default locale comes first so that it's what's matched when no
+		// translation is close.
+		localeTags := []language.Tag{language.Und}
+		for _, localeEntry := range localeEntries {
+			if !localeEntry.IsDir() {
+				continue
+			}
+
+			locale := localeEntry.Name()
+
+			tag, err := language.Parse(locale)
+			if err != nil {
+				return nil, fmt.Errorf("error loading template %q: locale directory %q isn't a BCP 47 language tag", name, locale)
+			}
+
+			localized, err := loadEmailTemplate(fsys, path.Join(name, locale))
+			if err != nil {
+				return nil, fmt.Errorf("error loading template %q in locale %q: %w", name, locale, err)
+			}
+
+			localeTags = append(localeTags, tag)
+			tmpl.locales = append(tmpl.locales, localized)
+		}
+		if len(tmpl.locales) > 0 {
+			tmpl.localeMatcher = language.NewMatcher(localeTags)
+		}
+
+		templates[name] = tmpl
+	}
+
+	return templates, nil
+}
+
+// loadEmailTemplate parses the template files in dir.
+func loadEmailTemplate(fsys fs.FS, dir string) (*emailTemplate, error) {
+	var (
+		err  error
+		tmpl emailTemplate
+	)
+	if tmpl.subject, err = parseTextTemplate(fsys, path.Join(dir, "subject.txt.tmpl")); err != nil {
+		return nil, err
+	}
+	if tmpl.body, err = parseTextTemplate(fsys, path.Join(dir, "body.txt.tmpl")); err != nil {
+		return nil, err
+	}
+
+	htmlPath := path.Join(dir, "body.html.tmpl")
+	if _, err := fs.Stat(fsys, htmlPath); err == nil {
+		if tmpl.bodyHTML, err = htmltemplate.New(path.Base(htmlPath)).Option("missingkey=error").ParseFS(fsys, htmlPath); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return &tmpl, nil
+}
+
+func parseTextTemplate(fsys fs.FS, file string) (*texttemplate.Template, error) {
+	return texttemplate.New(path.Base(file)).Option("missingkey=error").ParseFS(fsys, file)
+}
+
+// renderedEmail is the content of an email rendered from a template.
+type renderedEmail struct {
+	Body     string
+	BodyHTML string
+	Subject  string
+}
+
+// render renders the named template with data, in the translation that best
+// matches the preferred languages (see emailTemplate.localize). It's used both
+// to preview templates and to send email from them, so that a preview always
+// looks like the real thing. Data that doesn't satisfy the template, like a
+// missing key, is the caller's mistake and produces an APIError.
+func (t emailTemplates) render(name, preferredLanguages string, data map[string]any) (*renderedEmail, error) {
+	tmpl, ok := t[name]
+	if !ok {
+		return nil, &APIError{Code: errorCodeUnknownTemplate, Message: fmt.Sprintf("Unknown template %q.", name), StatusCode: http.StatusUnprocessableEntity}
+	}
+	tmpl = tmpl.localize(preferredLanguages)
+
+	renderErr := func(err error) error {
+		return &APIError{Code: errorCodeTemplateRenderFailed, Message: "Error rendering template: " + err.Error(), StatusCode: http.StatusUnprocessableEntity}
+	}
+
+	var (
+		rendered renderedEmail
+		sb       strings.Builder
+	)
+
+	if err := tmpl.subject.Execute(&sb, data); err != nil {
+		return nil, renderErr(err)
+	}
+	// A trailing newline in the file isn't part of the subject.
+	rendered.Subject = strings.TrimSpace(sb.String())
+
+	sb.Reset()
+	if err := tmpl.body.Execute(&sb, data); err != nil {
+		return nil, renderErr(err)
+	}
+	rendered.Body = sb.String()
+
+	if tmpl.bodyHTML != nil {
+		sb.Reset()
+		if err := tmpl.bodyHTML.Execute(&sb, data); err != nil {
+			return nil, renderErr(err)
+		}
+		rendered.BodyHTML = sb.String()
+	}
+
+	return &rendered, nil
+}
+
+type HandleEmailPreviewRequest struct {
+	Locale       string         `json:"locale"        validate:"omitempty,bcp47_language_tag"` // defaults to the Accept-Language header
+	Template     string         `json:"template"      validate:"required"`
+	TemplateData map[string]any `json:"template_data"`
+
+	acceptLanguage string
+}
+
+// BindRequest reads preferred languages from the `Accept-Language` header.
+func (r *HandleEmailPreviewRequest) BindRequest(httpReq *http.Request) error {
+	r.acceptLanguage = httpReq.Header.Get("Accept-Language")
+	return nil
+}
+
+type HandleEmailPreviewResponse struct {
+	Body     string `json:"body"`
+	BodyHTML string `json:"body_html,omitempty"`
+	Subject  string `json:"subject"`
+}
+
+// EmailPreview renders a template without queuing an email so that a UI can
+// show what it'll look like.
+func (s *APIService) EmailPreview(ctx context.Context, req *HandleEmailPreviewRequest) (*HandleEmailPreviewResponse, error) {
+	rendered, err := s.templates.render(req.Template, cmp.Or(req.Locale, req.acceptLanguage), req.TemplateData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HandleEmailPreviewResponse{
+		Body:     rendered.Body,
+		BodyHTML: rendered.BodyHTML,
+		Subject:  rendered.Subject,
+	}, nil
+}
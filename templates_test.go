@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/riverdriver/riverpgxv5"
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+)
+
+// testTemplatesFS has a template with an HTML body and translations, and one
+// with neither.
+var testTemplatesFS = fstest.MapFS{ //nolint:gochecknoglobals
+	"receipt/subject.txt.tmpl":    {Data: []byte("Your receipt for order {{.order_id}}\n")},
+	"receipt/body.txt.tmpl":       {Data: []byte("Thanks for your order, {{.name}}.\n")},
+	"welcome/subject.txt.tmpl":    {Data: []byte("Welcome, {{.name}}!\n")},
+	"welcome/body.txt.tmpl":       {Data: []byte("Hi {{.name}}, thanks for signing up.\n")},
+	"welcome/body.html.tmpl":      {Data: []byte("<p>Hi {{.name}}, thanks for signing up.</p>\n")},
+	"welcome/es/subject.txt.tmpl": {Data: []byte("¡Bienvenido, {{.name}}!\n")},
+	"welcome/es/body.txt.tmpl":    {Data: []byte("Hola {{.name}}, gracias por registrarte.\n")},
+	"welcome/fr/subject.txt.tmpl": {Data: []byte("Bienvenue, {{.name}} !\n")},
+	"welcome/fr/body.txt.tmpl":    {Data: []byte("Bonjour {{.name}}, merci de votre inscription.\n")},
+	"welcome/fr/body.html.tmpl":   {Data: []byte("<p>Bonjour {{.name}}, merci de votre inscription.</p>\n")},
+	"not-a-template-directory.md": {Data: []byte("Ignored.")},
+}
+
+func TestLoadEmailTemplates(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Embedded", func(t *testing.T) {
+		t.Parallel()
+
+		templatesDir, err := fs.Sub(templatesFS, "templates")
+		require.NoError(t, err)
+
+		templates, err := loadEmailTemplates(templatesDir)
+		require.NoError(t, err)
+		require.Contains(t, templates, "welcome")
+		require.Len(t, templates["welcome"].locales, 1)
+	})
+
+	t.Run("InvalidLocale", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := loadEmailTemplates(fstest.MapFS{
+			"welcome/subject.txt.tmpl":       {Data: []byte("Welcome!")},
+			"welcome/body.txt.tmpl":          {Data: []byte("Hi.")},
+			"welcome/partials/subject.txt":   {Data: []byte("Welcome!")},
+			"welcome/partials/body.txt.tmpl": {Data: []byte("Hi.")},
+		})
+		require.EqualError(t, err, `error loading template "welcome": locale directory "partials" isn't a BCP 47 language tag`)
+	})
+
+	t.Run("LocaleMissingBody", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := loadEmailTemplates(fstest.MapFS{
+			"welcome/subject.txt.tmpl":    {Data: []byte("Welcome!")},
+			"welcome/body.txt.tmpl":       {Data: []byte("Hi.")},
+			"welcome/fr/subject.txt.tmpl": {Data: []byte("Bienvenue !")},
+		})
+		require.ErrorContains(t, err, `error loading template "welcome" in locale "fr"`)
+	})
+
+	t.Run("MissingBody", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := loadEmailTemplates(fstest.MapFS{
+			"welcome/subject.txt.tmpl": {Data: []byte("Welcome!")},
+		})
+		require.ErrorContains(t, err, `error loading template "welcome"`)
+	})
+
+	t.Run("ParseError", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := loadEmailTemplates(fstest.MapFS{
+			"welcome/subject.txt.tmpl": {Data: []byte("Welcome, {{.name")},
+			"welcome/body.txt.tmpl":    {Data: []byte("Hi.")},
+		})
+		require.ErrorContains(t, err, `error loading template "welcome"`)
+	})
+}
+
+func TestEmailTemplatesRender(t *testing.T) {
+	t.Parallel()
+
+	templates, err := loadEmailTemplates(testTemplatesFS)
+	require.NoError(t, err)
+
+	t.Run("RendersAllParts", func(t *testing.T) {
+		t.Parallel()
+
+		rendered, err := templates.render("welcome", "", map[string]any{"name": "Ada"})
+		require.NoError(t, err)
+		require.Equal(t, &renderedEmail{
+			Body:     "Hi Ada, thanks for signing up.\n",
+			BodyHTML: "<p>Hi Ada, thanks for signing up.</p>\n",
+			Subject:  "Welcome, Ada!",
+		}, rendered)
+	})
+
+	t.Run("NoHTMLBody", func(t *testing.T) {
+		t.Parallel()
+
+		rendered, err := templates.render("receipt", "", map[string]any{"name": "Ada", "order_id": 123})
+		require.NoError(t, err)
+		require.Empty(t, rendered.BodyHTML)
+		require.Equal(t, "Your receipt for order 123", rendered.Subject)
+	})
+
+	t.Run("HTMLEscaped", func(t *testing.T) {
+		t.Parallel()
+
+		rendered, err := templates.render("welcome", "", map[string]any{"name": "<script>"})
+		require.NoError(t, err)
+		require.Equal(t, "<p>Hi &lt;script&gt;, thanks for signing up.</p>\n", rendered.BodyHTML)
+		require.Equal(t, "Hi <script>, thanks for signing up.\n", rendered.Body)
+	})
+
+	t.Run("Localized", func(t *testing.T) {
+		t.Parallel()
+
+		data := map[string]any{"name": "Ada"}
+
+		french, err := templates.render("welcome", "fr", data)
+		require.NoError(t, err)
+		require.Equal(t, &renderedEmail{
+			Body:     "Bonjour Ada, merci de votre inscription.\n",
+			BodyHTML: "<p>Bonjour Ada, merci de votre inscription.</p>\n",
+			Subject:  "Bienvenue, Ada !",
+		}, french)
+
+		spanish, err := templates.render("welcome", "es", data)
+		require.NoError(t, err)
+		require.Equal(t, &renderedEmail{
+			Body:    "Hola Ada, gracias por registrarte.\n",
+			Subject: "¡Bienvenido, Ada!",
+		}, spanish)
+
+		// Regional variants match their language.
+		rendered, err := templates.render("welcome", "fr-CA", data)
+		require.NoError(t, err)
+		require.Equal(t, french, rendered)
+
+		// The most preferred language with a translation wins.
+		rendered, err = templates.render("welcome", "de-DE, de;q=0.9, es;q=0.8, fr;q=0.7", data)
+		require.NoError(t, err)
+		require.Equal(t, spanish, rendered)
+	})
+
+	t.Run("LocaleFallsBackToDefault", func(t *testing.T) {
+		t.Parallel()
+
+		data := map[string]any{"name": "Ada"}
+
+		expected, err := templates.render("welcome", "", data)
+		require.NoError(t, err)
+		require.Equal(t, "Welcome, Ada!", expected.Subject)
+
+		for _, preferred := range []string{"de", "en-US", "not a language;;"} {
+			rendered, err := templates.render("welcome", preferred, data)
+			require.NoError(t, err)
+			require.Equal(t, expected, rendered, "Unexpected rendering for %q", preferred)
+		}
+
+		// Templates without any translations.
+		rendered, err := templates.render("receipt", "fr", map[string]any{"name": "Ada", "order_id": 123})
+		require.NoError(t, err)
+		require.Equal(t, "Your receipt for order 123", rendered.Subject)
+	})
+
+	t.Run("MissingData", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := templates.render("welcome", "", nil)
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, "template_render_failed", apiErr.Code)
+		require.Equal(t, http.StatusUnprocessableEntity, apiErr.StatusCode)
+		require.Contains(t, apiErr.Message, "Error rendering template: ")
+	})
+
+	t.Run("UnknownTemplate", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := templates.render("goodbye", "", nil)
+		require.Equal(t, &APIError{Code: "unknown_template", Message: `Unknown template "goodbye".`, StatusCode: http.StatusUnprocessableEntity}, err)
+	})
+}
+
+func TestAPIServiceEmailPreview(t *testing.T) {
+	t.Parallel()
+
+	type testBundle struct {
+		apiServer *APIService
+		tx        pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		riverClient, err := river.NewClient(riverpgxv5.New(nil), &river.Config{
+			TestOnly: true,
+			Workers:  makeWorkers(testConfig, nil, nil, nil, nil, nil, nil, nil, testTracer),
+		})
+		require.NoError(t, err)
+
+		templates, err := loadEmailTemplates(testTemplatesFS)
+		require.NoError(t, err)
+
+		return &testBundle{
+			apiServer: &APIService{
+				begin:       tx.Begin,
+				metrics:     newMetrics(),
+				riverClient: riverClient,
+				templates:   templates,
+				tracer:      testTracer,
+			},
+			tx: tx,
+		}, ctx
+	}
+
+	templateData := map[string]any{"name": "Ada"}
+
+	t.Run("RendersTemplate", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailPreview, &HandleEmailPreviewRequest{Template: "welcome", TemplateData: templateData})
+		require.NoError(t, err)
+		require.Equal(t, &HandleEmailPreviewResponse{
+			Body:     "Hi Ada, thanks for signing up.\n",
+			BodyHTML: "<p>Hi Ada, thanks for signing up.</p>\n",
+			Subject:  "Welcome, Ada!",
+		}, resp)
+
+		var numJobs int
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT count(*) FROM river_job").Scan(&numJobs))
+		require.Zero(t, numJobs)
+	})
+
+	t.Run("MatchesSentEmail", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		preview, err := invokeHandler(ctx, bundle.apiServer.EmailPreview, &HandleEmailPreviewRequest{Template: "welcome", TemplateData: templateData})
+		require.NoError(t, err)
+
+		idempotencyKey := uuid.NewString()
+		_, err = invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: idempotencyKey,
+			Template:       "welcome",
+			TemplateData:   templateData,
+		})
+		require.NoError(t, err)
+
+		var encodedArgs []byte
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args FROM river_job WHERE args->>'idempotency_key' = $1", idempotencyKey).Scan(&encodedArgs))
+
+		var args SendEmailArgs
+		require.NoError(t, json.Unmarshal(encodedArgs, &args))
+		require.Equal(t, preview, &HandleEmailPreviewResponse{Body: args.Body, BodyHTML: args.BodyHTML, Subject: args.Subject})
+	})
+
+	t.Run("RenderedAtSend", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.renderTemplatesAtSend = true
+
+		idempotencyKey := uuid.NewString()
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: idempotencyKey,
+			Locale:         "fr",
+			Template:       "welcome",
+			TemplateData:   templateData,
+		})
+		require.NoError(t, err)
+
+		var encodedArgs []byte
+		require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args FROM river_job WHERE args->>'idempotency_key' = $1", idempotencyKey).Scan(&encodedArgs))
+
+		// Only the template is stored, to be rendered when it's sent.
+		var args SendEmailArgs
+		require.NoError(t, json.Unmarshal(encodedArgs, &args))
+		require.Empty(t, args.Body)
+		require.Empty(t, args.BodyHTML)
+		require.Empty(t, args.Subject)
+		require.Equal(t, "welcome", args.Template)
+		require.Equal(t, templateData, args.TemplateData)
+		require.Equal(t, "fr", args.TemplateLocale)
+	})
+
+	t.Run("RenderedAtSendUnknownTemplate", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+		bundle.apiServer.renderTemplatesAtSend = true
+
+		// Templates are still checked when emails are queued.
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Template:       "goodbye",
+		})
+		require.Equal(t, &APIError{Code: "unknown_template", Message: `Unknown template "goodbye".`, StatusCode: http.StatusUnprocessableEntity}, err)
+	})
+
+	t.Run("Locale", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		resp, err := invokeHandler(ctx, bundle.apiServer.EmailPreview, &HandleEmailPreviewRequest{Locale: "fr", Template: "welcome", TemplateData: templateData})
+		require.NoError(t, err)
+		require.Equal(t, "Bienvenue, Ada !", resp.Subject)
+	})
+
+	t.Run("EmailCreateLocale", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		emailSubject := func(idempotencyKey string) string {
+			t.Helper()
+
+			var subject string
+			require.NoError(t, bundle.tx.QueryRow(ctx, "SELECT args->>'subject' FROM river_job WHERE args->>'idempotency_key' = $1", idempotencyKey).Scan(&subject))
+			return subject
+		}
+
+		// From the request field.
+		idempotencyKey := uuid.NewString()
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: idempotencyKey,
+			Locale:         "fr",
+			Template:       "welcome",
+			TemplateData:   templateData,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "Bienvenue, Ada !", emailSubject(idempotencyKey))
+
+		// From the Accept-Language header, which the field takes precedence
+		// over.
+		serve := func(locale string) string {
+			t.Helper()
+
+			idempotencyKey := uuid.NewString()
+			reqData, err := json.Marshal(&HandleEmailCreateRequest{
+				AccountID:      uuid.New(),
+				EmailRecipient: "receiver@example.com",
+				EmailSender:    "sender@example.com",
+				IdempotencyKey: idempotencyKey,
+				Locale:         locale,
+				Template:       "welcome",
+				TemplateData:   templateData,
+			})
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/emails", bytes.NewReader(reqData))
+			req.Header.Set("Accept-Language", "es-MX, es;q=0.9")
+			req.Header.Set("Content-Type", "application/json")
+
+			recorder := httptest.NewRecorder()
+			bundle.apiServer.ServeMux().ServeHTTP(recorder, req)
+			require.Equal(t, http.StatusCreated, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+			return emailSubject(idempotencyKey)
+		}
+		require.Equal(t, "¡Bienvenido, Ada!", serve(""))
+		require.Equal(t, "Bienvenue, Ada !", serve("fr"))
+	})
+
+	t.Run("InvalidLocale", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailPreview, &HandleEmailPreviewRequest{Locale: "not a locale", Template: "welcome", TemplateData: templateData})
+		require.Equal(t, &APIError{
+			Code:       "validation_failed",
+			Message:    "Invalid parameters.",
+			StatusCode: http.StatusBadRequest,
+			ValidationErrors: []*ValidationError{
+				{Field: "locale", Message: "locale must be a BCP 47 language tag like fr or pt-BR.", Rule: "bcp47_language_tag"},
+			},
+		}, err)
+	})
+
+	t.Run("TemplateWithContent", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailCreate, &HandleEmailCreateRequest{
+			AccountID:      uuid.New(),
+			EmailRecipient: "receiver@example.com",
+			EmailSender:    "sender@example.com",
+			IdempotencyKey: uuid.NewString(),
+			Subject:        "Hello.",
+			Template:       "welcome",
+			TemplateData:   templateData,
+		})
+		require.Equal(t, &APIError{Code: "invalid_request", Message: "body, body_html, and subject can't be set along with template.", StatusCode: http.StatusBadRequest}, err)
+	})
+
+	t.Run("UnknownTemplate", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		_, err := invokeHandler(ctx, bundle.apiServer.EmailPreview, &HandleEmailPreviewRequest{Template: "goodbye"})
+		require.Equal(t, &APIError{Code: "unknown_template", Message: `Unknown template "goodbye".`, StatusCode: http.StatusUnprocessableEntity}, err)
+	})
+}
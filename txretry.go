@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Bounds on the backoff between retries of a transaction. Each retry waits
+// twice as long as the one before, up to the maximum.
+const (
+	txRetryBaseDelay = 10 * time.Millisecond
+	txRetryMaxDelay  = 250 * time.Millisecond
+)
+
+// retryableTxErrorCodes are Postgres error codes for failures where running
+// the same transaction again is expected to succeed.
+var retryableTxErrorCodes = map[string]struct{}{ //nolint:gochecknoglobals
+	"40001": {}, // serialization_failure
+	"40P01": {}, // deadlock_detected
+}
+
+// retryTx runs f, which runs a transaction from beginning to end, and runs it
+// again up to maxRetries more times if it fails with an error that's likely
+// to be transient, waiting a little longer before each retry. f must be safe
+// to run more than once.
+func retryTx(ctx context.Context, maxRetries int, f func() error) error {
+	delay := txRetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= maxRetries || !isRetryableTxError(ctx, err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, txRetryMaxDelay)
+	}
+}
+
+// isRetryableTxError returns true if a transaction that failed with err is
+// worth running again: a serialization failure or deadlock, or a connection
+// that failed or dropped, as long as it wasn't because ctx is done.
+func isRetryableTxError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		_, ok := retryableTxErrorCodes[pgErr.Code]
+		return ok
+	}
+
+	var (
+		connectErr *pgconn.ConnectError
+		netErr     net.Error
+	)
+	return pgconn.SafeToRetry(err) ||
+		errors.As(err, &connectErr) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
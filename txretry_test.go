@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryTx(t *testing.T) {
+	t.Parallel()
+
+	serializationErr := &pgconn.PgError{Code: "40001", Message: "could not serialize access due to concurrent update"}
+
+	// Returns a function that fails with each of errs in turn, then succeeds,
+	// along with a pointer to the number of times it's been called.
+	failWith := func(errs ...error) (func() error, *int) {
+		var calls int
+		return func() error {
+			calls++
+			if calls <= len(errs) {
+				return errs[calls-1]
+			}
+			return nil
+		}, &calls
+	}
+
+	t.Run("SucceedsAfterRetryableErrors", func(t *testing.T) {
+		t.Parallel()
+
+		f, calls := failWith(serializationErr, &pgconn.PgError{Code: "40P01"})
+		require.NoError(t, retryTx(t.Context(), 3, f))
+		require.Equal(t, 3, *calls)
+	})
+
+	t.Run("RetriesCapped", func(t *testing.T) {
+		t.Parallel()
+
+		f, calls := failWith(serializationErr, serializationErr, serializationErr)
+		require.ErrorIs(t, retryTx(t.Context(), 2, f), serializationErr)
+		require.Equal(t, 3, *calls)
+	})
+
+	t.Run("NoRetries", func(t *testing.T) {
+		t.Parallel()
+
+		f, calls := failWith(serializationErr)
+		require.ErrorIs(t, retryTx(t.Context(), 0, f), serializationErr)
+		require.Equal(t, 1, *calls)
+	})
+
+	t.Run("NonRetryableError", func(t *testing.T) {
+		t.Parallel()
+
+		uniqueErr := &pgconn.PgError{Code: "23505"}
+
+		f, calls := failWith(uniqueErr)
+		require.ErrorIs(t, retryTx(t.Context(), 3, f), uniqueErr)
+		require.Equal(t, 1, *calls)
+	})
+
+	t.Run("ContextCancelled", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		f, calls := failWith(serializationErr)
+		require.ErrorIs(t, retryTx(ctx, 3, f), serializationErr)
+		require.Equal(t, 1, *calls)
+	})
+}
+
+func TestIsRetryableTxError(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		err      error
+		expected bool
+	}{
+		{&pgconn.PgError{Code: "40001"}, true},
+		{fmt.Errorf("error committing: %w", &pgconn.PgError{Code: "40P01"}), true},
+		{&pgconn.PgError{Code: "23505"}, false},
+		{io.ErrUnexpectedEOF, true},
+		{errors.New("something else"), false},
+	} {
+		require.Equal(t, tt.expected, isRetryableTxError(t.Context(), tt.err), "Unexpected result for %v", tt.err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	require.False(t, isRetryableTxError(ctx, &pgconn.PgError{Code: "40001"}))
+}
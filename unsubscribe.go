@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// errInvalidUnsubscribeToken is returned for unsubscribe tokens that are
+// malformed or whose signature doesn't match.
+var errInvalidUnsubscribeToken = errors.New("invalid unsubscribe token")
+
+// makeUnsubscribeToken makes a token identifying a recipient to unsubscribe
+// from an account's email. Tokens are signed with secret so that the
+// unsubscribe endpoint can trust them without keeping a record of each one
+// handed out, and so nobody can unsubscribe addresses other than their own.
+func makeUnsubscribeToken(secret []byte, accountID uuid.UUID, email string) string {
+	payload := accountID.String() + ":" + email
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(signUnsubscribePayload(secret, payload))
+}
+
+// parseUnsubscribeToken verifies a token made by makeUnsubscribeToken and
+// returns the account and recipient it identifies.
+func parseUnsubscribeToken(secret []byte, token string) (uuid.UUID, string, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return uuid.Nil, "", errInvalidUnsubscribeToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return uuid.Nil, "", errInvalidUnsubscribeToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, signUnsubscribePayload(secret, string(payload))) {
+		return uuid.Nil, "", errInvalidUnsubscribeToken
+	}
+
+	accountIDStr, email, _ := strings.Cut(string(payload), ":")
+	accountID, err := uuid.Parse(accountIDStr)
+	if err != nil {
+		return uuid.Nil, "", errInvalidUnsubscribeToken
+	}
+
+	return accountID, email, nil
+}
+
+func signUnsubscribePayload(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// makeUnsubscribeURL makes a URL that unsubscribes a recipient from an
+// account's email when posted to.
+func makeUnsubscribeURL(baseURL string, secret []byte, accountID uuid.UUID, email string) (string, error) {
+	unsubscribeURL, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := unsubscribeURL.Query()
+	query.Set("token", makeUnsubscribeToken(secret, accountID, email))
+	unsubscribeURL.RawQuery = query.Encode()
+
+	return unsubscribeURL.String(), nil
+}
+
+type HandleUnsubscribeResponse struct {
+	Message string `json:"message"`
+}
+
+// handleUnsubscribe handles a one-click unsubscribe as described by RFC 8058.
+// Mail clients post a form body of `List-Unsubscribe=One-Click` to the URL in
+// an email's `List-Unsubscribe` header, so unlike other endpoints this one
+// doesn't take JSON and isn't built with MakeHandler, though its responses
+// are like those of other endpoints. The recipient to unsubscribe is
+// identified by the token in the URL's query string.
+func (s *APIService) handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context()
+		opts = s.handlerOpts()
+	)
+
+	accountID, email, err := parseUnsubscribeToken(s.unsubscribeSecret, r.URL.Query().Get("token"))
+	if err != nil {
+		writeErrorWithOpts(w, opts, &APIError{Code: errorCodeInvalidRequest, Message: "Invalid unsubscribe token.", StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		writeErrorWithOpts(w, opts, err)
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO unsubscribes (account_id, email)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`,
+		accountID, normalizeAddress(email),
+	); err != nil {
+		writeErrorWithOpts(w, opts, err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		writeErrorWithOpts(w, opts, err)
+		return
+	}
+
+	respData, err := marshalResponse(wrapResponse(&HandleUnsubscribeResponse{Message: "Unsubscribed."}, opts), opts.JSONCase)
+	if err != nil {
+		writeErrorWithOpts(w, opts, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(respData); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing response: %s", err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/riverqueue/river/rivershared/riversharedtest"
+)
+
+func TestUnsubscribeToken(t *testing.T) {
+	t.Parallel()
+
+	var (
+		accountID = uuid.New()
+		secret    = []byte("a-secret")
+	)
+
+	t.Run("RoundTrips", func(t *testing.T) {
+		t.Parallel()
+
+		parsedAccountID, email, err := parseUnsubscribeToken(secret, makeUnsubscribeToken(secret, accountID, "receiver@example.com"))
+		require.NoError(t, err)
+		require.Equal(t, accountID, parsedAccountID)
+		require.Equal(t, "receiver@example.com", email)
+	})
+
+	t.Run("WrongSecret", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, err := parseUnsubscribeToken([]byte("another-secret"), makeUnsubscribeToken(secret, accountID, "receiver@example.com"))
+		require.ErrorIs(t, err, errInvalidUnsubscribeToken)
+	})
+
+	t.Run("TamperedPayload", func(t *testing.T) {
+		t.Parallel()
+
+		_, signature, _ := strings.Cut(makeUnsubscribeToken(secret, accountID, "receiver@example.com"), ".")
+		payload, _, _ := strings.Cut(makeUnsubscribeToken(secret, accountID, "someone-else@example.com"), ".")
+
+		_, _, err := parseUnsubscribeToken(secret, payload+"."+signature)
+		require.ErrorIs(t, err, errInvalidUnsubscribeToken)
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		t.Parallel()
+
+		for _, token := range []string{"", "no-separator", "!!!.!!!"} {
+			_, _, err := parseUnsubscribeToken(secret, token)
+			require.ErrorIs(t, err, errInvalidUnsubscribeToken)
+		}
+	})
+}
+
+func TestAPIServiceUnsubscribe(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("a-secret")
+
+	type testBundle struct {
+		mux *http.ServeMux
+		tx  pgx.Tx
+	}
+
+	setup := func(t *testing.T) (*testBundle, context.Context) {
+		t.Helper()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		return &testBundle{
+			mux: (&APIService{
+				begin:             tx.Begin,
+				metrics:           newMetrics(),
+				tracer:            testTracer,
+				unsubscribeSecret: secret,
+			}).ServeMux(),
+			tx: tx,
+		}, ctx
+	}
+
+	// Makes a one-click unsubscribe request like a mail client would.
+	newOneClickRequest := func(t *testing.T, unsubscribeURL string) *http.Request {
+		t.Helper()
+
+		parsedURL, err := url.Parse(unsubscribeURL)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, parsedURL.RequestURI(), strings.NewReader("List-Unsubscribe=One-Click"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+
+	t.Run("RecordsUnsubscribe", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, ctx := setup(t)
+
+		accountID := uuid.New()
+		unsubscribeURL, err := makeUnsubscribeURL("https://api.example.com/unsubscribe", secret, accountID, "receiver@example.com")
+		require.NoError(t, err)
+
+		// Unsubscribing twice is harmless.
+		for range 2 {
+			recorder := httptest.NewRecorder()
+			bundle.mux.ServeHTTP(recorder, newOneClickRequest(t, unsubscribeURL))
+			require.Equal(t, http.StatusOK, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+			require.JSONEq(t, `{"message":"Unsubscribed."}`, recorder.Body.String())
+		}
+
+		var numUnsubscribes int
+		require.NoError(t, bundle.tx.QueryRow(ctx,
+			"SELECT count(*) FROM unsubscribes WHERE account_id = $1 AND email = $2",
+			accountID, "receiver@example.com",
+		).Scan(&numUnsubscribes))
+		require.Equal(t, 1, numUnsubscribes)
+	})
+
+	t.Run("InvalidToken", func(t *testing.T) {
+		t.Parallel()
+
+		bundle, _ := setup(t)
+
+		unsubscribeURL, err := makeUnsubscribeURL("https://api.example.com/unsubscribe", []byte("another-secret"), uuid.New(), "receiver@example.com")
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		bundle.mux.ServeHTTP(recorder, newOneClickRequest(t, unsubscribeURL))
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+		require.JSONEq(t, `{"error_code":"invalid_request","message":"Invalid unsubscribe token."}`, recorder.Body.String())
+	})
+
+	t.Run("Envelope", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			ctx = t.Context()
+			tx  = riversharedtest.TestTx(ctx, t)
+		)
+
+		mux := (&APIService{
+			begin:             tx.Begin,
+			envelopeResponses: true,
+			metrics:           newMetrics(),
+			tracer:            testTracer,
+			unsubscribeSecret: secret,
+		}).ServeMux()
+
+		unsubscribeURL, err := makeUnsubscribeURL("https://api.example.com/unsubscribe", secret, uuid.New(), "receiver@example.com")
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, newOneClickRequest(t, unsubscribeURL))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.JSONEq(t, `{"data":{"message":"Unsubscribed."},"error":null}`, recorder.Body.String())
+
+		recorder = httptest.NewRecorder()
+		mux.ServeHTTP(recorder, newOneClickRequest(t, "https://api.example.com/unsubscribe?token=invalid"))
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+		require.JSONEq(t, `{"data":null,"error":{"error_code":"invalid_request","message":"Invalid unsubscribe token."}}`, recorder.Body.String())
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information injected when the binary is built, like:
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD)"
+//
+// `make build` sets both from git. They're empty for binaries built
+// without them, like with `go run`.
+var (
+	commit  = "" //nolint:gochecknoglobals
+	version = "" //nolint:gochecknoglobals
+)
+
+// riverModulePath is the module whose version is reported as River's.
+const riverModulePath = "github.com/riverqueue/river"
+
+type HandleVersionRequest struct{}
+
+type HandleVersionResponse struct {
+	Commit       string `json:"commit"` // from -ldflags, or else the revision Go stamped from the checkout it was built in
+	GoVersion    string `json:"go_version"`
+	RiverVersion string `json:"river_version"`
+	Version      string `json:"version"` // from -ldflags, or "dev" if not set
+}
+
+// Version reports which build is running for deploys and debugging. It's read
+// from what was compiled in, so it needs no database.
+func (s *APIService) Version(ctx context.Context, req *HandleVersionRequest) (*HandleVersionResponse, error) {
+	resp := &HandleVersionResponse{
+		Commit:       s.buildCommit,
+		GoVersion:    runtime.Version(),
+		RiverVersion: "unknown",
+		Version:      s.buildVersion,
+	}
+	if resp.Version == "" {
+		resp.Version = "dev"
+	}
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range buildInfo.Deps {
+			if dep.Path != riverModulePath {
+				continue
+			}
+			resp.RiverVersion = dep.Version
+			if dep.Replace != nil {
+				resp.RiverVersion = dep.Replace.Version
+			}
+		}
+
+		// Builds without -ldflags still know their commit if they were built
+		// from a git checkout.
+		if resp.Commit == "" {
+			for _, setting := range buildInfo.Settings {
+				if setting.Key == "vcs.revision" {
+					resp.Commit = setting.Value
+				}
+			}
+		}
+	}
+	if resp.Commit == "" {
+		resp.Commit = "unknown"
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIServiceVersion(t *testing.T) {
+	t.Parallel()
+
+	t.Run("InjectedVersion", func(t *testing.T) {
+		t.Parallel()
+
+		// As run sets them from what -ldflags injected.
+		apiServer := &APIService{
+			buildCommit:  "0123456789abcdef0123456789abcdef01234567",
+			buildVersion: "v1.2.3",
+			metrics:      newMetrics(),
+		}
+
+		recorder := httptest.NewRecorder()
+		apiServer.ServeMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/version", nil))
+		require.Equal(t, http.StatusOK, recorder.Code, "Unexpected status; response body: %s", recorder.Body.String())
+
+		var resp HandleVersionResponse
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+		require.Equal(t, "0123456789abcdef0123456789abcdef01234567", resp.Commit)
+		require.Equal(t, runtime.Version(), resp.GoVersion)
+		require.Regexp(t, `^v\d+\.\d+\.\d+`, resp.RiverVersion)
+		require.Equal(t, "v1.2.3", resp.Version)
+	})
+
+	t.Run("NotInjected", func(t *testing.T) {
+		t.Parallel()
+
+		resp, err := invokeHandler(t.Context(), (&APIService{}).Version, &HandleVersionRequest{})
+		require.NoError(t, err)
+		require.Equal(t, "dev", resp.Version)
+		require.Equal(t, "unknown", resp.Commit) // test binaries aren't stamped with a revision either
+	})
+}